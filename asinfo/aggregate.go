@@ -0,0 +1,100 @@
+package asinfo
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// AddrRange is an inclusive range of addresses of the same IP family.
+type AddrRange struct {
+	Start, End netip.Addr
+}
+
+// MergedRanges returns the sorted list of non-overlapping, non-adjacent ranges
+// covering exactly the addresses of the given prefixes. IPv4 ranges are sorted
+// before IPv6 ranges.
+func MergedRanges(prefixes []netip.Prefix) []AddrRange {
+	ranges := make([]AddrRange, 0, len(prefixes))
+	for _, pre := range prefixes {
+		pre = pre.Masked()
+		ranges = append(ranges, AddrRange{pre.Addr(), getLastAddr(pre)})
+	}
+	slices.SortFunc(ranges, func(a, b AddrRange) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			// IPv4 sorts before IPv6, so the ranges are only merged within a family.
+			next := last.End.Next()
+			if last.Start.Is4() == r.Start.Is4() && (!next.IsValid() || r.Start.Compare(next) <= 0) {
+				if r.End.Compare(last.End) > 0 {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangesToCIDRs converts each range to prefixes with ipRangeToCIDRs.
+func rangesToCIDRs(ranges []AddrRange) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range ranges {
+		cidrs, err := ipRangeToCIDRs(r.Start, r.End)
+		if err != nil {
+			// NOT REACHED: the ranges are built from valid prefixes
+			panic(err)
+		}
+		prefixes = append(prefixes, cidrs...)
+	}
+	return prefixes
+}
+
+// AggregatePrefixes returns the smallest sorted list of prefixes covering exactly
+// the same addresses as the given prefixes. Overlapping prefixes are deduplicated
+// and adjacent prefixes are merged into their covering prefix where possible.
+// IPv4 prefixes are sorted before IPv6 prefixes. The input is not modified.
+func AggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	return rangesToCIDRs(MergedRanges(prefixes))
+}
+
+// ComplementPrefixes returns the smallest sorted list of prefixes covering every
+// address of the IPv4 (is4=true) or IPv6 address space which is not covered by
+// the given prefixes. Prefixes of the other family are ignored.
+func ComplementPrefixes(prefixes []netip.Prefix, is4 bool) []netip.Prefix {
+	family := make([]netip.Prefix, 0, len(prefixes))
+	for _, pre := range prefixes {
+		if pre.Addr().Is4() == is4 {
+			family = append(family, pre)
+		}
+	}
+
+	all := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	if is4 {
+		all = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	}
+
+	var gaps []AddrRange
+	curr := all.Addr()
+	for _, r := range MergedRanges(family) {
+		if r.Start.Compare(curr) > 0 {
+			gaps = append(gaps, AddrRange{curr, r.Start.Prev()})
+		}
+		curr = r.End.Next()
+		if !curr.IsValid() {
+			// the range extends up to the last address of the family
+			return rangesToCIDRs(gaps)
+		}
+	}
+	gaps = append(gaps, AddrRange{curr, getLastAddr(all)})
+
+	return rangesToCIDRs(gaps)
+}
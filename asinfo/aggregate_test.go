@@ -0,0 +1,140 @@
+package asinfo
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func mustParsePrefixes(t *testing.T, ss []string) []netip.Prefix {
+	t.Helper()
+
+	prefixes := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		pre, err := netip.ParsePrefix(s)
+		if err != nil {
+			t.Fatalf("Failed to parse prefix %q: %v", s, err)
+		}
+		prefixes = append(prefixes, pre)
+	}
+	return prefixes
+}
+
+func assertPrefixes(t *testing.T, result []netip.Prefix, expected []string) {
+	t.Helper()
+
+	if len(result) != len(expected) {
+		t.Errorf("Expected %d prefixes %v, got %d %v", len(expected), expected, len(result), result)
+		return
+	}
+	for i, prefix := range result {
+		if prefix.String() != expected[i] {
+			t.Errorf("Expected prefix %d to be %s, got %s", i, expected[i], prefix.String())
+		}
+	}
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		expected []string
+	}{
+		{
+			name:     "empty",
+			prefixes: nil,
+			expected: nil,
+		},
+		{
+			name:     "adjacent prefixes are merged",
+			prefixes: []string{"192.168.1.0/25", "192.168.1.128/25"},
+			expected: []string{"192.168.1.0/24"},
+		},
+		{
+			name:     "contained prefixes are removed",
+			prefixes: []string{"10.0.0.0/8", "10.1.0.0/16", "10.2.3.4/32"},
+			expected: []string{"10.0.0.0/8"},
+		},
+		{
+			name:     "duplicates are removed and output is sorted",
+			prefixes: []string{"8.8.8.0/24", "8.8.4.0/24", "8.8.8.0/24"},
+			expected: []string{"8.8.4.0/24", "8.8.8.0/24"},
+		},
+		{
+			name:     "adjacent but unalignable prefixes",
+			prefixes: []string{"10.0.1.0/24", "10.0.2.0/24"},
+			expected: []string{"10.0.1.0/24", "10.0.2.0/24"},
+		},
+		{
+			name:     "families are kept apart",
+			prefixes: []string{"2001:db8:1::/48", "255.255.255.255/32", "2001:db8::/48", "0.0.0.0/1", "128.0.0.0/1"},
+			expected: []string{"0.0.0.0/0", "2001:db8::/47"},
+		},
+		{
+			name:     "unmasked prefixes",
+			prefixes: []string{"192.168.1.1/24"},
+			expected: []string{"192.168.1.0/24"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertPrefixes(t, AggregatePrefixes(mustParsePrefixes(t, tt.prefixes)), tt.expected)
+		})
+	}
+}
+
+func TestComplementPrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		is4      bool
+		expected []string
+	}{
+		{
+			name:     "empty IPv4",
+			is4:      true,
+			expected: []string{"0.0.0.0/0"},
+		},
+		{
+			name:     "empty IPv6",
+			is4:      false,
+			expected: []string{"::/0"},
+		},
+		{
+			name:     "everything",
+			prefixes: []string{"0.0.0.0/0"},
+			is4:      true,
+			expected: nil,
+		},
+		{
+			name:     "lower half",
+			prefixes: []string{"0.0.0.0/1"},
+			is4:      true,
+			expected: []string{"128.0.0.0/1"},
+		},
+		{
+			name:     "upper half",
+			prefixes: []string{"128.0.0.0/1"},
+			is4:      true,
+			expected: []string{"0.0.0.0/1"},
+		},
+		{
+			name:     "single prefix in the middle",
+			prefixes: []string{"64.0.0.0/2"},
+			is4:      true,
+			expected: []string{"0.0.0.0/2", "128.0.0.0/1"},
+		},
+		{
+			name:     "other family is ignored",
+			prefixes: []string{"2000::/3", "0.0.0.0/1"},
+			is4:      false,
+			expected: []string{"::/3", "4000::/2", "8000::/1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertPrefixes(t, ComplementPrefixes(mustParsePrefixes(t, tt.prefixes), tt.is4), tt.expected)
+		})
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/IPA-CyberLab/policybgp/cmd/policybgp/export"
 	"github.com/IPA-CyberLab/policybgp/cmd/policybgp/serve"
+	"github.com/IPA-CyberLab/policybgp/cmd/policybgp/status"
 )
 
 func beforeImpl(ctx context.Context, cmd *cli.Command) error {
@@ -49,6 +51,8 @@ var Command = &cli.Command{
 
 	Commands: []*cli.Command{
 		serve.Command,
+		export.Command,
+		status.Command,
 	},
 	Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
 		if err := beforeImpl(ctx, cmd); err != nil {
@@ -0,0 +1,241 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/render"
+)
+
+var Command = &cli.Command{
+	Name:                      "export",
+	Usage:                     "Write the prefixes of the policies in a format consumable by other tools",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "dbpath",
+			Usage:    "dbip-asn-lite csv file (or csv.gz)",
+			Required: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "policy",
+			Usage: "Policy to be exported. Format: <asn>,<ip4_nexthop>[,<ip6_nexthop>] where nexthops may be addresses or names defined in the configuration file",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "YAML configuration file defining named nexthops, per-site overrides of them and policies",
+		},
+		&cli.StringFlag{
+			Name:  "site",
+			Usage: "Apply the nexthop overrides of the site in the configuration file",
+		},
+		&cli.StringFlag{
+			Name:     "format",
+			Usage:    "Output format. One of: " + strings.Join(render.FormatNames(), ", "),
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "Output file path. Writes to stdout if empty",
+		},
+		&cli.StringFlag{
+			Name:  "previous",
+			Usage: "Output of the previous run, whose entries no longer listed are removed. Defaults to --output (ios)",
+		},
+		&cli.BoolFlag{
+			Name:  "aggregate",
+			Usage: "Merge the prefixes of each policy into the smallest covering list",
+			Value: render.DefaultOptions().Aggregate,
+		},
+		&cli.BoolFlag{
+			Name:  "invert",
+			Usage: "Export every address except the prefixes of the policies and the special-purpose ranges, such as private, loopback, link-local and multicast addresses (wireguard, openvpn, openvpn-push)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "invertExclude",
+			Usage: "Prefix or address also left out with --invert, such as the tunnel endpoint",
+		},
+		&cli.StringSliceFlag{
+			Name:  "pacProxy",
+			Usage: "Proxy directive for the prefixes of a policy. Format: <policy>=<directive> (e.g. as15169=PROXY proxy:8080) (pac)",
+		},
+		&cli.StringFlag{
+			Name:  "pacDefault",
+			Usage: "Proxy directive for addresses not covered by any policy (pac)",
+			Value: render.DefaultOptions().PACDefault,
+		},
+		&cli.StringFlag{
+			Name:  "pacMode",
+			Usage: "How the prefixes are matched: " + render.PACModeTable + " (binary search, IPv4 and IPv6) or " + render.PACModeIsInNet + " (isInNet checks) (pac)",
+			Value: render.DefaultOptions().PACMode,
+		},
+		&cli.Uint32Flag{
+			Name:  "table",
+			Usage: "Kernel routing table ID the routes are installed to (iproute)",
+			Value: render.DefaultOptions().Table,
+		},
+		&cli.Uint32Flag{
+			Name:  "routeProtocol",
+			Usage: "Routing protocol ID the routes are tagged with, 0 to omit (iproute)",
+		},
+		&cli.StringFlag{
+			Name:  "nftFamily",
+			Usage: "Family of the nftables table the sets are created in (nftables)",
+			Value: render.DefaultOptions().NftFamily,
+		},
+		&cli.StringFlag{
+			Name:  "nftTable",
+			Usage: "Name of the nftables table the sets are created in (nftables)",
+			Value: render.DefaultOptions().NftTable,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		logger := zap.L()
+		s := logger.Named("policybgp.export").Sugar()
+
+		format := cmd.String("format")
+		if _, ok := render.Formats[format]; !ok {
+			return cli.Exit(fmt.Errorf("unknown format %q. Expected one of: %s",
+				format, strings.Join(render.FormatNames(), ", ")), 1)
+		}
+
+		table := cmd.Uint32("table")
+		if table == 0 {
+			return cli.Exit("routing table cannot be 0", 1)
+		}
+		routeProtocol := cmd.Uint32("routeProtocol")
+		if routeProtocol > 255 {
+			return cli.Exit(fmt.Errorf("route protocol %d invalid. It must be between 0 and 255", routeProtocol), 1)
+		}
+
+		pacMode := cmd.String("pacMode")
+		if pacMode != render.PACModeTable && pacMode != render.PACModeIsInNet {
+			return cli.Exit(fmt.Errorf("invalid PAC mode %q", pacMode), 1)
+		}
+		pacProxies, err := render.ParsePACProxies(cmd.StringSlice("pacProxy"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		var invertExclude []netip.Prefix
+		for _, v := range cmd.StringSlice("invertExclude") {
+			pre, err := netip.ParsePrefix(v)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(v)
+				if aerr != nil {
+					return cli.Exit(fmt.Errorf("invalid prefix %q: %w", v, err), 1)
+				}
+				pre = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			invertExclude = append(invertExclude, pre.Masked())
+		}
+
+		opts := &render.Options{
+			Table:     table,
+			Protocol:  routeProtocol,
+			NftFamily: cmd.String("nftFamily"),
+			NftTable:  cmd.String("nftTable"),
+			Aggregate: cmd.Bool("aggregate"),
+			Invert:    cmd.Bool("invert"),
+
+			InvertExclude: invertExclude,
+
+			PACProxies: pacProxies,
+			PACDefault: cmd.String("pacDefault"),
+			PACMode:    pacMode,
+		}
+
+		conf, err := config.Load(cmd.String("config"), cmd.String("site"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		gateways := nexthop.NewGatewayWatcher(conf.Gateways(), logger)
+		gateways.Resolve()
+		policies, err := conf.ParsePolicies(cmd.StringSlice("policy"), gateways.Addrs())
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		if len(policies) == 0 {
+			return cli.Exit("No policies provided. Use --policy flag or the policies of the configuration file to specify at least one policy.", 1)
+		}
+		if err := render.CheckPACProxies(pacProxies, policies); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		dbPath := cmd.String("dbpath")
+		db, err := asinfo.ParseASInfoCSVFromFile(dbPath, s.Desugar())
+		if err != nil {
+			return err
+		}
+		for _, pol := range policies {
+			if err := pol.Resolve(db); err != nil {
+				return cli.Exit(fmt.Errorf("database %q: %w", dbPath, err), 1)
+			}
+		}
+
+		if format == "ios" {
+			prevPath := cmd.String("previous")
+			if prevPath == "" {
+				prevPath = cmd.String("output")
+			}
+			if prevPath != "" {
+				opts.IOSPrevious, err = readIOSPrevious(prevPath)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+			}
+		}
+
+		var w io.Writer = cmd.Writer
+		var f *os.File
+		if outPath := cmd.String("output"); outPath != "" {
+			f, err = os.Create(outPath)
+			if err != nil {
+				return fmt.Errorf("failed to create output file: %w", err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		if err := render.Render(w, format, policies, opts); err != nil {
+			return fmt.Errorf("failed to render %s: %w", format, err)
+		}
+		if f != nil {
+			if err := f.Close(); err != nil {
+				return fmt.Errorf("failed to close output file: %w", err)
+			}
+		}
+		s.Infof("Exported %d policies in %s format", len(policies), format)
+
+		return nil
+	},
+}
+
+// readIOSPrevious reads the prefix-list entries of the ios output at path.
+// A missing file yields no entries.
+func readIOSPrevious(path string) (map[string]map[uint32]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open previous output: %w", err)
+	}
+	defer f.Close()
+
+	lists, err := render.ParseIOS(f)
+	if err != nil {
+		return nil, fmt.Errorf("previous output %q: %w", path, err)
+	}
+	return lists, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/IPA-CyberLab/policybgp/cmd/policybgp/app"
 
@@ -29,7 +31,15 @@ func ExitCodeOfError(err error) int {
 }
 
 func main() {
-	if err := app.Command.Run(context.Background(), os.Args); err != nil {
+	// Commands stop once ctx is done, such as serve withdrawing its routes.
+	// A second signal terminates the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := app.Command.Run(ctx, os.Args); err != nil {
 		// omit stacktrace
 		zap.L().WithOptions(zap.AddStacktrace(zap.FatalLevel)).Error(err.Error())
 		os.Exit(ExitCodeOfError(err))
@@ -0,0 +1,416 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+type apiHandler struct {
+	s     *zap.SugaredLogger
+	srv   *Server
+	mgr   *PolicyManager
+	peers *PeerStates
+}
+
+// NewAPIHandler returns the handler of the management API, which manages the
+// policies of mgr applied to srv at runtime:
+//
+//	GET    /api/v1/policies                 all policies
+//	POST   /api/v1/policies                 add a policy
+//	GET    /api/v1/policies/{name}          a single policy
+//	PUT    /api/v1/policies/{name}          replace the definition of a policy
+//	DELETE /api/v1/policies/{name}          delete a policy
+//	POST   /api/v1/policies/{name}/enable   announce the routes of a policy
+//	POST   /api/v1/policies/{name}/disable  withdraw the routes of a policy
+//	POST   /api/v1/reload                   reload the database
+//	GET    /api/v1/status                   peers, policies, nexthops and database
+//	GET    /api/v1/drains                   drained scopes
+//	POST   /api/v1/drain                    drain all routes, a policy or a peer
+//	POST   /api/v1/undrain                  undrain them
+//
+// Requests and responses are JSON. Policies are defined in the format of the
+// --policy flag, as {"spec": "<policy>"}. Drains are given as {"scope":
+// "global"}, {"scope": "policy", "name": "<policy>"} or {"scope": "peer",
+// "name": "<address>"}. peers may be nil if BGP is not
+// served.
+func NewAPIHandler(srv *Server, mgr *PolicyManager, peers *PeerStates, l *zap.Logger) http.Handler {
+	h := &apiHandler{s: l.Named("api").Sugar(), srv: srv, mgr: mgr, peers: peers}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/policies", h.handleList)
+	mux.HandleFunc("POST /api/v1/policies", h.handleAdd)
+	mux.HandleFunc("GET /api/v1/policies/{name}", h.handleGet)
+	mux.HandleFunc("PUT /api/v1/policies/{name}", h.handleUpdate)
+	mux.HandleFunc("DELETE /api/v1/policies/{name}", h.handleDelete)
+	mux.HandleFunc("POST /api/v1/policies/{name}/enable", h.handleEnable(true))
+	mux.HandleFunc("POST /api/v1/policies/{name}/disable", h.handleEnable(false))
+	mux.HandleFunc("POST /api/v1/reload", h.handleReload)
+	mux.HandleFunc("GET /api/v1/status", h.handleStatus)
+	mux.HandleFunc("GET /api/v1/drains", h.handleDrains)
+	mux.HandleFunc("POST /api/v1/drain", h.handleDrain(true))
+	mux.HandleFunc("POST /api/v1/undrain", h.handleDrain(false))
+	return mux
+}
+
+// NextHopsEntry holds nexthops by address family.
+type NextHopsEntry struct {
+	IPv4 []netip.Addr `json:"ipv4"`
+	IPv6 []netip.Addr `json:"ipv6"`
+}
+
+// RoutesEntry holds route counts by address family.
+type RoutesEntry struct {
+	IPv4 int `json:"ipv4"`
+	IPv6 int `json:"ipv6"`
+}
+
+// PolicyEntry is a policy as returned by the management API.
+type PolicyEntry struct {
+	Name       string `json:"name"`
+	ASN        uint32 `json:"asn"`
+	Spec       string `json:"spec"`
+	Enabled    bool   `json:"enabled"`
+	Persistent bool   `json:"persistent"`
+	Multipath  bool   `json:"multipath"`
+	// NextHops are the nexthops as configured, without those depending on
+	// the peer (peer, self and the nexthops of sites).
+	NextHops NextHopsEntry `json:"nexthops"`
+	// Organization, ActiveNextHops and Routes are set once the routes of the
+	// policy are announced. ActiveNextHops are the nexthops currently in
+	// use, after health checks and nexthop selection, likewise.
+	Organization   string         `json:"organization,omitempty"`
+	ActiveNextHops *NextHopsEntry `json:"activeNexthops,omitempty"`
+	Routes         *RoutesEntry   `json:"routes,omitempty"`
+}
+
+// PeerEntry is the session state of a BGP peer.
+type PeerEntry struct {
+	Address string `json:"address"`
+	// State is the BGP FSM state, such as "established".
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+}
+
+// NextHopEntry is the health of a checked nexthop.
+type NextHopEntry struct {
+	Address   netip.Addr `json:"address"`
+	Up        bool       `json:"up"`
+	Since     time.Time  `json:"since"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// DatabaseEntry describes the database last loaded.
+type DatabaseEntry struct {
+	Path     string    `json:"path"`
+	LoadedAt time.Time `json:"loadedAt"`
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+	Reloads  uint64    `json:"reloads"`
+	Failures uint64    `json:"failures"`
+}
+
+// StatusResponse is the state of a running server as returned by the
+// management API.
+type StatusResponse struct {
+	Peers    []PeerEntry    `json:"peers"`
+	Policies []PolicyEntry  `json:"policies"`
+	NextHops []NextHopEntry `json:"nexthops"`
+	// Database is nil until the database is loaded.
+	Database *DatabaseEntry `json:"database"`
+	Drains   []Drain        `json:"drains"`
+}
+
+type policyRequest struct {
+	Spec    string `json:"spec"`
+	Enabled *bool  `json:"enabled"`
+}
+
+type reloadResponse struct {
+	LoadedAt time.Time `json:"loadedAt"`
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// routeCounts returns the number of routes of pol, a policy of a Snapshot
+// holding only the announced prefixes, of each address family.
+func routeCounts(pol *policy.Policy) (ip4, ip6 int) {
+	for _, pre := range pol.ASInfo.Prefixes {
+		if pre.Addr().Is4() {
+			ip4++
+		} else {
+			ip6++
+		}
+	}
+	return ip4, ip6
+}
+
+// entry returns the PolicyEntry of d, with the routes of snap if the policy
+// is announced.
+func (h *apiHandler) entry(d PolicyDef, snap *Snapshot) PolicyEntry {
+	e := PolicyEntry{
+		Name:       d.Name,
+		Spec:       d.Spec,
+		Enabled:    d.Enabled,
+		Persistent: d.Persistent,
+	}
+	if pol, err := h.mgr.parse(d.Spec); err == nil {
+		e.ASN = pol.ASN
+		e.Multipath = pol.Multipath
+		e.NextHops = NextHopsEntry{
+			IPv4: slices.DeleteFunc(pol.IP4NextHops, config.IsPlaceholder),
+			IPv6: slices.DeleteFunc(pol.IP6NextHops, config.IsPlaceholder),
+		}
+	}
+	if !d.Enabled || snap == nil {
+		return e
+	}
+	if pol := snap.FindPolicy(d.Name); pol != nil {
+		ip4, ip6 := routeCounts(pol)
+		e.Organization = pol.ASInfo.Organization
+		e.ActiveNextHops = &NextHopsEntry{IPv4: pol.IP4NextHops, IPv6: pol.IP6NextHops}
+		e.Routes = &RoutesEntry{IPv4: ip4, IPv6: ip6}
+	}
+	return e
+}
+
+func (h *apiHandler) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.s.Warnf("Failed to write response: %v", err)
+	}
+}
+
+func (h *apiHandler) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errPolicyNotFound), errors.Is(err, errNotDrained):
+		status = http.StatusNotFound
+	case errors.Is(err, errPolicyExists), errors.Is(err, errDrainedElsewhere), errors.Is(err, errPolicyReferenced):
+		status = http.StatusConflict
+	case errors.Is(err, errInvalidPolicy):
+		status = http.StatusBadRequest
+	default:
+		h.s.Errorf("Management API request failed: %v", err)
+	}
+	h.writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func (h *apiHandler) decode(w http.ResponseWriter, r *http.Request) (*policyRequest, bool) {
+	var req policyRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		h.writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return nil, false
+	}
+	if req.Spec == "" {
+		h.writeJSON(w, http.StatusBadRequest, errorResponse{Error: "spec is required"})
+		return nil, false
+	}
+	return &req, true
+}
+
+func (h *apiHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	snap := h.srv.Snapshot()
+	entries := []PolicyEntry{}
+	for _, d := range h.mgr.Defs() {
+		entries = append(entries, h.entry(d, snap))
+	}
+	h.writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *apiHandler) handleGet(w http.ResponseWriter, r *http.Request) {
+	d, err := h.mgr.Def(r.PathValue("name"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, h.entry(d, h.srv.Snapshot()))
+}
+
+func (h *apiHandler) handleAdd(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decode(w, r)
+	if !ok {
+		return
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+	d, err := h.mgr.Add(context.WithoutCancel(r.Context()), req.Spec, enabled)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.writeJSON(w, http.StatusCreated, h.entry(d, h.srv.Snapshot()))
+}
+
+func (h *apiHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decode(w, r)
+	if !ok {
+		return
+	}
+	if req.Enabled != nil {
+		h.writeJSON(w, http.StatusBadRequest, errorResponse{Error: "use enable or disable to change whether the policy is enabled"})
+		return
+	}
+	d, err := h.mgr.Update(context.WithoutCancel(r.Context()), r.PathValue("name"), req.Spec)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, h.entry(d, h.srv.Snapshot()))
+}
+
+func (h *apiHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := h.mgr.Delete(context.WithoutCancel(r.Context()), r.PathValue("name")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *apiHandler) handleEnable(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, err := h.mgr.SetEnabled(context.WithoutCancel(r.Context()), r.PathValue("name"), enabled)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		h.writeJSON(w, http.StatusOK, h.entry(d, h.srv.Snapshot()))
+	}
+}
+
+func (h *apiHandler) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := h.srv.Reload(context.WithoutCancel(r.Context()), true); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	db := h.srv.Database()
+	h.writeJSON(w, http.StatusOK, reloadResponse{LoadedAt: db.LoadedAt, Modified: db.ModTime, Size: db.Size})
+}
+
+func (h *apiHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	st := StatusResponse{
+		Peers:    []PeerEntry{},
+		Policies: []PolicyEntry{},
+		NextHops: []NextHopEntry{},
+	}
+	if h.peers != nil {
+		for addr, ps := range h.peers.States() {
+			st.Peers = append(st.Peers, PeerEntry{
+				Address: addr,
+				State:   strings.ToLower(ps.State.String()),
+				Since:   ps.Since,
+			})
+		}
+		slices.SortFunc(st.Peers, func(a, b PeerEntry) int { return strings.Compare(a.Address, b.Address) })
+	}
+
+	snap := h.srv.Snapshot()
+	for _, d := range h.mgr.Defs() {
+		st.Policies = append(st.Policies, h.entry(d, snap))
+	}
+
+	if health := h.srv.cfg.Health; health != nil {
+		for nh, hs := range health.Statuses() {
+			e := NextHopEntry{Address: nh, Up: hs.Up, Since: hs.Since}
+			if hs.LastError != nil {
+				e.LastError = hs.LastError.Error()
+			}
+			st.NextHops = append(st.NextHops, e)
+		}
+		slices.SortFunc(st.NextHops, func(a, b NextHopEntry) int { return a.Address.Compare(b.Address) })
+	}
+
+	st.Drains = h.srv.Drains()
+
+	if db := h.srv.Database(); db != nil {
+		succeeded, failed := h.srv.Reloads()
+		st.Database = &DatabaseEntry{
+			Path:     h.srv.cfg.DBPath,
+			LoadedAt: db.LoadedAt,
+			Modified: db.ModTime,
+			Size:     db.Size,
+			Reloads:  succeeded,
+			Failures: failed,
+		}
+	}
+	h.writeJSON(w, http.StatusOK, st)
+}
+
+func (h *apiHandler) handleDrains(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, http.StatusOK, h.srv.Drains())
+}
+
+func (h *apiHandler) handleDrain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var key DrainKey
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&key); err != nil {
+			h.writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+			return
+		}
+		if err := h.srv.checkDrainKey(&key); err != nil {
+			h.writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+
+		ctx := context.WithoutCancel(r.Context())
+		var err error
+		if drain {
+			err = h.srv.Drain(ctx, key, drainSourceAPI)
+		} else {
+			err = h.srv.Undrain(ctx, key, drainSourceAPI)
+		}
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		h.writeJSON(w, http.StatusOK, h.srv.Drains())
+	}
+}
+
+// listen listens on addr, which is either unix:<path> for a Unix socket or
+// <host>:<port> for TCP. A stale Unix socket left at the path is removed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket removes the Unix socket at path unless a server is
+// listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,185 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/osrg/gobgp/v4/api"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+)
+
+func TestAPIHandler(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "db.csv")
+	db := "8.8.8.0,8.8.8.255,15169,Google LLC\n1.1.1.0,1.1.1.255,13335,\"Cloudflare, Inc.\"\n45.57.0.0,45.57.127.255,2906,Netflix\n"
+	if err := os.WriteFile(dbPath, []byte(db), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	confPath := filepath.Join(dir, "policybgp.yaml")
+	if err := os.WriteFile(confPath, []byte("# Policies\npolicies:\n  - 15169,192.168.1.1\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+	conf, err := config.Load(confPath, "")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	gateways := nexthop.NewGatewayWatcher(nil, zap.NewNop())
+	mgr, err := NewPolicyManager(conf, []string{"2906,192.168.9.1"}, gateways, false, confPath, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create policy manager: %v", err)
+	}
+	pols, err := mgr.Policies()
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+	bgps := newTestBgpServer(t)
+	srv := NewServer(bgps, &ServerConfig{DBPath: dbPath, Policies: pols, LocalASN: 64513}, zap.NewNop())
+	mgr.srv = srv
+	if err := srv.Reload(ctx, true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	peers := NewPeerStates()
+	peers.update(&api.Peer{State: &api.PeerState{NeighborAddress: "192.168.0.1", SessionState: api.PeerState_ESTABLISHED}})
+	h := NewAPIHandler(srv, mgr, peers, zap.NewNop())
+
+	do := func(method, path, body string, wantStatus int, v any) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != wantStatus {
+			t.Fatalf("Expected %d for %s %s, got %d: %s", wantStatus, method, path, rec.Code, rec.Body)
+		}
+		if v != nil {
+			if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+				t.Fatalf("Failed to decode response of %s %s: %v", method, path, err)
+			}
+		}
+	}
+	google := netip.MustParsePrefix("8.8.8.0/24")
+	cloudflare := netip.MustParsePrefix("1.1.1.0/24")
+	bestOf := func(pre netip.Prefix) string {
+		_, best := ribPaths(t, bgps, pre)
+		return best
+	}
+
+	var entries []PolicyEntry
+	do("GET", "/api/v1/policies", "", http.StatusOK, &entries)
+	if len(entries) != 2 || entries[0].Name != "as15169" || entries[0].Routes == nil || entries[0].Routes.IPv4 != 1 ||
+		entries[1].Name != "as2906" || entries[1].Persistent {
+		t.Errorf("Unexpected policies %+v", entries)
+	}
+
+	e := PolicyEntry{}
+	do("POST", "/api/v1/policies", `{"spec": "13335,192.168.2.1"}`, http.StatusCreated, &e)
+	if e.Name != "as13335" || !e.Enabled || e.Routes == nil || e.Routes.IPv4 != 1 || e.Organization != "Cloudflare, Inc." {
+		t.Errorf("Unexpected added policy %+v", e)
+	}
+	if best := bestOf(cloudflare); best != "192.168.2.1" {
+		t.Errorf("Expected best nexthop 192.168.2.1 for %v, got %q", cloudflare, best)
+	}
+	do("POST", "/api/v1/policies", `{"spec": "13335,192.168.3.1"}`, http.StatusConflict, nil)
+	do("POST", "/api/v1/policies", `{"spec": "64512,192.168.3.1"}`, http.StatusBadRequest, nil)
+	do("POST", "/api/v1/policies", `{"spec": "13335,bogus"}`, http.StatusBadRequest, nil)
+	do("POST", "/api/v1/policies", `{"bogus": true}`, http.StatusBadRequest, nil)
+
+	e = PolicyEntry{}
+	do("PUT", "/api/v1/policies/as13335", `{"spec": "13335,192.168.3.1"}`, http.StatusOK, &e)
+	if best := bestOf(cloudflare); best != "192.168.3.1" {
+		t.Errorf("Expected best nexthop 192.168.3.1 for %v, got %q", cloudflare, best)
+	}
+	do("PUT", "/api/v1/policies/as13335", `{"spec": "15169,192.168.3.1"}`, http.StatusBadRequest, nil)
+	do("PUT", "/api/v1/policies/as1", `{"spec": "1,192.168.3.1"}`, http.StatusNotFound, nil)
+
+	e = PolicyEntry{}
+	do("POST", "/api/v1/policies/as15169/disable", "", http.StatusOK, &e)
+	if e.Enabled || e.Routes != nil {
+		t.Errorf("Expected the policy disabled without routes, got %+v", e)
+	}
+	if best := bestOf(google); best != "" {
+		t.Errorf("Expected %v withdrawn, got best nexthop %q", google, best)
+	}
+
+	saved, err := config.Load(confPath, "")
+	if err != nil {
+		t.Fatalf("Failed to load saved configuration: %v", err)
+	}
+	if want := []string{"13335,192.168.3.1"}; !slices.Equal(saved.Policies, want) {
+		t.Errorf("Expected saved policies %v, got %v", want, saved.Policies)
+	}
+	if want := []string{"15169,192.168.1.1"}; !slices.Equal(saved.DisabledPolicies, want) {
+		t.Errorf("Expected saved disabled policies %v, got %v", want, saved.DisabledPolicies)
+	}
+
+	do("POST", "/api/v1/policies/as15169/enable", "", http.StatusOK, nil)
+	if best := bestOf(google); best != "192.168.1.1" {
+		t.Errorf("Expected best nexthop 192.168.1.1 for %v, got %q", google, best)
+	}
+
+	do("DELETE", "/api/v1/policies/as13335", "", http.StatusNoContent, nil)
+	if best := bestOf(cloudflare); best != "" {
+		t.Errorf("Expected %v withdrawn, got best nexthop %q", cloudflare, best)
+	}
+	do("GET", "/api/v1/policies/as13335", "", http.StatusNotFound, nil)
+	do("DELETE", "/api/v1/policies/as13335", "", http.StatusNotFound, nil)
+
+	var reloaded reloadResponse
+	do("POST", "/api/v1/reload", "", http.StatusOK, &reloaded)
+	if reloaded.Size != int64(len(db)) {
+		t.Errorf("Expected database size %d, got %+v", len(db), reloaded)
+	}
+	if succeeded, _ := srv.Reloads(); succeeded != 2 {
+		t.Errorf("Expected 2 reloads, got %d", succeeded)
+	}
+
+	var drains []Drain
+	do("POST", "/api/v1/drain", `{"scope": "policy", "name": "as15169"}`, http.StatusOK, &drains)
+	if len(drains) != 1 || !slices.Equal(drains[0].Sources, []string{drainSourceAPI}) || !drains[0].Withdrawn {
+		t.Errorf("Expected the policy drained, got %+v", drains)
+	}
+	if best := bestOf(google); best != "" {
+		t.Errorf("Expected %v withdrawn, got best nexthop %q", google, best)
+	}
+	do("POST", "/api/v1/drain", `{"scope": "policy", "name": "as1"}`, http.StatusNotFound, nil)
+	do("POST", "/api/v1/drain", `{"scope": "peer", "name": "router1"}`, http.StatusBadRequest, nil)
+	do("POST", "/api/v1/drain", `{"scope": "site"}`, http.StatusBadRequest, nil)
+	do("POST", "/api/v1/undrain", `{"scope": "policy", "name": "as15169"}`, http.StatusOK, &drains)
+	if len(drains) != 0 {
+		t.Errorf("Expected no drains, got %+v", drains)
+	}
+	if best := bestOf(google); best != "192.168.1.1" {
+		t.Errorf("Expected best nexthop 192.168.1.1 for %v, got %q", google, best)
+	}
+	do("POST", "/api/v1/undrain", `{"scope": "global"}`, http.StatusNotFound, nil)
+
+	var st StatusResponse
+	do("GET", "/api/v1/status", "", http.StatusOK, &st)
+	if len(st.Peers) != 1 || st.Peers[0].Address != "192.168.0.1" || st.Peers[0].State != "established" {
+		t.Errorf("Expected the established peer, got %+v", st.Peers)
+	}
+	if len(st.Policies) != 2 || st.Policies[0].Routes == nil || st.Policies[0].Routes.IPv4 != 1 {
+		t.Errorf("Expected the policies with their routes, got %+v", st.Policies)
+	}
+	if st.Database == nil || st.Database.Path != dbPath || st.Database.Reloads != 2 {
+		t.Errorf("Expected the database loaded twice, got %+v", st.Database)
+	}
+
+	bs, _ := os.ReadFile(confPath)
+	if !strings.Contains(string(bs), "# Policies") || strings.Contains(string(bs), "2906") {
+		t.Errorf("Expected the comment kept and the flag policy not saved, got:\n%s", bs)
+	}
+}
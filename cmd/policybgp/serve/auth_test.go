@@ -0,0 +1,222 @@
+package serve
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestIsLoopback(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:50051", true},
+		{"[::1]:50051", true},
+		{"localhost:50051", true},
+		{"unix:/run/policybgp.sock", true},
+		{":50051", false},
+		{"0.0.0.0:50051", false},
+		{"[::]:50051", false},
+		{"192.168.0.1:50051", false},
+		{"router.example.com:50051", false},
+	} {
+		if got := isLoopback(tc.addr); got != tc.want {
+			t.Errorf("Expected %v for %q, got %v", tc.want, tc.addr, got)
+		}
+	}
+}
+
+func TestGobgpListenAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"127.0.0.1:50051", "127.0.0.1:50051"},
+		{"unix:/run/gobgp.sock", "unix:///run/gobgp.sock"},
+		{"unix:///run/gobgp.sock", "unix:///run/gobgp.sock"},
+	} {
+		if got := gobgpListenAddress(tc.addr); got != tc.want {
+			t.Errorf("Expected %q for %q, got %q", tc.want, tc.addr, got)
+		}
+	}
+}
+
+func TestWithToken(t *testing.T) {
+	h := withToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "secret")
+
+	for _, tc := range []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/policies", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("Expected %d for %q, got %d", tc.want, tc.header, rec.Code)
+		}
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := os.WriteFile(path, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := ReadToken(path); err != nil || token != "secret" {
+		t.Errorf("Expected the token without the newline, got %q, %v", token, err)
+	}
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadToken(path); err == nil {
+		t.Errorf("Expected an error for an empty token file")
+	}
+}
+
+// writeCert writes a certificate signed by parent, or self-signed if parent
+// is nil, and its key to dir, and returns their paths.
+func writeCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (certPath, keyPath string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert, key
+}
+
+func TestGobgpClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	caPath, _, ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "policybgp test CA"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	certPath, keyPath, _, _ := writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	clientCertPath, clientKeyPath, _, _ := writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	tlsCfg, err := serverTLSConfig(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatalf("Failed to load the TLS configuration: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx := context.Background()
+	bgps, err := startBgp(ctx, 64513, "10.64.51.3", "", addr,
+		[]grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsCfg))}, nil, NewPeerStates(), zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("Failed to start BGP server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = bgps.StopBgp(context.Background(), &api.StopBgpRequest{})
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getBgp := func(certs []tls.Certificate) error {
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err = api.NewGoBgpServiceClient(conn).GetBgp(ctx, &api.GetBgpRequest{})
+		return err
+	}
+
+	// The gRPC server is started asynchronously.
+	var lastErr error
+	for range 50 {
+		if lastErr = getBgp([]tls.Certificate{clientCert}); lastErr == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if lastErr != nil {
+		t.Fatalf("Expected the client with a certificate accepted, got %v", lastErr)
+	}
+	if err := getBgp(nil); err == nil {
+		t.Errorf("Expected the client without a certificate rejected")
+	}
+}
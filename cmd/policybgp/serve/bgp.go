@@ -0,0 +1,335 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// parsePeer parses the BGP peer of the --peer flag, in the format
+// <ip>:<port>.
+func parsePeer(addr string) (*config.Peer, error) {
+	peerHost, peerPortS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer format %q: %w", addr, err)
+	}
+	peerAddr, err := netip.ParseAddr(peerHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address %q: %w", peerHost, err)
+	}
+	peerPort := 179 // default BGP port
+	if peerPortS != "" {
+		peerPort, err = net.LookupPort("tcp", peerPortS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer port %q: %w", peerPortS, err)
+		}
+	}
+	if peerPort < 1 || peerPort > 65535 {
+		return nil, fmt.Errorf("peer port %d invalid. It must be between 1 and 65535", peerPort)
+	}
+	return &config.Peer{Address: peerAddr, Port: uint16(peerPort)}, nil
+}
+
+// newPeer returns the configuration of the BGP peer pc receiving up to
+// sendMax paths per prefix. asn is our ASN, which is also that of the peer
+// unless set.
+func newPeer(pc *config.Peer, asn uint32, sendMax int) (*api.Peer, error) {
+	peer, err := peerTemplate(&pc.PeerOptions, asn, sendMax)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: %w", pc.Address, err)
+	}
+	peer.Conf.NeighborAddress = pc.Address.String()
+	if pc.Port != 0 {
+		peer.Transport.RemotePort = uint32(pc.Port)
+	}
+	return peer, nil
+}
+
+// peerTemplate returns the configuration of the BGP peers with the options
+// o receiving up to sendMax paths per prefix, but for their address.
+func peerTemplate(o *config.PeerOptions, asn uint32, sendMax int) (*api.Peer, error) {
+	password, err := o.Password()
+	if err != nil {
+		return nil, err
+	}
+	peerAsn := asn
+	if o.ASN != 0 {
+		peerAsn = o.ASN
+	}
+	if o.Multihop != 0 && peerAsn == asn {
+		return nil, fmt.Errorf("multihop only applies to eBGP peers")
+	}
+
+	peer := &api.Peer{
+		Conf: &api.PeerConf{
+			PeerAsn:      peerAsn,
+			AuthPassword: password,
+			Description:  o.Description,
+		},
+		Transport: &api.Transport{
+			RemotePort:  179, // default BGP port
+			PassiveMode: o.Passive,
+		},
+		Timers: &api.Timers{Config: &api.TimersConfig{
+			ConnectRetry:      3,
+			HoldTime:          90,
+			KeepaliveInterval: 30,
+		}},
+		AfiSafis: []*api.AfiSafi{
+			{Config: &api.AfiSafiConfig{Family: &api.Family{
+				Afi:  api.Family_AFI_IP,
+				Safi: api.Family_SAFI_UNICAST,
+			}}},
+			{Config: &api.AfiSafiConfig{Family: &api.Family{
+				Afi:  api.Family_AFI_IP6,
+				Safi: api.Family_SAFI_UNICAST,
+			}}},
+		},
+	}
+
+	if o.LocalAddress.IsValid() {
+		peer.Transport.LocalAddress = o.LocalAddress.String()
+	}
+	if o.Multihop != 0 {
+		peer.EbgpMultihop = &api.EbgpMultihop{Enabled: true, MultihopTtl: uint32(o.Multihop)}
+	}
+	if o.TTLSecurity != 0 {
+		// Packets are sent with a TTL of 255, and those of the peer must
+		// have at most o.TTLSecurity hops behind them.
+		peer.TtlSecurity = &api.TtlSecurity{Enabled: true, TtlMin: 256 - uint32(o.TTLSecurity)}
+	}
+
+	// Multipath policies announce a path per nexthop to peers capable of ADD-PATH.
+	if sendMax > 1 {
+		for _, afiSafi := range peer.AfiSafis {
+			afiSafi.AddPaths = &api.AddPaths{Config: &api.AddPathsConfig{SendMax: uint32(sendMax)}}
+		}
+	}
+	return peer, nil
+}
+
+// newPeerGroup returns the GoBGP peer group whose dynamic neighbors are
+// configured after tmpl, as returned by peerTemplate with the name of the
+// group set. They always wait for the peers to connect.
+func newPeerGroup(tmpl *api.Peer) *api.PeerGroup {
+	transport := proto.Clone(tmpl.Transport).(*api.Transport)
+	transport.PassiveMode = true
+	return &api.PeerGroup{
+		Conf: &api.PeerGroupConf{
+			PeerGroupName: tmpl.Conf.PeerGroup,
+			PeerAsn:       tmpl.Conf.PeerAsn,
+			AuthPassword:  tmpl.Conf.AuthPassword,
+			Description:   tmpl.Conf.Description,
+		},
+		Transport:       transport,
+		Timers:          tmpl.Timers,
+		EbgpMultihop:    tmpl.EbgpMultihop,
+		TtlSecurity:     tmpl.TtlSecurity,
+		GracefulRestart: tmpl.GracefulRestart,
+		AfiSafis:        tmpl.AfiSafis,
+	}
+}
+
+// groupFilter restricts the paths sent to the peers of a peer group to those
+// of its policies.
+type groupFilter struct {
+	name string
+	// members are the prefixes of the addresses of the peers of the group,
+	// including its dynamic neighbors.
+	members []netip.Prefix
+	// asns are the ASNs of the policies announced to the group.
+	asns []uint32
+}
+
+// groupFilters returns the filters of the peer groups restricting their
+// policies, ordered by name. peerConfs are the peers, including those of
+// the groups.
+func groupFilters(groups map[string]*config.PeerGroup, peerConfs []*config.Peer) ([]*groupFilter, error) {
+	var filters []*groupFilter
+	for _, name := range slices.Sorted(maps.Keys(groups)) {
+		g := groups[name]
+		if len(g.Policies) == 0 {
+			continue
+		}
+		f := &groupFilter{name: name, members: slices.Clone(g.Neighbors)}
+		for _, pc := range peerConfs {
+			if pc.Group == name {
+				f.members = append(f.members, netip.PrefixFrom(pc.Address, pc.Address.BitLen()))
+			}
+		}
+		if len(f.members) == 0 {
+			continue
+		}
+		for _, pol := range g.Policies {
+			asn, err := policy.ParseName(pol)
+			if err != nil {
+				return nil, fmt.Errorf("peer group %q: %w", name, err)
+			}
+			f.asns = append(f.asns, asn)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// redactedText returns the text format of the peer or peer group m for
+// logging, without its password.
+func redactedText(m proto.Message) string {
+	m = proto.Clone(m)
+	switch m := m.(type) {
+	case *api.Peer:
+		if m.Conf.AuthPassword != "" {
+			m.Conf.AuthPassword = "<redacted>"
+		}
+	case *api.PeerGroup:
+		if m.Conf.AuthPassword != "" {
+			m.Conf.AuthPassword = "<redacted>"
+		}
+	}
+	bs, err := prototext.Marshal(m)
+	if err != nil {
+		return err.Error()
+	}
+	return string(bs)
+}
+
+// enableGracefulRestart advertises the Graceful Restart capability (RFC 4724)
+// to peer, asking it to retain our routes for restartTime once the session
+// drops without a NOTIFICATION, and retaining the routes received from it in
+// turn. The restart state and forwarding state bits are set only if
+// restarting, that is when the previous run left its routes to the peer. The
+// peer then keeps them until our paths are sent again, which is deferred
+// until it sent all of its routes, or at most for deferralTime. On a cold
+// start, the paths are sent right away.
+func enableGracefulRestart(peer *api.Peer, restartTime, deferralTime time.Duration, restarting bool) {
+	peer.GracefulRestart = &api.GracefulRestart{
+		Enabled:         true,
+		RestartTime:     uint32(restartTime / time.Second),
+		LocalRestarting: restarting,
+		DeferralTime:    uint32(deferralTime / time.Second),
+	}
+	for _, afiSafi := range peer.AfiSafis {
+		afiSafi.MpGracefulRestart = &api.MpGracefulRestart{Config: &api.MpGracefulRestartConfig{Enabled: true}}
+	}
+}
+
+// readRestartState reports whether the restart state file at path was written
+// less than restartTime before now, that is whether the previous run shut
+// down leaving its routes to the peer and the peer still retains them. The
+// file is removed, so that a later crash is not taken for a restart. A
+// missing file reports a cold start.
+func readRestartState(path string, restartTime time.Duration, now time.Time) (bool, error) {
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(bs)))
+	if err != nil {
+		return false, fmt.Errorf("invalid restart state file %s: %w", path, err)
+	}
+	return now.Sub(t) < restartTime, nil
+}
+
+// writeRestartState records at path that the routes were left to the peer at
+// now, for readRestartState of the next run.
+func writeRestartState(path string, now time.Time) error {
+	return os.WriteFile(path, []byte(now.Format(time.RFC3339Nano)+"\n"), 0o644)
+}
+
+// parseListenBGP parses the address BGP sessions are accepted on, in the
+// format [<ip>]:<port>, where an empty address listens on all addresses.
+// An empty addr does not listen at all.
+func parseListenBGP(addr string) (addrs []string, port int32, err error) {
+	if addr == "" {
+		return nil, -1, nil // gobgp won't listen on tcp:179
+	}
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid BGP listen address %q: %w", addr, err)
+	}
+	if host != "" {
+		a, err := netip.ParseAddr(host)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid BGP listen address %q: %w", host, err)
+		}
+		addrs = []string{a.String()}
+	}
+	p, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil || p == 0 {
+		return nil, 0, fmt.Errorf("invalid BGP listen port %q", portS)
+	}
+	return addrs, int32(p), nil
+}
+
+// startBgp starts the embedded BGP server, accepting BGP sessions on
+// listenBGP and serving the GoBGP gRPC API with grpcOpts on listenGobgp
+// unless they are empty. The paths sent to the peers are filtered by
+// filters. The session states of the peers are recorded in peers.
+func startBgp(ctx context.Context, asn uint32, routerId, listenBGP, listenGobgp string, grpcOpts []grpc.ServerOption, filters *exportFilters, peers *PeerStates, s *zap.SugaredLogger) (*server.BgpServer, error) {
+	listenAddrs, listenPort, err := parseListenBGP(listenBGP)
+	if err != nil {
+		return nil, err
+	}
+	sopts := []server.ServerOption{
+		server.LoggerOption(&logAdapter{l: s.Named("gobgp")}),
+	}
+	if listenGobgp != "" {
+		sopts = append(sopts, server.GrpcListenAddress(listenGobgp), server.GrpcOption(grpcOpts))
+	}
+	bgps := server.NewBgpServer(sopts...)
+	go bgps.Serve()
+
+	s.Infof("Starting BGP server with ASN %d and Router ID %s", asn, routerId)
+	if err := bgps.StartBgp(ctx, &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:             asn,
+			RouterId:        routerId,
+			ListenPort:      listenPort,
+			ListenAddresses: listenAddrs,
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := setupExportPolicy(ctx, bgps, filters); err != nil {
+		return nil, err
+	}
+	if err := setupImportPolicy(ctx, bgps); err != nil {
+		return nil, err
+	}
+
+	// monitor the change of the peer state
+	if err := bgps.WatchEvent(ctx, &api.WatchEventRequest{Peer: &api.WatchEventRequest_Peer{}}, func(r *api.WatchEventResponse) {
+		if p := r.GetPeer(); p != nil && p.Type == api.WatchEventResponse_PeerEvent_TYPE_STATE {
+			s.Info(p)
+			peers.update(p.Peer)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return bgps, nil
+}
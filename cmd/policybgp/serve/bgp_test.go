@@ -0,0 +1,440 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/server"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+)
+
+func TestParsePeer(t *testing.T) {
+	for _, tc := range []struct {
+		addr    string
+		want    netip.AddrPort
+		wantErr bool
+	}{
+		{addr: "192.168.0.1:179", want: netip.MustParseAddrPort("192.168.0.1:179")},
+		{addr: "[2001:db8::1]:10179", want: netip.MustParseAddrPort("[2001:db8::1]:10179")},
+		{addr: "192.168.0.1:bgp", want: netip.MustParseAddrPort("192.168.0.1:179")},
+		{addr: "192.168.0.1", wantErr: true},
+		{addr: "router1:179", wantErr: true},
+		{addr: "192.168.0.1:0", wantErr: true},
+	} {
+		pc, err := parsePeer(tc.addr)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Expected an error for %q, got %+v", tc.addr, pc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.addr, err)
+			continue
+		}
+		if got := netip.AddrPortFrom(pc.Address, pc.Port); got != tc.want {
+			t.Errorf("Expected %v for %q, got %v", tc.want, tc.addr, got)
+		}
+	}
+}
+
+func TestParseListenBGP(t *testing.T) {
+	for _, tc := range []struct {
+		addr      string
+		wantAddrs []string
+		wantPort  int32
+		wantErr   bool
+	}{
+		{addr: "", wantPort: -1},
+		{addr: ":179", wantPort: 179},
+		{addr: "192.168.0.10:179", wantAddrs: []string{"192.168.0.10"}, wantPort: 179},
+		{addr: "[2001:db8::10]:10179", wantAddrs: []string{"2001:db8::10"}, wantPort: 10179},
+		{addr: "192.168.0.10", wantErr: true},
+		{addr: "router1:179", wantErr: true},
+		{addr: ":0", wantErr: true},
+		{addr: ":bgp", wantErr: true},
+	} {
+		addrs, port, err := parseListenBGP(tc.addr)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.addr, err)
+			continue
+		}
+		if !slices.Equal(addrs, tc.wantAddrs) || port != tc.wantPort {
+			t.Errorf("Expected %v and %d for %q, got %v and %d", tc.wantAddrs, tc.wantPort, tc.addr, addrs, port)
+		}
+	}
+}
+
+func TestRestartState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restart")
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	if restarting, err := readRestartState(path, 120*time.Second, now); err != nil || restarting {
+		t.Errorf("Expected a cold start without the state file, got %v, %v", restarting, err)
+	}
+
+	for _, tc := range []struct {
+		age  time.Duration
+		want bool
+	}{
+		{age: 30 * time.Second, want: true},
+		{age: 120 * time.Second, want: false},
+	} {
+		if err := writeRestartState(path, now.Add(-tc.age)); err != nil {
+			t.Fatalf("Failed to write the restart state: %v", err)
+		}
+		restarting, err := readRestartState(path, 120*time.Second, now)
+		if err != nil {
+			t.Fatalf("Failed to read the restart state: %v", err)
+		}
+		if restarting != tc.want {
+			t.Errorf("Expected restarting %v %v after the shutdown, got %v", tc.want, tc.age, restarting)
+		}
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected the restart state file removed, got %v", err)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("garbage\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRestartState(path, 120*time.Second, now); err == nil {
+		t.Error("Expected an invalid restart state file rejected")
+	}
+}
+
+func TestNewPeer(t *testing.T) {
+	pwPath := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(pwPath, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := newPeer(&config.Peer{
+		Address: netip.MustParseAddr("192.168.0.1"),
+		PeerOptions: config.PeerOptions{
+			ASN:          64512,
+			LocalAddress: netip.MustParseAddr("10.0.0.1"),
+			PasswordFile: pwPath,
+			Multihop:     2,
+			Passive:      true,
+		},
+	}, 64513, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if peer.Conf.NeighborAddress != "192.168.0.1" || peer.Conf.PeerAsn != 64512 || peer.Conf.AuthPassword != "secret" {
+		t.Errorf("Expected the address, ASN and password of the peer, got %v", peer.Conf)
+	}
+	if peer.Transport.RemotePort != 179 || peer.Transport.LocalAddress != "10.0.0.1" || !peer.Transport.PassiveMode {
+		t.Errorf("Expected the port, local address and passive mode of the peer, got %v", peer.Transport)
+	}
+	if peer.EbgpMultihop == nil || peer.EbgpMultihop.MultihopTtl != 2 || peer.TtlSecurity != nil {
+		t.Errorf("Expected multihop with TTL 2, got %v and %v", peer.EbgpMultihop, peer.TtlSecurity)
+	}
+
+	t.Setenv("POLICYBGP_TEST_PASSWORD", "secret2")
+	peer, err = newPeer(&config.Peer{
+		Address: netip.MustParseAddr("192.168.0.1"),
+		Port:    10179,
+		PeerOptions: config.PeerOptions{
+			PasswordEnv: "POLICYBGP_TEST_PASSWORD",
+			TTLSecurity: 1,
+		},
+	}, 64513, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if peer.Conf.PeerAsn != 64513 || peer.Conf.AuthPassword != "secret2" || peer.Transport.RemotePort != 10179 {
+		t.Errorf("Expected an iBGP peer with the password of the environment, got %v", peer)
+	}
+	if peer.TtlSecurity == nil || peer.TtlSecurity.TtlMin != 255 {
+		t.Errorf("Expected the minimum TTL 255, got %v", peer.TtlSecurity)
+	}
+
+	for _, pc := range []*config.Peer{
+		{Address: netip.MustParseAddr("192.168.0.1"), PeerOptions: config.PeerOptions{Multihop: 2}},
+		{Address: netip.MustParseAddr("192.168.0.1"), PeerOptions: config.PeerOptions{PasswordEnv: "POLICYBGP_TEST_UNSET"}},
+		{Address: netip.MustParseAddr("192.168.0.1"), PeerOptions: config.PeerOptions{PasswordFile: filepath.Join(t.TempDir(), "missing")}},
+	} {
+		if _, err := newPeer(pc, 64513, 1); err == nil {
+			t.Errorf("Expected an error for %+v", pc)
+		}
+	}
+}
+
+func TestLimitPaths(t *testing.T) {
+	gateways := nexthop.NewGatewayWatcher(nil, zap.NewNop())
+	mgr, err := NewPolicyManager(&config.Config{}, []string{"15169,192.168.1.1+192.168.2.1"}, gateways, true, "", zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create policy manager: %v", err)
+	}
+	n, err := mgr.MaxPaths()
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 paths, got %d, %v", n, err)
+	}
+	if err := mgr.LimitPaths(n); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := mgr.Add(context.Background(), "13335,192.168.1.1+192.168.2.1+192.168.3.1", true); !errors.Is(err, errInvalidPolicy) {
+		t.Errorf("Expected %v for more paths than the peers receive, got %v", errInvalidPolicy, err)
+	}
+	if err := mgr.LimitPaths(1); err == nil {
+		t.Errorf("Expected error for a multipath policy but got none")
+	}
+
+	peer, err := newPeer(&config.Peer{Address: netip.MustParseAddr("192.168.0.1")}, 64513, n)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, afiSafi := range peer.AfiSafis {
+		if afiSafi.AddPaths.GetConfig().GetSendMax() != 2 {
+			t.Errorf("Expected ADD-PATH SendMax 2, got %v", afiSafi.AddPaths)
+		}
+	}
+}
+
+func TestPassivePeer(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	bgps, err := startBgp(ctx, 64513, "10.64.51.3", "127.0.0.1:"+strconv.Itoa(port), "", nil, nil, NewPeerStates(), zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("Failed to start BGP server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = bgps.StopBgp(context.Background(), &api.StopBgpRequest{})
+	})
+	peer, err := newPeer(&config.Peer{Address: netip.MustParseAddr("127.0.0.1"), PeerOptions: config.PeerOptions{Passive: true}}, 64513, 1)
+	if err != nil {
+		t.Fatalf("Failed to configure peer: %v", err)
+	}
+	if err := bgps.AddPeer(ctx, &api.AddPeerRequest{Peer: peer}); err != nil {
+		t.Fatalf("Failed to add peer: %v", err)
+	}
+
+	// The router connects to us.
+	router := server.NewBgpServer(server.LoggerOption(&logAdapter{l: zap.NewNop().Sugar()}))
+	go router.Serve()
+	if err := router.StartBgp(ctx, &api.StartBgpRequest{Global: &api.Global{
+		Asn:        64513,
+		RouterId:   "10.64.51.4",
+		ListenPort: -1,
+	}}); err != nil {
+		t.Fatalf("Failed to start router: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = router.StopBgp(context.Background(), &api.StopBgpRequest{})
+	})
+	if err := router.AddPeer(ctx, &api.AddPeerRequest{Peer: &api.Peer{
+		Conf:      &api.PeerConf{NeighborAddress: "127.0.0.1", PeerAsn: 64513},
+		Transport: &api.Transport{RemotePort: uint32(port), LocalAddress: "127.0.0.1"},
+		Timers:    &api.Timers{Config: &api.TimersConfig{ConnectRetry: 1}},
+	}}); err != nil {
+		t.Fatalf("Failed to add peer to router: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var state api.PeerState_SessionState
+		if err := bgps.ListPeer(ctx, &api.ListPeerRequest{}, func(p *api.Peer) {
+			state = p.State.SessionState
+		}); err != nil {
+			t.Fatalf("Failed to list peers: %v", err)
+		}
+		if state == api.PeerState_ESTABLISHED {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("BGP session not established, state %v", state)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// newTestDynamicPeering starts a BGP server with filters, accepting the
+// peers of the peer group edge from 127.0.0.0/8 as dynamic neighbors and
+// recording their states in peers, and a router connecting to it from
+// 127.0.0.1.
+func newTestDynamicPeering(t *testing.T, filters *exportFilters, edge *config.PeerGroup, peers *PeerStates) (bgps, router *server.BgpServer) {
+	t.Helper()
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	bgps, err = startBgp(ctx, 64513, "10.64.51.3", "127.0.0.1:"+strconv.Itoa(port), "", nil, filters, peers, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("Failed to start BGP server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = bgps.StopBgp(context.Background(), &api.StopBgpRequest{})
+	})
+	tmpl, err := peerTemplate(&edge.PeerOptions, 64513, 1)
+	if err != nil {
+		t.Fatalf("Failed to configure peer group: %v", err)
+	}
+	tmpl.Conf.PeerGroup = "edge"
+	if err := bgps.AddPeerGroup(ctx, &api.AddPeerGroupRequest{PeerGroup: newPeerGroup(tmpl)}); err != nil {
+		t.Fatalf("Failed to add peer group: %v", err)
+	}
+	if err := bgps.AddDynamicNeighbor(ctx, &api.AddDynamicNeighborRequest{DynamicNeighbor: &api.DynamicNeighbor{
+		Prefix:    "127.0.0.0/8",
+		PeerGroup: "edge",
+	}}); err != nil {
+		t.Fatalf("Failed to add dynamic neighbors: %v", err)
+	}
+
+	router = server.NewBgpServer(server.LoggerOption(&logAdapter{l: zap.NewNop().Sugar()}))
+	go router.Serve()
+	if err := router.StartBgp(ctx, &api.StartBgpRequest{Global: &api.Global{
+		Asn:        64513,
+		RouterId:   "10.64.51.4",
+		ListenPort: -1,
+	}}); err != nil {
+		t.Fatalf("Failed to start router: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = router.StopBgp(context.Background(), &api.StopBgpRequest{})
+	})
+	if err := router.AddPeer(ctx, &api.AddPeerRequest{Peer: &api.Peer{
+		Conf:      &api.PeerConf{NeighborAddress: "127.0.0.1", PeerAsn: 64513},
+		Transport: &api.Transport{RemotePort: uint32(port), LocalAddress: "127.0.0.1"},
+		Timers:    &api.Timers{Config: &api.TimersConfig{ConnectRetry: 1}},
+	}}); err != nil {
+		t.Fatalf("Failed to add peer to router: %v", err)
+	}
+	return bgps, router
+}
+
+// receivedIPv4 waits for router to receive IPv4 paths, and returns their
+// nexthops by prefix once no more arrive. IPv6 nexthops are those of
+// MP_REACH_NLRI.
+func receivedIPv4(t *testing.T, router *server.BgpServer) map[string]string {
+	t.Helper()
+	received := func() map[string]string {
+		nhs := make(map[string]string)
+		if err := router.ListPath(context.Background(), &api.ListPathRequest{
+			TableType: api.TableType_GLOBAL,
+			Family:    familyOf(netip.MustParsePrefix("0.0.0.0/0")),
+		}, func(d *api.Destination) {
+			for _, p := range d.Paths {
+				for _, attr := range p.Pattrs {
+					if a := attr.GetNextHop(); a != nil {
+						nhs[d.Prefix] = a.NextHop
+					}
+					if a := attr.GetMpReach(); a != nil && len(a.NextHops) > 0 {
+						nhs[d.Prefix] = a.NextHops[0]
+					}
+				}
+			}
+		}); err != nil {
+			t.Fatalf("Failed to list paths: %v", err)
+		}
+		return nhs
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("No path received")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Give the paths which are filtered time to arrive if they were sent.
+	time.Sleep(500 * time.Millisecond)
+	return received()
+}
+
+func TestPeerGroupPolicies(t *testing.T) {
+	groupConfs := map[string]*config.PeerGroup{
+		"edge": {
+			Neighbors: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			Policies:  []string{"as15169"},
+		},
+		"core": {Neighbors: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+	}
+	groups, err := groupFilters(groupConfs, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse peer groups: %v", err)
+	}
+	if len(groups) != 1 || groups[0].name != "edge" || !slices.Equal(groups[0].asns, []uint32{15169}) {
+		t.Fatalf("Expected the filter of the edge group, got %+v", groups)
+	}
+	bgps, router := newTestDynamicPeering(t, &exportFilters{groups: groups}, groupConfs["edge"], NewPeerStates())
+	newDrainTestServer(t, bgps, DrainConfig{})
+
+	// Only the path of the policy of the group is sent.
+	if got, want := slices.Sorted(maps.Keys(receivedIPv4(t, router))), []string{"8.8.8.0/24"}; !slices.Equal(got, want) {
+		t.Errorf("Expected the router to receive %v, got %v", want, got)
+	}
+}
+
+func TestPeerStatesIdle(t *testing.T) {
+	peers := NewPeerStates()
+	peers.configure([]string{"192.0.2.1"})
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		for _, st := range []api.PeerState_SessionState{api.PeerState_ESTABLISHED, api.PeerState_IDLE} {
+			peers.update(&api.Peer{State: &api.PeerState{NeighborAddress: addr, SessionState: st}})
+		}
+	}
+
+	states := peers.States()
+	if st, ok := states["192.0.2.1"]; !ok || st.State != api.PeerState_IDLE {
+		t.Errorf("Expected the configured peer kept idle, got %v", states)
+	}
+	// 192.0.2.2 is a dynamic neighbor, which is deleted once idle.
+	if _, ok := states["192.0.2.2"]; ok {
+		t.Errorf("Expected the dynamic neighbor forgotten, got %v", states)
+	}
+}
+
+func TestDynamicNeighborPeerStates(t *testing.T) {
+	edge := &config.PeerGroup{Neighbors: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	peers := NewPeerStates()
+	_, router := newTestDynamicPeering(t, &exportFilters{}, edge, peers)
+
+	waitStates := func(want func(map[string]PeerState) bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !want(peers.States()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Unexpected peer states %v", peers.States())
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitStates(func(states map[string]PeerState) bool {
+		return states["127.0.0.1"].State == api.PeerState_ESTABLISHED
+	})
+	if err := router.DeletePeer(context.Background(), &api.DeletePeerRequest{Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("Failed to delete peer: %v", err)
+	}
+	// The dynamic neighbor is deleted with its session.
+	waitStates(func(states map[string]PeerState) bool { return len(states) == 0 })
+}
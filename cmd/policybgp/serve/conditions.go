@@ -0,0 +1,173 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/osrg/gobgp/v4/api"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// parseConditions parses conditions in the format <policy>=<prefix>, which
+// make the policy depend on the prefix being received from the BGP peer. The
+// policy must be among names. The conditions are returned by policy name.
+func parseConditions(ss []string, names []string) (map[string][]netip.Prefix, error) {
+	conds := make(map[string][]netip.Prefix)
+	for _, s := range ss {
+		name, pres, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid condition %q. Expected <policy>=<prefix>", s)
+		}
+		if !slices.Contains(names, name) {
+			return nil, fmt.Errorf("condition %q refers to unknown policy %q", s, name)
+		}
+		pre, err := netip.ParsePrefix(pres)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix in condition %q: %w", s, err)
+		}
+		if pre != pre.Masked() {
+			return nil, fmt.Errorf("invalid prefix in condition %q: %v has host bits set", s, pre)
+		}
+		conds[name] = append(conds[name], pre)
+	}
+	return conds, nil
+}
+
+// conditionsMet reports whether all prefixes the policy name depends on are
+// received.
+func (srv *Server) conditionsMet(name string) bool {
+	for _, pre := range srv.cfg.Conditions[name] {
+		if !srv.received[pre] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyConditions returns pols with the prefixes of the policies whose
+// conditions are not met dropped, so that they are withdrawn.
+func (srv *Server) applyConditions(pols []*policy.Policy) []*policy.Policy {
+	if len(srv.cfg.Conditions) == 0 {
+		return pols
+	}
+
+	cpols := make([]*policy.Policy, 0, len(pols))
+	for _, pol := range pols {
+		if !srv.conditionsMet(pol.Name) {
+			info := *pol.ASInfo
+			info.Prefixes = nil
+			cpol := *pol
+			cpol.ASInfo = &info
+			pol = &cpol
+		}
+		cpols = append(cpols, pol)
+	}
+	return cpols
+}
+
+// receivedPrefixes returns which of the prefixes of the conditions are in
+// the Adj-RIB-In of any BGP peer.
+func (srv *Server) receivedPrefixes(ctx context.Context) (map[netip.Prefix]bool, error) {
+	var neighbors []string
+	if err := srv.bgps.ListPeer(ctx, &api.ListPeerRequest{}, func(p *api.Peer) {
+		neighbors = append(neighbors, p.Conf.NeighborAddress)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+
+	received := make(map[netip.Prefix]bool)
+	for _, pres := range srv.cfg.Conditions {
+		for _, pre := range pres {
+			received[pre] = false
+		}
+	}
+	for pre := range received {
+		for _, neighbor := range neighbors {
+			if err := srv.bgps.ListPath(ctx, &api.ListPathRequest{
+				TableType: api.TableType_ADJ_IN,
+				Name:      neighbor,
+				Family:    familyOf(pre),
+				Prefixes:  []*api.TableLookupPrefix{{Prefix: pre.String(), Type: api.TableLookupPrefix_TYPE_EXACT}},
+			}, func(d *api.Destination) {
+				// The lookup of a default route matches all prefixes.
+				if d.Prefix == pre.String() && len(d.Paths) > 0 {
+					received[pre] = true
+				}
+			}); err != nil {
+				return nil, fmt.Errorf("failed to list paths received from %s: %w", neighbor, err)
+			}
+		}
+	}
+	return received, nil
+}
+
+// WatchConditions applies the policies again whenever a prefix the policies
+// depend on is received or withdrawn by the BGP peer, until ctx is done.
+func (srv *Server) WatchConditions(ctx context.Context) error {
+	changed := make(chan struct{}, 1)
+	if err := srv.bgps.WatchEvent(ctx, &api.WatchEventRequest{
+		Peer: &api.WatchEventRequest_Peer{},
+		Table: &api.WatchEventRequest_Table{Filters: []*api.WatchEventRequest_Table_Filter{{
+			Type: api.WatchEventRequest_Table_Filter_TYPE_ADJIN,
+			Init: true,
+		}}},
+	}, func(*api.WatchEventResponse) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to watch received routes: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+
+		received, err := srv.receivedPrefixes(ctx)
+		if err != nil {
+			srv.s.Errorf("Failed to look up received routes: %v", err)
+			continue
+		}
+		if err := srv.setReceived(ctx, received); err != nil {
+			srv.s.Errorf("Failed to apply received route change: %v", err)
+		}
+	}
+}
+
+// setReceived records which prefixes of the conditions are received, and
+// applies the policies again if any condition changed.
+func (srv *Server) setReceived(ctx context.Context, received map[netip.Prefix]bool) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if maps.Equal(srv.received, received) {
+		return nil
+	}
+	before := make(map[string]bool, len(srv.cfg.Conditions))
+	for name := range srv.cfg.Conditions {
+		before[name] = srv.conditionsMet(name)
+	}
+	srv.received = received
+	for name := range srv.cfg.Conditions {
+		switch met := srv.conditionsMet(name); {
+		case met && !before[name]:
+			srv.s.Infof("Conditions of policy %s met, announcing its routes", name)
+		case !met && before[name]:
+			srv.s.Infof("Conditions of policy %s no longer met, withdrawing its routes", name)
+		}
+	}
+
+	if srv.resolved == nil {
+		return nil
+	}
+	return srv.apply(ctx, srv.resolved)
+}
@@ -0,0 +1,113 @@
+package serve
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+	"github.com/osrg/gobgp/v4/api"
+	"go.uber.org/zap"
+)
+
+func TestParseConditions(t *testing.T) {
+	names := []string{"as15169", "as2906"}
+	conds, err := parseConditions([]string{"as2906=0.0.0.0/0", "as2906=2001:db8::/32", "as15169=198.51.100.0/24"}, names)
+	if err != nil {
+		t.Fatalf("Failed to parse conditions: %v", err)
+	}
+	if want := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("2001:db8::/32")}; !slices.Equal(conds["as2906"], want) {
+		t.Errorf("Expected conditions %v for as2906, got %v", want, conds["as2906"])
+	}
+	if want := []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}; !slices.Equal(conds["as15169"], want) {
+		t.Errorf("Expected conditions %v for as15169, got %v", want, conds["as15169"])
+	}
+
+	for _, s := range []string{
+		"as2906",
+		"as64512=0.0.0.0/0",
+		"as2906=0.0.0.0",
+		"as2906=192.0.2.1/24",
+	} {
+		if _, err := parseConditions([]string{s}, names); err == nil {
+			t.Errorf("Expected error for condition %q, got nil", s)
+		}
+	}
+}
+
+func TestWatchConditions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	if err := os.WriteFile(dbPath, []byte("8.8.8.0,8.8.8.255,15169,Google LLC\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	pols, err := policy.ParseAll([]string{"15169,192.168.1.1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+
+	bgps := newTestBgpServer(t)
+	if err := setupImportPolicy(ctx, bgps); err != nil {
+		t.Fatalf("Failed to set up import policy: %v", err)
+	}
+	router := newTestPeering(t, bgps, false)
+
+	tracked := netip.MustParsePrefix("0.0.0.0/0")
+	srv := NewServer(bgps, &ServerConfig{
+		DBPath:     dbPath,
+		Policies:   pols,
+		LocalASN:   64513,
+		Conditions: map[string][]netip.Prefix{"as15169": {tracked}},
+	}, zap.NewNop())
+	if err := srv.Reload(ctx, true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	pre := netip.MustParsePrefix("8.8.8.0/24")
+	if nhs, _ := ribPaths(t, bgps, pre); len(nhs) != 0 {
+		t.Errorf("Expected no paths before the tracked route is received, got %v", nhs)
+	}
+	go srv.WatchConditions(ctx)
+
+	waitBest := func(want string) {
+		t.Helper()
+		var best string
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if _, best = ribPaths(t, bgps, pre); best == want {
+				return
+			}
+		}
+		t.Fatalf("Expected best nexthop %q, got %q", want, best)
+	}
+
+	path := newPath(tracked, 0, announcement{NextHop: netip.MustParseAddr("127.0.0.1"), ASN: 64500}, 64513)
+	path.Identifier = 0
+	if _, err := router.AddPath(ctx, &api.AddPathRequest{Path: path}); err != nil {
+		t.Fatalf("Failed to add tracked route: %v", err)
+	}
+	waitBest("192.168.1.1")
+
+	// The received route stays out of the global RIB.
+	if err := bgps.ListPath(ctx, &api.ListPathRequest{
+		TableType: api.TableType_GLOBAL,
+		Family:    familyOf(tracked),
+		Prefixes:  []*api.TableLookupPrefix{{Prefix: tracked.String(), Type: api.TableLookupPrefix_TYPE_EXACT}},
+	}, func(d *api.Destination) {
+		if d.Prefix == tracked.String() {
+			t.Errorf("Expected the received route not to be imported, got %v", d)
+		}
+	}); err != nil {
+		t.Fatalf("Failed to list paths: %v", err)
+	}
+
+	if err := router.DeletePath(ctx, &api.DeletePathRequest{Path: path}); err != nil {
+		t.Fatalf("Failed to delete tracked route: %v", err)
+	}
+	waitBest("")
+}
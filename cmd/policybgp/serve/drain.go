@@ -0,0 +1,622 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+const (
+	// Scopes of drains.
+	DrainGlobal = "global"
+	DrainPolicy = "policy"
+	DrainPeer   = "peer"
+
+	// Sources of drains.
+	drainSourceAPI    = "api"
+	drainSourceFile   = "file"
+	drainSourceSignal = "signal"
+
+	// communityGracefulShutdown is the well-known GRACEFUL_SHUTDOWN
+	// community of RFC 8326.
+	communityGracefulShutdown = "65535:0"
+	// localPrefGracefulShutdown is the LOCAL_PREF of the paths marked with
+	// GRACEFUL_SHUTDOWN, so that any other path is preferred over them.
+	localPrefGracefulShutdown = 0
+	// localPrefGracefulShutdownPeer is the LOCAL_PREF of the paths sent to
+	// the peers drained with GRACEFUL_SHUTDOWN. It is set by the export
+	// policy, where GoBGP ignores a LOCAL_PREF of 0.
+	localPrefGracefulShutdownPeer = 1
+
+	gshutCommunitySet = exportPolicyName + "-gshut"
+	// Neighbor sets of the drained peers. An empty neighbor set matches
+	// every peer, so they always hold drainPeerPlaceholder, which is never
+	// the address of a peer.
+	drainWithdrawPeerSet = exportPolicyName + "-drain-withdraw"
+	drainGshutPeerSet    = exportPolicyName + "-drain-gshut"
+	drainPeerPlaceholder = "0.0.0.0/32"
+)
+
+var (
+	errNotDrained       = errors.New("not drained")
+	errDrainedElsewhere = errors.New("drained by another source")
+)
+
+// DrainConfig configures how drained routes are taken out of service.
+type DrainConfig struct {
+	// GracefulShutdown keeps drained routes announced with the
+	// GRACEFUL_SHUTDOWN community and a lowered LOCAL_PREF, so that the peer moves
+	// the traffic to any other path first, rather than withdrawing them.
+	// Routes installed to a routing table are always removed.
+	GracefulShutdown bool
+	// WithdrawAfter withdraws the routes marked with GRACEFUL_SHUTDOWN once
+	// they are drained for that long. 0 keeps them until undrained.
+	WithdrawAfter time.Duration
+	// ResetPeers resets the sessions of drained peers to withdraw their
+	// routes, as GoBGP can not withdraw the routes of a single peer otherwise.
+	// Without it, the routes of drained peers stay marked with
+	// GRACEFUL_SHUTDOWN.
+	ResetPeers bool
+}
+
+// DrainKey identifies what is drained: all routes (DrainGlobal), the routes
+// of the policy Name (DrainPolicy), or all routes announced to the BGP peer
+// at address Name (DrainPeer).
+type DrainKey struct {
+	Scope string `json:"scope"`
+	Name  string `json:"name,omitempty"`
+}
+
+func (k DrainKey) String() string {
+	if k.Name == "" {
+		return k.Scope
+	}
+	return k.Scope + " " + k.Name
+}
+
+// ParseDrainKey parses a DrainKey in the format "global", "policy <name>" or
+// "peer <address>".
+func ParseDrainKey(s string) (DrainKey, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return DrainKey{}, fmt.Errorf("empty drain")
+	}
+	k := DrainKey{Scope: fields[0]}
+	if len(fields) > 1 {
+		k.Name = fields[1]
+	}
+	if len(fields) > 2 {
+		return DrainKey{}, fmt.Errorf("invalid drain %q", s)
+	}
+	if err := k.validate(); err != nil {
+		return DrainKey{}, err
+	}
+	return k, nil
+}
+
+func (k *DrainKey) validate() error {
+	switch k.Scope {
+	case DrainGlobal:
+		if k.Name != "" {
+			return fmt.Errorf("global drain takes no name, got %q", k.Name)
+		}
+	case DrainPolicy:
+		if k.Name == "" {
+			return fmt.Errorf("policy drain requires the name of the policy")
+		}
+	case DrainPeer:
+		addr, err := netip.ParseAddr(k.Name)
+		if err != nil {
+			return fmt.Errorf("peer drain requires the address of the peer: %w", err)
+		}
+		k.Name = addr.String()
+	default:
+		return fmt.Errorf("unknown drain scope %q. Expected %s, %s or %s", k.Scope, DrainGlobal, DrainPolicy, DrainPeer)
+	}
+	return nil
+}
+
+// Drain is a drained scope.
+type Drain struct {
+	DrainKey
+	Since time.Time `json:"since"`
+	// Sources are what drained it, sorted: api, file and signal. It stays
+	// drained until all of them undrain it.
+	Sources []string `json:"sources"`
+	// Withdrawn is set once the routes are withdrawn, rather than marked
+	// with GRACEFUL_SHUTDOWN.
+	Withdrawn bool `json:"withdrawn"`
+}
+
+// withdrawn reports whether the routes of d are withdrawn at now.
+func (srv *Server) withdrawn(d Drain, now time.Time) bool {
+	cfg := srv.cfg.Drain
+	if srv.cfg.Table != nil {
+		return true
+	}
+	if d.Scope == DrainPeer && !cfg.ResetPeers {
+		return false
+	}
+	if !cfg.GracefulShutdown {
+		return true
+	}
+	return cfg.WithdrawAfter > 0 && now.Sub(d.Since) >= cfg.WithdrawAfter
+}
+
+// Drains returns the drained scopes.
+func (srv *Server) Drains() []Drain {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	now := time.Now()
+	drains := make([]Drain, 0, len(srv.drains))
+	for _, d := range srv.drains {
+		d.Sources = slices.Clone(d.Sources)
+		d.Withdrawn = srv.withdrawn(d, now)
+		drains = append(drains, d)
+	}
+	slices.SortFunc(drains, func(a, b Drain) int { return strings.Compare(a.String(), b.String()) })
+	return drains
+}
+
+// Drain takes the routes of key out of service, until Undrain is called
+// with the same source.
+func (srv *Server) Drain(ctx context.Context, key DrainKey, source string) error {
+	if err := srv.checkDrainKey(&key); err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if err := srv.checkDrainPolicy(key); err != nil {
+		return err
+	}
+	if !srv.addDrain(key, source, time.Now()) {
+		return nil
+	}
+	return srv.applyDrains(ctx)
+}
+
+// Undrain removes the drain of key by source, and puts the routes of key
+// back into service unless other sources drained it too.
+func (srv *Server) Undrain(ctx context.Context, key DrainKey, source string) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	d, ok := srv.drains[key]
+	if !ok {
+		return fmt.Errorf("%w: %s", errNotDrained, key)
+	}
+	if !slices.Contains(d.Sources, source) {
+		return fmt.Errorf("%w: %s is drained by %s", errDrainedElsewhere, key, strings.Join(d.Sources, ", "))
+	}
+	if !srv.removeDrain(key, source) {
+		return nil
+	}
+	return srv.applyDrains(ctx)
+}
+
+// addDrain records the drain of key by source, and reports whether key was
+// newly drained. srv.mu must be held.
+func (srv *Server) addDrain(key DrainKey, source string, now time.Time) bool {
+	d, ok := srv.drains[key]
+	if ok && slices.Contains(d.Sources, source) {
+		return false
+	}
+	if !ok {
+		d = Drain{DrainKey: key, Since: now}
+	}
+	// The sources are cloned, as Drains hands out copies of the drains.
+	d.Sources = append(slices.Clone(d.Sources), source)
+	slices.Sort(d.Sources)
+	srv.drains[key] = d
+	srv.s.Infof("Drained %s (%s)", key, source)
+	return !ok
+}
+
+// removeDrain removes the drain of key by source, and reports whether key
+// is no longer drained. srv.mu must be held.
+func (srv *Server) removeDrain(key DrainKey, source string) bool {
+	d := srv.drains[key]
+	d.Sources = slices.DeleteFunc(slices.Clone(d.Sources), func(s string) bool { return s == source })
+	if len(d.Sources) > 0 {
+		srv.drains[key] = d
+		srv.s.Infof("Undrained %s (%s), still drained by %s", key, source, strings.Join(d.Sources, ", "))
+		return false
+	}
+	delete(srv.drains, key)
+	srv.s.Infof("Undrained %s (%s)", key, source)
+	return true
+}
+
+// setDrains replaces the drains of source with keys. The drains of policies
+// which do not exist are skipped and reported in the returned error, after
+// the others are applied.
+func (srv *Server) setDrains(ctx context.Context, keys []DrainKey, source string) error {
+	for i := range keys {
+		if err := srv.checkDrainKey(&keys[i]); err != nil {
+			return err
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var errs []error
+	keys = slices.DeleteFunc(slices.Clone(keys), func(key DrainKey) bool {
+		err := srv.checkDrainPolicy(key)
+		errs = append(errs, err)
+		return err != nil
+	})
+	changed := false
+	for key, d := range srv.drains {
+		if slices.Contains(d.Sources, source) && !slices.Contains(keys, key) {
+			changed = srv.removeDrain(key, source) || changed
+		}
+	}
+	now := time.Now()
+	for _, key := range keys {
+		changed = srv.addDrain(key, source, now) || changed
+	}
+	if changed {
+		errs = append(errs, srv.applyDrains(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (srv *Server) checkDrainKey(key *DrainKey) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	if key.Scope == DrainPeer && srv.cfg.Table != nil {
+		return fmt.Errorf("peers can only be drained in bgp mode")
+	}
+	return nil
+}
+
+// policyDefined reports whether the policy name is defined, enabled or not.
+// srv.mu must be held.
+func (srv *Server) policyDefined(name string) bool {
+	return slices.Contains(srv.cfg.Disabled, name) ||
+		slices.ContainsFunc(srv.cfg.Policies, func(pol *policy.Policy) bool { return pol.Name == name })
+}
+
+// checkDrainPolicy returns an error if key drains a policy which is not
+// defined, as draining it would drain nothing. srv.mu must be held.
+func (srv *Server) checkDrainPolicy(key DrainKey) error {
+	if key.Scope == DrainPolicy && !srv.policyDefined(key.Name) {
+		return fmt.Errorf("%w: %q", errPolicyNotFound, key.Name)
+	}
+	return nil
+}
+
+// dropDrains removes the drains of the policies no longer defined, by any
+// source. srv.mu must be held.
+func (srv *Server) dropDrains() {
+	changed := false
+	for key := range srv.drains {
+		if key.Scope == DrainPolicy && !srv.policyDefined(key.Name) {
+			delete(srv.drains, key)
+			srv.s.Infof("Undrained %s, which was removed", key)
+			changed = true
+		}
+	}
+	if changed {
+		select {
+		case srv.drainChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// applyDrains applies a change of the drains. srv.mu must be held.
+func (srv *Server) applyDrains(ctx context.Context) error {
+	select {
+	case srv.drainChanged <- struct{}{}:
+	default:
+	}
+	if srv.closed {
+		return nil
+	}
+	if srv.cfg.Table == nil {
+		if err := srv.syncDrainedPeers(ctx, time.Now()); err != nil {
+			return err
+		}
+	}
+	if srv.resolved == nil {
+		return nil
+	}
+	return srv.apply(ctx, srv.resolved)
+}
+
+// drainPolicies returns pols with the prefixes of the drained policies whose
+// routes are withdrawn removed, and the names of those whose routes are marked
+// with GRACEFUL_SHUTDOWN.
+func (srv *Server) drainPolicies(pols []*policy.Policy, now time.Time) ([]*policy.Policy, map[string]bool) {
+	if len(srv.drains) == 0 {
+		return pols, nil
+	}
+
+	gshut := make(map[string]bool)
+	dpols := make([]*policy.Policy, 0, len(pols))
+	for _, pol := range pols {
+		drained, withdrawn := false, false
+		for _, key := range []DrainKey{{Scope: DrainGlobal}, {Scope: DrainPolicy, Name: pol.Name}} {
+			if d, ok := srv.drains[key]; ok {
+				drained = true
+				withdrawn = withdrawn || srv.withdrawn(d, now)
+			}
+		}
+		switch {
+		case withdrawn:
+			info := *pol.ASInfo
+			info.Prefixes = nil
+			dpol := *pol
+			dpol.ASInfo = &info
+			pol = &dpol
+		case drained:
+			gshut[pol.Name] = true
+		}
+		dpols = append(dpols, pol)
+	}
+	return dpols, gshut
+}
+
+// syncDrainedPeers updates the neighbor sets of the drained peers, and has
+// the paths sent to the peers again when they changed. GoBGP does not
+// withdraw the paths rejected on a soft reset, so with
+// DrainConfig.ResetPeers the sessions of the peers newly drained in withdraw
+// mode are reset instead, and come back up without the paths.
+func (srv *Server) syncDrainedPeers(ctx context.Context, now time.Time) error {
+	want := map[string][]string{
+		drainWithdrawPeerSet: {drainPeerPlaceholder},
+		drainGshutPeerSet:    {drainPeerPlaceholder},
+	}
+	for key, d := range srv.drains {
+		if key.Scope != DrainPeer {
+			continue
+		}
+		set := drainGshutPeerSet
+		if srv.withdrawn(d, now) {
+			set = drainWithdrawPeerSet
+		}
+		addr := netip.MustParseAddr(key.Name)
+		want[set] = append(want[set], netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+
+	changed := false
+	var reset []string
+	for _, name := range slices.Sorted(maps.Keys(want)) {
+		cur := srv.drainedPeers[name]
+		if cur == nil {
+			cur = []string{drainPeerPlaceholder}
+		}
+		var added, removed []string
+		for _, a := range want[name] {
+			if !slices.Contains(cur, a) {
+				added = append(added, a)
+			}
+		}
+		for _, a := range cur {
+			if !slices.Contains(want[name], a) {
+				removed = append(removed, a)
+			}
+		}
+		if len(added) > 0 {
+			if err := srv.bgps.AddDefinedSet(ctx, &api.AddDefinedSetRequest{DefinedSet: &api.DefinedSet{
+				DefinedType: api.DefinedType_NEIGHBOR,
+				Name:        name,
+				List:        added,
+			}}); err != nil {
+				return fmt.Errorf("failed to add drained peers: %w", err)
+			}
+		}
+		if len(removed) > 0 {
+			if err := srv.bgps.DeleteDefinedSet(ctx, &api.DeleteDefinedSetRequest{DefinedSet: &api.DefinedSet{
+				DefinedType: api.DefinedType_NEIGHBOR,
+				Name:        name,
+				List:        removed,
+			}}); err != nil {
+				return fmt.Errorf("failed to remove undrained peers: %w", err)
+			}
+		}
+		srv.drainedPeers[name] = want[name]
+		changed = changed || len(added) > 0 || len(removed) > 0
+		if name == drainWithdrawPeerSet {
+			reset = added
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := srv.bgps.ResetPeer(ctx, &api.ResetPeerRequest{
+		Address:   "all",
+		Soft:      true,
+		Direction: api.ResetPeerRequest_DIRECTION_OUT,
+	}); err != nil {
+		return fmt.Errorf("failed to resend paths: %w", err)
+	}
+	for _, a := range reset {
+		addr := netip.MustParsePrefix(a).Addr().String()
+		if err := srv.bgps.ResetPeer(ctx, &api.ResetPeerRequest{
+			Address:       addr,
+			Communication: "drained",
+		}); err != nil {
+			return fmt.Errorf("failed to reset drained peer %s: %w", addr, err)
+		}
+	}
+	return nil
+}
+
+// nextDrainDeadline returns when the routes of a drain marked with
+// GRACEFUL_SHUTDOWN are to be withdrawn next, if any.
+func (srv *Server) nextDrainDeadline(now time.Time) (time.Time, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var next time.Time
+	for _, d := range srv.drains {
+		if srv.withdrawn(d, now) || srv.cfg.Drain.WithdrawAfter <= 0 {
+			continue
+		}
+		if d.Scope == DrainPeer && !srv.cfg.Drain.ResetPeers {
+			continue
+		}
+		if at := d.Since.Add(srv.cfg.Drain.WithdrawAfter); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// WatchDrains withdraws the routes marked with GRACEFUL_SHUTDOWN once they
+// were drained for DrainConfig.WithdrawAfter, until ctx is done.
+func (srv *Server) WatchDrains(ctx context.Context) {
+	for {
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if next, ok := srv.nextDrainDeadline(time.Now()); ok {
+			timer = time.NewTimer(time.Until(next))
+			expired = timer.C
+		}
+
+		fired := false
+		select {
+		case <-ctx.Done():
+		case <-srv.drainChanged:
+		case <-expired:
+			fired = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !fired {
+			continue
+		}
+
+		srv.mu.Lock()
+		err := srv.applyDrains(ctx)
+		srv.mu.Unlock()
+		if err != nil {
+			srv.s.Errorf("Failed to withdraw drained routes: %v", err)
+		}
+	}
+}
+
+// ParseDrainFile parses the drains of a drain file: one drain per line in
+// the format of ParseDrainKey, ignoring empty lines and comments starting
+// with #. A file without drains drains all routes.
+func ParseDrainFile(bs []byte) ([]DrainKey, error) {
+	var keys []DrainKey
+	for i, line := range strings.Split(string(bs), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		key, err := ParseDrainKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		keys = []DrainKey{{Scope: DrainGlobal}}
+	}
+	return keys, nil
+}
+
+// LoadDrainFile drains what the file at path lists, if it exists.
+func (srv *Server) LoadDrainFile(ctx context.Context, path string) error {
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read drain file: %w", err)
+	}
+	keys, err := ParseDrainFile(bs)
+	if err != nil {
+		return fmt.Errorf("invalid drain file %s: %w", path, err)
+	}
+	return srv.setDrains(ctx, keys, drainSourceFile)
+}
+
+// WatchDrainFile drains what the file at path lists while it exists,
+// checking it every interval until ctx is done.
+func (srv *Server) WatchDrainFile(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []byte
+	exists := false
+	for {
+		bs, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if exists {
+				srv.s.Infof("Drain file %s removed", path)
+				if err := srv.setDrains(ctx, nil, drainSourceFile); err != nil {
+					srv.s.Errorf("Failed to undrain: %v", err)
+				}
+			}
+			exists, last = false, nil
+		case err != nil:
+			srv.s.Errorf("Failed to read drain file: %v", err)
+		case !exists || !bytes.Equal(bs, last):
+			exists, last = true, bs
+			keys, err := ParseDrainFile(bs)
+			if err != nil {
+				srv.s.Errorf("Invalid drain file %s: %v", path, err)
+				break
+			}
+			if err := srv.setDrains(ctx, keys, drainSourceFile); err != nil {
+				srv.s.Errorf("Failed to drain: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// WatchDrainSignals drains all routes on drainSignal and undrains them on
+// undrainSignal received from sigCh, until ctx is done.
+func (srv *Server) WatchDrainSignals(ctx context.Context, sigCh <-chan os.Signal) {
+	global := DrainKey{Scope: DrainGlobal}
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigCh:
+			if sig == drainSignal {
+				err = srv.Drain(ctx, global, drainSourceSignal)
+			} else {
+				err = srv.Undrain(ctx, global, drainSourceSignal)
+			}
+		}
+		if err != nil && !errors.Is(err, errNotDrained) {
+			srv.s.Errorf("Failed to handle signal: %v", err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package serve
+
+import "os"
+
+// Routes cannot be drained by signals on this platform.
+var drainSignal, undrainSignal os.Signal
@@ -0,0 +1,445 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/server"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+func TestParseDrainFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    []DrainKey
+		wantErr bool
+	}{
+		{"empty", "", []DrainKey{{Scope: DrainGlobal}}, false},
+		{"comments only", "# maintenance\n\n", []DrainKey{{Scope: DrainGlobal}}, false},
+		{
+			"scopes",
+			"policy as15169 # ISP-A maintenance\npeer 2001:db8:0::1\npolicy as15169\n",
+			[]DrainKey{{Scope: DrainPolicy, Name: "as15169"}, {Scope: DrainPeer, Name: "2001:db8::1"}},
+			false,
+		},
+		{"global with name", "global as15169\n", nil, true},
+		{"policy without name", "policy\n", nil, true},
+		{"invalid peer", "peer router1\n", nil, true},
+		{"unknown scope", "site tokyo\n", nil, true},
+		{"too many fields", "policy as15169 as13335\n", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseDrainFile([]byte(tc.content))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// newDrainTestServer returns a Server announcing 8.8.8.0/24 of as15169 and
+// 1.1.1.0/24 of as13335.
+func newDrainTestServer(t *testing.T, bgps *server.BgpServer, cfg DrainConfig) *Server {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	if err := os.WriteFile(dbPath, []byte("8.8.8.0,8.8.8.255,15169,Google LLC\n1.1.1.0,1.1.1.255,13335,Cloudflare\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	pols, err := policy.ParseAll([]string{"15169,192.168.1.1", "13335,192.168.2.1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+	srv := NewServer(bgps, &ServerConfig{DBPath: dbPath, Policies: pols, LocalASN: 64513, Drain: cfg}, zap.NewNop())
+	if err := srv.Reload(context.Background(), true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	return srv
+}
+
+// gshutMarked reports whether the path of pre in the global RIB of bgps
+// carries the GRACEFUL_SHUTDOWN community.
+func gshutMarked(t *testing.T, bgps *server.BgpServer, pre netip.Prefix) bool {
+	t.Helper()
+
+	marked := false
+	if err := bgps.ListPath(context.Background(), &api.ListPathRequest{
+		TableType: api.TableType_GLOBAL,
+		Family:    familyOf(pre),
+		Prefixes:  []*api.TableLookupPrefix{{Prefix: pre.String()}},
+	}, func(d *api.Destination) {
+		for _, p := range d.Paths {
+			for _, attr := range p.Pattrs {
+				if c := attr.GetCommunities(); c != nil && slices.Contains(c.Communities, 0xffff0000) {
+					marked = true
+				}
+			}
+		}
+	}); err != nil {
+		t.Fatalf("Failed to list paths: %v", err)
+	}
+	return marked
+}
+
+func TestDrainWithdraw(t *testing.T) {
+	ctx := context.Background()
+	google := netip.MustParsePrefix("8.8.8.0/24")
+	cloudflare := netip.MustParsePrefix("1.1.1.0/24")
+	bgps := newTestBgpServer(t)
+	srv := newDrainTestServer(t, bgps, DrainConfig{})
+
+	count := func(pre netip.Prefix) int {
+		nhs, _ := ribPaths(t, bgps, pre)
+		return len(nhs)
+	}
+
+	if err := srv.Drain(ctx, DrainKey{Scope: DrainPolicy, Name: "as15169"}, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if count(google) != 0 || count(cloudflare) != 1 {
+		t.Errorf("Expected only the policy drained, got %d and %d paths", count(google), count(cloudflare))
+	}
+	if err := srv.Drain(ctx, DrainKey{Scope: DrainGlobal}, drainSourceSignal); err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if count(cloudflare) != 0 {
+		t.Errorf("Expected all routes drained, got %d paths", count(cloudflare))
+	}
+
+	// Reloads keep the drains.
+	if err := srv.Reload(ctx, true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if count(google) != 0 || count(cloudflare) != 0 {
+		t.Errorf("Expected the routes drained after reload, got %d and %d paths", count(google), count(cloudflare))
+	}
+	if drains := srv.Drains(); len(drains) != 2 || !drains[0].Withdrawn {
+		t.Errorf("Expected 2 withdrawn drains, got %+v", drains)
+	}
+
+	if err := srv.Undrain(ctx, DrainKey{Scope: DrainGlobal}, drainSourceSignal); err != nil {
+		t.Fatalf("Failed to undrain: %v", err)
+	}
+	if count(google) != 0 || count(cloudflare) != 1 {
+		t.Errorf("Expected the policy still drained, got %d and %d paths", count(google), count(cloudflare))
+	}
+	if err := srv.Undrain(ctx, DrainKey{Scope: DrainPolicy, Name: "as15169"}, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to undrain: %v", err)
+	}
+	if count(google) != 1 {
+		t.Errorf("Expected the policy undrained, got %d paths", count(google))
+	}
+	if err := srv.Undrain(ctx, DrainKey{Scope: DrainGlobal}, drainSourceSignal); err == nil {
+		t.Errorf("Expected an error undraining what is not drained")
+	}
+
+	// Draining a policy which does not exist would drain nothing.
+	if err := srv.Drain(ctx, DrainKey{Scope: DrainPolicy, Name: "as1516"}, drainSourceAPI); !errors.Is(err, errPolicyNotFound) {
+		t.Errorf("Expected %v draining an unknown policy, got %v", errPolicyNotFound, err)
+	}
+	// The drain file still drains the others.
+	if err := srv.setDrains(ctx, []DrainKey{{Scope: DrainGlobal}, {Scope: DrainPolicy, Name: "as1516"}}, drainSourceFile); !errors.Is(err, errPolicyNotFound) {
+		t.Errorf("Expected %v draining an unknown policy, got %v", errPolicyNotFound, err)
+	}
+	if drains := srv.Drains(); len(drains) != 1 || drains[0].Scope != DrainGlobal {
+		t.Errorf("Expected only the global drain, got %+v", drains)
+	}
+	if count(google) != 0 || count(cloudflare) != 0 {
+		t.Errorf("Expected all routes drained, got %d and %d paths", count(google), count(cloudflare))
+	}
+}
+
+func TestDrainSources(t *testing.T) {
+	ctx := context.Background()
+	google := netip.MustParsePrefix("8.8.8.0/24")
+	bgps := newTestBgpServer(t)
+	srv := newDrainTestServer(t, bgps, DrainConfig{})
+	key := DrainKey{Scope: DrainPolicy, Name: "as15169"}
+
+	if err := srv.Drain(ctx, key, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "drain")
+	if err := os.WriteFile(path, []byte("policy as15169\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.LoadDrainFile(ctx, path); err != nil {
+		t.Fatalf("Failed to load drain file: %v", err)
+	}
+	if drains := srv.Drains(); len(drains) != 1 || !slices.Equal(drains[0].Sources, []string{drainSourceAPI, drainSourceFile}) {
+		t.Errorf("Expected the policy drained by the API and the file, got %+v", drains)
+	}
+
+	// The file keeps the policy drained.
+	if err := srv.Undrain(ctx, key, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to undrain: %v", err)
+	}
+	if nhs, _ := ribPaths(t, bgps, google); len(nhs) != 0 {
+		t.Errorf("Expected the policy still drained by the file, got %v", nhs)
+	}
+	if err := srv.Undrain(ctx, key, drainSourceAPI); !errors.Is(err, errDrainedElsewhere) {
+		t.Errorf("Expected %v undraining the drain of the file, got %v", errDrainedElsewhere, err)
+	}
+
+	if err := srv.setDrains(ctx, nil, drainSourceFile); err != nil {
+		t.Fatalf("Failed to undrain: %v", err)
+	}
+	if nhs, _ := ribPaths(t, bgps, google); len(nhs) != 1 {
+		t.Errorf("Expected the policy undrained, got %v", nhs)
+	}
+}
+
+func TestDrainDefinedPolicies(t *testing.T) {
+	ctx := context.Background()
+	google := netip.MustParsePrefix("8.8.8.0/24")
+	bgps := newTestBgpServer(t)
+	srv := newDrainTestServer(t, bgps, DrainConfig{})
+	pols := srv.Policies()
+
+	// Disabled policies can be drained before they are enabled.
+	if err := srv.SetPolicies(ctx, pols[1:], []string{"as15169"}); err != nil {
+		t.Fatalf("Failed to set policies: %v", err)
+	}
+	key := DrainKey{Scope: DrainPolicy, Name: "as15169"}
+	if err := srv.Drain(ctx, key, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if err := srv.SetPolicies(ctx, pols, nil); err != nil {
+		t.Fatalf("Failed to set policies: %v", err)
+	}
+	if nhs, _ := ribPaths(t, bgps, google); len(nhs) != 0 {
+		t.Errorf("Expected the enabled policy drained, got %v", nhs)
+	}
+
+	// The drains of deleted policies are dropped.
+	if err := srv.SetPolicies(ctx, pols[1:], nil); err != nil {
+		t.Fatalf("Failed to set policies: %v", err)
+	}
+	if drains := srv.Drains(); len(drains) != 0 {
+		t.Errorf("Expected the drain of the deleted policy dropped, got %+v", drains)
+	}
+	if err := srv.Drain(ctx, key, drainSourceAPI); !errors.Is(err, errPolicyNotFound) {
+		t.Errorf("Expected %v draining a deleted policy, got %v", errPolicyNotFound, err)
+	}
+}
+
+func TestDesiredPathsGracefulShutdown(t *testing.T) {
+	pol := func(name, pre string) *policy.Policy {
+		return &policy.Policy{
+			Name:        name,
+			ASN:         15169,
+			IP4NextHops: []netip.Addr{netip.MustParseAddr("192.168.1.1")},
+			ASInfo:      &asinfo.ASInfo{Prefixes: []netip.Prefix{netip.MustParsePrefix(pre)}},
+		}
+	}
+	desired := desiredPaths([]*policy.Policy{pol("google-dns", "8.8.8.0/24"), pol("google-web", "142.250.0.0/15")}, map[string]bool{"google-dns": true})
+
+	// Only the drained policy is marked, although both share the ASN.
+	if as := desired[netip.MustParsePrefix("8.8.8.0/24")]; len(as) != 1 || !as[0].GracefulShutdown {
+		t.Errorf("Expected the path of the drained policy marked, got %+v", as)
+	}
+	if as := desired[netip.MustParsePrefix("142.250.0.0/15")]; len(as) != 1 || as[0].GracefulShutdown {
+		t.Errorf("Expected the path of the other policy unmarked, got %+v", as)
+	}
+}
+
+func TestDrainGracefulShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	google := netip.MustParsePrefix("8.8.8.0/24")
+	bgps := newTestBgpServer(t)
+	srv := newDrainTestServer(t, bgps, DrainConfig{GracefulShutdown: true, WithdrawAfter: 200 * time.Millisecond})
+	go srv.WatchDrains(ctx)
+
+	if err := srv.Drain(ctx, DrainKey{Scope: DrainPolicy, Name: "as15169"}, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if nhs, _ := ribPaths(t, bgps, google); len(nhs) != 1 || !gshutMarked(t, bgps, google) {
+		t.Errorf("Expected the path kept and marked, got %v", nhs)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if nhs, _ := ribPaths(t, bgps, google); len(nhs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the path withdrawn after WithdrawAfter")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := srv.Undrain(ctx, DrainKey{Scope: DrainPolicy, Name: "as15169"}, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to undrain: %v", err)
+	}
+	if nhs, _ := ribPaths(t, bgps, google); len(nhs) != 1 || gshutMarked(t, bgps, google) {
+		t.Errorf("Expected the path announced without the mark, got %v", nhs)
+	}
+}
+
+func TestDrainPeer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  DrainConfig
+		// withdrawn is set if the path is withdrawn rather than marked.
+		withdrawn bool
+	}{
+		{name: drainWithdraw, cfg: DrainConfig{ResetPeers: true}, withdrawn: true},
+		{name: drainWithdraw + " without reset", cfg: DrainConfig{}},
+		{name: drainGshut, cfg: DrainConfig{GracefulShutdown: true, ResetPeers: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			google := netip.MustParsePrefix("8.8.8.0/24")
+			bgps := newTestBgpServer(t)
+			if err := setupExportPolicy(ctx, bgps, nil); err != nil {
+				t.Fatalf("Failed to set up export policy: %v", err)
+			}
+			srv := newDrainTestServer(t, bgps, tc.cfg)
+			// The session of a peer drained in withdraw mode is reset, and
+			// comes back up after the idle hold time.
+			rcv := newTestPeering(t, bgps, false, func(p *api.Peer) {
+				p.Timers = &api.Timers{Config: &api.TimersConfig{ConnectRetry: 1, IdleHoldTimeAfterReset: 1}}
+			})
+
+			// received returns the paths of google received by rcv, and
+			// their LOCAL_PREF.
+			received := func() (n int, localPref uint32) {
+				if err := rcv.ListPath(ctx, &api.ListPathRequest{
+					TableType: api.TableType_GLOBAL,
+					Family:    familyOf(google),
+					Prefixes:  []*api.TableLookupPrefix{{Prefix: google.String()}},
+				}, func(d *api.Destination) {
+					for _, p := range d.Paths {
+						n++
+						for _, attr := range p.Pattrs {
+							if lp := attr.GetLocalPref(); lp != nil {
+								localPref = lp.LocalPref
+							}
+						}
+					}
+				}); err != nil {
+					t.Fatalf("Failed to list paths: %v", err)
+				}
+				return n, localPref
+			}
+			waitFor := func(desc string, ok func(n int, localPref uint32) bool) {
+				t.Helper()
+				deadline := time.Now().Add(10 * time.Second)
+				for {
+					n, lp := received()
+					if ok(n, lp) {
+						return
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("Expected %s, got %d paths with LOCAL_PREF %d", desc, n, lp)
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+			}
+
+			waitFor("the path received", func(n int, lp uint32) bool { return n == 1 && lp == localPrefBest })
+
+			// uptime returns when the session of rcv was established.
+			uptime := func() time.Time {
+				var up time.Time
+				if err := rcv.ListPeer(ctx, &api.ListPeerRequest{}, func(p *api.Peer) {
+					up = p.GetTimers().GetState().GetUptime().AsTime()
+				}); err != nil {
+					t.Fatalf("Failed to list peers: %v", err)
+				}
+				return up
+			}
+			up := uptime()
+
+			peer := DrainKey{Scope: DrainPeer, Name: "127.0.0.1"}
+			if err := srv.Drain(ctx, peer, drainSourceAPI); err != nil {
+				t.Fatalf("Failed to drain: %v", err)
+			}
+			if tc.withdrawn {
+				waitFor("the path withdrawn", func(n int, lp uint32) bool { return n == 0 })
+			} else {
+				waitFor("the path with the lowered LOCAL_PREF", func(n int, lp uint32) bool { return n == 1 && lp == localPrefGracefulShutdownPeer })
+				if got := uptime(); !got.Equal(up) {
+					t.Errorf("Expected the session kept up since %v, got %v", up, got)
+				}
+			}
+			// The peer drain is applied on export, so the RIB is unchanged.
+			if nhs, _ := ribPaths(t, bgps, google); len(nhs) != 1 {
+				t.Errorf("Expected the path kept in the RIB, got %v", nhs)
+			}
+
+			if err := srv.Undrain(ctx, peer, drainSourceAPI); err != nil {
+				t.Fatalf("Failed to undrain: %v", err)
+			}
+			waitFor("the path received again", func(n int, lp uint32) bool { return n == 1 && lp == localPrefBest })
+		})
+	}
+}
+
+func TestWatchDrainFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	google := netip.MustParsePrefix("8.8.8.0/24")
+	bgps := newTestBgpServer(t)
+	srv := newDrainTestServer(t, bgps, DrainConfig{})
+	path := filepath.Join(t.TempDir(), "drain")
+	go srv.WatchDrainFile(ctx, path, 20*time.Millisecond)
+
+	waitFor := func(desc string, want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			nhs, _ := ribPaths(t, bgps, google)
+			if len(nhs) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s, got %v", desc, nhs)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("policy as15169\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the policy drained", 0)
+
+	// The drains of the file are only undrained through the file.
+	if err := srv.Undrain(ctx, DrainKey{Scope: DrainPolicy, Name: "as15169"}, drainSourceAPI); !errors.Is(err, errDrainedElsewhere) {
+		t.Errorf("Expected %v undraining the drain of the file, got %v", errDrainedElsewhere, err)
+	}
+
+	// Drains of other sources are kept when the file is removed.
+	if err := srv.Drain(ctx, DrainKey{Scope: DrainPolicy, Name: "as13335"}, drainSourceAPI); err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the policy undrained", 1)
+	if drains := srv.Drains(); len(drains) != 1 || drains[0].Name != "as13335" {
+		t.Errorf("Expected the drain of the API kept, got %+v", drains)
+	}
+}
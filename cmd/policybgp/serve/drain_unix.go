@@ -0,0 +1,11 @@
+//go:build unix
+
+package serve
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignal drains all routes, and undrainSignal undrains them.
+var drainSignal, undrainSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
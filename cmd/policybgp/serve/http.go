@@ -0,0 +1,198 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/render"
+)
+
+// contentTypes maps the render formats to the Content-Type they are served with.
+// Formats not listed here are served as text/plain.
+var contentTypes = map[string]string{
+	"json": "application/json",
+	"pac":  "application/x-ns-proxy-autoconfig",
+}
+
+type httpHandler struct {
+	s    *zap.SugaredLogger
+	srv  *Server
+	opts *render.Options
+}
+
+// NewHTTPHandler returns the handler publishing the prefixes of the policies
+// currently announced by srv:
+//
+//	GET /policies                   index of the policies (JSON)
+//	GET /policies/{name}/{format}   prefixes of a single policy
+//	GET /prefixes/{format}          prefixes of all policies
+//	GET /load                       load rules and their latest shifts (JSON)
+//
+// {format} is any format accepted by the export command, rendered with opts.
+// Pass ?aggregate=true to aggregate the prefixes instead of listing them as
+// announced over BGP.
+func NewHTTPHandler(srv *Server, opts *render.Options, l *zap.Logger) http.Handler {
+	h := &httpHandler{s: l.Named("http").Sugar(), srv: srv, opts: opts}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /policies", h.handleIndex)
+	mux.HandleFunc("GET /policies/{name}/{format}", h.handleDoc)
+	mux.HandleFunc("GET /prefixes/{format}", h.handleDoc)
+	mux.HandleFunc("GET /load", h.handleLoad)
+	return mux
+}
+
+type indexEntry struct {
+	Name         string    `json:"name"`
+	ASN          uint32    `json:"asn"`
+	Organization string    `json:"organization"`
+	Prefixes     int       `json:"prefixes"`
+	Modified     time.Time `json:"modified"`
+}
+
+type index struct {
+	LoadedAt time.Time    `json:"loadedAt"`
+	Formats  []string     `json:"formats"`
+	Policies []indexEntry `json:"policies"`
+}
+
+func (h *httpHandler) snapshotOrError(w http.ResponseWriter) *Snapshot {
+	snap := h.srv.Snapshot()
+	if snap == nil {
+		http.Error(w, "database not loaded yet", http.StatusServiceUnavailable)
+	}
+	return snap
+}
+
+func (h *httpHandler) handleIndex(w http.ResponseWriter, r *http.Request) {
+	snap := h.snapshotOrError(w)
+	if snap == nil {
+		return
+	}
+
+	idx := index{
+		LoadedAt: snap.LoadedAt,
+		Formats:  render.FormatNames(),
+		Policies: make([]indexEntry, 0, len(snap.Policies)),
+	}
+	for _, pol := range snap.Policies {
+		idx.Policies = append(idx.Policies, indexEntry{
+			Name:         pol.Name,
+			ASN:          pol.ASN,
+			Organization: pol.ASInfo.Organization,
+			Prefixes:     len(pol.ASInfo.Prefixes),
+			Modified:     snap.ModTimes[pol.Name],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(idx); err != nil {
+		h.s.Warnf("Failed to write index: %v", err)
+	}
+}
+
+func (h *httpHandler) handleDoc(w http.ResponseWriter, r *http.Request) {
+	snap := h.snapshotOrError(w)
+	if snap == nil {
+		return
+	}
+
+	name := r.PathValue("name")
+	format := r.PathValue("format")
+	if _, ok := render.Formats[format]; !ok {
+		http.Error(w, "unknown format", http.StatusNotFound)
+		return
+	}
+	if name != "" && snap.FindPolicy(name) == nil {
+		http.Error(w, "unknown policy", http.StatusNotFound)
+		return
+	}
+
+	opts := *h.opts
+	opts.Aggregate = false
+	if v := r.URL.Query().Get("aggregate"); v != "" {
+		var err error
+		if opts.Aggregate, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid aggregate parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	doc, err := snap.Render(name, format, &opts)
+	if err != nil {
+		h.s.Errorf("Failed to render %s for %q: %v", format, name, err)
+		http.Error(w, "failed to render", http.StatusInternalServerError)
+		return
+	}
+
+	contentType, ok := contentTypes[format]
+	if !ok {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", doc.ETag)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", doc.ModTime, bytes.NewReader(doc.Body))
+}
+
+type loadRuleEntry struct {
+	Policy    string `json:"policy"`
+	Interface string `json:"interface"`
+	Direction string `json:"direction"`
+	// Utilization is null until measured.
+	Utilization *float64   `json:"utilization"`
+	Shifted     bool       `json:"shifted"`
+	Since       *time.Time `json:"since,omitempty"`
+}
+
+type loadEventEntry struct {
+	Time        time.Time `json:"time"`
+	Policy      string    `json:"policy"`
+	Interface   string    `json:"interface"`
+	Direction   string    `json:"direction"`
+	Utilization float64   `json:"utilization"`
+	Shifted     bool      `json:"shifted"`
+}
+
+type loadIndex struct {
+	Rules  []loadRuleEntry  `json:"rules"`
+	Events []loadEventEntry `json:"events"`
+}
+
+func (h *httpHandler) handleLoad(w http.ResponseWriter, r *http.Request) {
+	load := h.srv.cfg.Load
+	if load == nil {
+		http.Error(w, "no load rules", http.StatusNotFound)
+		return
+	}
+
+	idx := loadIndex{Rules: []loadRuleEntry{}, Events: []loadEventEntry{}}
+	for _, st := range load.Status() {
+		e := loadRuleEntry{
+			Policy:    st.Policy,
+			Interface: st.Interface,
+			Direction: st.Direction,
+			Shifted:   st.Shifted,
+		}
+		if st.Utilization >= 0 {
+			e.Utilization = &st.Utilization
+		}
+		if !st.Since.IsZero() {
+			e.Since = &st.Since
+		}
+		idx.Rules = append(idx.Rules, e)
+	}
+	for _, ev := range load.Events() {
+		idx.Events = append(idx.Events, loadEventEntry(ev))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(idx); err != nil {
+		h.s.Warnf("Failed to write load rules: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package serve
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/policy"
+	"github.com/IPA-CyberLab/policybgp/render"
+)
+
+func testResolvedPolicies(t *testing.T, prefixes ...string) []*policy.Policy {
+	t.Helper()
+
+	info := &asinfo.ASInfo{Organization: "Google LLC"}
+	for _, s := range prefixes {
+		info.Prefixes = append(info.Prefixes, netip.MustParsePrefix(s))
+	}
+
+	pol, err := policy.Parse("15169,192.168.1.1", nil)
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	if err := pol.Resolve(asinfo.ASInfoMap{15169: info}); err != nil {
+		t.Fatalf("Failed to resolve policy: %v", err)
+	}
+	return []*policy.Policy{pol}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	srv := &Server{}
+	h := NewHTTPHandler(srv, render.DefaultOptions(), zap.NewNop())
+
+	get := func(path string, hdr http.Header) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	if resp := get("/prefixes/text", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the database is loaded, got %d", resp.StatusCode)
+	}
+
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.snap.Store(newSnapshot(testResolvedPolicies(t, "8.8.4.0/24", "8.8.5.0/24"), nil, t0))
+
+	resp := get("/policies/as15169/text", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "8.8.4.0/24\n8.8.5.0/24\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Errorf("Expected ETag header")
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != t0.Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified %q, got %q", t0.Format(http.TimeFormat), lm)
+	}
+
+	if resp := get("/policies/as15169/text", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for matching ETag, got %d", resp.StatusCode)
+	}
+
+	if resp := get("/prefixes/text?aggregate=true", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != "8.8.4.0/23\n" {
+		t.Errorf("Unexpected aggregated body %q", body)
+	}
+
+	// A reload which does not change the routes keeps the modification time.
+	t1 := t0.Add(time.Hour)
+	srv.snap.Store(newSnapshot(testResolvedPolicies(t, "8.8.4.0/24", "8.8.5.0/24"), srv.Snapshot(), t1))
+	resp = get("/policies/as15169/text", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 after reload without changes, got %d", resp.StatusCode)
+	}
+
+	// A reload which changes the routes updates both the ETag and modification time.
+	srv.snap.Store(newSnapshot(testResolvedPolicies(t, "8.8.8.0/24"), srv.Snapshot(), t1))
+	resp = get("/policies/as15169/text", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 after reload with changes, got %d", resp.StatusCode)
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != t1.Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified %q, got %q", t1.Format(http.TimeFormat), lm)
+	}
+
+	for _, path := range []string{"/policies/as1/text", "/policies/as15169/nonexistent", "/prefixes/nonexistent"} {
+		if resp := get(path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPHandlerAnnouncedOnly(t *testing.T) {
+	srv := &Server{}
+	h := NewHTTPHandler(srv, render.DefaultOptions(), zap.NewNop())
+
+	// The IPv6 prefixes of an IPv4-only policy are not announced.
+	srv.snap.Store(newSnapshot(testResolvedPolicies(t, "8.8.8.0/24", "2001:4860::/32"), nil, time.Now()))
+
+	req := httptest.NewRequest(http.MethodGet, "/prefixes/text", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "8.8.8.0/24\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	// Nothing is announced for a policy whose gateway is not resolved yet.
+	pols := testResolvedPolicies(t, "8.8.8.0/24", "2001:4860::/32")
+	pols[0].IP4NextHops = nil
+	srv.snap.Store(newSnapshot(pols, srv.Snapshot(), time.Now()))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/policies/as15169/text", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "" {
+		t.Errorf("Expected no prefixes, got %q", body)
+	}
+}
+
+func TestHTTPHandlerPeerNextHops(t *testing.T) {
+	srv := &Server{}
+	h := NewHTTPHandler(srv, render.DefaultOptions(), zap.NewNop())
+
+	conf, err := config.Parse([]byte("peers:\n  - address: 192.168.0.1\n"), "")
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	pol, err := policy.Parse("15169,peer|192.168.1.1", conf.PeerNextHopNames(nil))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	self, err := policy.Parse("13335,self", conf.PeerNextHopNames(nil))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	db := asinfo.ASInfoMap{
+		15169: {Organization: "Google LLC", Prefixes: []netip.Prefix{netip.MustParsePrefix("8.8.8.0/24")}},
+		13335: {Organization: "Cloudflare", Prefixes: []netip.Prefix{netip.MustParsePrefix("1.1.1.0/24")}},
+	}
+	for _, p := range []*policy.Policy{pol, self} {
+		if err := p.Resolve(db); err != nil {
+			t.Fatalf("Failed to resolve policy: %v", err)
+		}
+	}
+	srv.snap.Store(newSnapshot([]*policy.Policy{pol, self}, nil, time.Now()))
+
+	get := func(path string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d", path, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	// The routes via the nexthops depending on the peer are announced, but
+	// have no address to be rendered with.
+	if body := get("/prefixes/text"); body != "8.8.8.0/24\n1.1.1.0/24\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	for _, path := range []string{"/prefixes/iproute", "/prefixes/routeros-route", "/prefixes/json"} {
+		body := get(path)
+		if strings.Contains(body, "0.0.0.") || strings.Contains(body, "100::") {
+			t.Errorf("Expected no placeholder nexthop in %s, got:\n%s", path, body)
+		}
+	}
+	if body := get("/prefixes/iproute"); !strings.Contains(body, "8.8.8.0/24 via 192.168.1.1") || strings.Contains(body, "1.1.1.0/24") {
+		t.Errorf("Expected only the route via 192.168.1.1, got:\n%s", body)
+	}
+}
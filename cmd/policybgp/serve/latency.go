@@ -0,0 +1,38 @@
+package serve
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// parseLatencyChecks parses latency selections as described in
+// nexthop.ParseLatency, whose candidates are the nexthops of the policy.
+func parseLatencyChecks(ss []string, pols []*policy.Policy) ([]*nexthop.LatencyCheck, error) {
+	checks := make([]*nexthop.LatencyCheck, 0, len(ss))
+	for _, s := range ss {
+		name, cfg, err := nexthop.ParseLatency(s)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(pols, func(pol *policy.Policy) bool { return pol.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("latency selection %q refers to unknown policy %q", s, name)
+		}
+		pol := pols[i]
+		if pol.Multipath {
+			return nil, fmt.Errorf("latency selection %q refers to multipath policy %q", s, name)
+		}
+		if slices.ContainsFunc(checks, func(chk *nexthop.LatencyCheck) bool { return chk.Policy == name }) {
+			return nil, fmt.Errorf("policy %q has more than one latency selection", name)
+		}
+		checks = append(checks, &nexthop.LatencyCheck{
+			Policy:   name,
+			NextHops: slices.Concat(pol.IP4NextHops, pol.IP6NextHops),
+			Config:   cfg,
+		})
+	}
+	return checks, nil
+}
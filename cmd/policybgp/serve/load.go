@@ -0,0 +1,47 @@
+package serve
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// parseLoadRules parses load rules as described in nexthop.ParseLoadRule,
+// whose nexthop is an address or a name in names standing for its addresses.
+func parseLoadRules(ss []string, pols []*policy.Policy, names policy.NextHopNames) ([]*nexthop.LoadRule, error) {
+	rules := make([]*nexthop.LoadRule, 0, len(ss))
+	for _, s := range ss {
+		name, to, cfg, err := nexthop.ParseLoadRule(s)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(pols, func(pol *policy.Policy) bool { return pol.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("load rule %q refers to unknown policy %q", s, name)
+		}
+		if pols[i].Multipath {
+			return nil, fmt.Errorf("load rule %q refers to multipath policy %q", s, name)
+		}
+
+		var nhs []netip.Addr
+		if nh, err := netip.ParseAddr(to); err == nil {
+			nhs = append(nhs, nh)
+		} else if named, ok := names[to]; ok {
+			for _, nh := range []netip.Addr{named.IP4, named.IP6} {
+				if nh.IsValid() {
+					nhs = append(nhs, nh)
+				}
+			}
+			if len(nhs) == 0 {
+				return nil, fmt.Errorf("nexthop %q of load rule %q has no address", to, s)
+			}
+		} else {
+			return nil, fmt.Errorf("nexthop %q of load rule %q is neither an IP address nor a known nexthop", to, s)
+		}
+		rules = append(rules, &nexthop.LoadRule{Policy: name, To: nhs, Config: cfg})
+	}
+	return rules, nil
+}
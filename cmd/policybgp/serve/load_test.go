@@ -0,0 +1,76 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+	"github.com/IPA-CyberLab/policybgp/render"
+)
+
+func TestParseLoadRules(t *testing.T) {
+	names := policy.NextHopNames{
+		"isp-b": {IP4: netip.MustParseAddr("192.168.2.1"), IP6: netip.MustParseAddr("2001:db8::2")},
+		"isp-c": {},
+	}
+	pols, err := policy.ParseAll([]string{"15169,192.168.1.1", "2906,192.168.1.1+192.168.2.1"}, names)
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+
+	rules, err := parseLoadRules([]string{"as15169,interface=ppp0,to=isp-b"}, pols, names)
+	if err != nil {
+		t.Fatalf("Failed to parse load rules: %v", err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("192.168.2.1"), netip.MustParseAddr("2001:db8::2")}
+	if len(rules) != 1 || rules[0].Policy != "as15169" || !slices.Equal(rules[0].To, want) || rules[0].Config.Interface != "ppp0" {
+		t.Errorf("Expected as15169 shifted to %v, got %+v", want, rules)
+	}
+
+	for _, s := range []string{
+		"as64512,interface=ppp0,to=192.168.2.1",
+		"as2906,interface=ppp0,to=192.168.2.1",
+		"as15169,interface=ppp0,to=isp-c",
+		"as15169,interface=ppp0,to=isp-d",
+		"as15169,interface=ppp0",
+	} {
+		if _, err := parseLoadRules([]string{s}, pols, names); err == nil {
+			t.Errorf("Expected error for load rule %q, got nil", s)
+		}
+	}
+}
+
+func TestPreferNextHop(t *testing.T) {
+	a := netip.MustParseAddr("192.168.1.1")
+	b := netip.MustParseAddr("192.168.2.1")
+	c := netip.MustParseAddr("192.168.3.1")
+
+	for _, tc := range []struct {
+		nhs  []netip.Addr
+		nh   netip.Addr
+		want []netip.Addr
+	}{
+		{[]netip.Addr{a, b, c}, a, []netip.Addr{a, b, c}},
+		{[]netip.Addr{a, b, c}, c, []netip.Addr{c, a, b}},
+		{[]netip.Addr{a, b}, c, []netip.Addr{c, a, b}},
+		{nil, c, []netip.Addr{c}},
+	} {
+		if got := preferNextHop(tc.nhs, tc.nh); !slices.Equal(got, tc.want) {
+			t.Errorf("Expected %v preferring %v to be %v, got %v", tc.nhs, tc.nh, tc.want, got)
+		}
+	}
+}
+
+func TestHTTPLoadWithoutRules(t *testing.T) {
+	h := NewHTTPHandler(&Server{}, render.DefaultOptions(), zap.NewNop())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/load", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without load rules, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,419 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+var (
+	errPolicyNotFound = errors.New("policy not found")
+	errPolicyExists   = errors.New("policy already exists")
+	errInvalidPolicy  = errors.New("invalid policy")
+	// errPolicyReferenced is returned when deleting a policy which
+	// conditions, latency selections or load rules refer to, as they are only
+	// set at startup.
+	errPolicyReferenced = errors.New("policy is referred to by conditions, latency selections or load rules")
+)
+
+// PolicyDef is the definition of a policy.
+type PolicyDef struct {
+	Name string
+	// Spec is the policy in the format of the --policy flag.
+	Spec    string
+	Enabled bool
+	// Persistent is set for the policies saved to the configuration file,
+	// as opposed to those given by --policy.
+	Persistent bool
+}
+
+// PolicyManager holds the definitions of the policies, and applies changes
+// to them to a Server at runtime.
+type PolicyManager struct {
+	s        *zap.SugaredLogger
+	conf     *config.Config
+	gateways *nexthop.GatewayWatcher
+	// peerNextHops enables the nexthops depending on the BGP peer.
+	peerNextHops bool
+	// savePath is the configuration file the persistent policies are saved
+	// to after each change, or empty.
+	savePath string
+	// offLink describes the peers which cannot resolve link-local nexthops,
+	// or is empty if they are accepted.
+	offLink string
+	// maxPaths is the number of paths per prefix multipath policies may
+	// announce, or 0 if unlimited.
+	maxPaths int
+	// referenced are the names of the policies which conditions, latency
+	// selections or load rules refer to.
+	referenced []string
+	srv        *Server
+
+	mu   sync.Mutex
+	defs []*PolicyDef
+}
+
+// NewPolicyManager returns a PolicyManager for the policies of conf followed
+// by flags, resolving the named nexthops of conf against gateways. The
+// nexthops depending on the BGP peer the routes are sent to are only known
+// if peerNextHops is set. If savePath is not empty, changes are saved to
+// that configuration file.
+func NewPolicyManager(conf *config.Config, flags []string, gateways *nexthop.GatewayWatcher, peerNextHops bool, savePath string, l *zap.Logger) (*PolicyManager, error) {
+	m := &PolicyManager{
+		s:            l.Named("policies").Sugar(),
+		conf:         conf,
+		gateways:     gateways,
+		peerNextHops: peerNextHops,
+		savePath:     savePath,
+	}
+	for _, src := range []struct {
+		specs      []string
+		enabled    bool
+		persistent bool
+	}{
+		{conf.Policies, true, true},
+		{conf.DisabledPolicies, false, true},
+		{flags, true, false},
+	} {
+		for _, spec := range src.specs {
+			pol, err := m.parse(spec)
+			if err != nil {
+				return nil, err
+			}
+			if slices.ContainsFunc(m.defs, func(d *PolicyDef) bool { return d.Name == pol.Name }) {
+				return nil, fmt.Errorf("policy %q is defined more than once", pol.Name)
+			}
+			m.defs = append(m.defs, &PolicyDef{Name: pol.Name, Spec: spec, Enabled: src.enabled, Persistent: src.persistent})
+		}
+	}
+	return m, nil
+}
+
+func (m *PolicyManager) parse(spec string) (*policy.Policy, error) {
+	if m.peerNextHops {
+		return policy.Parse(spec, m.conf.PeerNextHopNames(m.gateways.Addrs()))
+	}
+	return policy.Parse(spec, m.conf.NamedNextHops(m.gateways.Addrs()))
+}
+
+// RejectLinkLocal rejects the policies with link-local nexthops, which the
+// peers described by offLink cannot resolve, as well as those defined so far.
+// The gateways are not checked, as their addresses change at runtime; the
+// export policy withholds the paths via them from these peers instead.
+func (m *PolicyManager) RejectLinkLocal(offLink string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offLink = offLink
+	for _, d := range m.defs {
+		if err := m.checkLinkLocal(d.Spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *PolicyManager) checkLinkLocal(spec string) error {
+	if m.offLink == "" {
+		return nil
+	}
+	pol, err := policy.Parse(spec, m.conf.PeerNextHopNames(nil))
+	if err != nil {
+		return err
+	}
+	for _, nh := range slices.Concat(pol.IP4NextHops, pol.IP6NextHops) {
+		if nh.Is6() && nh.IsLinkLocalUnicast() {
+			return fmt.Errorf("link-local nexthop %s of policy %q cannot be announced to %s, which may not share a link", nh, pol.Name, m.offLink)
+		}
+	}
+	return nil
+}
+
+// KeepReferenced rejects the deletion of the policies names, which
+// conditions, latency selections or load rules refer to, as these are only set
+// at startup and a policy added later under the same name would inherit them.
+// Such policies can be disabled instead.
+func (m *PolicyManager) KeepReferenced(names []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.referenced = names
+}
+
+// pathCount returns the number of paths announced per prefix of pol.
+func pathCount(pol *policy.Policy) int {
+	if !pol.Multipath {
+		return 1
+	}
+	return max(len(pol.IP4NextHops), len(pol.IP6NextHops))
+}
+
+// MaxPaths returns the largest number of paths per prefix of the policies,
+// enabled or not.
+func (m *PolicyManager) MaxPaths() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 1
+	for _, d := range m.defs {
+		pol, err := m.parse(d.Spec)
+		if err != nil {
+			return 0, err
+		}
+		n = max(n, pathCount(pol))
+	}
+	return n, nil
+}
+
+// LimitPaths rejects the multipath policies announcing more than n paths per
+// prefix, the ADD-PATH SendMax of the peers, as well as those defined so far.
+func (m *PolicyManager) LimitPaths(n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxPaths = n
+	for _, d := range m.defs {
+		pol, err := m.parse(d.Spec)
+		if err != nil {
+			return err
+		}
+		if err := m.checkPaths(pol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *PolicyManager) checkPaths(pol *policy.Policy) error {
+	if m.maxPaths == 0 || pathCount(pol) <= m.maxPaths {
+		return nil
+	}
+	return fmt.Errorf("policy %q announces %d paths per prefix, more than the %d sent to the peers", pol.Name, pathCount(pol), m.maxPaths)
+}
+
+// Policies parses the enabled policies with the current addresses of the
+// gateways.
+func (m *PolicyManager) Policies() ([]*policy.Policy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.policies(m.defs)
+}
+
+func (m *PolicyManager) policies(defs []*PolicyDef) ([]*policy.Policy, error) {
+	pols := make([]*policy.Policy, 0, len(defs))
+	for _, d := range defs {
+		if !d.Enabled {
+			continue
+		}
+		pol, err := m.parse(d.Spec)
+		if err != nil {
+			return nil, err
+		}
+		pols = append(pols, pol)
+	}
+	return pols, nil
+}
+
+// disabled returns the names of the disabled policies of defs.
+func disabled(defs []*PolicyDef) []string {
+	var names []string
+	for _, d := range defs {
+		if !d.Enabled {
+			names = append(names, d.Name)
+		}
+	}
+	return names
+}
+
+// Disabled returns the names of the disabled policies.
+func (m *PolicyManager) Disabled() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return disabled(m.defs)
+}
+
+// Defs returns the definitions of the policies.
+func (m *PolicyManager) Defs() []PolicyDef {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defs := make([]PolicyDef, 0, len(m.defs))
+	for _, d := range m.defs {
+		defs = append(defs, *d)
+	}
+	return defs
+}
+
+// Def returns the definition of the policy name.
+func (m *PolicyManager) Def(name string) (PolicyDef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(name)
+	if i < 0 {
+		return PolicyDef{}, fmt.Errorf("%w: %q", errPolicyNotFound, name)
+	}
+	return *m.defs[i], nil
+}
+
+func (m *PolicyManager) index(name string) int {
+	return slices.IndexFunc(m.defs, func(d *PolicyDef) bool { return d.Name == name })
+}
+
+// Add adds the policy spec.
+func (m *PolicyManager) Add(ctx context.Context, spec string, enabled bool) (PolicyDef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pol, err := m.parse(spec)
+	if err == nil {
+		err = m.checkLinkLocal(spec)
+	}
+	if err == nil {
+		err = m.checkPaths(pol)
+	}
+	if err != nil {
+		return PolicyDef{}, fmt.Errorf("%w: %w", errInvalidPolicy, err)
+	}
+	if m.index(pol.Name) >= 0 {
+		return PolicyDef{}, fmt.Errorf("%w: %q", errPolicyExists, pol.Name)
+	}
+	d := &PolicyDef{Name: pol.Name, Spec: spec, Enabled: enabled, Persistent: true}
+	if err := m.commit(ctx, append(slices.Clone(m.defs), d)); err != nil {
+		return PolicyDef{}, err
+	}
+	m.s.Infof("Added policy %s: %s", d.Name, spec)
+	return *d, nil
+}
+
+// Update replaces the definition of the policy name with spec, which must
+// define a policy of the same name.
+func (m *PolicyManager) Update(ctx context.Context, name, spec string) (PolicyDef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(name)
+	if i < 0 {
+		return PolicyDef{}, fmt.Errorf("%w: %q", errPolicyNotFound, name)
+	}
+	pol, err := m.parse(spec)
+	if err == nil {
+		err = m.checkLinkLocal(spec)
+	}
+	if err == nil {
+		err = m.checkPaths(pol)
+	}
+	if err != nil {
+		return PolicyDef{}, fmt.Errorf("%w: %w", errInvalidPolicy, err)
+	}
+	if pol.Name != name {
+		return PolicyDef{}, fmt.Errorf("%w: %q defines policy %q instead of %q", errInvalidPolicy, spec, pol.Name, name)
+	}
+	return m.replace(ctx, i, func(d *PolicyDef) { d.Spec = spec })
+}
+
+// SetEnabled enables or disables the policy name. The routes of disabled
+// policies are withdrawn.
+func (m *PolicyManager) SetEnabled(ctx context.Context, name string, enabled bool) (PolicyDef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(name)
+	if i < 0 {
+		return PolicyDef{}, fmt.Errorf("%w: %q", errPolicyNotFound, name)
+	}
+	return m.replace(ctx, i, func(d *PolicyDef) { d.Enabled = enabled })
+}
+
+func (m *PolicyManager) replace(ctx context.Context, i int, update func(*PolicyDef)) (PolicyDef, error) {
+	d := *m.defs[i]
+	update(&d)
+	defs := slices.Clone(m.defs)
+	defs[i] = &d
+	if err := m.commit(ctx, defs); err != nil {
+		return PolicyDef{}, err
+	}
+	m.s.Infof("Updated policy %s: %s (enabled: %v)", d.Name, d.Spec, d.Enabled)
+	return d, nil
+}
+
+// Delete deletes the policy name, withdrawing its routes.
+func (m *PolicyManager) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", errPolicyNotFound, name)
+	}
+	if slices.Contains(m.referenced, name) {
+		return fmt.Errorf("%w: %q cannot be deleted, but can be disabled", errPolicyReferenced, name)
+	}
+	if err := m.commit(ctx, slices.Delete(slices.Clone(m.defs), i, i+1)); err != nil {
+		return err
+	}
+	m.s.Infof("Deleted policy %s", name)
+	return nil
+}
+
+// Apply applies the policies to the Server again, such as after the address
+// of a gateway changed.
+func (m *PolicyManager) Apply(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pols, err := m.policies(m.defs)
+	if err != nil {
+		return err
+	}
+	return m.srv.SetPolicies(ctx, pols, disabled(m.defs))
+}
+
+// commit applies defs to the Server, and makes them the current definitions
+// if they were applied. The persistent definitions are then saved.
+func (m *PolicyManager) commit(ctx context.Context, defs []*PolicyDef) error {
+	pols, err := m.policies(defs)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidPolicy, err)
+	}
+	if err := m.srv.SetPolicies(ctx, pols, disabled(defs)); err != nil {
+		return fmt.Errorf("failed to apply policies: %w", err)
+	}
+	m.defs = defs
+
+	if m.savePath == "" {
+		return nil
+	}
+	var enabled, disabled []string
+	for _, d := range defs {
+		switch {
+		case !d.Persistent:
+		case d.Enabled:
+			enabled = append(enabled, d.Spec)
+		default:
+			disabled = append(disabled, d.Spec)
+		}
+	}
+	if err := config.SavePolicies(m.savePath, enabled, disabled); err != nil {
+		return fmt.Errorf("policies applied but not saved: %w", err)
+	}
+	return nil
+}
+
+// WatchGateways applies the policies again whenever the address of a gateway
+// changes, until ctx is done.
+func (m *PolicyManager) WatchGateways(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.gateways.Changed():
+		}
+
+		if err := m.Apply(ctx); err != nil {
+			m.s.Errorf("Failed to apply gateway change: %v", err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+)
+
+func TestKeepReferenced(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	if err := os.WriteFile(dbPath, []byte("8.8.8.0,8.8.8.255,15169,Google LLC\n1.1.1.0,1.1.1.255,13335,Cloudflare\n31.13.64.0,31.13.127.255,32934,Facebook\n45.57.0.0,45.57.127.255,2906,Netflix\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	gateways := nexthop.NewGatewayWatcher(nil, zap.NewNop())
+	conf := &config.Config{DisabledPolicies: []string{"2906,192.168.2.1"}}
+	mgr, err := NewPolicyManager(conf, []string{"15169,192.168.1.1|192.168.2.1", "13335,192.168.1.1", "32934,192.168.1.1"}, gateways, true, "", zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create policy manager: %v", err)
+	}
+	pols, err := mgr.Policies()
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+	mgr.srv = NewServer(newTestBgpServer(t), &ServerConfig{DBPath: dbPath, Policies: pols, Disabled: mgr.Disabled(), LocalASN: 64513}, zap.NewNop())
+	if err := mgr.srv.Reload(ctx, true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	// Disabled policies can have conditions too.
+	conds, err := parseConditions([]string{"as2906=0.0.0.0/0"}, []string{"as15169", "as13335", "as32934", "as2906"})
+	if err != nil {
+		t.Fatalf("Failed to parse conditions: %v", err)
+	}
+	checks, err := parseLatencyChecks([]string{"as15169,targets=8.8.8.8"}, pols)
+	if err != nil {
+		t.Fatalf("Failed to parse latency selections: %v", err)
+	}
+	rules, err := parseLoadRules([]string{"as13335,interface=ppp0,to=192.168.2.1"}, pols, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse load rules: %v", err)
+	}
+	referenced := slices.Collect(maps.Keys(conds))
+	referenced = append(referenced, checks[0].Policy, rules[0].Policy)
+	mgr.KeepReferenced(referenced)
+
+	for _, name := range []string{"as2906", "as15169", "as13335"} {
+		if err := mgr.Delete(ctx, name); !errors.Is(err, errPolicyReferenced) {
+			t.Errorf("Expected %v deleting %s, got %v", errPolicyReferenced, name, err)
+		}
+	}
+	if _, err := mgr.SetEnabled(ctx, "as15169", false); err != nil {
+		t.Errorf("Expected a referenced policy to be disabled, got %v", err)
+	}
+	if err := mgr.Delete(ctx, "as32934"); err != nil {
+		t.Errorf("Expected a policy without rules deleted, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package serve
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "policybgp"
+
+var (
+	sessionUpDesc = prometheus.NewDesc(metricsNamespace+"_bgp_session_up",
+		"Whether the BGP session with the peer is established.",
+		[]string{"peer"}, nil)
+	sessionStateDesc = prometheus.NewDesc(metricsNamespace+"_bgp_session_state",
+		"State of the BGP session with the peer: 1 idle, 2 connect, 3 active, 4 opensent, 5 openconfirm, 6 established.",
+		[]string{"peer"}, nil)
+	sessionSinceDesc = prometheus.NewDesc(metricsNamespace+"_bgp_session_state_since_timestamp_seconds",
+		"Time the BGP session with the peer entered its current state.",
+		[]string{"peer"}, nil)
+	routesDesc = prometheus.NewDesc(metricsNamespace+"_routes",
+		"Number of routes announced for the policy.",
+		[]string{"policy", "family"}, nil)
+	dbLoadedDesc = prometheus.NewDesc(metricsNamespace+"_database_loaded_timestamp_seconds",
+		"Time the database was last loaded successfully.",
+		nil, nil)
+	dbModifiedDesc = prometheus.NewDesc(metricsNamespace+"_database_modified_timestamp_seconds",
+		"Modification time of the database file last loaded.",
+		nil, nil)
+	dbAgeDesc = prometheus.NewDesc(metricsNamespace+"_database_age_seconds",
+		"Time since the modification of the database file last loaded.",
+		nil, nil)
+	dbSizeDesc = prometheus.NewDesc(metricsNamespace+"_database_size_bytes",
+		"Size of the database file last loaded.",
+		nil, nil)
+	reloadsDesc = prometheus.NewDesc(metricsNamespace+"_database_reloads_total",
+		"Number of loads of the database by result.",
+		[]string{"result"}, nil)
+	nexthopUpDesc = prometheus.NewDesc(metricsNamespace+"_nexthop_up",
+		"Whether the health checked nexthop is up.",
+		[]string{"nexthop"}, nil)
+	drainedDesc = prometheus.NewDesc(metricsNamespace+"_drained",
+		"Drained scope: 1 while its routes are marked with GRACEFUL_SHUTDOWN, 2 once they are withdrawn.",
+		[]string{"scope", "name"}, nil)
+)
+
+// metricsCollector exposes the state of a Server and its BGP peers.
+type metricsCollector struct {
+	srv   *Server
+	peers *PeerStates
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		sessionUpDesc, sessionStateDesc, sessionSinceDesc, routesDesc,
+		dbLoadedDesc, dbModifiedDesc, dbAgeDesc, dbSizeDesc, reloadsDesc, nexthopUpDesc, drainedDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	boolean := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	timestamp := func(t time.Time) float64 {
+		return float64(t.UnixNano()) / 1e9
+	}
+
+	if c.peers != nil {
+		for addr, st := range c.peers.States() {
+			gauge(sessionUpDesc, boolean(st.State == api.PeerState_ESTABLISHED), addr)
+			gauge(sessionStateDesc, float64(st.State), addr)
+			gauge(sessionSinceDesc, timestamp(st.Since), addr)
+		}
+	}
+
+	if snap := c.srv.Snapshot(); snap != nil {
+		for _, pol := range snap.Policies {
+			n4, n6 := routeCounts(pol)
+			gauge(routesDesc, float64(n4), pol.Name, "ipv4")
+			gauge(routesDesc, float64(n6), pol.Name, "ipv6")
+		}
+	}
+
+	if db := c.srv.Database(); db != nil {
+		gauge(dbLoadedDesc, timestamp(db.LoadedAt))
+		gauge(dbModifiedDesc, timestamp(db.ModTime))
+		gauge(dbAgeDesc, time.Since(db.ModTime).Seconds())
+		gauge(dbSizeDesc, float64(db.Size))
+	}
+	succeeded, failed := c.srv.Reloads()
+	ch <- prometheus.MustNewConstMetric(reloadsDesc, prometheus.CounterValue, float64(succeeded), "success")
+	ch <- prometheus.MustNewConstMetric(reloadsDesc, prometheus.CounterValue, float64(failed), "failure")
+
+	if health := c.srv.cfg.Health; health != nil {
+		for nh, st := range health.Statuses() {
+			gauge(nexthopUpDesc, boolean(st.Up), nh.String())
+		}
+	}
+
+	for _, d := range c.srv.Drains() {
+		gauge(drainedDesc, 1+boolean(d.Withdrawn), d.Scope, d.Name)
+	}
+}
+
+// NewMetricsHandler returns the handler exposing the metrics of srv and the
+// session states of peers, which may be nil, in the Prometheus format at
+// /metrics.
+func NewMetricsHandler(srv *Server, peers *PeerStates) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		&metricsCollector{srv: srv, peers: peers},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return mux
+}
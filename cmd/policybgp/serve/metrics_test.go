@@ -0,0 +1,68 @@
+package serve
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/osrg/gobgp/v4/api"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	ctx := context.Background()
+
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	db := "8.8.8.0,8.8.8.255,15169,Google LLC\n2001:4860::,2001:4860:ffff:ffff:ffff:ffff:ffff:ffff,15169,Google LLC\n"
+	if err := os.WriteFile(dbPath, []byte(db), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	pols, err := policy.ParseAll([]string{"15169,192.168.1.1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+
+	srv := NewServer(newTestBgpServer(t), &ServerConfig{DBPath: dbPath, Policies: pols, LocalASN: 64513}, zap.NewNop())
+	if err := srv.Reload(ctx, true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if err := os.Remove(dbPath); err != nil {
+		t.Fatalf("Failed to remove database: %v", err)
+	}
+	if err := srv.Reload(ctx, true); err == nil {
+		t.Fatalf("Expected reload of a removed database to fail")
+	}
+
+	peers := NewPeerStates()
+	peers.update(&api.Peer{State: &api.PeerState{NeighborAddress: "127.0.0.1", SessionState: api.PeerState_ESTABLISHED}})
+
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(srv, peers).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`policybgp_bgp_session_up{peer="127.0.0.1"} 1`,
+		`policybgp_bgp_session_state{peer="127.0.0.1"} 6`,
+		`policybgp_routes{family="ipv4",policy="as15169"} 1`,
+		`policybgp_routes{family="ipv6",policy="as15169"} 0`,
+		`policybgp_database_size_bytes ` + strconv.Itoa(len(db)),
+		`policybgp_database_reloads_total{result="success"} 1`,
+		`policybgp_database_reloads_total{result="failure"} 1`,
+		`policybgp_database_loaded_timestamp_seconds `,
+		`policybgp_database_age_seconds `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
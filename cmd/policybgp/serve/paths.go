@@ -0,0 +1,261 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/server"
+)
+
+const (
+	// localPrefBest is the LOCAL_PREF of the most preferred path of a prefix.
+	// Each less preferred path gets one less, so that GoBGP deterministically
+	// sends the most preferred path to peers without ADD-PATH.
+	localPrefBest = 100
+	// exportPolicyName is the GoBGP policy resetting the LOCAL_PREF of all
+	// exported paths to localPrefBest, so that peers receiving multiple
+	// paths over ADD-PATH see them as equal and can share the traffic.
+	exportPolicyName = "policybgp-export"
+	// importPolicyName is the GoBGP policy keeping the paths received from
+	// peers out of the global RIB.
+	importPolicyName = "policybgp-import"
+)
+
+// announcement is the content of a path announced for a prefix.
+type announcement struct {
+	NextHop netip.Addr
+	ASN     uint32
+	// Weight is announced as link bandwidth if non-zero.
+	Weight uint32
+	// GracefulShutdown marks the path with the GRACEFUL_SHUTDOWN community
+	// and lowers its LOCAL_PREF to localPrefGracefulShutdown.
+	GracefulShutdown bool
+}
+
+// familyOf returns the BGP address family of pre.
+func familyOf(pre netip.Prefix) *api.Family {
+	if pre.Addr().Is4() {
+		return &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+	}
+	return &api.Family{Afi: api.Family_AFI_IP6, Safi: api.Family_SAFI_UNICAST}
+}
+
+// newPath builds the path announcing pre with the attributes of a. rank is
+// the position of the path in the order of preference of the paths of pre.
+// localASN is the ASN of the link bandwidth extended community.
+func newPath(pre netip.Prefix, rank int, a announcement, localASN uint32) *api.Path {
+	nlri := &api.NLRI{Nlri: &api.NLRI_Prefix{Prefix: &api.IPAddressPrefix{
+		Prefix:    pre.Addr().String(),
+		PrefixLen: uint32(pre.Bits()),
+	}}}
+	localPref := uint32(localPrefBest - rank)
+	if a.GracefulShutdown {
+		localPref = localPrefGracefulShutdown
+	}
+	attrs := []*api.Attribute{
+		{Attr: &api.Attribute_Origin{Origin: &api.OriginAttribute{
+			Origin: uint32(api.RouteOriginType_ORIGIN_IGP),
+		}}},
+		// The zone of a link-local nexthop names our interface, while
+		// the peer reaches it through the link of the session. GoBGP
+		// announces it as the only nexthop of MP_REACH_NLRI, so that it
+		// is withheld from the peers off the link.
+		{Attr: &api.Attribute_NextHop{NextHop: &api.NextHopAttribute{
+			NextHop: a.NextHop.WithZone("").String(),
+		}}},
+		{Attr: &api.Attribute_AsPath{AsPath: &api.AsPathAttribute{
+			Segments: []*api.AsSegment{{
+				Type:    api.AsSegment_TYPE_AS_SEQUENCE,
+				Numbers: []uint32{a.ASN},
+			}},
+		}}},
+		{Attr: &api.Attribute_LocalPref{LocalPref: &api.LocalPrefAttribute{
+			LocalPref: localPref,
+		}}},
+	}
+	if a.Weight != 0 {
+		attrs = append(attrs, &api.Attribute{Attr: &api.Attribute_ExtendedCommunities{
+			ExtendedCommunities: &api.ExtendedCommunitiesAttribute{Communities: []*api.ExtendedCommunity{
+				{Extcom: &api.ExtendedCommunity_LinkBandwidth{LinkBandwidth: &api.LinkBandwidthExtended{
+					Asn:       localASN,
+					Bandwidth: float32(a.Weight),
+				}}},
+			}},
+		}})
+	}
+
+	if a.GracefulShutdown {
+		attrs = append(attrs, &api.Attribute{Attr: &api.Attribute_Communities{
+			Communities: &api.CommunitiesAttribute{Communities: []uint32{0xffff0000}},
+		}})
+	}
+
+	return &api.Path{
+		Family:     familyOf(pre),
+		Nlri:       nlri,
+		Pattrs:     attrs,
+		Identifier: uint32(rank + 1),
+	}
+}
+
+// exportFilters are the parts of the export policy depending on the peers.
+type exportFilters struct {
+	// groups restrict the policies sent to the peer groups.
+	groups []*groupFilter
+	// nextHops replace the nexthops depending on the peer.
+	nextHops []*nextHopRewrite
+	// extendedNexthop are the peers accepting IPv4 paths via IPv6 nexthops.
+	extendedNexthop []netip.Prefix
+	// offLink are the peers which may not share a link with us, and thus
+	// cannot resolve link-local nexthops.
+	offLink []netip.Prefix
+}
+
+// setupExportPolicy installs the export policy named exportPolicyName. It
+// also rejects the paths of other policies than those of the peer groups of
+// filters to their peers, the IPv4 paths via IPv6 nexthops to the peers not
+// accepting them, the paths via link-local nexthops to the peers off the
+// link, the paths whose nexthop is not defined for the peer, and
+// the paths to the peers drained in withdraw mode, replaces the
+// nexthops depending on the peer, keeps the LOCAL_PREF of the paths marked
+// with GRACEFUL_SHUTDOWN, and marks the paths sent to the peers drained in
+// graceful shutdown mode. filters may be nil.
+func setupExportPolicy(ctx context.Context, bgps *server.BgpServer, filters *exportFilters) error {
+	if filters == nil {
+		filters = &exportFilters{}
+	}
+	sets := []*api.DefinedSet{
+		{DefinedType: api.DefinedType_COMMUNITY, Name: gshutCommunitySet, List: []string{communityGracefulShutdown}},
+		{DefinedType: api.DefinedType_NEIGHBOR, Name: drainWithdrawPeerSet, List: []string{drainPeerPlaceholder}},
+		{DefinedType: api.DefinedType_NEIGHBOR, Name: drainGshutPeerSet, List: []string{drainPeerPlaceholder}},
+	}
+	var statements []*api.Statement
+	for _, g := range filters.groups {
+		membersSet := exportPolicyName + "-group-" + g.name
+		policiesSet := membersSet + "-policies"
+		members := make([]string, 0, len(g.members))
+		for _, pre := range g.members {
+			members = append(members, pre.String())
+		}
+		// The paths of a policy originate from the AS of the policy.
+		origins := make([]string, 0, len(g.asns))
+		for _, asn := range g.asns {
+			origins = append(origins, fmt.Sprintf("_%d$", asn))
+		}
+		sets = append(sets,
+			&api.DefinedSet{DefinedType: api.DefinedType_NEIGHBOR, Name: membersSet, List: members},
+			&api.DefinedSet{DefinedType: api.DefinedType_AS_PATH, Name: policiesSet, List: origins},
+		)
+		statements = append(statements, &api.Statement{
+			Name: membersSet,
+			Conditions: &api.Conditions{
+				NeighborSet: &api.MatchSet{Type: api.MatchSet_ANY, Name: membersSet},
+				AsPathSet:   &api.MatchSet{Type: api.MatchSet_INVERT, Name: policiesSet},
+			},
+			Actions: &api.Actions{RouteAction: api.RouteAction_ROUTE_ACTION_REJECT},
+		})
+	}
+
+	extendedSet, extendedReject := extendedNexthopStatement(filters.extendedNexthop)
+	if extendedSet != nil {
+		sets = append(sets, extendedSet)
+	}
+	statements = append(statements, extendedReject)
+	if linkLocalSet, linkLocalReject := linkLocalStatement(filters.offLink); linkLocalSet != nil {
+		sets = append(sets, linkLocalSet)
+		statements = append(statements, linkLocalReject)
+	}
+
+	nextHopSets, nextHopRejects, nextHopReplaces := nextHopStatements(filters.nextHops)
+	sets = append(sets, nextHopSets...)
+	statements = append(statements, nextHopRejects...)
+	statements = append(statements, &api.Statement{
+		Name:       exportPolicyName + "-drain-withdraw",
+		Conditions: &api.Conditions{NeighborSet: &api.MatchSet{Type: api.MatchSet_ANY, Name: drainWithdrawPeerSet}},
+		Actions:    &api.Actions{RouteAction: api.RouteAction_ROUTE_ACTION_REJECT},
+	})
+	// The nexthops are replaced before the paths are accepted.
+	statements = append(statements, nextHopReplaces...)
+	statements = append(statements, &api.Statement{
+		Name:       exportPolicyName + "-gshut",
+		Conditions: &api.Conditions{CommunitySet: &api.MatchSet{Type: api.MatchSet_ANY, Name: gshutCommunitySet}},
+		Actions:    &api.Actions{RouteAction: api.RouteAction_ROUTE_ACTION_ACCEPT},
+	}, &api.Statement{
+		Name:       exportPolicyName + "-drain-gshut",
+		Conditions: &api.Conditions{NeighborSet: &api.MatchSet{Type: api.MatchSet_ANY, Name: drainGshutPeerSet}},
+		Actions: &api.Actions{
+			RouteAction: api.RouteAction_ROUTE_ACTION_ACCEPT,
+			LocalPref:   &api.LocalPrefAction{Value: localPrefGracefulShutdownPeer},
+			Community: &api.CommunityAction{
+				Type:        api.CommunityAction_TYPE_ADD,
+				Communities: []string{communityGracefulShutdown},
+			},
+		},
+	}, &api.Statement{
+		Name:    exportPolicyName + "-local-pref",
+		Actions: &api.Actions{LocalPref: &api.LocalPrefAction{Value: localPrefBest}},
+	})
+
+	for _, set := range sets {
+		if err := bgps.AddDefinedSet(ctx, &api.AddDefinedSetRequest{DefinedSet: set}); err != nil {
+			return fmt.Errorf("failed to add defined set %s: %w", set.Name, err)
+		}
+	}
+
+	if err := bgps.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{
+		Name:       exportPolicyName,
+		Statements: statements,
+	}}); err != nil {
+		return fmt.Errorf("failed to add export policy: %w", err)
+	}
+
+	if err := bgps.AddPolicyAssignment(ctx, &api.AddPolicyAssignmentRequest{Assignment: &api.PolicyAssignment{
+		Name:          "global",
+		Direction:     api.PolicyDirection_POLICY_DIRECTION_EXPORT,
+		Policies:      []*api.Policy{{Name: exportPolicyName}},
+		DefaultAction: api.RouteAction_ROUTE_ACTION_ACCEPT,
+	}}); err != nil {
+		return fmt.Errorf("failed to assign export policy: %w", err)
+	}
+	return nil
+}
+
+// setupImportPolicy installs the import policy named importPolicyName,
+// which rejects all paths received from peers, so that they stay in the
+// Adj-RIB-In, where conditions look them up, and never replace the announced
+// paths as best path of a prefix.
+func setupImportPolicy(ctx context.Context, bgps *server.BgpServer) error {
+	// Paths added locally have no neighbor and never match the set.
+	if err := bgps.AddDefinedSet(ctx, &api.AddDefinedSetRequest{DefinedSet: &api.DefinedSet{
+		DefinedType: api.DefinedType_NEIGHBOR,
+		Name:        importPolicyName + "-peers",
+		List:        []string{"0.0.0.0/0", "::/0"},
+	}}); err != nil {
+		return fmt.Errorf("failed to add neighbor set: %w", err)
+	}
+	if err := bgps.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{
+		Name: importPolicyName,
+		Statements: []*api.Statement{{
+			Name: importPolicyName + "-reject-received",
+			Conditions: &api.Conditions{NeighborSet: &api.MatchSet{
+				Type: api.MatchSet_ANY,
+				Name: importPolicyName + "-peers",
+			}},
+			Actions: &api.Actions{RouteAction: api.RouteAction_ROUTE_ACTION_REJECT},
+		}},
+	}}); err != nil {
+		return fmt.Errorf("failed to add import policy: %w", err)
+	}
+
+	if err := bgps.AddPolicyAssignment(ctx, &api.AddPolicyAssignmentRequest{Assignment: &api.PolicyAssignment{
+		Name:          "global",
+		Direction:     api.PolicyDirection_POLICY_DIRECTION_IMPORT,
+		Policies:      []*api.Policy{{Name: importPolicyName}},
+		DefaultAction: api.RouteAction_ROUTE_ACTION_ACCEPT,
+	}}); err != nil {
+		return fmt.Errorf("failed to assign import policy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package serve
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+
+	"github.com/osrg/gobgp/v4/api"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+)
+
+// nextHopRewrite replaces the nexthop from of the paths sent to the peers in
+// members, which depends on the peer. A placeholder without action is not
+// defined for any peer.
+type nextHopRewrite struct {
+	from    netip.Addr
+	members []netip.Prefix
+	action  *api.NexthopAction
+}
+
+// nextHopRewrites returns the rewrites of the nexthops of conf depending on
+// the peer: config.NextHopPeer and config.NextHopSelf for the peers of the
+// family of the paths and, for IPv4, the IPv6 peers among extended, followed
+// by the nexthops overridden by the sites of the peer groups and then of
+// peerConfs, so that the site of a peer applies over that of its group.
+func nextHopRewrites(conf *config.Config, peerConfs []*config.Peer, extended []netip.Prefix) []*nextHopRewrite {
+	names := conf.PeerNextHopNames(nil)
+	all4 := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+	all6 := []netip.Prefix{netip.MustParsePrefix("::/0")}
+	for _, pre := range extended {
+		if pre.Addr().Is6() {
+			all4 = append(all4, pre)
+		}
+	}
+	rewrites := []*nextHopRewrite{
+		{from: names[config.NextHopPeer].IP4, members: all4, action: &api.NexthopAction{PeerAddress: true}},
+		{from: names[config.NextHopPeer].IP6, members: all6, action: &api.NexthopAction{PeerAddress: true}},
+		{from: names[config.NextHopSelf].IP4, members: all4, action: &api.NexthopAction{Self: true}},
+		{from: names[config.NextHopSelf].IP6, members: all6, action: &api.NexthopAction{Self: true}},
+	}
+
+	addSite := func(site string, members []netip.Prefix) {
+		nhs := conf.Sites[site].NextHops
+		for _, name := range slices.Sorted(maps.Keys(nhs)) {
+			o := nhs[name]
+			if o == nil {
+				continue
+			}
+			for _, nh := range []struct{ from, to netip.Addr }{
+				{names[name].IP4, o.IP4},
+				{names[name].IP6, o.IP6},
+			} {
+				if nh.to.IsValid() && nh.to != nh.from {
+					rewrites = append(rewrites, &nextHopRewrite{
+						from:    nh.from,
+						members: members,
+						action:  &api.NexthopAction{Address: nh.to.String()},
+					})
+				}
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.PeerGroups)) {
+		if g := conf.PeerGroups[name]; g.Site != "" && len(g.Neighbors) > 0 {
+			addSite(g.Site, g.Neighbors)
+		}
+	}
+	for _, pc := range peerConfs {
+		if pc.Site != "" {
+			addSite(pc.Site, []netip.Prefix{netip.PrefixFrom(pc.Address, pc.Address.BitLen())})
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		for _, nh := range []netip.Addr{names[name].IP4, names[name].IP6} {
+			if config.IsPlaceholder(nh) && !slices.ContainsFunc(rewrites, func(rw *nextHopRewrite) bool { return rw.from == nh }) {
+				rewrites = append(rewrites, &nextHopRewrite{from: nh})
+			}
+		}
+	}
+	return rewrites
+}
+
+// extendedNexthopPeers returns the prefixes of the peer groups with dynamic
+// neighbors and of peerConfs which accept IPv4 paths via IPv6 nexthops.
+func extendedNexthopPeers(conf *config.Config, peerConfs []*config.Peer) []netip.Prefix {
+	var members []netip.Prefix
+	for _, name := range slices.Sorted(maps.Keys(conf.PeerGroups)) {
+		if g := conf.PeerGroups[name]; g.ExtendedNexthop {
+			members = append(members, g.Neighbors...)
+		}
+	}
+	for _, pc := range peerConfs {
+		if pc.ExtendedNexthop {
+			members = append(members, netip.PrefixFrom(pc.Address, pc.Address.BitLen()))
+		}
+	}
+	return members
+}
+
+// extendedNexthopStatement returns the defined set, which is nil without
+// members, and the statement of the export policy rejecting the IPv4 paths
+// via IPv6 nexthops (RFC 8950) to the peers other than members.
+func extendedNexthopStatement(members []netip.Prefix) (*api.DefinedSet, *api.Statement) {
+	name := exportPolicyName + "-extended-nexthop"
+	stmt := &api.Statement{
+		Name: name,
+		Conditions: &api.Conditions{
+			AfiSafiIn:     []*api.Family{familyOf(netip.MustParsePrefix("0.0.0.0/0"))},
+			NextHopInList: []string{"::/0"},
+		},
+		Actions: &api.Actions{RouteAction: api.RouteAction_ROUTE_ACTION_REJECT},
+	}
+	if len(members) == 0 {
+		return nil, stmt
+	}
+	list := make([]string, 0, len(members))
+	for _, pre := range members {
+		list = append(list, pre.String())
+	}
+	stmt.Conditions.NeighborSet = &api.MatchSet{Type: api.MatchSet_INVERT, Name: name}
+	return &api.DefinedSet{DefinedType: api.DefinedType_NEIGHBOR, Name: name, List: list}, stmt
+}
+
+// offLinkPeers returns the prefixes of the peers which may not share a link
+// with us, the dynamic neighbors of the peer groups and the multihop peers
+// of peerConfs, and a description of them for errors, which is empty if
+// there are none.
+func offLinkPeers(conf *config.Config, peerConfs []*config.Peer) ([]netip.Prefix, string) {
+	var members []netip.Prefix
+	var desc string
+	for _, name := range slices.Sorted(maps.Keys(conf.PeerGroups)) {
+		if g := conf.PeerGroups[name]; len(g.Neighbors) > 0 {
+			members = append(members, g.Neighbors...)
+			if desc == "" {
+				desc = fmt.Sprintf("the dynamic neighbors of peer group %q", name)
+			}
+		}
+	}
+	for _, pc := range peerConfs {
+		if pc.Multihop > 0 {
+			members = append(members, netip.PrefixFrom(pc.Address, pc.Address.BitLen()))
+			if desc == "" {
+				desc = fmt.Sprintf("multihop peer %s", pc.Address)
+			}
+		}
+	}
+	return members, desc
+}
+
+// linkLocalStatement returns the defined set and the statement of the export
+// policy rejecting the paths via link-local nexthops to members, which
+// cannot resolve them. Both are nil without members.
+func linkLocalStatement(members []netip.Prefix) (*api.DefinedSet, *api.Statement) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+	name := exportPolicyName + "-link-local"
+	list := make([]string, 0, len(members))
+	for _, pre := range members {
+		list = append(list, pre.String())
+	}
+	return &api.DefinedSet{DefinedType: api.DefinedType_NEIGHBOR, Name: name, List: list}, &api.Statement{
+		Name: name,
+		Conditions: &api.Conditions{
+			NextHopInList: []string{"fe80::/10"},
+			NeighborSet:   &api.MatchSet{Type: api.MatchSet_ANY, Name: name},
+		},
+		Actions: &api.Actions{RouteAction: api.RouteAction_ROUTE_ACTION_REJECT},
+	}
+}
+
+// nextHopStatements returns the defined sets and the statements of the
+// export policy applying rewrites. The paths whose nexthop is a placeholder
+// are rejected for the peers no rewrite of the placeholder applies to, and
+// the rewrites then replace the nexthop without deciding on the path.
+func nextHopStatements(rewrites []*nextHopRewrite) (sets []*api.DefinedSet, rejects, replaces []*api.Statement) {
+	defined := make(map[netip.Addr][]string)
+	var placeholders []netip.Addr
+	for i, rw := range rewrites {
+		if _, ok := defined[rw.from]; !ok && config.IsPlaceholder(rw.from) {
+			placeholders = append(placeholders, rw.from)
+			defined[rw.from] = nil
+		}
+		if rw.action == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s-nexthop-%d", exportPolicyName, i+1)
+		members := make([]string, 0, len(rw.members))
+		for _, pre := range rw.members {
+			members = append(members, pre.String())
+		}
+		sets = append(sets, &api.DefinedSet{DefinedType: api.DefinedType_NEIGHBOR, Name: name, List: members})
+		replaces = append(replaces, &api.Statement{
+			Name: name,
+			Conditions: &api.Conditions{
+				NextHopInList: []string{netip.PrefixFrom(rw.from, rw.from.BitLen()).String()},
+				NeighborSet:   &api.MatchSet{Type: api.MatchSet_ANY, Name: name},
+			},
+			Actions: &api.Actions{Nexthop: rw.action},
+		})
+		if config.IsPlaceholder(rw.from) {
+			defined[rw.from] = append(defined[rw.from], members...)
+		}
+	}
+	for i, ph := range placeholders {
+		name := fmt.Sprintf("%s-placeholder-%d", exportPolicyName, i+1)
+		stmt := &api.Statement{
+			Name:       name,
+			Conditions: &api.Conditions{NextHopInList: []string{netip.PrefixFrom(ph, ph.BitLen()).String()}},
+			Actions:    &api.Actions{RouteAction: api.RouteAction_ROUTE_ACTION_REJECT},
+		}
+		if members := defined[ph]; len(members) > 0 {
+			sets = append(sets, &api.DefinedSet{DefinedType: api.DefinedType_NEIGHBOR, Name: name, List: members})
+			stmt.Conditions.NeighborSet = &api.MatchSet{Type: api.MatchSet_INVERT, Name: name}
+		}
+		rejects = append(rejects, stmt)
+	}
+	return sets, rejects, replaces
+}
@@ -0,0 +1,225 @@
+package serve
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+func TestPeerNextHops(t *testing.T) {
+	conf, err := config.Parse([]byte(`
+nexthops:
+  isp-fiber:
+    ip4: 192.168.1.1
+sites:
+  osaka:
+    nexthops:
+      isp-fiber:
+        ip4: 10.1.0.1
+  kyoto:
+    nexthops:
+      isp-kyoto:
+        ip4: 10.2.0.1
+peerGroups:
+  edge:
+    site: osaka
+    neighbors: [127.0.0.0/8]
+  kyoto:
+    site: kyoto
+    neighbors: [10.2.0.0/16]
+`), "")
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	filters := &exportFilters{nextHops: nextHopRewrites(conf, nil, nil)}
+	bgps, router := newTestDynamicPeering(t, filters, conf.PeerGroups["edge"], NewPeerStates())
+
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	db := "8.8.8.0,8.8.8.255,15169,Google LLC\n1.1.1.0,1.1.1.255,13335,Cloudflare\n45.57.0.0,45.57.127.255,2906,Netflix\n"
+	if err := os.WriteFile(dbPath, []byte(db), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	pols, err := policy.ParseAll([]string{"15169,peer", "13335,isp-fiber", "2906,isp-kyoto"}, conf.PeerNextHopNames(nil))
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+	srv := NewServer(bgps, &ServerConfig{DBPath: dbPath, Policies: pols, LocalASN: 64513}, zap.NewNop())
+	if err := srv.Reload(context.Background(), true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	// The nexthops are those of the peer and of its site, and isp-kyoto
+	// is not defined for the peer.
+	want := map[string]string{"8.8.8.0/24": "127.0.0.1", "1.1.1.0/24": "10.1.0.1"}
+	if got := receivedIPv4(t, router); !maps.Equal(got, want) {
+		t.Errorf("Expected the router to receive %v, got %v", want, got)
+	}
+}
+
+func TestExtendedNexthop(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	db := "8.8.8.0,8.8.8.255,15169,Google LLC\n1.1.1.0,1.1.1.255,13335,Cloudflare\n"
+	if err := os.WriteFile(dbPath, []byte(db), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		extended bool
+		want     map[string]string
+	}{
+		{
+			name:     "accepted",
+			extended: true,
+			want:     map[string]string{"8.8.8.0/24": "2001:db8::1", "1.1.1.0/24": "192.168.1.1"},
+		},
+		{
+			name: "not accepted",
+			want: map[string]string{"1.1.1.0/24": "192.168.1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := config.Parse([]byte(`
+nexthops:
+  underlay:
+    ip6: 2001:db8::1
+    extendedNexthop: true
+peerGroups:
+  edge:
+    neighbors: [127.0.0.0/8]
+`), "")
+			if err != nil {
+				t.Fatalf("Failed to parse configuration: %v", err)
+			}
+			conf.PeerGroups["edge"].ExtendedNexthop = tt.extended
+			extended := extendedNexthopPeers(conf, nil)
+			filters := &exportFilters{nextHops: nextHopRewrites(conf, nil, extended), extendedNexthop: extended}
+			bgps, router := newTestDynamicPeering(t, filters, conf.PeerGroups["edge"], NewPeerStates())
+
+			pols, err := policy.ParseAll([]string{"15169,underlay", "13335,192.168.1.1"}, conf.PeerNextHopNames(nil))
+			if err != nil {
+				t.Fatalf("Failed to parse policies: %v", err)
+			}
+			srv := NewServer(bgps, &ServerConfig{DBPath: dbPath, Policies: pols, LocalASN: 64513}, zap.NewNop())
+			if err := srv.Reload(context.Background(), true); err != nil {
+				t.Fatalf("Failed to reload: %v", err)
+			}
+
+			if got := receivedIPv4(t, router); !maps.Equal(got, tt.want) {
+				t.Errorf("Expected the router to receive %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLinkLocalNexthop(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	db := "8.8.8.0,8.8.8.255,15169,Google LLC\n1.1.1.0,1.1.1.255,13335,Cloudflare\n"
+	if err := os.WriteFile(dbPath, []byte(db), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		offLink bool
+		want    map[string]string
+	}{
+		{
+			name: "on link",
+			want: map[string]string{"8.8.8.0/24": "fe80::1", "1.1.1.0/24": "192.168.1.1"},
+		},
+		{
+			name:    "off link",
+			offLink: true,
+			want:    map[string]string{"1.1.1.0/24": "192.168.1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := config.Parse([]byte(`
+nexthops:
+  lan:
+    ip6: fe80::1%eth0
+    extendedNexthop: true
+peerGroups:
+  edge:
+    extendedNexthop: true
+    neighbors: [127.0.0.0/8]
+`), "")
+			if err != nil {
+				t.Fatalf("Failed to parse configuration: %v", err)
+			}
+			extended := extendedNexthopPeers(conf, nil)
+			filters := &exportFilters{nextHops: nextHopRewrites(conf, nil, extended), extendedNexthop: extended}
+			if tt.offLink {
+				filters.offLink, _ = offLinkPeers(conf, nil)
+			}
+			bgps, router := newTestDynamicPeering(t, filters, conf.PeerGroups["edge"], NewPeerStates())
+
+			pols, err := policy.ParseAll([]string{"15169,lan", "13335,192.168.1.1"}, conf.PeerNextHopNames(nil))
+			if err != nil {
+				t.Fatalf("Failed to parse policies: %v", err)
+			}
+			srv := NewServer(bgps, &ServerConfig{DBPath: dbPath, Policies: pols, LocalASN: 64513}, zap.NewNop())
+			if err := srv.Reload(context.Background(), true); err != nil {
+				t.Fatalf("Failed to reload: %v", err)
+			}
+
+			if got := receivedIPv4(t, router); !maps.Equal(got, tt.want) {
+				t.Errorf("Expected the router to receive %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRejectLinkLocal(t *testing.T) {
+	conf, err := config.Parse([]byte(`
+nexthops:
+  isp-pppoe:
+    gateway:
+      interface: ppp0
+peers:
+  - address: 10.0.0.1
+    multihop: 2
+`), "")
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	_, offLink := offLinkPeers(conf, conf.Peers)
+	if offLink != "multihop peer 10.0.0.1" {
+		t.Errorf("Unexpected description %q", offLink)
+	}
+
+	gateways := nexthop.NewGatewayWatcher(nil, zap.NewNop())
+	mgr, err := NewPolicyManager(conf, []string{"15169,192.168.1.1,isp-pppoe"}, gateways, true, "", zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create policy manager: %v", err)
+	}
+	// Gateways are withheld by the export policy instead.
+	if err := mgr.RejectLinkLocal(offLink); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := mgr.Add(context.Background(), "13335,,fe80::1%eth0", true); err == nil {
+		t.Errorf("Expected error for a link-local nexthop but got none")
+	}
+
+	mgr, err = NewPolicyManager(conf, []string{"13335,,fe80::1%eth0"}, gateways, true, "", zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create policy manager: %v", err)
+	}
+	if err := mgr.RejectLinkLocal(offLink); err == nil {
+		t.Errorf("Expected error for a link-local nexthop but got none")
+	}
+	if err := mgr.RejectLinkLocal(""); err != nil {
+		t.Errorf("Unexpected error without peers off the link: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package serve
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+)
+
+// PeerState is the session state of a BGP peer.
+type PeerState struct {
+	State api.PeerState_SessionState
+	// Since is the time the peer entered State.
+	Since time.Time
+}
+
+// PeerStates tracks the session state of the BGP peers from the peer events
+// of the BGP server.
+type PeerStates struct {
+	mu     sync.Mutex
+	states map[string]PeerState
+	// configured are the addresses of the configured peers. The others are
+	// dynamic neighbors, which the BGP server deletes once their session goes
+	// down.
+	configured []string
+}
+
+func NewPeerStates() *PeerStates {
+	return &PeerStates{states: make(map[string]PeerState)}
+}
+
+// configure records the addresses of the configured peers.
+func (ps *PeerStates) configure(addrs []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.configured = addrs
+}
+
+// update records the state of p from a peer event. Dynamic neighbors are
+// forgotten once idle, as the BGP server deletes them.
+func (ps *PeerStates) update(p *api.Peer) {
+	addr := p.GetState().GetNeighborAddress()
+	if addr == "" {
+		return
+	}
+	st := p.GetState().GetSessionState()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if st == api.PeerState_IDLE && !slices.Contains(ps.configured, addr) {
+		delete(ps.states, addr)
+		return
+	}
+	if cur, ok := ps.states[addr]; ok && cur.State == st {
+		return
+	}
+	ps.states[addr] = PeerState{State: st, Since: time.Now()}
+}
+
+// States returns the state of the peers by neighbor address.
+func (ps *PeerStates) States() map[string]PeerState {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return maps.Clone(ps.states)
+}
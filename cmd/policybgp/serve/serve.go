@@ -3,26 +3,48 @@ package serve
 import (
 	"context"
 	"fmt"
+	"maps"
 	"net"
+	"net/http"
 	"net/netip"
-	"strconv"
+	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/kernel"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/render"
+	"github.com/IPA-CyberLab/policybgp/zebra"
 	"github.com/osrg/gobgp/v4/api"
 	"github.com/osrg/gobgp/v4/pkg/server"
 	"github.com/urfave/cli/v3"
 	"go.uber.org/zap"
-	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-type Policy struct {
-	ASN        uint32
-	IP4NextHop netip.Addr
-	IP6NextHop netip.Addr
+const (
+	modeBGP     = "bgp"
+	modeNetlink = "netlink"
+	modeZebra   = "zebra"
 
-	ASInfo *asinfo.ASInfo
-}
+	shutdownWithdraw = "withdraw"
+	shutdownKeep     = "keep"
+
+	drainWithdraw = "withdraw"
+	drainGshut    = "gshut"
+
+	// drainFileInterval is the interval the drain file is checked at.
+	drainFileInterval = 5 * time.Second
+
+	// defaultKernelProtocol is the routing protocol ID of the routes
+	// installed in netlink mode, which is unused by common routing daemons.
+	defaultKernelProtocol = 200
+)
 
 var Command = &cli.Command{
 	Name:                      "serve",
@@ -45,24 +67,202 @@ var Command = &cli.Command{
 			Value: "10.64.51.3",
 		},
 		&cli.StringFlag{
-			Name:     "peer",
-			Usage:    "BGP peer address in the format <ip>:<port>",
-			Required: true,
+			Name:  "mode",
+			Usage: "Where the routes are sent: " + modeBGP + " (to the BGP peer) or " + modeNetlink + " (installed to a kernel routing table, Linux only) or " + modeZebra + " (installed to the RIB of FRR's zebra)",
+			Value: modeBGP,
+		},
+		&cli.StringFlag{
+			Name:  "peer",
+			Usage: "BGP peer address in the format <ip>:<port>. Required in bgp mode unless peers or dynamic neighbors are defined in the configuration file",
+		},
+		&cli.StringFlag{
+			Name:  "listenBGP",
+			Usage: "Accept BGP sessions from the peers on the specified address, in the format [<ip>]:<port>. Required by passive peers and dynamic neighbors",
+		},
+		&cli.BoolFlag{
+			Name:  "gracefulRestart",
+			Usage: "Advertise the BGP Graceful Restart capability, so that the peer retains our routes while we restart, and retain the routes of the peer while it restarts",
+		},
+		&cli.DurationFlag{
+			Name:  "gracefulRestartTime",
+			Usage: "Time the peer retains our routes after the session drops, with --gracefulRestart",
+			Value: 120 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "gracefulRestartDeferral",
+			Usage: "After a restart with --gracefulRestartState, the longest our routes are held back waiting for the peer to send all of its routes, with --gracefulRestart",
+			Value: 60 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "gracefulRestartState",
+			Usage: "File recording that --shutdownMode=" + shutdownKeep + " left the routes to the peer, so that the next start within --gracefulRestartTime restarts gracefully. Without it, every start is a cold start",
+		},
+		&cli.StringFlag{
+			Name:  "shutdownMode",
+			Usage: "What happens to the routes on SIGTERM or SIGINT: " + shutdownWithdraw + " (withdraw them and wait for --shutdownWait before closing the BGP session) or " + shutdownKeep + " (leave them to the peer through Graceful Restart in bgp mode, or in the kernel routing table in netlink mode)",
+			Value: shutdownWithdraw,
+		},
+		&cli.DurationFlag{
+			Name:  "shutdownWait",
+			Usage: "Time to wait after withdrawing the routes before closing the BGP session with --shutdownMode=" + shutdownWithdraw,
+			Value: 5 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "drainMode",
+			Usage: "How drained routes are taken out of service: " + drainWithdraw + " (withdraw them) or " + drainGshut + " (keep them announced with the GRACEFUL_SHUTDOWN community and a lowered LOCAL_PREF in bgp mode, so that the peer moves the traffic to other paths first)",
+			Value: drainWithdraw,
+		},
+		&cli.DurationFlag{
+			Name:  "drainWithdrawAfter",
+			Usage: "With --drainMode=" + drainGshut + ", withdraw the drained routes after this long. 0 to keep them until undrained",
+		},
+		&cli.BoolFlag{
+			Name:  "drainResetPeers",
+			Usage: "Reset the session of a drained peer to withdraw its routes in withdraw mode or after --drainWithdrawAfter. Otherwise its routes stay announced with the GRACEFUL_SHUTDOWN community and a lowered LOCAL_PREF (bgp mode)",
+		},
+		&cli.StringFlag{
+			Name:  "drainFile",
+			Usage: "Drain the routes while this file exists. It lists what to drain, one per line: global, policy <name> or peer <address>. An empty file drains all routes",
+		},
+		&cli.Uint32Flag{
+			Name:  "addPathSendMax",
+			Usage: "Maximum number of paths per prefix announced over ADD-PATH, which bounds the nexthops of the multipath policies added at runtime. 0 for the most paths of the policies defined at start",
+		},
+		&cli.Uint32Flag{
+			Name:  "kernelTable",
+			Usage: "Kernel routing table ID the routes are installed to in netlink mode",
+			Value: render.DefaultOptions().Table,
+		},
+		&cli.Uint32Flag{
+			Name:  "kernelProtocol",
+			Usage: "Routing protocol ID the routes are tagged with in netlink mode. Routes of the table with this protocol are owned by policybgp and removed if not part of a policy",
+			Value: defaultKernelProtocol,
+		},
+		&cli.StringFlag{
+			Name:  "zebraURL",
+			Usage: "Address of the zserv socket of zebra in zebra mode, in the format unix:<path> or tcp:<ip>:<port>",
+			Value: zebra.DefaultURL,
+		},
+		&cli.Uint32Flag{
+			Name:  "zebraVersion",
+			Usage: "ZAPI version spoken to zebra in zebra mode. FRR 7.2 and later speak version 6",
+			Value: 6,
+		},
+		&cli.StringFlag{
+			Name:  "zebraSoftware",
+			Usage: "zebra software and version the messages are formatted for in zebra mode, such as frr7.5 or frr8.2. Defaults to the latest FRR of the ZAPI version",
+		},
+		&cli.StringFlag{
+			Name:  "zebraRouteType",
+			Usage: "Route type of the routes installed in zebra mode, such as static, kernel or bgp",
+			Value: "static",
+		},
+		&cli.Uint32Flag{
+			Name:  "zebraDistance",
+			Usage: "Administrative distance of the routes installed in zebra mode. 0 uses the default distance of the route type",
 		},
 		&cli.StringSliceFlag{
 			Name:  "policy",
-			Usage: "Policy routing policy to be distributed to the peer. Format: <asn>!<ip4_nexthop>[!<ip6_nexthop>]",
+			Usage: "Policy routing policy to be distributed to the peer. Format: <asn>,<ip4_nexthops>[,<ip6_nexthops>] where multiple nexthops are separated by \"|\" in order of preference, or by \"+\" to share the traffic between them, optionally weighted as <nexthop>@<weight>. Nexthops may be addresses or names defined in the configuration file. Link-local IPv6 nexthops take their interface as zone, as in fe80::1%eth0, and cannot be announced to multihop peers or dynamic neighbors. IPv4 nexthops must be IPv4 addresses; routing IPv4 via IPv6 (RFC 8950) takes a named nexthop with extendedNexthop",
+		},
+		&cli.StringSliceFlag{
+			Name:  "condition",
+			Usage: "Only announce the routes of a policy while the BGP peer sends a route to the prefix. Format: <policy>=<prefix>. The routes are withdrawn while any of the prefixes of the policy is missing. Only supported in bgp mode",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "YAML configuration file defining named nexthops, per-site overrides of them and policies",
+		},
+		&cli.StringFlag{
+			Name:  "site",
+			Usage: "Apply the nexthop overrides of the site in the configuration file",
+		},
+		&cli.StringSliceFlag{
+			Name: "healthCheck",
+			Usage: "Health check a nexthop and withdraw its routes, or switch them to the fallback nexthop, while it is down. " +
+				"Format: <nexthop>,<method>[,<key>=<value>...] where <method> is icmp, tcp or http, and <key> is one of " +
+				"target, source, interface, interval, timeout, rise, fall, holddown and fallback",
+		},
+		&cli.StringSliceFlag{
+			Name: "latency",
+			Usage: "Select the nexthop of a policy by the latency measured through each of its nexthops, sending ICMP echo probes from the source or interface of their health checks. " +
+				"Format: <policy>[,<key>=<value>...] where <key> is one of targets (separated by \"|\"), interval, timeout, margin and hold",
+		},
+		&cli.StringSliceFlag{
+			Name: "loadRule",
+			Usage: "Shift a policy to another nexthop while the utilisation of a link is high. " +
+				"Format: <policy>,interface=<interface>,to=<nexthop>[,<key>=<value>...] where <key> is one of direction (tx or rx), capacity (bits/s with k, M or G), threshold, clear (percentages), for, cooldown and interval",
 		},
 		&cli.StringFlag{
 			Name:  "listenGobgp",
-			Usage: "Enable GoBGP gRPC server on the specified address",
-			Value: ":50051",
+			Usage: "Enable GoBGP gRPC server on the specified address, in the format <host>:<port> or unix:<path>. Empty to disable",
+			Value: "127.0.0.1:50051",
+		},
+		&cli.StringFlag{
+			Name:  "gobgpTLSCert",
+			Usage: "Serve the GoBGP gRPC API over TLS with the certificate of this PEM file",
+		},
+		&cli.StringFlag{
+			Name:  "gobgpTLSKey",
+			Usage: "Private key of --gobgpTLSCert",
+		},
+		&cli.StringFlag{
+			Name:  "gobgpClientCA",
+			Usage: "Require clients of the GoBGP gRPC API to present a certificate signed by a CA of this PEM file. Requires --gobgpTLSCert",
+		},
+		&cli.DurationFlag{
+			Name:  "dbReloadInterval",
+			Usage: "Interval to check the database file for changes and reload it. 0 to disable. The database is also reloaded on SIGHUP",
+			Value: time.Minute,
+		},
+		&cli.StringFlag{
+			Name:  "listenHTTP",
+			Usage: "Serve the prefix lists of the policies over HTTP on the specified address",
+		},
+		&cli.StringFlag{
+			Name:  "listenMetrics",
+			Usage: "Serve Prometheus metrics at /metrics over HTTP on the specified address",
+		},
+		&cli.StringFlag{
+			Name:  "listenAPI",
+			Usage: "Serve the management API over HTTP on the specified address, in the format unix:<path> or <host>:<port>",
+		},
+		&cli.BoolFlag{
+			Name:  "persistPolicies",
+			Usage: "Save the policies changed through the management API to the configuration file",
+		},
+		&cli.StringFlag{
+			Name:  "apiTokenFile",
+			Usage: "Require the bearer token read from this file in the requests to the management API",
+		},
+		&cli.StringSliceFlag{
+			Name:  "pacProxy",
+			Usage: "Proxy directive for the prefixes of a policy in the PAC file served over HTTP. Format: <policy>=<directive>",
+		},
+		&cli.StringFlag{
+			Name:  "pacDefault",
+			Usage: "Proxy directive for addresses not covered by any policy in the PAC file served over HTTP",
+			Value: render.DefaultOptions().PACDefault,
+		},
+		&cli.StringFlag{
+			Name:  "pacMode",
+			Usage: "How the prefixes are matched in the PAC file served over HTTP: " + render.PACModeTable + " or " + render.PACModeIsInNet,
+			Value: render.DefaultOptions().PACMode,
 		},
 	},
 	Action: func(ctx context.Context, cmd *cli.Command) error {
 		logger := zap.L()
 		s := logger.Named("policybgp.serve").Sugar()
 
+		shutdownMode := cmd.String("shutdownMode")
+		if shutdownMode != shutdownWithdraw && shutdownMode != shutdownKeep {
+			return cli.Exit(fmt.Errorf("unknown shutdown mode %q. Expected %s or %s", shutdownMode, shutdownWithdraw, shutdownKeep), 1)
+		}
+		drainMode := cmd.String("drainMode")
+		if drainMode != drainWithdraw && drainMode != drainGshut {
+			return cli.Exit(fmt.Errorf("unknown drain mode %q. Expected %s or %s", drainMode, drainWithdraw, drainGshut), 1)
+		}
+
 		bgpASN := cmd.Uint32("bgpASN")
 		if bgpASN < 1 || bgpASN > 65535 {
 			return cli.Exit(fmt.Errorf("BGP ASN %d invalid. It must be between 1 and 65535", bgpASN), 1)
@@ -73,222 +273,492 @@ var Command = &cli.Command{
 			return cli.Exit("routerId cannot be empty", 1)
 		}
 
-		peerS := cmd.String("peer")
-		peerHost, peerPortS, err := net.SplitHostPort(peerS)
+		conf, err := config.Load(cmd.String("config"), cmd.String("site"))
 		if err != nil {
-			return cli.Exit(fmt.Errorf("invalid peer format %q: %w", peerS, err), 1)
+			return cli.Exit(err, 1)
 		}
-		peerPort := 179 // default BGP port
-		if peerPortS != "" {
-			var err error
-			peerPort, err = net.LookupPort("tcp", peerPortS)
-			if err != nil {
-				return cli.Exit(fmt.Errorf("invalid peer port %q: %w", peerPortS, err), 1)
+		gateways := nexthop.NewGatewayWatcher(conf.Gateways(), logger.Named("policybgp"))
+		hasGateways := len(conf.Gateways()) > 0
+		if hasGateways {
+			gateways.Resolve()
+		}
+		var savePath string
+		if cmd.Bool("persistPolicies") {
+			if savePath = cmd.String("config"); savePath == "" {
+				return cli.Exit("--persistPolicies requires --config", 1)
 			}
 		}
-		if peerPort < 1 || peerPort > 65535 {
-			return cli.Exit(fmt.Errorf("peer port %d invalid. It must be between 1 and 65535", peerPort), 1)
+		policyMgr, err := NewPolicyManager(conf, cmd.StringSlice("policy"), gateways, cmd.String("mode") == modeBGP, savePath, logger.Named("policybgp"))
+		if err != nil {
+			return cli.Exit(err, 1)
 		}
-
-		policyStrings := cmd.StringSlice("policy")
-		policies := make([]*Policy, 0, len(policyStrings))
-		for _, policyStr := range policyStrings {
-			parts := strings.SplitN(policyStr, ",", 3)
-			if len(parts) < 2 || len(parts) > 3 {
-				s.Debugf("parts: %+v", parts)
-				return cli.Exit(fmt.Errorf("invalid policy format %q. Expected <asn>,<ip4_nexthop>[,<ip6_nexthop>]", policyStr), 1)
-			}
-
-			asn, err := strconv.Atoi(parts[0])
-			if err != nil {
-				return cli.Exit(fmt.Errorf("invalid ASN in policy %q: %w", policyStr, err), 1)
-			}
-			if asn == 0 || asn > 4294967295 { // Max ASN for 32-bit
-				return cli.Exit(fmt.Errorf("ASN %d in policy %q is out of valid range", asn, policyStr), 1)
+		policies, err := policyMgr.Policies()
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		for _, pol := range policies {
+			if len(pol.IP4NextHops) == 0 && len(pol.IP6NextHops) == 0 {
+				if !hasGateways {
+					return cli.Exit(fmt.Errorf("policy for ASN %d has no nexthop", pol.ASN), 1)
+				}
+				s.Warnf("Policy for ASN %d has no nexthop until its gateway is resolved", pol.ASN)
 			}
-
-			ip4NextHop, err := netip.ParseAddr(parts[1])
-			if err != nil || !ip4NextHop.Is4() {
-				return cli.Exit(fmt.Errorf("invalid IPv4 nexthop %q in policy %q: %w", parts[1], policyStr, err), 1)
+			if cmd.String("mode") == modeBGP {
+				continue
 			}
-
-			var ip6NextHop netip.Addr
-			if len(parts) == 3 && parts[2] != "" {
-				ip6NextHop, err = netip.ParseAddr(parts[2])
-				if err != nil || !ip6NextHop.Is6() {
-					return cli.Exit(fmt.Errorf("invalid IPv6 nexthop %q in policy %q: %w", parts[2], policyStr, err), 1)
+			// Installed routes need the interface of link-local nexthops,
+			// while announced ones are resolved by the peer.
+			for _, nh := range slices.Concat(pol.IP4NextHops, pol.IP6NextHops) {
+				if nh.Is6() && nh.IsLinkLocalUnicast() && nh.Zone() == "" {
+					return cli.Exit(fmt.Errorf("link-local nexthop %s of policy for ASN %d requires its interface as zone, as in %s%%eth0", nh, pol.ASN, nh), 1)
 				}
 			}
-
-			policies = append(policies, &Policy{
-				ASN:        uint32(asn),
-				IP4NextHop: ip4NextHop,
-				IP6NextHop: ip6NextHop,
-			})
 		}
 
 		s.Infof("Parsed %d policies", len(policies))
-		if len(policies) == 0 {
-			return cli.Exit("No policies provided. Use --policy flag to specify at least one policy.", 1)
+		if len(policies) == 0 && cmd.String("listenAPI") == "" {
+			return cli.Exit("No policies provided. Use --policy flag or the policies of the configuration file to specify at least one policy, or --listenAPI to add them at runtime.", 1)
 		}
 
-		dbPath := cmd.String("dbpath")
-		db, err := asinfo.ParseASInfoCSVFromFile(dbPath, s.Desugar())
+		var names []string
+		for _, d := range policyMgr.Defs() {
+			names = append(names, d.Name)
+		}
+		conditions, err := parseConditions(cmd.StringSlice("condition"), names)
 		if err != nil {
-			return err
+			return cli.Exit(err, 1)
 		}
 
-		for _, pol := range policies {
-			info := db[int(pol.ASN)]
-			if info == nil {
-				return cli.Exit(fmt.Errorf("ASN %d not found in database %q", pol.ASN, dbPath), 1)
+		checks, err := conf.HealthChecks()
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		for _, hc := range cmd.StringSlice("healthCheck") {
+			nh, cfg, err := nexthop.ParseCheck(hc)
+			if err != nil {
+				return cli.Exit(err, 1)
 			}
-
-			pol.ASInfo = info
-
-			s.Infof("Configuring policy: %d prefixes to ASN %d (%s) nexthop v4 %s and v6 %s",
-				len(info.Prefixes), pol.ASN, info.Organization, pol.IP4NextHop, pol.IP6NextHop)
+			checks = append(checks, &nexthop.Check{NextHops: []netip.Addr{nh}, Config: cfg})
 		}
-
-		peer := &api.Peer{
-			Conf: &api.PeerConf{
-				NeighborAddress: peerHost,
-				PeerAsn:         bgpASN,
-			},
-			Transport: &api.Transport{
-				RemotePort: uint32(peerPort),
-			},
-			Timers: &api.Timers{Config: &api.TimersConfig{
-				ConnectRetry:      3,
-				HoldTime:          90,
-				KeepaliveInterval: 30,
-			}},
-			AfiSafis: []*api.AfiSafi{
-				{Config: &api.AfiSafiConfig{Family: &api.Family{
-					Afi:  api.Family_AFI_IP,
-					Safi: api.Family_SAFI_UNICAST,
-				}}},
-				{Config: &api.AfiSafiConfig{Family: &api.Family{
-					Afi:  api.Family_AFI_IP6,
-					Safi: api.Family_SAFI_UNICAST,
-				}}},
-			},
+		health, err := nexthop.NewMonitor(checks, logger.Named("policybgp"))
+		if err != nil {
+			return cli.Exit(err, 1)
 		}
 
-		sopts := []server.ServerOption{
-			server.LoggerOption(&logAdapter{l: s.Named("gobgp")}),
+		latencyChecks, err := parseLatencyChecks(cmd.StringSlice("latency"), policies)
+		if err != nil {
+			return cli.Exit(err, 1)
 		}
-		if listenAddr := cmd.String("listenGobgp"); listenAddr != "" {
-			sopts = append(sopts, server.GrpcListenAddress(listenAddr))
+		var latency *nexthop.LatencyMonitor
+		if len(latencyChecks) > 0 {
+			latency, err = nexthop.NewLatencyMonitor(latencyChecks, health, logger.Named("policybgp"))
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
 		}
-		bgps := server.NewBgpServer(sopts...)
-		go bgps.Serve()
 
-		s.Infof("Starting BGP server with ASN %d and Router ID %s", bgpASN, routerId)
-		if err := bgps.StartBgp(ctx, &api.StartBgpRequest{
-			Global: &api.Global{
-				Asn:        bgpASN,
-				RouterId:   routerId,
-				ListenPort: -1, // gobgp won't listen on tcp:179
-			},
-		}); err != nil {
-			return err
+		loadRules, err := parseLoadRules(cmd.StringSlice("loadRule"), policies, conf.NamedNextHops(gateways.Addrs()))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		var load *nexthop.LoadMonitor
+		if len(loadRules) > 0 {
+			load, err = nexthop.NewLoadMonitor(loadRules, logger.Named("policybgp"))
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
 		}
+		referenced := slices.Collect(maps.Keys(conditions))
+		for _, chk := range latencyChecks {
+			referenced = append(referenced, chk.Policy)
+		}
+		for _, rule := range loadRules {
+			referenced = append(referenced, rule.Policy)
+		}
+		policyMgr.KeepReferenced(referenced)
 
-		// monitor the change of the peer state
-		// TBD: is this really needed?
-		if err := bgps.WatchEvent(ctx, &api.WatchEventRequest{Peer: &api.WatchEventRequest_Peer{}}, func(r *api.WatchEventResponse) {
-			if p := r.GetPeer(); p != nil && p.Type == api.WatchEventResponse_PeerEvent_TYPE_STATE {
-				s.Info(p)
+		var (
+			bgps     *server.BgpServer
+			bgpPeers []*api.Peer
+			peers    = NewPeerStates()
+			table    RouteTable
+
+			// bgpGroups are the peer groups of dynamicNeighbors.
+			bgpGroups        []*api.PeerGroup
+			dynamicNeighbors []*api.DynamicNeighbor
+		)
+		switch mode := cmd.String("mode"); mode {
+		case modeBGP:
+			sendMax := int(cmd.Uint32("addPathSendMax"))
+			if sendMax == 0 {
+				if sendMax, err = policyMgr.MaxPaths(); err != nil {
+					return cli.Exit(err, 1)
+				}
+			}
+			if err := policyMgr.LimitPaths(sendMax); err != nil {
+				return cli.Exit(err, 1)
+			}
+			peerConfs := conf.Peers
+			if addr := cmd.String("peer"); addr != "" {
+				pc, err := parsePeer(addr)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				if slices.ContainsFunc(peerConfs, func(p *config.Peer) bool { return p.Address == pc.Address }) {
+					return cli.Exit(fmt.Errorf("peer %s of --peer is also defined in the configuration file", pc.Address), 1)
+				}
+				for name, g := range conf.PeerGroups {
+					if slices.ContainsFunc(g.Neighbors, func(pre netip.Prefix) bool { return pre.Contains(pc.Address) }) {
+						return cli.Exit(fmt.Errorf("peer %s of --peer is among the neighbors of peer group %q", pc.Address, name), 1)
+					}
+				}
+				peerConfs = append([]*config.Peer{pc}, peerConfs...)
+			}
+			// groupTmpls are the options of the dynamic neighbors of
+			// the peer groups.
+			var groupTmpls []*api.Peer
+			for _, name := range slices.Sorted(maps.Keys(conf.PeerGroups)) {
+				g := conf.PeerGroups[name]
+				if len(g.Neighbors) == 0 {
+					continue
+				}
+				if cmd.String("listenBGP") == "" {
+					return cli.Exit(fmt.Errorf("dynamic neighbors of peer group %q require --listenBGP", name), 1)
+				}
+				tmpl, err := peerTemplate(&g.PeerOptions, bgpASN, sendMax)
+				if err != nil {
+					return cli.Exit(fmt.Errorf("peer group %q: %w", name, err), 1)
+				}
+				tmpl.Conf.PeerGroup = name
+				groupTmpls = append(groupTmpls, tmpl)
+				for _, pre := range g.Neighbors {
+					dynamicNeighbors = append(dynamicNeighbors, &api.DynamicNeighbor{Prefix: pre.String(), PeerGroup: name})
+				}
+			}
+			if len(peerConfs) == 0 && len(groupTmpls) == 0 {
+				return cli.Exit("--peer, or peers or dynamic neighbors in the configuration file are required in bgp mode", 1)
+			}
+			groups, err := groupFilters(conf.PeerGroups, peerConfs)
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			extended := extendedNexthopPeers(conf, peerConfs)
+			offLink, offLinkDesc := offLinkPeers(conf, peerConfs)
+			if err := policyMgr.RejectLinkLocal(offLinkDesc); err != nil {
+				return cli.Exit(err, 1)
+			}
+			filters := &exportFilters{
+				groups:          groups,
+				nextHops:        nextHopRewrites(conf, peerConfs, extended),
+				extendedNexthop: extended,
+				offLink:         offLink,
 			}
-		}); err != nil {
-			return err
+			for _, pc := range peerConfs {
+				if pc.Passive && cmd.String("listenBGP") == "" {
+					return cli.Exit(fmt.Errorf("passive peer %s requires --listenBGP", pc.Address), 1)
+				}
+				peer, err := newPeer(pc, bgpASN, sendMax)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				bgpPeers = append(bgpPeers, peer)
+			}
+			if cmd.Bool("gracefulRestart") {
+				restartTime := cmd.Duration("gracefulRestartTime")
+				if restartTime < time.Second || restartTime > 4095*time.Second {
+					return cli.Exit(fmt.Errorf("graceful restart time %v invalid. It must be between 1s and 4095s", restartTime), 1)
+				}
+				deferralTime := cmd.Duration("gracefulRestartDeferral")
+				if deferralTime < time.Second || deferralTime > 65535*time.Second {
+					return cli.Exit(fmt.Errorf("graceful restart deferral time %v invalid. It must be between 1s and 65535s", deferralTime), 1)
+				}
+				var restarting bool
+				if path := cmd.String("gracefulRestartState"); path != "" {
+					restarting, err = readRestartState(path, restartTime, time.Now())
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+				}
+				if restarting {
+					s.Infof("Restarting gracefully, the peers retain the routes of the previous run")
+				}
+				for _, peer := range bgpPeers {
+					enableGracefulRestart(peer, restartTime, deferralTime, restarting)
+				}
+				for _, tmpl := range groupTmpls {
+					enableGracefulRestart(tmpl, restartTime, deferralTime, restarting)
+				}
+			} else if shutdownMode == shutdownKeep {
+				return cli.Exit("--shutdownMode="+shutdownKeep+" requires --gracefulRestart in bgp mode", 1)
+			}
+			for _, tmpl := range groupTmpls {
+				bgpGroups = append(bgpGroups, newPeerGroup(tmpl))
+			}
+			grpcOpts, err := gobgpServerOptions(cmd, s)
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			var peerAddrs []string
+			for _, peer := range bgpPeers {
+				peerAddrs = append(peerAddrs, peer.Conf.NeighborAddress)
+			}
+			peers.configure(peerAddrs)
+			bgps, err = startBgp(ctx, bgpASN, routerId, cmd.String("listenBGP"), gobgpListenAddress(cmd.String("listenGobgp")), grpcOpts, filters, peers, s)
+			if err != nil {
+				return err
+			}
+		case modeNetlink:
+			if len(conditions) > 0 {
+				return cli.Exit("--condition is only supported in bgp mode", 1)
+			}
+			table, err = kernel.NewTable(int(cmd.Uint32("kernelTable")), int(cmd.Uint32("kernelProtocol")))
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			s.Infof("Installing routes to kernel routing table %d with protocol %d, taking over %d existing routes",
+				cmd.Uint32("kernelTable"), cmd.Uint32("kernelProtocol"), table.Len())
+		case modeZebra:
+			if len(conditions) > 0 {
+				return cli.Exit("--condition is only supported in bgp mode", 1)
+			}
+			if shutdownMode == shutdownKeep {
+				return cli.Exit("--shutdownMode="+shutdownKeep+" is not supported in zebra mode", 1)
+			}
+			if cmd.Uint32("zebraVersion") > 255 || cmd.Uint32("zebraDistance") > 255 {
+				return cli.Exit("zebraVersion and zebraDistance must be at most 255", 1)
+			}
+			zt, err := zebra.NewTable(&zebra.Config{
+				URL:       cmd.String("zebraURL"),
+				Version:   uint8(cmd.Uint32("zebraVersion")),
+				Software:  cmd.String("zebraSoftware"),
+				RouteType: cmd.String("zebraRouteType"),
+				Distance:  uint8(cmd.Uint32("zebraDistance")),
+			}, logger.Named("policybgp"), &logAdapter{l: s.Named("zapi")})
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			go zt.Run(ctx)
+			s.Infof("Installing %s routes to zebra at %s", cmd.String("zebraRouteType"), cmd.String("zebraURL"))
+			table = zt
+		default:
+			return cli.Exit(fmt.Errorf("unknown mode %q. Expected %s, %s or %s", mode, modeBGP, modeNetlink, modeZebra), 1)
 		}
 
-		peerText, err := prototext.Marshal(peer)
-		if err != nil {
-			return cli.Exit(fmt.Errorf("failed to marshal peer: %w", err), 1)
+		srv := NewServer(bgps, &ServerConfig{
+			DBPath:     cmd.String("dbpath"),
+			Policies:   policies,
+			Disabled:   policyMgr.Disabled(),
+			LocalASN:   bgpASN,
+			Health:     health,
+			Latency:    latency,
+			Load:       load,
+			Conditions: conditions,
+			Table:      table,
+			Drain: DrainConfig{
+				GracefulShutdown: drainMode == drainGshut,
+				WithdrawAfter:    cmd.Duration("drainWithdrawAfter"),
+				ResetPeers:       cmd.Bool("drainResetPeers"),
+			},
+		}, s.Desugar())
+		policyMgr.srv = srv
+		defer func() {
+			// ctx is done by now, but the routes are still to be withdrawn.
+			if err := srv.Shutdown(context.WithoutCancel(ctx), shutdownMode == shutdownKeep, cmd.Duration("shutdownWait")); err != nil {
+				s.Errorf("Failed to shut down: %v", err)
+				return
+			}
+			if path := cmd.String("gracefulRestartState"); path != "" && bgps != nil && shutdownMode == shutdownKeep {
+				if err := writeRestartState(path, time.Now()); err != nil {
+					s.Errorf("Failed to write the restart state: %v", err)
+				}
+			}
+		}()
+		// Drain before announcing anything, if restarted during maintenance.
+		if path := cmd.String("drainFile"); path != "" {
+			if err := srv.LoadDrainFile(ctx, path); err != nil {
+				return cli.Exit(err, 1)
+			}
+		}
+		if err := srv.Reload(ctx, true); err != nil {
+			return cli.Exit(err, 1)
+		}
+		go health.Run(ctx)
+		go srv.WatchHealth(ctx)
+		if latency != nil {
+			go latency.Run(ctx)
+			go srv.WatchLatency(ctx)
 		}
-		s.Infof("Adding peer: %s", peerText)
+		if load != nil {
+			go load.Run(ctx)
+			go srv.WatchLoad(ctx)
+		}
+		if len(conditions) > 0 {
+			go func() {
+				if err := srv.WatchConditions(ctx); err != nil {
+					s.Errorf("Stopped watching conditions: %v", err)
+				}
+			}()
+		}
+		if hasGateways {
+			go func() {
+				if err := gateways.Run(ctx); err != nil {
+					s.Errorf("Stopped watching gateways: %v", err)
+				}
+			}()
+			go policyMgr.WatchGateways(ctx)
+		}
+
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+		go srv.WatchDatabase(ctx, cmd.Duration("dbReloadInterval"), hupCh)
 
-		if err := bgps.AddPeer(ctx, &api.AddPeerRequest{Peer: peer}); err != nil {
-			return cli.Exit(fmt.Errorf("failed to add peer: %w", err), 1)
+		go srv.WatchDrains(ctx)
+		if drainSignal != nil {
+			drainCh := make(chan os.Signal, 1)
+			signal.Notify(drainCh, drainSignal, undrainSignal)
+			defer signal.Stop(drainCh)
+			go srv.WatchDrainSignals(ctx, drainCh)
+		}
+		if path := cmd.String("drainFile"); path != "" {
+			go srv.WatchDrainFile(ctx, path, drainFileInterval)
 		}
 
-		for _, pol := range policies {
-			for _, pre := range pol.ASInfo.Prefixes {
-				if pre.Addr().Is4() {
-					nlri := &api.NLRI{Nlri: &api.NLRI_Prefix{Prefix: &api.IPAddressPrefix{
-						Prefix:    pre.Addr().String(),
-						PrefixLen: uint32(pre.Bits()),
-					}}}
-					attrs := []*api.Attribute{
-						{Attr: &api.Attribute_Origin{Origin: &api.OriginAttribute{
-							Origin: uint32(api.RouteOriginType_ORIGIN_IGP),
-						}}},
-						{Attr: &api.Attribute_NextHop{NextHop: &api.NextHopAttribute{
-							NextHop: pol.IP4NextHop.String(),
-						}}},
-						{Attr: &api.Attribute_AsPath{AsPath: &api.AsPathAttribute{
-							Segments: []*api.AsSegment{{
-								Type:    api.AsSegment_TYPE_AS_SEQUENCE,
-								Numbers: []uint32{pol.ASN},
-							}},
-						}}},
-					}
+		if listenAddr := cmd.String("listenHTTP"); listenAddr != "" {
+			renderOpts := render.DefaultOptions()
+			renderOpts.PACDefault = cmd.String("pacDefault")
+			renderOpts.PACMode = cmd.String("pacMode")
+			if renderOpts.PACMode != render.PACModeTable && renderOpts.PACMode != render.PACModeIsInNet {
+				return cli.Exit(fmt.Errorf("invalid PAC mode %q", renderOpts.PACMode), 1)
+			}
+			renderOpts.PACProxies, err = render.ParsePACProxies(cmd.StringSlice("pacProxy"))
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			if err := render.CheckPACProxies(renderOpts.PACProxies, policies); err != nil {
+				return cli.Exit(err, 1)
+			}
 
-					if _, err := bgps.AddPath(ctx, &api.AddPathRequest{
-						Path: &api.Path{
-							Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
-							Nlri:   nlri,
-							Pattrs: attrs,
-						},
-					}); err != nil {
-						return cli.Exit(fmt.Errorf("failed to add IPv4 path for ASN %d: %w", pol.ASN, err), 1)
-					}
-					s.Infof("Added IPv4 path %v for ASN %d (%s) with nexthop %s", pre, pol.ASN, pol.ASInfo.Organization, pol.IP4NextHop)
-				} else if pre.Addr().Is6() {
-					if !pol.IP6NextHop.IsValid() {
-						s.Debugf("Skipping IPv6 path for ASN %d (%s) because IPv6 nexthop is not configured", pol.ASN, pol.ASInfo.Organization)
-						continue
-					}
-					nlri := &api.NLRI{Nlri: &api.NLRI_Prefix{Prefix: &api.IPAddressPrefix{
-						Prefix:    pre.Addr().String(),
-						PrefixLen: uint32(pre.Bits()),
-					}}}
-					attrs := []*api.Attribute{
-						{Attr: &api.Attribute_Origin{Origin: &api.OriginAttribute{
-							Origin: uint32(api.RouteOriginType_ORIGIN_IGP),
-						}}},
-						{Attr: &api.Attribute_NextHop{NextHop: &api.NextHopAttribute{
-							NextHop: pol.IP6NextHop.String(),
-						}}},
-						{Attr: &api.Attribute_AsPath{AsPath: &api.AsPathAttribute{
-							Segments: []*api.AsSegment{{
-								Type:    api.AsSegment_TYPE_AS_SEQUENCE,
-								Numbers: []uint32{pol.ASN},
-							}},
-						}}},
-					}
+			ln, err := net.Listen("tcp", listenAddr)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("failed to listen HTTP on %q: %w", listenAddr, err), 1)
+			}
+			httpSrv := &http.Server{
+				Handler:           NewHTTPHandler(srv, renderOpts, s.Desugar()),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			go func() {
+				if err := httpSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					s.Errorf("HTTP server failed: %v", err)
+				}
+			}()
+			defer httpSrv.Close()
+			s.Infof("Serving prefix lists over HTTP on %s", ln.Addr())
+		}
 
-					if _, err := bgps.AddPath(ctx, &api.AddPathRequest{
-						Path: &api.Path{
-							Family: &api.Family{Afi: api.Family_AFI_IP6, Safi: api.Family_SAFI_UNICAST},
-							Nlri:   nlri,
-							Pattrs: attrs,
-						},
-					}); err != nil {
-						return cli.Exit(fmt.Errorf("failed to add IPv6 path for ASN %d: %w", pol.ASN, err), 1)
-					}
-					s.Infof("Added IPv6 path %v for ASN %d (%s) with nexthop %s", pre, pol.ASN, pol.ASInfo.Organization, pol.IP6NextHop)
-				} else {
-					s.Errorf("unsupported prefix address family %s for ASN %d", pre.Addr().String(), pol.ASN)
+		if listenAddr := cmd.String("listenAPI"); listenAddr != "" {
+			ln, err := listen(listenAddr)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("failed to listen for the management API on %q: %w", listenAddr, err), 1)
+			}
+			handler := NewAPIHandler(srv, policyMgr, peers, s.Desugar())
+			if tokenPath := cmd.String("apiTokenFile"); tokenPath != "" {
+				token, err := ReadToken(tokenPath)
+				if err != nil {
+					return cli.Exit(fmt.Errorf("failed to read the token of the management API: %w", err), 1)
+				}
+				handler = withToken(handler, token)
+			} else if !isLoopback(listenAddr) {
+				s.Warnf("The management API on %s is reachable from other hosts without authentication, so anyone reaching it can change the announced routes. Set --apiTokenFile or listen on a loopback address or Unix socket", listenAddr)
+			}
+			apiSrv := &http.Server{
+				Handler:           handler,
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			go func() {
+				if err := apiSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					s.Errorf("Management API server failed: %v", err)
+				}
+			}()
+			defer apiSrv.Close()
+			s.Infof("Serving the management API on %s", ln.Addr())
+		}
+
+		if listenAddr := cmd.String("listenMetrics"); listenAddr != "" {
+			ln, err := net.Listen("tcp", listenAddr)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("failed to listen for metrics on %q: %w", listenAddr, err), 1)
+			}
+			metricsSrv := &http.Server{
+				Handler:           NewMetricsHandler(srv, peers),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			go func() {
+				if err := metricsSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					s.Errorf("Metrics server failed: %v", err)
 				}
+			}()
+			defer metricsSrv.Close()
+			s.Infof("Serving metrics on %s", ln.Addr())
+		}
+
+		for _, peer := range bgpPeers {
+			s.Infof("Adding peer: %s", redactedText(peer))
+			if err := bgps.AddPeer(ctx, &api.AddPeerRequest{Peer: peer}); err != nil {
+				return cli.Exit(fmt.Errorf("failed to add peer %s: %w", peer.Conf.NeighborAddress, err), 1)
+			}
+		}
+		for _, g := range bgpGroups {
+			s.Infof("Adding peer group: %s", redactedText(g))
+			if err := bgps.AddPeerGroup(ctx, &api.AddPeerGroupRequest{PeerGroup: g}); err != nil {
+				return cli.Exit(fmt.Errorf("failed to add peer group %s: %w", g.Conf.PeerGroupName, err), 1)
+			}
+		}
+		for _, dn := range dynamicNeighbors {
+			s.Infof("Accepting peers of group %s from %s", dn.PeerGroup, dn.Prefix)
+			if err := bgps.AddDynamicNeighbor(ctx, &api.AddDynamicNeighborRequest{DynamicNeighbor: dn}); err != nil {
+				return cli.Exit(fmt.Errorf("failed to add dynamic neighbors %s: %w", dn.Prefix, err), 1)
 			}
 		}
 
 		<-ctx.Done()
+		s.Infof("Shutting down in %s mode", shutdownMode)
 
 		return nil
 	},
 }
+
+// gobgpServerOptions returns the options of the GoBGP gRPC server for the
+// TLS flags of cmd, and warns if the server is reachable from other hosts
+// without client authentication.
+func gobgpServerOptions(cmd *cli.Command, s *zap.SugaredLogger) ([]grpc.ServerOption, error) {
+	addr := cmd.String("listenGobgp")
+	certPath, keyPath, caPath := cmd.String("gobgpTLSCert"), cmd.String("gobgpTLSKey"), cmd.String("gobgpClientCA")
+	if (certPath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("--gobgpTLSCert and --gobgpTLSKey must be set together")
+	}
+	if caPath != "" && certPath == "" {
+		return nil, fmt.Errorf("--gobgpClientCA requires --gobgpTLSCert")
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	if path, ok := strings.CutPrefix(gobgpListenAddress(addr), "unix://"); ok {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, fmt.Errorf("GoBGP gRPC API: %w", err)
+		}
+	}
+
+	var opts []grpc.ServerOption
+	if certPath != "" {
+		cfg, err := serverTLSConfig(certPath, keyPath, caPath)
+		if err != nil {
+			return nil, fmt.Errorf("GoBGP gRPC API: %w", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+	if caPath == "" && !isLoopback(addr) {
+		s.Warnf("The GoBGP gRPC API on %s is reachable from other hosts without client certificate verification, so anyone reaching it can add or delete routes. Set --gobgpClientCA or listen on a loopback address or Unix socket", addr)
+	}
+	return opts, nil
+}
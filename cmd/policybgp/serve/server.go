@@ -0,0 +1,641 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/server"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/kernel"
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// ServerConfig configures a Server.
+type ServerConfig struct {
+	DBPath   string
+	Policies []*policy.Policy
+	// Disabled are the names of the disabled policies, which can be drained
+	// before they are enabled.
+	Disabled []string
+	// LocalASN is the ASN of the BGP speaker.
+	LocalASN uint32
+	// Health tracks the health of the nexthops. It may be nil if no nexthop
+	// is health checked.
+	Health *nexthop.Monitor
+	// Latency selects the nexthop of policies by latency. It may be nil.
+	Latency *nexthop.LatencyMonitor
+	// Load shifts policies to other nexthops while their links are busy. It
+	// may be nil.
+	Load *nexthop.LoadMonitor
+	// Conditions holds, by policy name, the prefixes which must all be
+	// received from the BGP peer for the routes of the policy to be announced.
+	Conditions map[string][]netip.Prefix
+	// Table receives the routes instead of the BGP RIB if set.
+	Table RouteTable
+	// Drain configures how the routes are drained.
+	Drain DrainConfig
+}
+
+// RouteTable is a routing table the routes are installed to instead of the
+// BGP RIB, such as a kernel routing table or the RIB of zebra.
+type RouteTable interface {
+	fmt.Stringer
+	// Sync installs, replaces and removes routes so that the table holds
+	// want.
+	Sync(want map[netip.Prefix]kernel.Route) (installed, removed int, err error)
+	// Len returns the number of routes installed.
+	Len() int
+	// Flush removes all routes installed.
+	Flush() (removed int, err error)
+}
+
+// Server keeps the paths in the BGP RIB, or the routes in a RouteTable, in
+// sync with the policies resolved against the latest database and
+// the health of their nexthops.
+type Server struct {
+	s    *zap.SugaredLogger
+	bgps *server.BgpServer
+	cfg  ServerConfig
+
+	// mu serializes reloads and guards the fields below.
+	mu     sync.Mutex
+	dbStat os.FileInfo
+	// asinfo is the database last loaded successfully, which policies added
+	// at runtime are resolved against.
+	asinfo   asinfo.ASInfoMap
+	resolved []*policy.Policy
+	// announced holds the paths of each prefix in the order they were
+	// installed, which is their order of preference.
+	announced map[netip.Prefix][]announcement
+	// received holds whether each prefix of the conditions is received from
+	// the BGP peer.
+	received map[netip.Prefix]bool
+	// closed is set once Shutdown is called.
+	closed bool
+	// drains holds the drained scopes.
+	drains map[DrainKey]Drain
+	// gshut holds the names of the policies whose paths are marked with
+	// GRACEFUL_SHUTDOWN.
+	gshut map[string]bool
+	// drainedPeers holds the addresses of each neighbor set of drained
+	// peers.
+	drainedPeers map[string][]string
+	// drainChanged is signaled when drains changes.
+	drainChanged chan struct{}
+
+	snap atomic.Pointer[Snapshot]
+	db   atomic.Pointer[DatabaseInfo]
+	// reloads and reloadFailures count the successful and failed loads of
+	// the database.
+	reloads        atomic.Uint64
+	reloadFailures atomic.Uint64
+}
+
+// DatabaseInfo describes the database last loaded successfully.
+type DatabaseInfo struct {
+	LoadedAt time.Time
+	ModTime  time.Time
+	Size     int64
+}
+
+func NewServer(bgps *server.BgpServer, cfg *ServerConfig, l *zap.Logger) *Server {
+	return &Server{
+		s:         l.Named("server").Sugar(),
+		bgps:      bgps,
+		cfg:       *cfg,
+		announced: make(map[netip.Prefix][]announcement),
+
+		drains:       make(map[DrainKey]Drain),
+		drainedPeers: make(map[string][]string),
+		drainChanged: make(chan struct{}, 1),
+	}
+}
+
+// Snapshot returns the latest Snapshot applied to the BGP RIB, or nil if the
+// database has not been loaded yet.
+func (srv *Server) Snapshot() *Snapshot {
+	return srv.snap.Load()
+}
+
+// Database returns the DatabaseInfo of the database last loaded
+// successfully, or nil if it has not been loaded yet.
+func (srv *Server) Database() *DatabaseInfo {
+	return srv.db.Load()
+}
+
+// Reloads returns the number of successful and failed loads of the database.
+func (srv *Server) Reloads() (succeeded, failed uint64) {
+	return srv.reloads.Load(), srv.reloadFailures.Load()
+}
+
+// Reload loads the database and applies the resulting routes to the BGP RIB.
+// Unless force is set, the database is only loaded if the file changed since
+// the last successful load. On error, the previously applied routes are kept.
+func (srv *Server) Reload(ctx context.Context, force bool) (err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	defer func() {
+		if err != nil {
+			srv.reloadFailures.Add(1)
+		}
+	}()
+
+	fi, err := os.Stat(srv.cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("error stating database %q: %w", srv.cfg.DBPath, err)
+	}
+	if !force && srv.dbStat != nil &&
+		fi.ModTime().Equal(srv.dbStat.ModTime()) && fi.Size() == srv.dbStat.Size() {
+		srv.s.Debugf("Database %q unchanged, skipping reload", srv.cfg.DBPath)
+		return nil
+	}
+
+	db, err := asinfo.ParseASInfoCSVFromFile(srv.cfg.DBPath, srv.s.Desugar())
+	if err != nil {
+		return err
+	}
+
+	resolved, err := srv.resolve(srv.cfg.Policies, db)
+	if err != nil {
+		return fmt.Errorf("database %q: %w", srv.cfg.DBPath, err)
+	}
+	for _, rpol := range resolved {
+		srv.s.Infof("Configuring policy: %d prefixes to ASN %d (%s) nexthops v4 %v and v6 %v",
+			len(rpol.ASInfo.Prefixes), rpol.ASN, rpol.ASInfo.Organization, rpol.IP4NextHops, rpol.IP6NextHops)
+	}
+
+	if err := srv.apply(ctx, resolved); err != nil {
+		return err
+	}
+
+	srv.dbStat = fi
+	srv.asinfo = db
+	srv.resolved = resolved
+	srv.db.Store(&DatabaseInfo{LoadedAt: time.Now(), ModTime: fi.ModTime(), Size: fi.Size()})
+	srv.reloads.Add(1)
+	return nil
+}
+
+// resolve returns pols resolved against db.
+func (srv *Server) resolve(pols []*policy.Policy, db asinfo.ASInfoMap) ([]*policy.Policy, error) {
+	resolved := make([]*policy.Policy, 0, len(pols))
+	for _, pol := range pols {
+		rpol := *pol
+		if err := rpol.Resolve(db); err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, &rpol)
+		if srv.cfg.Latency != nil {
+			srv.cfg.Latency.SetPrefixes(rpol.Name, rpol.ASInfo.Prefixes)
+		}
+	}
+	return resolved, nil
+}
+
+// Resync applies the policies resolved by the last successful reload again,
+// picking up the current health of their nexthops.
+func (srv *Server) Resync(ctx context.Context) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.resolved == nil {
+		return nil
+	}
+	return srv.apply(ctx, srv.resolved)
+}
+
+// apply syncs the BGP RIB with the resolved policies, after preferring the
+// nexthops selected by latency or shifted to by load, substituting the
+// nexthops according to their health, dropping the routes of policies whose
+// conditions are not met and draining, and publishes the resulting Snapshot.
+func (srv *Server) apply(ctx context.Context, resolved []*policy.Policy) error {
+	pols := resolved
+	if srv.cfg.Latency != nil {
+		lpols := make([]*policy.Policy, 0, len(pols))
+		for _, pol := range pols {
+			lpols = append(lpols, applyLatency(pol, srv.cfg.Latency))
+		}
+		pols = lpols
+	}
+	if srv.cfg.Load != nil {
+		lpols := make([]*policy.Policy, 0, len(pols))
+		for _, pol := range pols {
+			lpols = append(lpols, applyLoad(pol, srv.cfg.Load))
+		}
+		pols = lpols
+	}
+	if srv.cfg.Health != nil {
+		hpols := make([]*policy.Policy, 0, len(pols))
+		for _, pol := range pols {
+			hpols = append(hpols, applyHealth(pol, srv.cfg.Health))
+		}
+		pols = hpols
+	}
+
+	pols = srv.applyConditions(pols)
+	pols, srv.gshut = srv.drainPolicies(pols, time.Now())
+
+	if srv.closed {
+		return nil
+	}
+	syncRoutes := srv.syncPaths
+	if srv.cfg.Table != nil {
+		syncRoutes = srv.syncTable
+	}
+	if err := syncRoutes(ctx, pols); err != nil {
+		return err
+	}
+
+	srv.snap.Store(newSnapshot(pols, srv.snap.Load(), time.Now()))
+	return nil
+}
+
+// applyLatency returns pol with the nexthop latency selected for each
+// address family moved to the front, so that it is preferred while usable.
+func applyLatency(pol *policy.Policy, latency *nexthop.LatencyMonitor) *policy.Policy {
+	lpol := *pol
+	if nh, ok := latency.Selected(pol.Name, true); ok && slices.Contains(pol.IP4NextHops, nh) {
+		lpol.IP4NextHops = preferNextHop(pol.IP4NextHops, nh)
+	}
+	if nh, ok := latency.Selected(pol.Name, false); ok && slices.Contains(pol.IP6NextHops, nh) {
+		lpol.IP6NextHops = preferNextHop(pol.IP6NextHops, nh)
+	}
+	return &lpol
+}
+
+// applyLoad returns pol with the nexthops it is shifted to by load moved or
+// added to the front, so that they are preferred while usable. Address
+// families without nexthops are left alone.
+func applyLoad(pol *policy.Policy, load *nexthop.LoadMonitor) *policy.Policy {
+	to, ok := load.Shifted(pol.Name)
+	if !ok {
+		return pol
+	}
+
+	lpol := *pol
+	for _, nh := range slices.Backward(to) {
+		switch {
+		case nh.Is4() && len(lpol.IP4NextHops) > 0:
+			lpol.IP4NextHops = preferNextHop(lpol.IP4NextHops, nh)
+		case nh.Is6() && len(lpol.IP6NextHops) > 0:
+			lpol.IP6NextHops = preferNextHop(lpol.IP6NextHops, nh)
+		}
+	}
+	return &lpol
+}
+
+// preferNextHop returns nhs with nh moved, or added, to the front.
+func preferNextHop(nhs []netip.Addr, nh netip.Addr) []netip.Addr {
+	if len(nhs) > 0 && nhs[0] == nh {
+		return nhs
+	}
+	preferred := make([]netip.Addr, 0, len(nhs)+1)
+	preferred = append(preferred, nh)
+	for _, a := range nhs {
+		if a != nh {
+			preferred = append(preferred, a)
+		}
+	}
+	return preferred
+}
+
+// applyHealth returns pol with the nexthops of each address family replaced
+// by the ones health selects from them. The prefixes of an address family
+// without a usable nexthop are dropped, so that they are withdrawn.
+func applyHealth(pol *policy.Policy, health *nexthop.Monitor) *policy.Policy {
+	hpol := *pol
+	if pol.Weights != nil {
+		hpol.Weights = make(map[netip.Addr]uint32)
+	}
+
+	var ok4, ok6 bool
+	hpol.IP4NextHops, ok4 = selectNextHops(pol, pol.IP4NextHops, health, hpol.Weights)
+	hpol.IP6NextHops, ok6 = selectNextHops(pol, pol.IP6NextHops, health, hpol.Weights)
+	if !ok4 || !ok6 {
+		info := *pol.ASInfo
+		info.Prefixes = nil
+		for _, pre := range pol.ASInfo.Prefixes {
+			if pre.Addr().Is4() && ok4 || !pre.Addr().Is4() && ok6 {
+				info.Prefixes = append(info.Prefixes, pre)
+			}
+		}
+		hpol.ASInfo = &info
+	}
+	return &hpol
+}
+
+// selectNextHops returns the nexthops health selects from nhs of pol: the
+// first usable one, or every usable one if pol is multipath. The weights of
+// the nexthops are added to weights under the nexthops replacing them. It
+// returns false if nhs is not empty but none of its nexthops is usable.
+func selectNextHops(pol *policy.Policy, nhs []netip.Addr, health *nexthop.Monitor, weights map[netip.Addr]uint32) ([]netip.Addr, bool) {
+	if len(nhs) == 0 {
+		return nil, true
+	}
+
+	if !pol.Multipath {
+		nh, ok := health.Select(nhs)
+		if !ok {
+			return nil, false
+		}
+		return []netip.Addr{nh}, true
+	}
+
+	var selected []netip.Addr
+	for _, nh := range nhs {
+		r, ok := health.Resolve(nh)
+		if !ok {
+			continue
+		}
+		if !slices.Contains(selected, r) {
+			selected = append(selected, r)
+		}
+		if weights != nil {
+			weights[r] += pol.Weights[nh]
+		}
+	}
+	return selected, len(selected) > 0
+}
+
+// desiredPaths returns the paths to announce for each prefix of pols, in
+// order of preference. The paths of the policies in gshut are marked with
+// GRACEFUL_SHUTDOWN.
+func desiredPaths(pols []*policy.Policy, gshut map[string]bool) map[netip.Prefix][]announcement {
+	desired := make(map[netip.Prefix][]announcement)
+	for _, pol := range pols {
+		for _, pre := range pol.ASInfo.Prefixes {
+			nhs := pol.NextHopsFor(pre)
+			if !pol.Multipath && len(nhs) > 1 {
+				nhs = nhs[:1]
+			}
+
+			as := make([]announcement, 0, len(nhs))
+			for _, nh := range nhs {
+				as = append(as, announcement{NextHop: nh, ASN: pol.ASN, Weight: pol.Weights[nh], GracefulShutdown: gshut[pol.Name]})
+			}
+			desired[pre] = as
+		}
+	}
+	return desired
+}
+
+// syncPaths adds, replaces and withdraws paths in the BGP RIB so that it
+// matches the routes of pols.
+func (srv *Server) syncPaths(ctx context.Context, pols []*policy.Policy) error {
+	desired := desiredPaths(pols, srv.gshut)
+
+	var added, withdrawn int
+	for pre, want := range desired {
+		a, w, err := srv.syncPrefix(ctx, pre, want)
+		added += a
+		withdrawn += w
+		if err != nil {
+			return err
+		}
+	}
+	for pre := range srv.announced {
+		if _, ok := desired[pre]; ok {
+			continue
+		}
+		_, w, err := srv.syncPrefix(ctx, pre, nil)
+		withdrawn += w
+		if err != nil {
+			return err
+		}
+	}
+
+	srv.s.Infof("Synced BGP RIB: %d paths added or updated, %d withdrawn, %d prefixes announced in total",
+		added, withdrawn, len(srv.announced))
+	return nil
+}
+
+// syncTable installs, replaces and removes routes in the routing table so
+// that it matches the routes of pols.
+func (srv *Server) syncTable(ctx context.Context, pols []*policy.Policy) error {
+	want := make(map[netip.Prefix]kernel.Route)
+	for pre, as := range desiredPaths(pols, nil) {
+		var r kernel.Route
+		for _, a := range as {
+			r.NextHops = append(r.NextHops, kernel.NextHop{Addr: a.NextHop, Weight: a.Weight})
+		}
+		want[pre] = r
+	}
+
+	installed, removed, err := srv.cfg.Table.Sync(want)
+	srv.s.Infof("Synced %v: %d routes installed or updated, %d removed, %d routes in total",
+		srv.cfg.Table, installed, removed, srv.cfg.Table.Len())
+	return err
+}
+
+// Shutdown stops announcing and installing routes: later reloads and
+// resyncs do nothing. Unless keep is set, the routes are removed from the
+// routing table, or withdrawn from the BGP peers, waiting for wait for the
+// withdrawals to propagate before the BGP sessions are closed. If keep is
+// set, the routes are left in the routing table, or left for the BGP peers to
+// retain through Graceful Restart once the sessions drop.
+func (srv *Server) Shutdown(ctx context.Context, keep bool, wait time.Duration) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closed = true
+	if srv.cfg.Table != nil {
+		if keep {
+			srv.s.Infof("Keeping %d routes in the %v", srv.cfg.Table.Len(), srv.cfg.Table)
+			return nil
+		}
+		removed, err := srv.cfg.Table.Flush()
+		srv.s.Infof("Removed %d routes from the %v", removed, srv.cfg.Table)
+		return err
+	}
+
+	if keep {
+		srv.s.Infof("Keeping %d prefixes announced for the peers to retain through Graceful Restart", len(srv.announced))
+		return nil
+	}
+	if err := srv.syncPaths(ctx, nil); err != nil {
+		return err
+	}
+	if wait > 0 {
+		srv.s.Infof("Waiting %v for the withdrawals to propagate", wait)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+	return srv.bgps.StopBgp(ctx, &api.StopBgpRequest{})
+}
+
+// syncPrefix replaces the paths announced for pre with want, which are in
+// order of preference. The paths are identified by their rank, and are
+// updated starting from the most preferred one, so that peers without
+// ADD-PATH see at most a single in-place update of the best path.
+func (srv *Server) syncPrefix(ctx context.Context, pre netip.Prefix, want []announcement) (added, withdrawn int, err error) {
+	cur := srv.announced[pre]
+	defer func() {
+		if len(cur) == 0 {
+			delete(srv.announced, pre)
+		} else {
+			srv.announced[pre] = cur
+		}
+	}()
+
+	for i, a := range want {
+		if i < len(cur) && cur[i] == a {
+			continue
+		}
+
+		if _, err := srv.bgps.AddPath(ctx, &api.AddPathRequest{
+			Path: newPath(pre, i, a, srv.cfg.LocalASN),
+		}); err != nil {
+			return added, withdrawn, fmt.Errorf("failed to add path %v for ASN %d: %w", pre, a.ASN, err)
+		}
+		if i < len(cur) {
+			cur[i] = a
+		} else {
+			cur = append(cur, a)
+		}
+		added++
+		srv.s.Debugf("Added path %v for ASN %d with nexthop %s", pre, a.ASN, a.NextHop)
+	}
+
+	for len(cur) > len(want) {
+		i := len(cur) - 1
+		a := cur[i]
+		if err := srv.bgps.DeletePath(ctx, &api.DeletePathRequest{
+			Family: familyOf(pre),
+			Path:   newPath(pre, i, a, srv.cfg.LocalASN),
+		}); err != nil {
+			return added, withdrawn, fmt.Errorf("failed to withdraw path %v for ASN %d: %w", pre, a.ASN, err)
+		}
+		cur = cur[:i]
+		withdrawn++
+		srv.s.Debugf("Withdrew path %v for ASN %d with nexthop %s", pre, a.ASN, a.NextHop)
+	}
+	return added, withdrawn, nil
+}
+
+// WatchDatabase reloads the database whenever the file changes, checking
+// every interval, or unconditionally when a signal is received from sigCh.
+// It returns when ctx is done.
+func (srv *Server) WatchDatabase(ctx context.Context, interval time.Duration, sigCh <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case sig := <-sigCh:
+			srv.s.Infof("Received %v, reloading database", sig)
+			force = true
+		}
+
+		if err := srv.Reload(ctx, force); err != nil {
+			srv.s.Errorf("Failed to reload database, keeping the previous routes: %v", err)
+		}
+	}
+}
+
+// SetPolicies replaces the policies with pols, and the names of the disabled
+// ones with disabled, and applies them without reloading the database.
+// Policies may be added, changed and removed, and only the paths of the
+// prefixes whose routes changed are updated. The drains of removed policies
+// are dropped. On error, the previous policies are kept.
+func (srv *Server) SetPolicies(ctx context.Context, pols []*policy.Policy, disabled []string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.resolved == nil {
+		srv.cfg.Policies = pols
+		srv.cfg.Disabled = disabled
+		srv.dropDrains()
+		return nil
+	}
+
+	resolved, err := srv.resolve(pols, srv.asinfo)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidPolicy, err)
+	}
+	for _, rpol := range resolved {
+		srv.s.Infof("Updating policy for ASN %d: nexthops v4 %v and v6 %v", rpol.ASN, rpol.IP4NextHops, rpol.IP6NextHops)
+	}
+	if err := srv.apply(ctx, resolved); err != nil {
+		return err
+	}
+	srv.cfg.Policies = pols
+	srv.cfg.Disabled = disabled
+	srv.resolved = resolved
+	srv.dropDrains()
+	return nil
+}
+
+// Policies returns the policies currently configured.
+func (srv *Server) Policies() []*policy.Policy {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return slices.Clone(srv.cfg.Policies)
+}
+
+// WatchLatency resyncs the BGP RIB whenever the nexthop selected by latency
+// for a policy changes. It returns when ctx is done.
+func (srv *Server) WatchLatency(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-srv.cfg.Latency.Changed():
+		}
+
+		if err := srv.Resync(ctx); err != nil {
+			srv.s.Errorf("Failed to apply nexthop latency change: %v", err)
+		}
+	}
+}
+
+// WatchLoad resyncs the BGP RIB whenever a policy is shifted by load. It
+// returns when ctx is done.
+func (srv *Server) WatchLoad(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-srv.cfg.Load.Changed():
+		}
+
+		if err := srv.Resync(ctx); err != nil {
+			srv.s.Errorf("Failed to apply load shift: %v", err)
+		}
+	}
+}
+
+// WatchHealth resyncs the BGP RIB whenever a nexthop changes state. It
+// returns when ctx is done.
+func (srv *Server) WatchHealth(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-srv.cfg.Health.Changed():
+		}
+
+		if err := srv.Resync(ctx); err != nil {
+			srv.s.Errorf("Failed to apply nexthop health change: %v", err)
+		}
+	}
+}
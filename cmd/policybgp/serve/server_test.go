@@ -0,0 +1,420 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/server"
+	"go.uber.org/zap"
+)
+
+func newTestBgpServer(t *testing.T) *server.BgpServer {
+	t.Helper()
+
+	bgps := server.NewBgpServer(server.LoggerOption(&logAdapter{l: zap.NewNop().Sugar()}))
+	go bgps.Serve()
+	if err := bgps.StartBgp(context.Background(), &api.StartBgpRequest{
+		Global: &api.Global{Asn: 64513, RouterId: "10.64.51.3", ListenPort: -1},
+	}); err != nil {
+		t.Fatalf("Failed to start BGP server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = bgps.StopBgp(context.Background(), &api.StopBgpRequest{})
+	})
+	return bgps
+}
+
+// ribPaths returns the nexthops of the paths of pre in the global RIB, and
+// the nexthop of the best path.
+func ribPaths(t *testing.T, bgps *server.BgpServer, pre netip.Prefix) (nhs map[uint32]string, best string) {
+	t.Helper()
+
+	nhs = make(map[uint32]string)
+	if err := bgps.ListPath(context.Background(), &api.ListPathRequest{
+		TableType: api.TableType_GLOBAL,
+		Family:    familyOf(pre),
+	}, func(d *api.Destination) {
+		if d.Prefix != pre.String() {
+			return
+		}
+		for _, p := range d.Paths {
+			var nh string
+			for _, attr := range p.Pattrs {
+				if a := attr.GetNextHop(); a != nil {
+					nh = a.NextHop
+				}
+			}
+			nhs[p.Identifier] = nh
+			if p.Best {
+				best = nh
+			}
+		}
+	}); err != nil {
+		t.Fatalf("Failed to list paths: %v", err)
+	}
+	return nhs, best
+}
+
+func TestSyncPrefix(t *testing.T) {
+	bgps := newTestBgpServer(t)
+	srv := NewServer(bgps, &ServerConfig{LocalASN: 64513}, zap.NewNop())
+	pre := netip.MustParsePrefix("8.8.8.0/24")
+
+	a := announcement{NextHop: netip.MustParseAddr("192.168.1.1"), ASN: 15169}
+	b := announcement{NextHop: netip.MustParseAddr("192.168.2.1"), ASN: 15169}
+	c := announcement{NextHop: netip.MustParseAddr("192.168.3.1"), ASN: 15169}
+
+	steps := []struct {
+		name      string
+		want      []announcement
+		added     int
+		withdrawn int
+	}{
+		{name: "announce", want: []announcement{a, b}, added: 2},
+		{name: "unchanged", want: []announcement{a, b}},
+		{name: "append", want: []announcement{a, b, c}, added: 1},
+		{name: "reorder", want: []announcement{a, c, b}, added: 2},
+		{name: "replace best", want: []announcement{b, c}, added: 1, withdrawn: 1},
+		{name: "shrink", want: []announcement{b}, withdrawn: 1},
+		{name: "replace single", want: []announcement{a}, added: 1},
+		{name: "withdraw", want: nil, withdrawn: 1},
+	}
+
+	for _, step := range steps {
+		added, withdrawn, err := srv.syncPrefix(context.Background(), pre, step.want)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if added != step.added || withdrawn != step.withdrawn {
+			t.Errorf("%s: expected %d added and %d withdrawn, got %d and %d",
+				step.name, step.added, step.withdrawn, added, withdrawn)
+		}
+
+		nhs, best := ribPaths(t, bgps, pre)
+		if len(nhs) != len(step.want) {
+			t.Errorf("%s: expected %d paths, got %v", step.name, len(step.want), nhs)
+		}
+		for i, w := range step.want {
+			if nhs[uint32(i+1)] != w.NextHop.String() {
+				t.Errorf("%s: expected nexthop %s for path %d, got %q", step.name, w.NextHop, i+1, nhs[uint32(i+1)])
+			}
+		}
+		if len(step.want) > 0 && best != step.want[0].NextHop.String() {
+			t.Errorf("%s: expected best nexthop %s, got %q", step.name, step.want[0].NextHop, best)
+		}
+		if got := len(srv.announced[pre]); got != len(step.want) {
+			t.Errorf("%s: expected %d announced paths, got %d", step.name, len(step.want), got)
+		}
+	}
+}
+
+// newTestPeering starts a BGP server peering with bgps over loopback, and
+// returns it once the session is established. configure is applied to the
+// configuration of both peers.
+func newTestPeering(t *testing.T, bgps *server.BgpServer, addPath bool, configure ...func(*api.Peer)) *server.BgpServer {
+	t.Helper()
+	ctx := context.Background()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	rcv := server.NewBgpServer(server.LoggerOption(&logAdapter{l: zap.NewNop().Sugar()}))
+	go rcv.Serve()
+	if err := rcv.StartBgp(ctx, &api.StartBgpRequest{Global: &api.Global{
+		Asn:             64513,
+		RouterId:        "10.64.51.4",
+		ListenPort:      int32(port),
+		ListenAddresses: []string{"127.0.0.1"},
+	}}); err != nil {
+		t.Fatalf("Failed to start receiving BGP server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = rcv.StopBgp(context.Background(), &api.StopBgpRequest{})
+	})
+
+	afiSafis := func(addPaths *api.AddPathsConfig) []*api.AfiSafi {
+		return []*api.AfiSafi{{
+			Config:   &api.AfiSafiConfig{Family: familyOf(netip.MustParsePrefix("0.0.0.0/0"))},
+			AddPaths: &api.AddPaths{Config: addPaths},
+		}}
+	}
+	var sendMax uint32
+	if addPath {
+		sendMax = 8
+	}
+	rcvPeer := &api.Peer{
+		Conf:      &api.PeerConf{NeighborAddress: "127.0.0.1", PeerAsn: 64513},
+		Transport: &api.Transport{PassiveMode: true},
+		AfiSafis:  afiSafis(&api.AddPathsConfig{Receive: addPath}),
+	}
+	peer := &api.Peer{
+		Conf:      &api.PeerConf{NeighborAddress: "127.0.0.1", PeerAsn: 64513},
+		Transport: &api.Transport{RemotePort: uint32(port), LocalAddress: "127.0.0.1"},
+		Timers:    &api.Timers{Config: &api.TimersConfig{ConnectRetry: 1}},
+		AfiSafis:  afiSafis(&api.AddPathsConfig{SendMax: sendMax}),
+	}
+	for _, f := range configure {
+		f(rcvPeer)
+		f(peer)
+	}
+	if err := rcv.AddPeer(ctx, &api.AddPeerRequest{Peer: rcvPeer}); err != nil {
+		t.Fatalf("Failed to add peer to receiving BGP server: %v", err)
+	}
+	if err := bgps.AddPeer(ctx, &api.AddPeerRequest{Peer: peer}); err != nil {
+		t.Fatalf("Failed to add peer: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var state api.PeerState_SessionState
+		if err := rcv.ListPeer(ctx, &api.ListPeerRequest{}, func(p *api.Peer) {
+			state = p.State.SessionState
+		}); err != nil {
+			t.Fatalf("Failed to list peers: %v", err)
+		}
+		if state == api.PeerState_ESTABLISHED {
+			return rcv
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("BGP session not established, state %v", state)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestExportedPaths(t *testing.T) {
+	pre := netip.MustParsePrefix("8.8.8.0/24")
+	a := announcement{NextHop: netip.MustParseAddr("192.168.1.1"), ASN: 15169, Weight: 3}
+	b := announcement{NextHop: netip.MustParseAddr("192.168.2.1"), ASN: 15169, Weight: 1}
+
+	for _, addPath := range []bool{true, false} {
+		t.Run(fmt.Sprintf("addPath=%v", addPath), func(t *testing.T) {
+			bgps := newTestBgpServer(t)
+			if err := setupExportPolicy(context.Background(), bgps, nil); err != nil {
+				t.Fatalf("Failed to set up export policy: %v", err)
+			}
+			rcv := newTestPeering(t, bgps, addPath)
+
+			srv := NewServer(bgps, &ServerConfig{LocalASN: 64513}, zap.NewNop())
+			if _, _, err := srv.syncPrefix(context.Background(), pre, []announcement{b, a}); err != nil {
+				t.Fatalf("Failed to sync: %v", err)
+			}
+			// Swap the preference to check that peers follow updates in place.
+			if _, _, err := srv.syncPrefix(context.Background(), pre, []announcement{a, b}); err != nil {
+				t.Fatalf("Failed to sync: %v", err)
+			}
+
+			want := map[string]float32{"192.168.1.1": 3}
+			if addPath {
+				want["192.168.2.1"] = 1
+			}
+
+			var got map[string]float32
+			deadline := time.Now().Add(10 * time.Second)
+			for time.Now().Before(deadline) {
+				got = make(map[string]float32)
+				if err := rcv.ListPath(context.Background(), &api.ListPathRequest{
+					TableType: api.TableType_GLOBAL,
+					Family:    familyOf(pre),
+				}, func(d *api.Destination) {
+					for _, p := range d.Paths {
+						var nh string
+						var bw float32
+						for _, attr := range p.Pattrs {
+							if lp := attr.GetLocalPref(); lp != nil && lp.LocalPref != localPrefBest {
+								t.Errorf("Expected LOCAL_PREF %d, got %d", localPrefBest, lp.LocalPref)
+							}
+							if a := attr.GetNextHop(); a != nil {
+								nh = a.NextHop
+							}
+							if ec := attr.GetExtendedCommunities(); ec != nil {
+								for _, c := range ec.Communities {
+									if lb := c.GetLinkBandwidth(); lb != nil {
+										bw = lb.Bandwidth
+									}
+								}
+							}
+						}
+						got[nh] = bw
+					}
+				}); err != nil {
+					t.Fatalf("Failed to list paths: %v", err)
+				}
+				if maps.Equal(got, want) {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			t.Errorf("Expected received nexthops and bandwidths %v, got %v", want, got)
+		})
+	}
+}
+
+func TestSetPolicies(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	if err := os.WriteFile(dbPath, []byte("8.8.8.0,8.8.8.255,15169,Google LLC\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	parse := func(s string) []*policy.Policy {
+		pols, err := policy.ParseAll([]string{s}, nil)
+		if err != nil {
+			t.Fatalf("Failed to parse policy: %v", err)
+		}
+		return pols
+	}
+
+	bgps := newTestBgpServer(t)
+	srv := NewServer(bgps, &ServerConfig{
+		DBPath:   dbPath,
+		Policies: parse("15169,192.168.1.1"),
+		LocalASN: 64513,
+	}, zap.NewNop())
+	if err := srv.Reload(context.Background(), true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	pre := netip.MustParsePrefix("8.8.8.0/24")
+	if _, best := ribPaths(t, bgps, pre); best != "192.168.1.1" {
+		t.Errorf("Expected best nexthop 192.168.1.1, got %q", best)
+	}
+
+	if err := srv.SetPolicies(context.Background(), parse("15169,192.168.2.1"), nil); err != nil {
+		t.Fatalf("Failed to set policies: %v", err)
+	}
+	if _, best := ribPaths(t, bgps, pre); best != "192.168.2.1" {
+		t.Errorf("Expected best nexthop 192.168.2.1, got %q", best)
+	}
+
+	// A gateway without address withdraws the routes.
+	if err := srv.SetPolicies(context.Background(), parse("15169,"), nil); err != nil {
+		t.Fatalf("Failed to set policies: %v", err)
+	}
+	if nhs, _ := ribPaths(t, bgps, pre); len(nhs) != 0 {
+		t.Errorf("Expected no paths, got %v", nhs)
+	}
+
+	// Reloading the database keeps the nexthops.
+	if err := srv.SetPolicies(context.Background(), parse("15169,192.168.3.1"), nil); err != nil {
+		t.Fatalf("Failed to set policies: %v", err)
+	}
+	if err := srv.Reload(context.Background(), true); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if _, best := ribPaths(t, bgps, pre); best != "192.168.3.1" {
+		t.Errorf("Expected best nexthop 192.168.3.1, got %q", best)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.csv")
+	if err := os.WriteFile(dbPath, []byte("8.8.8.0,8.8.8.255,15169,Google LLC\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	pols, err := policy.ParseAll([]string{"15169,192.168.1.1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	pre := netip.MustParsePrefix("8.8.8.0/24")
+
+	for _, keep := range []bool{true, false} {
+		t.Run(fmt.Sprintf("keep=%v", keep), func(t *testing.T) {
+			bgps := newTestBgpServer(t)
+			srv := NewServer(bgps, &ServerConfig{DBPath: dbPath, Policies: pols, LocalASN: 64513}, zap.NewNop())
+			if err := srv.Reload(context.Background(), true); err != nil {
+				t.Fatalf("Failed to reload: %v", err)
+			}
+			if err := srv.Shutdown(context.Background(), keep, 0); err != nil {
+				t.Fatalf("Failed to shut down: %v", err)
+			}
+
+			// The BGP server is stopped once the paths are withdrawn.
+			want := 0
+			if keep {
+				want = 1
+				if nhs, _ := ribPaths(t, bgps, pre); len(nhs) != 1 {
+					t.Errorf("Expected the path kept, got %v", nhs)
+				}
+			}
+			if got := len(srv.announced); got != want {
+				t.Errorf("Expected %d announced prefixes, got %d", want, got)
+			}
+
+			// Later changes are ignored.
+			if err := srv.SetPolicies(context.Background(), nil, nil); err != nil {
+				t.Fatalf("Failed to set policies: %v", err)
+			}
+			if got := len(srv.announced); got != want {
+				t.Errorf("Expected %d announced prefixes after shutdown, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestGracefulRestart(t *testing.T) {
+	for _, restarting := range []bool{false, true} {
+		t.Run(fmt.Sprintf("restarting=%v", restarting), func(t *testing.T) {
+			bgps := newTestBgpServer(t)
+			if err := setupExportPolicy(context.Background(), bgps, nil); err != nil {
+				t.Fatalf("Failed to set up export policy: %v", err)
+			}
+			pre := netip.MustParsePrefix("8.8.8.0/24")
+			srv := NewServer(bgps, &ServerConfig{LocalASN: 64513}, zap.NewNop())
+			if _, _, err := srv.syncPrefix(context.Background(), pre, []announcement{
+				{NextHop: netip.MustParseAddr("192.168.1.1"), ASN: 15169},
+			}); err != nil {
+				t.Fatalf("Failed to sync: %v", err)
+			}
+
+			// When restarting, both peers are, as when both speakers
+			// started at once.
+			rcv := newTestPeering(t, bgps, false, func(p *api.Peer) {
+				enableGracefulRestart(p, 120*time.Second, 60*time.Second, restarting)
+			})
+
+			var restartTime uint32
+			if err := rcv.ListPeer(context.Background(), &api.ListPeerRequest{}, func(p *api.Peer) {
+				restartTime = p.GetGracefulRestart().GetPeerRestartTime()
+			}); err != nil {
+				t.Fatalf("Failed to list peers: %v", err)
+			}
+			if restartTime != 120 {
+				t.Errorf("Expected the restart time 120 received, got %d", restartTime)
+			}
+
+			// The paths are sent right away on a cold start, and once the
+			// End-of-RIB markers are exchanged when restarting.
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				var n int
+				if err := rcv.ListPath(context.Background(), &api.ListPathRequest{
+					TableType: api.TableType_GLOBAL,
+					Family:    familyOf(pre),
+				}, func(d *api.Destination) {
+					n += len(d.Paths)
+				}); err != nil {
+					t.Fatalf("Failed to list paths: %v", err)
+				}
+				if n == 1 {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected the path received, got %d paths", n)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package serve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/IPA-CyberLab/policybgp/config"
+	"github.com/IPA-CyberLab/policybgp/policy"
+	"github.com/IPA-CyberLab/policybgp/render"
+)
+
+// Snapshot is an immutable view of the policies resolved against a database,
+// as announced to the BGP peer.
+type Snapshot struct {
+	Policies []*policy.Policy
+	// ModTimes holds the time the routes of each policy (by name) last changed.
+	ModTimes map[string]time.Time
+	LoadedAt time.Time
+
+	renderMu sync.Mutex
+	rendered map[renderKey]*renderedDoc
+}
+
+type renderKey struct {
+	policy    string // empty for all policies
+	format    string
+	aggregate bool
+}
+
+// renderedDoc is a cached rendering of (some of) the policies of a Snapshot.
+type renderedDoc struct {
+	Body    []byte
+	ETag    string
+	ModTime time.Time
+}
+
+// routesFingerprint returns a digest of the routes of pol, used to tell
+// whether the routes changed across reloads.
+func routesFingerprint(pol *policy.Policy) [sha256.Size]byte {
+	h := sha256.New()
+	for _, nh := range slices.Concat(pol.IP4NextHops, pol.IP6NextHops) {
+		b, _ := nh.MarshalBinary()
+		h.Write(b)
+	}
+	for _, pre := range pol.ASInfo.Prefixes {
+		b, _ := pre.MarshalBinary()
+		h.Write(b)
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// announcedPolicy returns pol with the prefixes which are not announced, as
+// their address family has no nexthop, left out. The nexthops depending on
+// the peer are left out as well, as they are placeholders rather than
+// addresses, so that the routes via them are only rendered as prefixes.
+func announcedPolicy(pol *policy.Policy) *policy.Policy {
+	info := *pol.ASInfo
+	info.Prefixes = nil
+	for _, pre := range pol.ASInfo.Prefixes {
+		if len(pol.NextHopsFor(pre)) > 0 {
+			info.Prefixes = append(info.Prefixes, pre)
+		}
+	}
+	apol := *pol
+	apol.ASInfo = &info
+	apol.IP4NextHops = slices.DeleteFunc(slices.Clone(pol.IP4NextHops), config.IsPlaceholder)
+	apol.IP6NextHops = slices.DeleteFunc(slices.Clone(pol.IP6NextHops), config.IsPlaceholder)
+	return &apol
+}
+
+// newSnapshot returns the Snapshot of the routes announced for pols. The
+// modification times of the policies whose routes did not change since prev
+// are carried over.
+func newSnapshot(pols []*policy.Policy, prev *Snapshot, now time.Time) *Snapshot {
+	snap := &Snapshot{
+		Policies: make([]*policy.Policy, 0, len(pols)),
+		ModTimes: make(map[string]time.Time, len(pols)),
+		LoadedAt: now,
+		rendered: make(map[renderKey]*renderedDoc),
+	}
+	for _, pol := range pols {
+		snap.Policies = append(snap.Policies, announcedPolicy(pol))
+	}
+
+	prevPols := make(map[string]*policy.Policy)
+	if prev != nil {
+		for _, pol := range prev.Policies {
+			prevPols[pol.Name] = pol
+		}
+	}
+	for _, pol := range snap.Policies {
+		snap.ModTimes[pol.Name] = now
+		if p := prevPols[pol.Name]; p != nil && routesFingerprint(p) == routesFingerprint(pol) {
+			snap.ModTimes[pol.Name] = prev.ModTimes[pol.Name]
+		}
+	}
+
+	return snap
+}
+
+// FindPolicy returns the policy named name, or nil if there is none.
+func (snap *Snapshot) FindPolicy(name string) *policy.Policy {
+	for _, pol := range snap.Policies {
+		if pol.Name == name {
+			return pol
+		}
+	}
+	return nil
+}
+
+// Render returns the rendering of the policy named polName (or all policies
+// if empty) in format. Renderings are cached for the lifetime of the Snapshot,
+// so opts must not change other than opts.Aggregate.
+func (snap *Snapshot) Render(polName, format string, opts *render.Options) (*renderedDoc, error) {
+	key := renderKey{polName, format, opts.Aggregate}
+
+	snap.renderMu.Lock()
+	defer snap.renderMu.Unlock()
+
+	if doc := snap.rendered[key]; doc != nil {
+		return doc, nil
+	}
+
+	pols := snap.Policies
+	if polName != "" {
+		pol := snap.FindPolicy(polName)
+		if pol == nil {
+			return nil, fmt.Errorf("policy %q not found", polName)
+		}
+		pols = []*policy.Policy{pol}
+	}
+
+	var modTime time.Time
+	for _, pol := range pols {
+		if t := snap.ModTimes[pol.Name]; t.After(modTime) {
+			modTime = t
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := render.Render(&buf, format, pols, opts); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	doc := &renderedDoc{
+		Body:    buf.Bytes(),
+		ETag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+		ModTime: modTime,
+	}
+	snap.rendered[key] = doc
+	return doc, nil
+}
@@ -0,0 +1,232 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v3"
+
+	"github.com/IPA-CyberLab/policybgp/cmd/policybgp/serve"
+)
+
+// DefaultAPI is the management API address the status is fetched from by
+// default.
+const DefaultAPI = "unix:/run/policybgp.sock"
+
+var Command = &cli.Command{
+	Name:  "status",
+	Usage: "Show the peers, policies, nexthops and database of a running serve instance",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "api",
+			Usage: "Address of the management API of serve (--listenAPI). Format: unix:<path> or <host>:<port>",
+			Value: DefaultAPI,
+		},
+		&cli.StringFlag{
+			Name:  "tokenFile",
+			Usage: "Authenticate with the bearer token read from this file (--apiTokenFile of serve)",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the status as JSON",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Timeout of the request to the management API",
+			Value: 10 * time.Second,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		ctx, cancel := context.WithTimeout(ctx, cmd.Duration("timeout"))
+		defer cancel()
+
+		var token string
+		if tokenPath := cmd.String("tokenFile"); tokenPath != "" {
+			var err error
+			token, err = serve.ReadToken(tokenPath)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("failed to read the token: %w", err), 1)
+			}
+		}
+
+		addr := cmd.String("api")
+		body, err := fetch(ctx, addr, "/api/v1/status", token)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("failed to get the status from %q: %w", addr, err), 1)
+		}
+		if cmd.Bool("json") {
+			_, err := cmd.Writer.Write(body)
+			return err
+		}
+
+		var st serve.StatusResponse
+		if err := json.Unmarshal(body, &st); err != nil {
+			return cli.Exit(fmt.Errorf("invalid status from %q: %w", addr, err), 1)
+		}
+		return Print(cmd.Writer, &st, time.Now())
+	},
+}
+
+// fetch returns the body of a GET request of path to the management API at
+// addr, which is either unix:<path> or <host>:<port>, authenticating with
+// token unless it is empty.
+func fetch(ctx context.Context, addr, path, token string) ([]byte, error) {
+	tr := &http.Transport{}
+	if sock, ok := strings.CutPrefix(addr, "unix:"); ok {
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+		addr = "localhost"
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return body, nil
+}
+
+// Print writes st as tables to w, with the durations relative to now.
+func Print(w io.Writer, st *serve.StatusResponse, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "PEER\tSTATE\tSINCE")
+	if len(st.Peers) == 0 {
+		fmt.Fprintln(tw, "(none)\t\t")
+	}
+	for _, p := range st.Peers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Address, p.State, ago(now, p.Since))
+	}
+
+	fmt.Fprintln(tw, "\nPOLICY\tSTATE\tORGANIZATION\tNEXTHOPS\tIPV4\tIPV6")
+	if len(st.Policies) == 0 {
+		fmt.Fprintln(tw, "(none)\t\t\t\t\t")
+	}
+	for _, p := range st.Policies {
+		state := "disabled"
+		if p.Enabled {
+			state = "enabled"
+		}
+		if !p.Persistent {
+			state += " (flag)"
+		}
+		nhs, ip4, ip6 := "-", "-", "-"
+		if p.ActiveNextHops != nil {
+			nhs = addrs(p.ActiveNextHops.IPv4, p.ActiveNextHops.IPv6)
+		}
+		if p.Routes != nil {
+			ip4, ip6 = fmt.Sprint(p.Routes.IPv4), fmt.Sprint(p.Routes.IPv6)
+		}
+		org := p.Organization
+		if org == "" {
+			org = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, state, org, nhs, ip4, ip6)
+	}
+
+	if len(st.Drains) > 0 {
+		fmt.Fprintln(tw, "\nDRAINED\tSTATE\tSINCE\tSOURCES")
+		for _, d := range st.Drains {
+			state := "graceful shutdown"
+			if d.Withdrawn {
+				state = "withdrawn"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.DrainKey, state, ago(now, d.Since), strings.Join(d.Sources, ","))
+		}
+	}
+
+	if len(st.NextHops) > 0 {
+		fmt.Fprintln(tw, "\nNEXTHOP\tHEALTH\tSINCE\tLAST ERROR")
+		for _, nh := range st.NextHops {
+			health := "down"
+			if nh.Up {
+				health = "up"
+			}
+			lastErr := nh.LastError
+			if lastErr == "" {
+				lastErr = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", nh.Address, health, ago(now, nh.Since), lastErr)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	if db := st.Database; db != nil {
+		fmt.Fprintf(w, "Database: %s\n", db.Path)
+		fmt.Fprintf(w, "  Modified: %s (%s ago)\n", db.Modified.Local().Format(time.RFC3339), ago(now, db.Modified))
+		fmt.Fprintf(w, "  Loaded:   %s (%s ago)\n", db.LoadedAt.Local().Format(time.RFC3339), ago(now, db.LoadedAt))
+		fmt.Fprintf(w, "  Size:     %d bytes\n", db.Size)
+		_, err := fmt.Fprintf(w, "  Reloads:  %d succeeded, %d failed\n", db.Reloads, db.Failures)
+		return err
+	}
+	_, err := fmt.Fprintln(w, "Database: not loaded")
+	return err
+}
+
+func addrs(ip4, ip6 []netip.Addr) string {
+	var ss []string
+	for _, a := range slices.Concat(ip4, ip6) {
+		ss = append(ss, a.String())
+	}
+	if len(ss) == 0 {
+		return "-"
+	}
+	return strings.Join(ss, ",")
+}
+
+// ago returns the time elapsed from t to now, such as 3d4h or 12m5s.
+func ago(now, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := now.Sub(t).Truncate(time.Second)
+	if d < 0 {
+		d = 0
+	}
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, d/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, d%time.Hour/time.Minute)
+	default:
+		return d.String()
+	}
+}
@@ -0,0 +1,108 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IPA-CyberLab/policybgp/cmd/policybgp/serve"
+)
+
+func TestAgo(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Time{}, "-"},
+		{now, "0s"},
+		{now.Add(-90 * time.Second), "1m30s"},
+		{now.Add(-(2*time.Hour + 5*time.Minute + 3*time.Second)), "2h5m"},
+		{now.Add(-(50*time.Hour + 30*time.Minute)), "2d2h"},
+		{now.Add(time.Minute), "0s"},
+	} {
+		if got := ago(now, tc.t); got != tc.want {
+			t.Errorf("Expected %q for %v, got %q", tc.want, now.Sub(tc.t), got)
+		}
+	}
+}
+
+func TestFetchAndPrint(t *testing.T) {
+	now := time.Now()
+	st := serve.StatusResponse{
+		Peers: []serve.PeerEntry{{Address: "192.168.0.1", State: "established", Since: now.Add(-time.Hour)}},
+		Policies: []serve.PolicyEntry{
+			{
+				Name: "as15169", ASN: 15169, Enabled: true, Persistent: true, Organization: "Google LLC",
+				ActiveNextHops: &serve.NextHopsEntry{IPv4: []netip.Addr{netip.MustParseAddr("192.168.1.1")}},
+				Routes:         &serve.RoutesEntry{IPv4: 42},
+			},
+			{Name: "as2906", ASN: 2906},
+		},
+		NextHops: []serve.NextHopEntry{{Address: netip.MustParseAddr("192.168.1.1"), Up: false, Since: now, LastError: "timeout"}},
+		Database: &serve.DatabaseEntry{Path: "/var/lib/dbip.csv", Modified: now, LoadedAt: now, Size: 1234, Reloads: 3},
+	}
+
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	hs := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "unauthorized"}`))
+			return
+		}
+		if r.URL.Path != "/api/v1/status" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(st)
+	}))
+	hs.Listener = ln
+	hs.Start()
+	defer hs.Close()
+
+	if _, err := fetch(context.Background(), "unix:"+sock, "/api/v1/status", ""); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("Expected unauthorized without the token, got %v", err)
+	}
+	body, err := fetch(context.Background(), "unix:"+sock, "/api/v1/status", "secret")
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	var got serve.StatusResponse
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if _, err := fetch(context.Background(), "unix:"+sock, "/nonexistent", "secret"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected the error of the API, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Print(&buf, &got, now); err != nil {
+		t.Fatalf("Failed to print: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"192.168.0.1  established  1h0m",
+		"as15169  enabled          Google LLC    192.168.1.1  42    0",
+		"as2906   disabled (flag)  -             -            -     -",
+		"192.168.1.1  down    0s     timeout",
+		"Database: /var/lib/dbip.csv",
+		"3 succeeded, 0 failed",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in the output, got:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// Package config loads the configuration file defining the nexthops policies
+// refer to by name, overrides of them for each site, the policies, and the
+// BGP peers.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// Config is the content of a configuration file.
+type Config struct {
+	// NextHops maps the names policies refer to to nexthops.
+	NextHops map[string]*NextHop `yaml:"nexthops"`
+	// Sites holds the overrides of the nexthops for each site sharing the
+	// configuration, such as branches connected to different ISPs.
+	Sites map[string]*Site `yaml:"sites"`
+	// Policies are parsed like the --policy flag.
+	Policies []string `yaml:"policies"`
+	// DisabledPolicies are policies which are defined but not announced,
+	// such as those disabled through the management API.
+	DisabledPolicies []string `yaml:"disabledPolicies"`
+	// Peers are the BGP peers, in addition to the one of the --peer flag.
+	Peers []*Peer `yaml:"peers"`
+	// PeerGroups are the groups of BGP peers by name.
+	PeerGroups map[string]*PeerGroup `yaml:"peerGroups"`
+}
+
+// NextHop is a gateway with an IPv4 address, an IPv6 address or both, which
+// are either static or learned from the kernel.
+type NextHop struct {
+	Description string     `yaml:"description"`
+	IP4         netip.Addr `yaml:"ip4"`
+	IP6         netip.Addr `yaml:"ip6"`
+	// Gateway learns the addresses from the kernel instead of ip4 and ip6.
+	Gateway *Gateway `yaml:"gateway"`
+	// ExtendedNexthop routes IPv4 via the IPv6 address while the nexthop has
+	// no IPv4 address (RFC 8950), as on an IPv6-only underlay. It is a
+	// pointer so that sites can unset it.
+	ExtendedNexthop *bool `yaml:"extendedNexthop"`
+	// HealthCheck checks both addresses at once. It is optional.
+	HealthCheck *HealthCheck `yaml:"healthCheck"`
+}
+
+// Gateway selects the default route the addresses of a nexthop are learned
+// from. See nexthop.Gateway.
+type Gateway struct {
+	Interface string `yaml:"interface"`
+	Table     int    `yaml:"table"`
+}
+
+// HealthCheck is the health check of a nexthop. Unset fields take their
+// defaults from nexthop.DefaultCheckConfig.
+type HealthCheck struct {
+	Method    string        `yaml:"method"`
+	Target    string        `yaml:"target"`
+	Source    netip.Addr    `yaml:"source"`
+	Interface string        `yaml:"interface"`
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Rise      int           `yaml:"rise"`
+	Fall      int           `yaml:"fall"`
+	HoldDown  time.Duration `yaml:"holdDown"`
+}
+
+// Site overrides the nexthops of the configuration. The fields set on a
+// nexthop of a site replace those of the nexthop of the same name, and
+// nexthops not defined globally are added. Setting a gateway replaces the
+// static addresses and vice versa.
+type Site struct {
+	Description string              `yaml:"description"`
+	NextHops    map[string]*NextHop `yaml:"nexthops"`
+}
+
+var nameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// Load reads the configuration file at path and applies the overrides of
+// site, unless site is empty. An empty path yields an empty configuration.
+func Load(path, site string) (*Config, error) {
+	if path == "" {
+		if site != "" {
+			return nil, fmt.Errorf("site %q requires a configuration file", site)
+		}
+		return &Config{}, nil
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	c, err := Parse(bs, site)
+	if err != nil {
+		return nil, fmt.Errorf("configuration %q: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse parses a configuration and applies the overrides of site, unless
+// site is empty.
+func Parse(bs []byte, site string) (*Config, error) {
+	c := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(bs))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if site != "" {
+		s, ok := c.Sites[site]
+		if !ok || s == nil {
+			return nil, fmt.Errorf("unknown site %q", site)
+		}
+		if c.NextHops == nil && len(s.NextHops) > 0 {
+			c.NextHops = make(map[string]*NextHop, len(s.NextHops))
+		}
+		for name, o := range s.NextHops {
+			if o == nil {
+				continue
+			}
+			nh := &NextHop{}
+			if orig := c.NextHops[name]; orig != nil {
+				*nh = *orig
+			}
+			nh.override(o)
+			c.NextHops[name] = nh
+		}
+	}
+
+	for name, nh := range c.NextHops {
+		if !nameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid nexthop name %q. Names must start with a letter and consist of letters, digits, \"_\", \".\" and \"-\"", name)
+		}
+		if name == NextHopPeer || name == NextHopSelf {
+			return nil, fmt.Errorf("nexthop name %q is reserved", name)
+		}
+		if nh == nil || !nh.IP4.IsValid() && !nh.IP6.IsValid() && nh.Gateway == nil {
+			return nil, fmt.Errorf("nexthop %q has no address", name)
+		}
+		if nh.Gateway != nil {
+			if nh.IP4.IsValid() || nh.IP6.IsValid() {
+				return nil, fmt.Errorf("nexthop %q has both addresses and a gateway", name)
+			}
+			if nh.Gateway.Interface == "" && nh.Gateway.Table == 0 {
+				return nil, fmt.Errorf("gateway of nexthop %q requires an interface, a table or both", name)
+			}
+			if nh.Gateway.Table < 0 {
+				return nil, fmt.Errorf("invalid table %d of nexthop %q", nh.Gateway.Table, name)
+			}
+			if nh.HealthCheck != nil {
+				return nil, fmt.Errorf("nexthop %q with a gateway cannot be health checked. Its routes are withdrawn while it has no default route", name)
+			}
+		}
+		if nh.IP4.IsValid() && !nh.IP4.Is4() {
+			return nil, fmt.Errorf("ip4 %s of nexthop %q is not an IPv4 address", nh.IP4, name)
+		}
+		if nh.IP6.IsValid() && !nh.IP6.Is6() {
+			return nil, fmt.Errorf("ip6 %s of nexthop %q is not an IPv6 address", nh.IP6, name)
+		}
+		if nh.extendedNexthop() && nh.Gateway == nil && !nh.IP6.IsValid() {
+			return nil, fmt.Errorf("extendedNexthop of nexthop %q requires ip6", name)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.PeerGroups)) {
+		if err := c.PeerGroups[name].validate(name); err != nil {
+			return nil, err
+		}
+	}
+	peers := make(map[netip.Addr]bool, len(c.Peers))
+	for i, p := range c.Peers {
+		if err := p.validate(i, c.PeerGroups); err != nil {
+			return nil, err
+		}
+		if peers[p.Address] {
+			return nil, fmt.Errorf("duplicate peer %s", p.Address)
+		}
+		peers[p.Address] = true
+	}
+	if err := checkNeighbors(c.PeerGroups, c.Peers); err != nil {
+		return nil, err
+	}
+	if err := c.checkSites(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// override replaces the fields of nh set in o.
+func (nh *NextHop) override(o *NextHop) {
+	if o.Description != "" {
+		nh.Description = o.Description
+	}
+	if o.IP4.IsValid() || o.IP6.IsValid() {
+		nh.Gateway = nil
+	}
+	if o.IP4.IsValid() {
+		nh.IP4 = o.IP4
+	}
+	if o.IP6.IsValid() {
+		nh.IP6 = o.IP6
+	}
+	if o.Gateway != nil {
+		nh.IP4, nh.IP6 = netip.Addr{}, netip.Addr{}
+		nh.Gateway = o.Gateway
+	}
+	if o.HealthCheck != nil {
+		nh.HealthCheck = o.HealthCheck
+	}
+	if o.ExtendedNexthop != nil {
+		nh.ExtendedNexthop = o.ExtendedNexthop
+	}
+}
+
+// extendedNexthop reports whether ExtendedNexthop is set to true.
+func (nh *NextHop) extendedNexthop() bool {
+	return nh.ExtendedNexthop != nil && *nh.ExtendedNexthop
+}
+
+// NamedNextHops returns the addresses of the nexthops by name, or nil if no
+// nexthop is defined. The addresses of the nexthops with a gateway are taken
+// from gateways, and are unset if missing. The IPv4 address of a nexthop
+// with ExtendedNexthop and without IPv4 address is its IPv6 address.
+func (c *Config) NamedNextHops(gateways map[string]nexthop.Addrs) policy.NextHopNames {
+	if len(c.NextHops) == 0 {
+		return nil
+	}
+	names := make(policy.NextHopNames, len(c.NextHops))
+	for name, nh := range c.NextHops {
+		named := policy.NamedNextHop{IP4: nh.IP4, IP6: nh.IP6}
+		if nh.Gateway != nil {
+			a := gateways[name]
+			named = policy.NamedNextHop{IP4: a.IP4, IP6: a.IP6}
+		}
+		if nh.extendedNexthop() && !named.IP4.IsValid() {
+			named.IP4 = named.IP6
+		}
+		names[name] = named
+	}
+	return names
+}
+
+// Gateways returns the gateways of the nexthops learning their addresses
+// from the kernel, keyed by name.
+func (c *Config) Gateways() map[string]*nexthop.Gateway {
+	gws := make(map[string]*nexthop.Gateway)
+	for name, nh := range c.NextHops {
+		if nh.Gateway != nil {
+			gws[name] = &nexthop.Gateway{Interface: nh.Gateway.Interface, Table: nh.Gateway.Table}
+		}
+	}
+	return gws
+}
+
+// ParsePolicies parses the policies of the configuration followed by ss,
+// which may refer to the nexthops of the configuration by name. gateways
+// holds the current addresses of the nexthops with a gateway.
+func (c *Config) ParsePolicies(ss []string, gateways map[string]nexthop.Addrs) ([]*policy.Policy, error) {
+	return policy.ParseAll(slices.Concat(c.Policies, ss), c.NamedNextHops(gateways))
+}
+
+// HealthChecks returns the health checks of the nexthops, ordered by name.
+func (c *Config) HealthChecks() ([]*nexthop.Check, error) {
+	var checks []*nexthop.Check
+	for _, name := range slices.Sorted(maps.Keys(c.NextHops)) {
+		nh := c.NextHops[name]
+		if nh.HealthCheck == nil {
+			continue
+		}
+
+		var nhs []netip.Addr
+		for _, a := range []netip.Addr{nh.IP4, nh.IP6} {
+			if a.IsValid() {
+				nhs = append(nhs, a)
+			}
+		}
+
+		cfg := nh.HealthCheck.checkConfig()
+		// The check is validated against the IPv4 address if there is one,
+		// which is also the default target of ICMP checks.
+		if err := cfg.Validate(nhs[0]); err != nil {
+			return nil, fmt.Errorf("invalid health check of nexthop %q: %w", name, err)
+		}
+		checks = append(checks, &nexthop.Check{Name: name, NextHops: nhs, Config: cfg})
+	}
+	return checks, nil
+}
+
+func (hc *HealthCheck) checkConfig() *nexthop.CheckConfig {
+	cfg := nexthop.DefaultCheckConfig()
+	if hc.Method != "" {
+		cfg.Method = hc.Method
+	}
+	cfg.Target = hc.Target
+	cfg.Source = hc.Source
+	cfg.Interface = hc.Interface
+	if hc.Interval != 0 {
+		cfg.Interval = hc.Interval
+	}
+	if hc.Timeout != 0 {
+		cfg.Timeout = hc.Timeout
+	}
+	if hc.Rise != 0 {
+		cfg.Rise = hc.Rise
+	}
+	if hc.Fall != 0 {
+		cfg.Fall = hc.Fall
+	}
+	if hc.HoldDown != 0 {
+		cfg.HoldDown = hc.HoldDown
+	}
+	return cfg
+}
+
+// SavePolicies replaces the policies and the disabled policies of the
+// configuration file at path, keeping the rest of the file including its
+// comments. The file is replaced atomically.
+func SavePolicies(path string, policies, disabled []string) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration: %w", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat configuration: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return fmt.Errorf("configuration %q: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("configuration %q is not a mapping", path)
+	}
+	setSequence(root, "policies", policies)
+	setSequence(root, "disabledPolicies", disabled)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := f.Chmod(fi.Mode().Perm()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	return nil
+}
+
+// setSequence sets key of the mapping node m to a sequence of ss, keeping
+// the comments of an existing key. The key is removed if ss is empty.
+func setSequence(m *yaml.Node, key string, ss []string) {
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, s := range ss {
+		seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s})
+	}
+
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != key {
+			continue
+		}
+		if len(ss) == 0 {
+			m.Content = slices.Delete(m.Content, i, i+2)
+			return
+		}
+		old := m.Content[i+1]
+		seq.HeadComment, seq.LineComment, seq.FootComment = old.HeadComment, old.LineComment, old.FootComment
+		m.Content[i+1] = seq
+		return
+	}
+	if len(ss) > 0 {
+		m.Content = append(m.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			seq)
+	}
+}
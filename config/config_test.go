@@ -0,0 +1,372 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+)
+
+const testConfig = `
+nexthops:
+  isp-fiber:
+    description: Fiber uplink
+    ip4: 192.168.1.1
+    ip6: 2001:db8::1
+    healthCheck:
+      method: icmp
+      interval: 2s
+      fall: 5
+  isp-lte:
+    ip4: 192.168.2.1
+sites:
+  osaka:
+    description: Osaka branch
+    nexthops:
+      isp-fiber:
+        ip4: 10.1.0.1
+      isp-cable:
+        ip4: 10.1.1.1
+        healthCheck:
+          method: tcp
+          target: 10.1.1.1:80
+policies:
+  - 15169,isp-fiber|isp-lte
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    string
+		ip4     map[string]string
+		ip6     map[string]string
+		wantErr bool
+	}{
+		{
+			name: "no site",
+			ip4:  map[string]string{"isp-fiber": "192.168.1.1", "isp-lte": "192.168.2.1"},
+			ip6:  map[string]string{"isp-fiber": "2001:db8::1"},
+		},
+		{
+			name: "site override",
+			site: "osaka",
+			ip4:  map[string]string{"isp-fiber": "10.1.0.1", "isp-lte": "192.168.2.1", "isp-cable": "10.1.1.1"},
+			ip6:  map[string]string{"isp-fiber": "2001:db8::1"},
+		},
+		{
+			name:    "unknown site",
+			site:    "kyoto",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse([]byte(testConfig), tt.site)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(c.NextHops) != len(tt.ip4) {
+				t.Errorf("Expected %d nexthops, got %d", len(tt.ip4), len(c.NextHops))
+			}
+			for name, nh := range c.NextHops {
+				if got := nh.IP4.String(); got != tt.ip4[name] {
+					t.Errorf("Expected IPv4 address %q for %s, got %q", tt.ip4[name], name, got)
+				}
+				if want := tt.ip6[name]; want != "" && nh.IP6.String() != want || want == "" && nh.IP6.IsValid() {
+					t.Errorf("Expected IPv6 address %q for %s, got %q", want, name, nh.IP6)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "unknown field", input: "nexthops:\n  isp-a:\n    ip: 192.168.1.1\n"},
+		{name: "invalid name", input: "nexthops:\n  isp+a:\n    ip4: 192.168.1.1\n"},
+		{name: "address as name", input: "nexthops:\n  192.168.1.1:\n    ip4: 192.168.1.1\n"},
+		{name: "no address", input: "nexthops:\n  isp-a:\n    description: ISP A\n"},
+		{name: "IPv6 address as ip4", input: "nexthops:\n  isp-a:\n    ip4: 2001:db8::1\n"},
+		{name: "IPv4 address as ip6", input: "nexthops:\n  isp-a:\n    ip6: 192.168.1.1\n"},
+		{name: "invalid address", input: "nexthops:\n  isp-a:\n    ip4: 192.168.1.256\n"},
+		{name: "addresses and gateway", input: "nexthops:\n  isp-a:\n    ip4: 192.168.1.1\n    gateway:\n      interface: ppp0\n"},
+		{name: "empty gateway", input: "nexthops:\n  isp-a:\n    gateway: {}\n"},
+		{name: "health checked gateway", input: "nexthops:\n  isp-a:\n    gateway:\n      interface: ppp0\n    healthCheck:\n      method: icmp\n"},
+		{name: "peer without address", input: "peers:\n  - asn: 64512\n"},
+		{name: "peer with zone", input: "peers:\n  - address: fe80::1%eth0\n"},
+		{name: "local address of other family", input: "peers:\n  - address: 192.168.0.1\n    localAddress: 2001:db8::1\n"},
+		{name: "password file and env", input: "peers:\n  - address: 192.168.0.1\n    passwordFile: /etc/pw\n    passwordEnv: PW\n"},
+		{name: "multihop and ttl security", input: "peers:\n  - address: 192.168.0.1\n    multihop: 2\n    ttlSecurity: 1\n"},
+		{name: "ttl security of 255 hops", input: "peers:\n  - address: 192.168.0.1\n    ttlSecurity: 255\n"},
+		{name: "duplicate peer", input: "peers:\n  - address: 192.168.0.1\n  - address: 192.168.0.1\n    port: 10179\n"},
+		{name: "inline password", input: "peers:\n  - address: 192.168.0.1\n    password: secret\n"},
+		{name: "unknown peer group", input: "peers:\n  - address: 192.168.0.1\n    group: branches\n"},
+		{name: "invalid peer group name", input: "peerGroups:\n  branch+es:\n    asn: 64600\n"},
+		{name: "neighbors with host bits", input: "peerGroups:\n  branches:\n    neighbors: [10.1.0.1/16]\n"},
+		{name: "invalid policy of peer group", input: "peerGroups:\n  branches:\n    policies: [netflix]\n"},
+		{name: "local address of other family than neighbors", input: "peerGroups:\n  branches:\n    localAddress: 10.0.0.1\n    neighbors: [2001:db8::/32]\n"},
+		{name: "overlapping neighbors", input: "peerGroups:\n  branches:\n    neighbors: [10.0.0.0/8]\n  core:\n    neighbors: [10.1.0.0/16]\n"},
+		{name: "peer among neighbors of other group", input: "peerGroups:\n  branches:\n    neighbors: [10.0.0.0/8]\npeers:\n  - address: 10.0.0.1\n"},
+		{name: "reserved nexthop name", input: "nexthops:\n  peer:\n    ip4: 192.168.1.1\n"},
+		{name: "unknown site of peer", input: "peers:\n  - address: 192.168.0.1\n    site: osaka\n"},
+		{name: "gateway of site of peer", input: "sites:\n  osaka:\n    nexthops:\n      isp:\n        gateway:\n          interface: ppp0\npeers:\n  - address: 192.168.0.1\n    site: osaka\n"},
+		{name: "extended nexthop without ip6", input: "nexthops:\n  isp-a:\n    ip4: 192.168.1.1\n    extendedNexthop: true\n"},
+		{name: "extended nexthop of site of peer", input: "sites:\n  osaka:\n    nexthops:\n      isp:\n        ip6: 2001:db8:1::1\n        extendedNexthop: true\npeers:\n  - address: 192.168.0.1\n    site: osaka\n"},
+		{name: "reserved nexthop name of site of peer", input: "sites:\n  osaka:\n    nexthops:\n      self:\n        ip4: 10.1.0.1\npeers:\n  - address: 192.168.0.1\n    site: osaka\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.input), ""); err == nil {
+				t.Errorf("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	c, err := Parse([]byte(testConfig), "osaka")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checks, err := c.HealthChecks()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(checks) != 2 {
+		t.Fatalf("Expected 2 health checks, got %d", len(checks))
+	}
+
+	cable, fiber := checks[0], checks[1]
+	if cable.Name != "isp-cable" || fiber.Name != "isp-fiber" {
+		t.Fatalf("Expected checks of isp-cable and isp-fiber, got %s and %s", cable.Name, fiber.Name)
+	}
+	if cable.Config.Method != "tcp" || cable.Config.Target != "10.1.1.1:80" {
+		t.Errorf("Expected tcp check of 10.1.1.1:80, got %s check of %s", cable.Config.Method, cable.Config.Target)
+	}
+
+	wantNhs := []netip.Addr{netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("2001:db8::1")}
+	if len(fiber.NextHops) != 2 || fiber.NextHops[0] != wantNhs[0] || fiber.NextHops[1] != wantNhs[1] {
+		t.Errorf("Expected nexthops %v, got %v", wantNhs, fiber.NextHops)
+	}
+	// The ICMP target follows the overridden address, and unset fields keep their defaults.
+	if fiber.Config.Target != "10.1.0.1" {
+		t.Errorf("Expected target 10.1.0.1, got %q", fiber.Config.Target)
+	}
+	if fiber.Config.Interval != 2*time.Second || fiber.Config.Fall != 5 || fiber.Config.Rise != 3 {
+		t.Errorf("Expected interval 2s, fall 5 and rise 3, got %v, %d and %d",
+			fiber.Config.Interval, fiber.Config.Fall, fiber.Config.Rise)
+	}
+
+	c, err = Parse([]byte("nexthops:\n  isp-a:\n    ip4: 192.168.1.1\n    healthCheck:\n      method: tcp\n"), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := c.HealthChecks(); err == nil {
+		t.Errorf("Expected error for a tcp check without target")
+	}
+}
+
+func TestParsePolicies(t *testing.T) {
+	c, err := Parse([]byte(testConfig), "osaka")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pols, err := c.ParsePolicies([]string{"32934,isp-cable|192.168.3.1"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pols) != 2 {
+		t.Fatalf("Expected 2 policies, got %d", len(pols))
+	}
+
+	want := []netip.Addr{netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("192.168.2.1")}
+	if got := pols[0].IP4NextHops; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected IPv4 nexthops %v, got %v", want, got)
+	}
+	if got := pols[0].IP6NextHops; len(got) != 1 || got[0] != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("Expected IPv6 nexthops [2001:db8::1], got %v", got)
+	}
+	if got := pols[1].IP4NextHops; len(got) != 2 || got[0] != netip.MustParseAddr("10.1.1.1") {
+		t.Errorf("Expected IPv4 nexthops [10.1.1.1 192.168.3.1], got %v", got)
+	}
+}
+
+func TestGateways(t *testing.T) {
+	const input = `
+nexthops:
+  isp-fiber:
+    ip4: 192.168.1.1
+  isp-lte:
+    gateway:
+      interface: wwan0
+sites:
+  home:
+    nexthops:
+      isp-fiber:
+        gateway:
+          interface: ppp0
+          table: 100
+      isp-lte:
+        ip4: 192.168.2.1
+policies:
+  - 15169,isp-fiber|isp-lte
+`
+	c, err := Parse([]byte(input), "home")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	gws := c.Gateways()
+	if len(gws) != 1 || gws["isp-fiber"] == nil || *gws["isp-fiber"] != (nexthop.Gateway{Interface: "ppp0", Table: 100}) {
+		t.Fatalf("Expected gateway isp-fiber via ppp0 in table 100, got %v", gws)
+	}
+	if c.NextHops["isp-fiber"].IP4.IsValid() {
+		t.Errorf("Expected the gateway to replace the address of isp-fiber")
+	}
+
+	tests := []struct {
+		name  string
+		addrs map[string]nexthop.Addrs
+		ip4   []netip.Addr
+		ip6   []netip.Addr
+	}{
+		{
+			name: "unresolved",
+			ip4:  []netip.Addr{netip.MustParseAddr("192.168.2.1")},
+		},
+		{
+			name:  "resolved",
+			addrs: map[string]nexthop.Addrs{"isp-fiber": {IP4: netip.MustParseAddr("100.64.0.1"), IP6: netip.MustParseAddr("2001:db8::1")}},
+			ip4:   []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("192.168.2.1")},
+			ip6:   []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pols, err := c.ParsePolicies(nil, tt.addrs)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(pols[0].IP4NextHops, tt.ip4) {
+				t.Errorf("Expected IPv4 nexthops %v, got %v", tt.ip4, pols[0].IP4NextHops)
+			}
+			if !slices.Equal(pols[0].IP6NextHops, tt.ip6) {
+				t.Errorf("Expected IPv6 nexthops %v, got %v", tt.ip6, pols[0].IP6NextHops)
+			}
+		})
+	}
+}
+
+func TestIPv6NextHops(t *testing.T) {
+	c, err := Parse([]byte(`
+nexthops:
+  underlay:
+    ip6: 2001:db8::1
+    extendedNexthop: true
+  lan:
+    ip6: fe80::1%eth0
+  isp-fiber:
+    gateway:
+      interface: ppp0
+    extendedNexthop: true
+policies:
+  - 15169,underlay|isp-fiber
+  - 2906,lan
+`), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	gw := netip.MustParseAddr("fe80::2%ppp0")
+	pols, err := c.ParsePolicies(nil, map[string]nexthop.Addrs{"isp-fiber": {IP6: gw}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// IPv4 is routed via the IPv6 addresses of the nexthops with extendedNexthop.
+	if want := []netip.Addr{netip.MustParseAddr("2001:db8::1"), gw}; !slices.Equal(pols[0].IP4NextHops, want) || !slices.Equal(pols[0].IP6NextHops, want) {
+		t.Errorf("Expected nexthops %v of both families, got %v and %v", want, pols[0].IP4NextHops, pols[0].IP6NextHops)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("fe80::1%eth0")}; len(pols[1].IP4NextHops) != 0 || !slices.Equal(pols[1].IP6NextHops, want) {
+		t.Errorf("Expected only IPv6 nexthops %v, got %v and %v", want, pols[1].IP4NextHops, pols[1].IP6NextHops)
+	}
+
+	// Sites can turn extendedNexthop off.
+	c, err = Parse([]byte(`
+nexthops:
+  underlay:
+    ip6: 2001:db8::1
+    extendedNexthop: true
+sites:
+  dualstack:
+    nexthops:
+      underlay:
+        extendedNexthop: false
+`), "dualstack")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if named := c.NamedNextHops(nil)["underlay"]; named.IP4.IsValid() {
+		t.Errorf("Expected no IPv4 address with extendedNexthop turned off, got %v", named.IP4)
+	}
+}
+
+func TestSavePolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policybgp.yaml")
+	orig := "# Nexthops of all sites\nnexthops:\n  isp-lte:\n    ip4: 192.168.2.1 # LTE router\npolicies:\n  - 15169,isp-lte\n"
+	if err := os.WriteFile(path, []byte(orig), 0o600); err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+
+	if err := SavePolicies(path, []string{"15169,isp-lte", "2906,192.168.3.1"}, []string{"32934,isp-lte"}); err != nil {
+		t.Fatalf("Failed to save policies: %v", err)
+	}
+	c, err := Load(path, "")
+	if err != nil {
+		t.Fatalf("Failed to load saved configuration: %v", err)
+	}
+	if want := []string{"15169,isp-lte", "2906,192.168.3.1"}; !slices.Equal(c.Policies, want) {
+		t.Errorf("Expected policies %v, got %v", want, c.Policies)
+	}
+	if want := []string{"32934,isp-lte"}; !slices.Equal(c.DisabledPolicies, want) {
+		t.Errorf("Expected disabled policies %v, got %v", want, c.DisabledPolicies)
+	}
+	if c.NextHops["isp-lte"].IP4 != netip.MustParseAddr("192.168.2.1") {
+		t.Errorf("Expected the nexthops to be kept, got %v", c.NextHops)
+	}
+
+	bs, _ := os.ReadFile(path)
+	for _, comment := range []string{"# Nexthops of all sites", "# LTE router"} {
+		if !strings.Contains(string(bs), comment) {
+			t.Errorf("Expected comment %q to be kept, got:\n%s", comment, bs)
+		}
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 0600 to be kept, got %v, %v", fi.Mode(), err)
+	}
+
+	if err := SavePolicies(path, []string{"15169,isp-lte"}, nil); err != nil {
+		t.Fatalf("Failed to save policies: %v", err)
+	}
+	if bs, _ := os.ReadFile(path); strings.Contains(string(bs), "disabledPolicies") {
+		t.Errorf("Expected disabledPolicies to be removed, got:\n%s", bs)
+	}
+}
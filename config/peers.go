@@ -0,0 +1,327 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/IPA-CyberLab/policybgp/nexthop"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// maxPasswordLen is the longest TCP MD5 signature key Linux accepts.
+const maxPasswordLen = 80
+
+const (
+	// NextHopPeer is the name of the nexthop standing for the address of
+	// the BGP peer the routes are sent to.
+	NextHopPeer = "peer"
+	// NextHopSelf is the name of the nexthop standing for our address on the
+	// session with the BGP peer the routes are sent to.
+	NextHopSelf = "self"
+)
+
+// PeerOptions are the options of the sessions with a BGP peer, or with the
+// peers of a group.
+type PeerOptions struct {
+	Description string `yaml:"description"`
+	// ASN defaults to the ASN of policybgp, for an iBGP session.
+	ASN uint32 `yaml:"asn"`
+	// LocalAddress is the source address of the session, such as that of
+	// a loopback interface.
+	LocalAddress netip.Addr `yaml:"localAddress"`
+	// PasswordFile and PasswordEnv are the file and the environment
+	// variable the TCP MD5 signature password (RFC 2385) is read from, so
+	// that it is not part of the configuration.
+	PasswordFile string `yaml:"passwordFile"`
+	PasswordEnv  string `yaml:"passwordEnv"`
+	// Multihop is the TTL of the packets to an eBGP peer which is not
+	// directly connected.
+	Multihop uint8 `yaml:"multihop"`
+	// TTLSecurity enables the Generalized TTL Security Mechanism (RFC 5082),
+	// only accepting the packets of the peer from at most this many hops
+	// away.
+	TTLSecurity uint8 `yaml:"ttlSecurity"`
+	// Passive waits for the peer to connect instead of connecting to it.
+	Passive bool `yaml:"passive"`
+	// Site is the site whose nexthops the routes sent to the peer are
+	// routed to, where they differ from those of the configuration.
+	Site string `yaml:"site"`
+	// ExtendedNexthop sends the peer the IPv4 routes via IPv6 nexthops
+	// (RFC 8950), which other peers are not sent as they cannot parse them.
+	ExtendedNexthop bool `yaml:"extendedNexthop"`
+}
+
+// Peer is a BGP peer the routes are announced to.
+type Peer struct {
+	Address netip.Addr `yaml:"address"`
+	// Port defaults to 179.
+	Port uint16 `yaml:"port"`
+	// Group is the name of the peer group the peer belongs to. The options
+	// of the group apply to the peer unless set on the peer.
+	Group       string `yaml:"group"`
+	PeerOptions `yaml:",inline"`
+}
+
+// PeerGroup is a group of BGP peers sharing their options and the policies
+// announced to them.
+type PeerGroup struct {
+	PeerOptions `yaml:",inline"`
+	// Neighbors are the prefixes from which any router is accepted as a
+	// peer of the group, as dynamic neighbors.
+	Neighbors []netip.Prefix `yaml:"neighbors"`
+	// Policies are the names of the policies announced to the peers of the
+	// group. All policies are announced if empty.
+	Policies []string `yaml:"policies"`
+}
+
+// validate checks o, the options of the peer or the group desc.
+func (o *PeerOptions) validate(desc string) error {
+	if o.PasswordFile != "" && o.PasswordEnv != "" {
+		return fmt.Errorf("%s has both passwordFile and passwordEnv", desc)
+	}
+	if o.Multihop != 0 && o.TTLSecurity != 0 {
+		return fmt.Errorf("%s has both multihop and ttlSecurity", desc)
+	}
+	if o.TTLSecurity == 255 {
+		return fmt.Errorf("ttlSecurity of %s must be between 1 and 254", desc)
+	}
+	return nil
+}
+
+// inherit sets the options of o which are unset to those of g.
+func (o *PeerOptions) inherit(g *PeerOptions) {
+	if o.Description == "" {
+		o.Description = g.Description
+	}
+	if o.ASN == 0 {
+		o.ASN = g.ASN
+	}
+	if !o.LocalAddress.IsValid() {
+		o.LocalAddress = g.LocalAddress
+	}
+	if o.PasswordFile == "" && o.PasswordEnv == "" {
+		o.PasswordFile, o.PasswordEnv = g.PasswordFile, g.PasswordEnv
+	}
+	if o.Multihop == 0 && o.TTLSecurity == 0 {
+		o.Multihop, o.TTLSecurity = g.Multihop, g.TTLSecurity
+	}
+	o.Passive = o.Passive || g.Passive
+	if o.Site == "" {
+		o.Site = g.Site
+	}
+	o.ExtendedNexthop = o.ExtendedNexthop || g.ExtendedNexthop
+}
+
+// validate checks p, the peer at index i of the configuration, and applies
+// the options of its group in groups.
+func (p *Peer) validate(i int, groups map[string]*PeerGroup) error {
+	if p == nil || !p.Address.IsValid() {
+		return fmt.Errorf("peer %d has no address", i+1)
+	}
+	if p.Address.Zone() != "" {
+		return fmt.Errorf("address %s of peer %d must not have a zone", p.Address, i+1)
+	}
+	if p.Group != "" {
+		g, ok := groups[p.Group]
+		if !ok {
+			return fmt.Errorf("unknown peer group %q of peer %s", p.Group, p.Address)
+		}
+		p.inherit(&g.PeerOptions)
+	}
+	if p.LocalAddress.IsValid() && p.LocalAddress.Is4() != p.Address.Is4() {
+		return fmt.Errorf("local address %s of peer %s is not of its address family", p.LocalAddress, p.Address)
+	}
+	return p.PeerOptions.validate("peer " + p.Address.String())
+}
+
+// validate checks g, the peer group named name.
+func (g *PeerGroup) validate(name string) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("invalid peer group name %q. Names must start with a letter and consist of letters, digits, \"_\", \".\" and \"-\"", name)
+	}
+	if g == nil {
+		return fmt.Errorf("peer group %q is empty", name)
+	}
+	for _, pre := range g.Neighbors {
+		if pre != pre.Masked() {
+			return fmt.Errorf("neighbors %s of peer group %q has host bits set", pre, name)
+		}
+		if g.LocalAddress.IsValid() && g.LocalAddress.Is4() != pre.Addr().Is4() {
+			return fmt.Errorf("local address %s of peer group %q is not of the address family of neighbors %s", g.LocalAddress, name, pre)
+		}
+	}
+	for _, pol := range g.Policies {
+		if _, err := policy.ParseName(pol); err != nil {
+			return fmt.Errorf("peer group %q: %w", name, err)
+		}
+	}
+	return g.PeerOptions.validate(fmt.Sprintf("peer group %q", name))
+}
+
+// checkNeighbors checks that the neighbors of groups do not overlap, and
+// that peers are not among the neighbors of another group than theirs, so
+// that each router belongs to a single group.
+func checkNeighbors(groups map[string]*PeerGroup, peers []*Peer) error {
+	names := slices.Sorted(maps.Keys(groups))
+	for i, name := range names {
+		for _, pre := range groups[name].Neighbors {
+			for _, other := range names[i+1:] {
+				for _, otherPre := range groups[other].Neighbors {
+					if pre.Overlaps(otherPre) {
+						return fmt.Errorf("neighbors %s of peer group %q overlap neighbors %s of peer group %q", pre, name, otherPre, other)
+					}
+				}
+			}
+			for _, p := range peers {
+				if p.Group != name && pre.Contains(p.Address) {
+					return fmt.Errorf("peer %s is among the neighbors %s of peer group %q but not in the group", p.Address, pre, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// peerSites returns the sites of the peer groups and the peers, mapped to
+// the description of one of them.
+func (c *Config) peerSites() map[string]string {
+	sites := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(c.PeerGroups)) {
+		if site := c.PeerGroups[name].Site; site != "" {
+			sites[site] = fmt.Sprintf("peer group %q", name)
+		}
+	}
+	for _, p := range c.Peers {
+		if p.Site != "" {
+			sites[p.Site] = "peer " + p.Address.String()
+		}
+	}
+	return sites
+}
+
+// checkSites checks that the sites of groups and peers exist, and that the
+// nexthops they override have static addresses of their family, which the
+// nexthops of the routes sent to the peers are replaced with.
+func (c *Config) checkSites() error {
+	sites := c.peerSites()
+	for _, site := range slices.Sorted(maps.Keys(sites)) {
+		s := c.Sites[site]
+		if s == nil {
+			return fmt.Errorf("unknown site %q of %s", site, sites[site])
+		}
+		for name, o := range s.NextHops {
+			if name == NextHopPeer || name == NextHopSelf {
+				return fmt.Errorf("nexthop name %q of site %q is reserved", name, site)
+			}
+			if o == nil {
+				continue
+			}
+			if o.Gateway != nil || c.NextHops[name] != nil && c.NextHops[name].Gateway != nil {
+				return fmt.Errorf("nexthop %q of site %q of %s must have static addresses", name, site, sites[site])
+			}
+			if o.IP4.IsValid() && !o.IP4.Is4() || o.IP6.IsValid() && !o.IP6.Is6() {
+				return fmt.Errorf("nexthop %q of site %q has an address of the wrong family", name, site)
+			}
+			extended := c.NextHops[name] != nil && c.NextHops[name].extendedNexthop()
+			if o.ExtendedNexthop != nil {
+				extended = *o.ExtendedNexthop
+			}
+			if extended {
+				return fmt.Errorf("nexthop %q of site %q of %s cannot use extendedNexthop", name, site, sites[site])
+			}
+		}
+	}
+	return nil
+}
+
+// PeerNextHopNames returns the addresses of the nexthops by name like
+// NamedNextHops, adding those depending on the peer the routes are sent to:
+// NextHopPeer, NextHopSelf and the nexthops defined by the sites of peers
+// for a family they have no address of otherwise. Their addresses are
+// placeholders, which are replaced when the routes are sent.
+func (c *Config) PeerNextHopNames(gateways map[string]nexthop.Addrs) policy.NextHopNames {
+	names := c.NamedNextHops(gateways)
+	if names == nil {
+		names = make(policy.NextHopNames)
+	}
+	names[NextHopPeer] = placeholder(0)
+	names[NextHopSelf] = placeholder(1)
+
+	vars := make(map[string]bool)
+	for site := range c.peerSites() {
+		for name := range c.Sites[site].NextHops {
+			vars[name] = true
+		}
+	}
+	for i, name := range slices.Sorted(maps.Keys(vars)) {
+		ph := placeholder(2 + i)
+		nh := names[name]
+		if !nh.IP4.IsValid() {
+			nh.IP4 = ph.IP4
+		}
+		if !nh.IP6.IsValid() {
+			nh.IP6 = ph.IP6
+		}
+		names[name] = nh
+	}
+	return names
+}
+
+var (
+	// placeholderPrefix4 and placeholderPrefix6 are the ranges of the
+	// placeholder addresses of the nexthops depending on the peer. Neither
+	// is ever the address of a router: 0.0.0.0/8 identifies "this network"
+	// (RFC 1122), and 100::/64 is discarded (RFC 6666).
+	placeholderPrefix4 = netip.MustParsePrefix("0.0.0.0/8")
+	placeholderPrefix6 = netip.MustParsePrefix("100::/64")
+)
+
+// placeholder returns the placeholder addresses of the i-th nexthop
+// depending on the peer.
+func placeholder(i int) policy.NamedNextHop {
+	ip4 := placeholderPrefix4.Addr().As4()
+	ip6 := placeholderPrefix6.Addr().As16()
+	for j, b := 0, i+1; j < 3; j, b = j+1, b>>8 {
+		ip4[3-j] = byte(b)
+		ip6[15-j] = byte(b)
+	}
+	return policy.NamedNextHop{IP4: netip.AddrFrom4(ip4), IP6: netip.AddrFrom16(ip6)}
+}
+
+// IsPlaceholder reports whether nh is the placeholder address of a nexthop
+// depending on the peer, as returned by PeerNextHopNames.
+func IsPlaceholder(nh netip.Addr) bool {
+	return placeholderPrefix4.Contains(nh) || placeholderPrefix6.Contains(nh)
+}
+
+// Password returns the TCP MD5 signature password of o, or "" if o has
+// none.
+func (o *PeerOptions) Password() (string, error) {
+	var pw string
+	switch {
+	case o.PasswordFile != "":
+		bs, err := os.ReadFile(o.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		pw = strings.TrimSpace(string(bs))
+	case o.PasswordEnv != "":
+		pw = os.Getenv(o.PasswordEnv)
+		if pw == "" {
+			return "", fmt.Errorf("environment variable %s with the password is not set", o.PasswordEnv)
+		}
+	default:
+		return "", nil
+	}
+	if pw == "" {
+		return "", fmt.Errorf("password is empty")
+	}
+	if len(pw) > maxPasswordLen {
+		return "", fmt.Errorf("password is longer than %d bytes", maxPasswordLen)
+	}
+	return pw, nil
+}
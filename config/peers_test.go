@@ -0,0 +1,163 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPeerPassword(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	t.Setenv("POLICYBGP_TEST_PASSWORD", "secret2")
+	t.Setenv("POLICYBGP_TEST_EMPTY", "")
+
+	tests := []struct {
+		name    string
+		peer    PeerOptions
+		want    string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "file", peer: PeerOptions{PasswordFile: write("pw", "secret\n")}, want: "secret"},
+		{name: "env", peer: PeerOptions{PasswordEnv: "POLICYBGP_TEST_PASSWORD"}, want: "secret2"},
+		{name: "empty file", peer: PeerOptions{PasswordFile: write("empty", "\n")}, wantErr: true},
+		{name: "missing file", peer: PeerOptions{PasswordFile: filepath.Join(dir, "missing")}, wantErr: true},
+		{name: "empty env", peer: PeerOptions{PasswordEnv: "POLICYBGP_TEST_EMPTY"}, wantErr: true},
+		{name: "too long", peer: PeerOptions{PasswordFile: write("long", strings.Repeat("x", maxPasswordLen+1))}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.peer.Password()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error but got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	c, err := Parse([]byte(`
+peers:
+  - address: 192.168.0.1
+    asn: 64512
+    localAddress: 10.0.0.1
+    passwordEnv: ROUTER1_PASSWORD
+    multihop: 2
+  - address: 2001:db8::1
+    port: 10179
+    ttlSecurity: 1
+    passive: true
+`), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(c.Peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(c.Peers))
+	}
+	if p := c.Peers[0]; p.Address.String() != "192.168.0.1" || p.ASN != 64512 || p.LocalAddress.String() != "10.0.0.1" || p.PasswordEnv != "ROUTER1_PASSWORD" || p.Multihop != 2 {
+		t.Errorf("Unexpected first peer %+v", p)
+	}
+	if p := c.Peers[1]; p.Address.String() != "2001:db8::1" || p.Port != 10179 || p.TTLSecurity != 1 || !p.Passive {
+		t.Errorf("Unexpected second peer %+v", p)
+	}
+}
+
+func TestParsePeerGroups(t *testing.T) {
+	c, err := Parse([]byte(`
+peerGroups:
+  branches:
+    asn: 64600
+    passwordFile: /etc/policybgp/branches.password
+    ttlSecurity: 1
+    neighbors:
+      - 10.1.0.0/16
+      - 2001:db8:1::/48
+    policies:
+      - as2906
+peers:
+  - address: 10.2.0.1
+    group: branches
+    passwordEnv: OSAKA_PASSWORD
+  - address: 10.3.0.1
+    group: branches
+    multihop: 2
+`), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := c.PeerGroups["branches"]
+	if g == nil || len(g.Neighbors) != 2 || len(g.Policies) != 1 || g.ASN != 64600 {
+		t.Fatalf("Unexpected peer group %+v", g)
+	}
+	// Options set on the peer replace those of the group.
+	if p := c.Peers[0]; p.ASN != 64600 || p.PasswordFile != "" || p.PasswordEnv != "OSAKA_PASSWORD" || p.TTLSecurity != 1 {
+		t.Errorf("Unexpected first peer %+v", p)
+	}
+	if p := c.Peers[1]; p.PasswordFile != g.PasswordFile || p.Multihop != 2 || p.TTLSecurity != 0 {
+		t.Errorf("Unexpected second peer %+v", p)
+	}
+}
+
+func TestPeerNextHopNames(t *testing.T) {
+	c, err := Parse([]byte(`
+nexthops:
+  isp-fiber:
+    ip4: 192.168.1.1
+sites:
+  osaka:
+    nexthops:
+      isp-fiber:
+        ip4: 10.1.0.1
+      isp-local:
+        ip4: 10.1.0.2
+        ip6: 2001:db8:1::2
+  kyoto:
+    nexthops:
+      isp-kyoto:
+        ip4: 10.2.0.1
+peerGroups:
+  osaka:
+    site: osaka
+    neighbors: [10.1.0.0/16]
+`), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	names := c.PeerNextHopNames(nil)
+	for _, name := range []string{NextHopPeer, NextHopSelf, "isp-local"} {
+		if nh := names[name]; !IsPlaceholder(nh.IP4) || !IsPlaceholder(nh.IP6) {
+			t.Errorf("Expected placeholders for %s, got %+v", name, nh)
+		}
+	}
+	if nh := names["isp-fiber"]; nh.IP4 != netip.MustParseAddr("192.168.1.1") || !IsPlaceholder(nh.IP6) {
+		t.Errorf("Expected the address of isp-fiber and an IPv6 placeholder, got %+v", nh)
+	}
+	if names[NextHopPeer] == names[NextHopSelf] || names[NextHopSelf] == names["isp-local"] {
+		t.Errorf("Expected distinct placeholders, got %+v", names)
+	}
+	// Sites of no peer are not variables.
+	if _, ok := names["isp-kyoto"]; ok {
+		t.Errorf("Expected no nexthop isp-kyoto, got %+v", names["isp-kyoto"])
+	}
+	if IsPlaceholder(netip.MustParseAddr("192.168.1.1")) || IsPlaceholder(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("Expected addresses of routers not to be placeholders")
+	}
+}
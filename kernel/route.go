@@ -0,0 +1,81 @@
+// Package kernel programs routes into a routing table of the kernel.
+package kernel
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+// maxWeight is the highest weight of a nexthop of a multipath route the
+// kernel supports.
+const maxWeight = 256
+
+// NextHop is a nexthop of a route.
+type NextHop struct {
+	// Addr may be an IPv6 address for an IPv4 route. A link-local address
+	// has the interface it is reached through as its zone.
+	Addr netip.Addr
+	// Weight is the share of the traffic of the nexthop in a multipath
+	// route. 0 is treated as 1.
+	Weight uint32
+}
+
+// LinkIndex returns the index of the interface named by the zone of the
+// address of nh, or 0 if it has none. The zone may also be the index itself.
+// Link-local IPv6 addresses are ambiguous without their interface, which is
+// thus required.
+func (nh NextHop) LinkIndex() (int, error) {
+	zone := nh.Addr.Zone()
+	if zone == "" {
+		if nh.Addr.Is6() && nh.Addr.IsLinkLocalUnicast() {
+			return 0, fmt.Errorf("link-local nexthop %s requires its interface as zone, as in %s%%eth0", nh.Addr, nh.Addr)
+		}
+		return 0, nil
+	}
+	if i, err := strconv.Atoi(zone); err == nil && i > 0 {
+		return i, nil
+	}
+	ifi, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, fmt.Errorf("interface of nexthop %s: %w", nh.Addr, err)
+	}
+	return ifi.Index, nil
+}
+
+// Route is the set of nexthops the traffic to a prefix is sent to. Routes
+// with more than one nexthop are multipath routes.
+type Route struct {
+	NextHops []NextHop
+}
+
+// Equal reports whether r and o route the traffic the same way.
+func (r Route) Equal(o Route) bool {
+	return slices.Equal(r.normalize().NextHops, o.normalize().NextHops)
+}
+
+// normalize returns r with the weights set to what the kernel reports them
+// as: between 1 and maxWeight, scaled down if necessary, and 1 for routes
+// with a single nexthop.
+func (r Route) normalize() Route {
+	nr := Route{NextHops: slices.Clone(r.NextHops)}
+	if len(nr.NextHops) == 1 {
+		nr.NextHops[0].Weight = 1
+		return nr
+	}
+
+	var top uint32
+	for _, nh := range nr.NextHops {
+		top = max(top, nh.Weight)
+	}
+	for i := range nr.NextHops {
+		w := max(nr.NextHops[i].Weight, 1)
+		if top > maxWeight {
+			w = max(uint32(uint64(w)*maxWeight/uint64(top)), 1)
+		}
+		nr.NextHops[i].Weight = w
+	}
+	return nr
+}
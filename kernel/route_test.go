@@ -0,0 +1,83 @@
+package kernel
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRouteEqual(t *testing.T) {
+	a := netip.MustParseAddr("192.168.1.1")
+	b := netip.MustParseAddr("192.168.2.1")
+
+	tests := []struct {
+		name  string
+		r, o  Route
+		equal bool
+	}{
+		{
+			name:  "single nexthop ignores weight",
+			r:     Route{NextHops: []NextHop{{Addr: a}}},
+			o:     Route{NextHops: []NextHop{{Addr: a, Weight: 5}}},
+			equal: true,
+		},
+		{
+			name:  "zero weight is one",
+			r:     Route{NextHops: []NextHop{{Addr: a}, {Addr: b}}},
+			o:     Route{NextHops: []NextHop{{Addr: a, Weight: 1}, {Addr: b, Weight: 1}}},
+			equal: true,
+		},
+		{
+			name:  "scaled weights",
+			r:     Route{NextHops: []NextHop{{Addr: a, Weight: 1000}, {Addr: b, Weight: 500}}},
+			o:     Route{NextHops: []NextHop{{Addr: a, Weight: 256}, {Addr: b, Weight: 128}}},
+			equal: true,
+		},
+		{
+			name: "different weights",
+			r:    Route{NextHops: []NextHop{{Addr: a, Weight: 3}, {Addr: b, Weight: 1}}},
+			o:    Route{NextHops: []NextHop{{Addr: a, Weight: 1}, {Addr: b, Weight: 3}}},
+		},
+		{
+			name: "different nexthop",
+			r:    Route{NextHops: []NextHop{{Addr: a}}},
+			o:    Route{NextHops: []NextHop{{Addr: b}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.Equal(tt.o); got != tt.equal {
+				t.Errorf("Expected equal %v, got %v", tt.equal, got)
+			}
+		})
+	}
+}
+
+func TestNextHopLinkIndex(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    int
+		wantErr bool
+	}{
+		{addr: "192.168.1.1"},
+		{addr: "2001:db8::1"},
+		{addr: "fe80::1%1", want: 1},
+		{addr: "fe80::1", wantErr: true},
+		{addr: "fe80::1%policybgp-missing0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := NextHop{Addr: netip.MustParseAddr(tt.addr)}.LinkIndex()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error but got %d", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Expected link %d, got %d: %v", tt.want, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Table keeps the routes tagged with a protocol ID in a routing table in
+// sync with the desired routes. The routes of the table tagged with other
+// protocol IDs are left alone.
+type Table struct {
+	id       int
+	protocol int
+	// installed holds the normalized routes owned by the table.
+	installed map[netip.Prefix]Route
+}
+
+// NewTable returns a Table for the routing table id owning the routes tagged
+// with protocol. The routes it already holds, such as those left by a
+// previous run, are taken over, so that the first Sync only changes what
+// differs.
+func NewTable(id, protocol int) (*Table, error) {
+	if id <= 0 || id == unix.RT_TABLE_LOCAL {
+		return nil, fmt.Errorf("invalid routing table %d", id)
+	}
+	// Protocols up to static are used by the kernel and by routes added
+	// manually, which must not be removed.
+	if protocol <= unix.RTPROT_STATIC || protocol > 255 {
+		return nil, fmt.Errorf("invalid route protocol %d. It must be between %d and 255", protocol, unix.RTPROT_STATIC+1)
+	}
+
+	t := &Table{id: id, protocol: protocol}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Table) String() string {
+	return fmt.Sprintf("kernel routing table %d", t.id)
+}
+
+// Len returns the number of routes owned by the table.
+func (t *Table) Len() int {
+	return len(t.installed)
+}
+
+// load reads the routes owned by the table from the kernel.
+func (t *Table) load() error {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Table:    t.id,
+		Protocol: netlink.RouteProtocol(t.protocol),
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of table %d: %w", t.id, err)
+	}
+
+	t.installed = make(map[netip.Prefix]Route, len(routes))
+	for _, nr := range routes {
+		if pre, r, ok := fromNetlink(nr); ok {
+			t.installed[pre] = r
+		}
+	}
+	return nil
+}
+
+// Sync installs, replaces and removes routes so that the routes owned by the
+// table are want. Routes without nexthop are removed. Failing routes are
+// skipped, and the first error is returned after all routes were processed.
+func (t *Table) Sync(want map[netip.Prefix]Route) (installed, removed int, err error) {
+	var failed int
+	fail := func(e error) {
+		if failed == 0 {
+			err = e
+		}
+		failed++
+	}
+
+	for pre, r := range want {
+		if len(r.NextHops) == 0 {
+			continue
+		}
+		if cur, ok := t.installed[pre]; ok && cur.Equal(r) {
+			continue
+		}
+		nr, e := t.netlinkRoute(pre, r)
+		if e == nil {
+			e = netlink.RouteReplace(nr)
+		}
+		if e != nil {
+			fail(fmt.Errorf("failed to install route %v: %w", pre, e))
+			continue
+		}
+		t.installed[pre] = r.normalize()
+		installed++
+	}
+
+	for pre, r := range t.installed {
+		if len(want[pre].NextHops) > 0 {
+			continue
+		}
+		// A nexthop whose interface is gone needs no removal; the kernel already
+		// dropped the routes through it.
+		nr, e := t.netlinkRoute(pre, r)
+		if e == nil {
+			e = netlink.RouteDel(nr)
+		}
+		if e != nil && nr != nil && !errors.Is(e, unix.ESRCH) {
+			fail(fmt.Errorf("failed to remove route %v: %w", pre, e))
+			continue
+		}
+		delete(t.installed, pre)
+		removed++
+	}
+
+	if failed > 1 {
+		err = fmt.Errorf("%d routes failed, first: %w", failed, err)
+	}
+	return installed, removed, err
+}
+
+// Flush removes all routes owned by the table, including those installed by
+// others with the same protocol since it was created.
+func (t *Table) Flush() (removed int, err error) {
+	if err := t.load(); err != nil {
+		return 0, err
+	}
+	_, removed, err = t.Sync(nil)
+	return removed, err
+}
+
+// netlinkRoute returns the netlink message for r to pre. The nexthops of
+// another family than pre, as IPv6 nexthops of IPv4 routes (RFC 8950), are
+// given as RTA_VIA, which requires Linux 5.2.
+func (t *Table) netlinkRoute(pre netip.Prefix, r Route) (*netlink.Route, error) {
+	nr := &netlink.Route{
+		Dst: &net.IPNet{
+			IP:   pre.Addr().AsSlice(),
+			Mask: net.CIDRMask(pre.Bits(), pre.Addr().BitLen()),
+		},
+		Table:    t.id,
+		Protocol: netlink.RouteProtocol(t.protocol),
+	}
+
+	r = r.normalize()
+	for _, nh := range r.NextHops {
+		link, err := nh.LinkIndex()
+		if err != nil {
+			return nil, err
+		}
+		info := &netlink.NexthopInfo{LinkIndex: link, Hops: int(nh.Weight - 1)}
+		if nh.Addr.Is4() == pre.Addr().Is4() {
+			info.Gw = nh.Addr.AsSlice()
+		} else {
+			info.Via = &netlink.Via{AddrFamily: netlink.FAMILY_V6, Addr: nh.Addr.AsSlice()}
+		}
+		if len(r.NextHops) == 1 {
+			nr.LinkIndex, nr.Gw, nr.Via = info.LinkIndex, info.Gw, info.Via
+			return nr, nil
+		}
+		nr.MultiPath = append(nr.MultiPath, info)
+	}
+	return nr, nil
+}
+
+// fromNetlink converts a unicast route read from the kernel. ok is false if
+// nr is not a route Table could have installed.
+func fromNetlink(nr netlink.Route) (pre netip.Prefix, r Route, ok bool) {
+	if nr.Type != unix.RTN_UNICAST {
+		return netip.Prefix{}, Route{}, false
+	}
+
+	if nr.Dst == nil {
+		pre = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if nr.Family == netlink.FAMILY_V6 {
+			pre = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+	} else {
+		addr, _ := netip.AddrFromSlice(nr.Dst.IP)
+		ones, _ := nr.Dst.Mask.Size()
+		pre = netip.PrefixFrom(addr.Unmap(), ones)
+	}
+
+	add := func(gw net.IP, via netlink.Destination, link, hops int) {
+		if v, ok := via.(*netlink.Via); ok && gw == nil {
+			gw = v.Addr
+		}
+		addr, ok := netip.AddrFromSlice(gw)
+		if !ok {
+			return
+		}
+		addr = addr.Unmap()
+		if addr.Is6() && addr.IsLinkLocalUnicast() {
+			addr = addr.WithZone(linkName(link))
+		}
+		r.NextHops = append(r.NextHops, NextHop{Addr: addr, Weight: uint32(hops + 1)})
+	}
+	if nr.Gw != nil || nr.Via != nil {
+		add(nr.Gw, nr.Via, nr.LinkIndex, 0)
+	}
+	for _, nh := range nr.MultiPath {
+		add(nh.Gw, nh.Via, nh.LinkIndex, nh.Hops)
+	}
+	return pre, r, pre.IsValid() && len(r.NextHops) > 0
+}
+
+// linkName returns the name of the interface with index link, which is the
+// zone of the link-local nexthops through it, or the index if it has none.
+func linkName(link int) string {
+	if ifi, err := net.InterfaceByIndex(link); err == nil {
+		return ifi.Name
+	}
+	return strconv.Itoa(link)
+}
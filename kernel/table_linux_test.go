@@ -0,0 +1,262 @@
+package kernel
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const netnsEnv = "POLICYBGP_TEST_NETNS"
+
+// inNetns runs the calling test in new user and network namespaces, which
+// requires no privileges, by running the test binary again. It reports
+// whether the caller is the test running inside the namespaces.
+func inNetns(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(netnsEnv) == t.Name() {
+		return true
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"="+t.Name())
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		t.Fatalf("Test in network namespace failed:\n%s", out)
+	case err != nil:
+		t.Skipf("Cannot create network namespace: %v", err)
+	}
+	return false
+}
+
+// setupLink creates a link with a connected IPv4 and IPv6 subnet to route via.
+func setupLink(t *testing.T) {
+	t.Helper()
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatalf("Failed to add link: %v", err)
+	}
+	for _, name := range []string{"veth0", "veth1"} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("Failed to get link: %v", err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatalf("Failed to set link up: %v", err)
+		}
+	}
+	link, _ := netlink.LinkByName("veth0")
+	for _, s := range []string{"192.0.2.1/24", "2001:db8::1/64"} {
+		addr, _ := netlink.ParseAddr(s)
+		addr.Flags = unix.IFA_F_NODAD
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			t.Fatalf("Failed to add address %s: %v", s, err)
+		}
+	}
+}
+
+// tableRoutes returns the routes of table tagged with protocol.
+func tableRoutes(t *testing.T, table, protocol int) map[netip.Prefix]Route {
+	t.Helper()
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Table:    table,
+		Protocol: netlink.RouteProtocol(protocol),
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+	got := make(map[netip.Prefix]Route)
+	for _, nr := range routes {
+		if pre, r, ok := fromNetlink(nr); ok {
+			got[pre] = r
+		}
+	}
+	return got
+}
+
+func TestTableSync(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	setupLink(t)
+
+	const table, protocol = 100, 200
+	gw1 := NextHop{Addr: netip.MustParseAddr("192.0.2.11")}
+	gw2 := NextHop{Addr: netip.MustParseAddr("192.0.2.12")}
+	gw6 := NextHop{Addr: netip.MustParseAddr("2001:db8::11")}
+	pre1 := netip.MustParsePrefix("8.8.8.0/24")
+	pre2 := netip.MustParsePrefix("8.8.4.0/24")
+	pre6 := netip.MustParsePrefix("2001:4860::/32")
+	stale := netip.MustParsePrefix("198.51.100.0/24")
+
+	// A route left by a previous run, and one of another protocol.
+	for _, nr := range []*netlink.Route{
+		{Dst: &net.IPNet{IP: net.ParseIP("198.51.100.0"), Mask: net.CIDRMask(24, 32)}, Gw: net.ParseIP("192.0.2.11"), Table: table, Protocol: protocol},
+		{Dst: &net.IPNet{IP: net.ParseIP("203.0.113.0"), Mask: net.CIDRMask(24, 32)}, Gw: net.ParseIP("192.0.2.11"), Table: table, Protocol: unix.RTPROT_STATIC},
+	} {
+		if err := netlink.RouteAdd(nr); err != nil {
+			t.Fatalf("Failed to add route: %v", err)
+		}
+	}
+
+	tbl, err := NewTable(table, protocol)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if tbl.Len() != 1 {
+		t.Errorf("Expected 1 route taken over, got %d", tbl.Len())
+	}
+
+	steps := []struct {
+		name      string
+		want      map[netip.Prefix]Route
+		installed int
+		removed   int
+	}{
+		{
+			name: "reconcile",
+			want: map[netip.Prefix]Route{
+				pre1:  {NextHops: []NextHop{gw1}},
+				pre6:  {NextHops: []NextHop{gw6}},
+				stale: {NextHops: []NextHop{gw1}},
+			},
+			installed: 2,
+		},
+		{
+			name: "unchanged",
+			want: map[netip.Prefix]Route{
+				pre1:  {NextHops: []NextHop{gw1}},
+				pre6:  {NextHops: []NextHop{gw6}},
+				stale: {NextHops: []NextHop{gw1}},
+			},
+		},
+		{
+			name: "change and remove",
+			want: map[netip.Prefix]Route{
+				pre1: {NextHops: []NextHop{gw2}},
+				pre2: {NextHops: []NextHop{{Addr: gw1.Addr, Weight: 3}, {Addr: gw2.Addr, Weight: 1}}},
+				pre6: {},
+			},
+			installed: 2,
+			removed:   2,
+		},
+	}
+
+	for _, step := range steps {
+		installed, removed, err := tbl.Sync(step.want)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if installed != step.installed || removed != step.removed {
+			t.Errorf("%s: expected %d installed and %d removed, got %d and %d",
+				step.name, step.installed, step.removed, installed, removed)
+		}
+
+		got := tableRoutes(t, table, protocol)
+		wantLen := 0
+		for pre, r := range step.want {
+			if len(r.NextHops) == 0 {
+				continue
+			}
+			wantLen++
+			if !got[pre].Equal(r) {
+				t.Errorf("%s: expected route %v via %v, got %v", step.name, pre, r.NextHops, got[pre].NextHops)
+			}
+		}
+		if len(got) != wantLen {
+			t.Errorf("%s: expected %d routes, got %v", step.name, wantLen, got)
+		}
+	}
+
+	// Routes taken over are not installed again.
+	tbl, err = NewTable(table, protocol)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if installed, _, err := tbl.Sync(steps[len(steps)-1].want); err != nil || installed != 0 {
+		t.Errorf("Expected no route installed after restart, got %d: %v", installed, err)
+	}
+
+	if removed, err := tbl.Flush(); err != nil || removed != 2 {
+		t.Errorf("Expected 2 routes flushed, got %d: %v", removed, err)
+	}
+	if got := tableRoutes(t, table, protocol); len(got) != 0 {
+		t.Errorf("Expected no routes after flush, got %v", got)
+	}
+	if got := tableRoutes(t, table, unix.RTPROT_STATIC); len(got) != 1 {
+		t.Errorf("Expected the route of another protocol to be kept, got %v", got)
+	}
+}
+
+func TestTableSyncIPv6NextHops(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	setupLink(t)
+
+	const table, protocol = 100, 200
+	tbl, err := NewTable(table, protocol)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	want := map[netip.Prefix]Route{
+		// IPv4 via IPv6 (RFC 8950).
+		netip.MustParsePrefix("8.8.8.0/24"): {NextHops: []NextHop{{Addr: netip.MustParseAddr("2001:db8::11")}}},
+		netip.MustParsePrefix("8.8.4.0/24"): {NextHops: []NextHop{
+			{Addr: netip.MustParseAddr("192.0.2.11")},
+			{Addr: netip.MustParseAddr("fe80::11%veth0")},
+		}},
+		netip.MustParsePrefix("2001:4860::/32"): {NextHops: []NextHop{{Addr: netip.MustParseAddr("fe80::11%veth0")}}},
+	}
+	if installed, _, err := tbl.Sync(want); err != nil || installed != 3 {
+		t.Fatalf("Expected 3 routes installed, got %d: %v", installed, err)
+	}
+	got := tableRoutes(t, table, protocol)
+	for pre, r := range want {
+		if !got[pre].Equal(r) {
+			t.Errorf("Expected route %v via %v, got %v", pre, r.NextHops, got[pre].NextHops)
+		}
+	}
+
+	// Routes taken over are not installed again.
+	tbl, err = NewTable(table, protocol)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if installed, _, err := tbl.Sync(want); err != nil || installed != 0 {
+		t.Errorf("Expected no route installed after restart, got %d: %v", installed, err)
+	}
+
+	noZone := map[netip.Prefix]Route{
+		netip.MustParsePrefix("2001:4860::/32"): {NextHops: []NextHop{{Addr: netip.MustParseAddr("fe80::11")}}},
+	}
+	if _, _, err := tbl.Sync(noZone); err == nil {
+		t.Error("Expected error for a link-local nexthop without zone")
+	}
+}
+
+func TestNewTableInvalid(t *testing.T) {
+	for _, tc := range []struct{ id, protocol int }{
+		{0, 200}, {unix.RT_TABLE_LOCAL, 200}, {100, 0}, {100, unix.RTPROT_STATIC}, {100, 256},
+	} {
+		if _, err := NewTable(tc.id, tc.protocol); err == nil {
+			t.Errorf("Expected error for table %d and protocol %d", tc.id, tc.protocol)
+		}
+	}
+}
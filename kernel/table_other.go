@@ -0,0 +1,35 @@
+//go:build !linux
+
+package kernel
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var errUnsupported = errors.New("installing routes is only supported on Linux")
+
+// Table keeps the routes of a kernel routing table in sync. It is only
+// supported on Linux.
+type Table struct{}
+
+// NewTable fails, as routes are installed through netlink, which is Linux only.
+func NewTable(id, protocol int) (*Table, error) {
+	return nil, errUnsupported
+}
+
+func (t *Table) String() string {
+	return "kernel routing table"
+}
+
+func (t *Table) Len() int {
+	return 0
+}
+
+func (t *Table) Sync(want map[netip.Prefix]Route) (installed, removed int, err error) {
+	return 0, 0, errUnsupported
+}
+
+func (t *Table) Flush() (removed int, err error) {
+	return 0, errUnsupported
+}
@@ -0,0 +1,150 @@
+package nexthop
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MethodICMP = "icmp"
+	MethodTCP  = "tcp"
+	MethodHTTP = "http"
+)
+
+// CheckConfig describes how the health of a nexthop is checked.
+type CheckConfig struct {
+	// Method is one of MethodICMP, MethodTCP or MethodHTTP.
+	Method string
+	// Target is the destination probed: an IP address for MethodICMP
+	// (defaults to the nexthop itself), <host>:<port> for MethodTCP and a URL
+	// for MethodHTTP.
+	Target string
+	// Source is the local address the probes are sent from. Optional.
+	Source netip.Addr
+	// Interface is the network interface the probes are bound to. Optional, Linux only.
+	Interface string
+
+	Interval time.Duration
+	Timeout  time.Duration
+	// Rise is the number of consecutive successful probes after which a down nexthop is declared up.
+	Rise int
+	// Fall is the number of consecutive failed probes after which an up nexthop is declared down.
+	Fall int
+	// HoldDown is the minimum time a nexthop stays down once declared down.
+	HoldDown time.Duration
+
+	// Fallback is the nexthop routes are switched to while the nexthop is
+	// down. If invalid, the routes are withdrawn instead.
+	Fallback netip.Addr
+}
+
+// DefaultCheckConfig returns a CheckConfig with the default timers and thresholds.
+func DefaultCheckConfig() *CheckConfig {
+	return &CheckConfig{
+		Method:   MethodICMP,
+		Interval: 5 * time.Second,
+		Timeout:  2 * time.Second,
+		Rise:     3,
+		Fall:     3,
+		HoldDown: 30 * time.Second,
+	}
+}
+
+// ParseCheck parses a health check in the format
+// <nexthop>,<method>[,<key>=<value>...]. The keys are target, source,
+// interface, interval, timeout, rise, fall, holddown and fallback.
+func ParseCheck(s string) (netip.Addr, *CheckConfig, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < 2 {
+		return netip.Addr{}, nil, fmt.Errorf("invalid health check format %q. Expected <nexthop>,<method>[,<key>=<value>...]", s)
+	}
+
+	nh, err := netip.ParseAddr(parts[0])
+	if err != nil {
+		return netip.Addr{}, nil, fmt.Errorf("invalid nexthop %q in health check %q: %w", parts[0], s, err)
+	}
+
+	cfg := DefaultCheckConfig()
+	cfg.Method = parts[1]
+	for _, kv := range parts[2:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return netip.Addr{}, nil, fmt.Errorf("invalid option %q in health check %q. Expected <key>=<value>", kv, s)
+		}
+
+		switch k {
+		case "target":
+			cfg.Target = v
+		case "source":
+			cfg.Source, err = netip.ParseAddr(v)
+		case "interface":
+			cfg.Interface = v
+		case "interval":
+			cfg.Interval, err = time.ParseDuration(v)
+		case "timeout":
+			cfg.Timeout, err = time.ParseDuration(v)
+		case "rise":
+			cfg.Rise, err = strconv.Atoi(v)
+		case "fall":
+			cfg.Fall, err = strconv.Atoi(v)
+		case "holddown":
+			cfg.HoldDown, err = time.ParseDuration(v)
+		case "fallback":
+			cfg.Fallback, err = netip.ParseAddr(v)
+		default:
+			return netip.Addr{}, nil, fmt.Errorf("unknown option %q in health check %q", k, s)
+		}
+		if err != nil {
+			return netip.Addr{}, nil, fmt.Errorf("invalid %s %q in health check %q: %w", k, v, s, err)
+		}
+	}
+
+	if err := cfg.Validate(nh); err != nil {
+		return netip.Addr{}, nil, fmt.Errorf("invalid health check %q: %w", s, err)
+	}
+	return nh, cfg, nil
+}
+
+// Validate fills in the default target and checks that cfg is usable for nh.
+func (cfg *CheckConfig) Validate(nh netip.Addr) error {
+	switch cfg.Method {
+	case MethodICMP:
+		if cfg.Target == "" {
+			cfg.Target = nh.String()
+		}
+		if _, err := netip.ParseAddr(cfg.Target); err != nil {
+			return fmt.Errorf("ICMP target must be an IP address: %w", err)
+		}
+	case MethodTCP, MethodHTTP:
+		if cfg.Target == "" {
+			return fmt.Errorf("%s health check requires a target", cfg.Method)
+		}
+	default:
+		return fmt.Errorf("unknown method %q. Expected one of %s, %s, %s", cfg.Method, MethodICMP, MethodTCP, MethodHTTP)
+	}
+
+	if cfg.Interval <= 0 || cfg.Timeout <= 0 {
+		return fmt.Errorf("interval and timeout must be positive")
+	}
+	if cfg.Rise < 1 || cfg.Fall < 1 {
+		return fmt.Errorf("rise and fall must be at least 1")
+	}
+	if cfg.HoldDown < 0 {
+		return fmt.Errorf("holddown must not be negative")
+	}
+	if cfg.Source.IsValid() && cfg.Source.Is4() != nh.Is4() {
+		return fmt.Errorf("source %s is not of the same address family as nexthop %s", cfg.Source, nh)
+	}
+	if cfg.Fallback.IsValid() {
+		if cfg.Fallback.Is4() != nh.Is4() {
+			return fmt.Errorf("fallback %s is not of the same address family as nexthop %s", cfg.Fallback, nh)
+		}
+		if cfg.Fallback == nh {
+			return fmt.Errorf("fallback must differ from the nexthop")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package nexthop
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		nh      string
+		want    CheckConfig
+		wantErr bool
+	}{
+		{
+			name:  "ICMP defaults to the nexthop",
+			input: "192.168.1.1,icmp",
+			nh:    "192.168.1.1",
+			want: CheckConfig{
+				Method:   MethodICMP,
+				Target:   "192.168.1.1",
+				Interval: 5 * time.Second,
+				Timeout:  2 * time.Second,
+				Rise:     3,
+				Fall:     3,
+				HoldDown: 30 * time.Second,
+			},
+		},
+		{
+			name:  "all options",
+			input: "192.168.1.1,http,target=http://example.com/,source=192.168.1.2,interface=eth1,interval=1s,timeout=500ms,rise=5,fall=2,holddown=1m,fallback=192.168.2.1",
+			nh:    "192.168.1.1",
+			want: CheckConfig{
+				Method:    MethodHTTP,
+				Target:    "http://example.com/",
+				Source:    netip.MustParseAddr("192.168.1.2"),
+				Interface: "eth1",
+				Interval:  time.Second,
+				Timeout:   500 * time.Millisecond,
+				Rise:      5,
+				Fall:      2,
+				HoldDown:  time.Minute,
+				Fallback:  netip.MustParseAddr("192.168.2.1"),
+			},
+		},
+		{
+			name:  "IPv6 TCP",
+			input: "2001:db8::1,tcp,target=[2001:db8::53]:53,holddown=0s",
+			nh:    "2001:db8::1",
+			want: CheckConfig{
+				Method:   MethodTCP,
+				Target:   "[2001:db8::53]:53",
+				Interval: 5 * time.Second,
+				Timeout:  2 * time.Second,
+				Rise:     3,
+				Fall:     3,
+			},
+		},
+		{
+			name:    "missing method",
+			input:   "192.168.1.1",
+			wantErr: true,
+		},
+		{
+			name:    "unknown method",
+			input:   "192.168.1.1,udp",
+			wantErr: true,
+		},
+		{
+			name:    "TCP without target",
+			input:   "192.168.1.1,tcp",
+			wantErr: true,
+		},
+		{
+			name:    "unknown option",
+			input:   "192.168.1.1,icmp,count=3",
+			wantErr: true,
+		},
+		{
+			name:    "option without value",
+			input:   "192.168.1.1,icmp,rise",
+			wantErr: true,
+		},
+		{
+			name:    "zero fall",
+			input:   "192.168.1.1,icmp,fall=0",
+			wantErr: true,
+		},
+		{
+			name:    "fallback of other family",
+			input:   "192.168.1.1,icmp,fallback=2001:db8::1",
+			wantErr: true,
+		},
+		{
+			name:    "fallback to itself",
+			input:   "192.168.1.1,icmp,fallback=192.168.1.1",
+			wantErr: true,
+		},
+		{
+			name:    "source of other family",
+			input:   "192.168.1.1,icmp,source=2001:db8::1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nh, cfg, err := ParseCheck(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for input %q, got nil", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error for input %q: %v", tt.input, err)
+			}
+
+			if nh != netip.MustParseAddr(tt.nh) {
+				t.Errorf("Expected nexthop %s, got %s", tt.nh, nh)
+			}
+			if *cfg != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, *cfg)
+			}
+		})
+	}
+}
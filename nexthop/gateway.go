@@ -0,0 +1,108 @@
+package nexthop
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Gateway is a nexthop learned from the kernel: the gateway of the default
+// route via an interface, of the default route in a routing table, or both.
+// Point-to-point interfaces such as PPPoE, whose default route has no
+// gateway, resolve to the peer address of the interface.
+type Gateway struct {
+	// Interface restricts the default routes to those via the interface.
+	Interface string
+	// Table is the routing table of the default route. 0 selects the main table.
+	Table int
+}
+
+// Addrs holds the IPv4 and IPv6 address of a gateway. Either may be invalid.
+type Addrs struct {
+	IP4 netip.Addr
+	IP6 netip.Addr
+}
+
+func (a Addrs) String() string {
+	s := func(addr netip.Addr) string {
+		if !addr.IsValid() {
+			return "none"
+		}
+		return addr.String()
+	}
+	return fmt.Sprintf("IPv4 %s, IPv6 %s", s(a.IP4), s(a.IP6))
+}
+
+// GatewayWatcher resolves gateways and tracks their changes. A gateway has no
+// address of a family while it has no usable default route of the family, in
+// particular while its interface is down. Link-local IPv6 gateways are only
+// used if there is no other, with the name of their interface as zone.
+type GatewayWatcher struct {
+	s        *zap.SugaredLogger
+	gateways map[string]*Gateway
+	changed  chan struct{}
+
+	mu    sync.Mutex
+	addrs map[string]Addrs
+}
+
+// NewGatewayWatcher returns a GatewayWatcher for gateways, keyed by name.
+// The gateways are unresolved until Resolve or Run is called.
+func NewGatewayWatcher(gateways map[string]*Gateway, l *zap.Logger) *GatewayWatcher {
+	return &GatewayWatcher{
+		s:        l.Named("gateway").Sugar(),
+		gateways: gateways,
+		changed:  make(chan struct{}, 1),
+		addrs:    make(map[string]Addrs),
+	}
+}
+
+// Changed returns a channel receiving a value after the address of any
+// gateway changed. Consecutive changes may be coalesced.
+func (w *GatewayWatcher) Changed() <-chan struct{} {
+	return w.changed
+}
+
+// Addrs returns the current addresses of the gateways by name.
+func (w *GatewayWatcher) Addrs() map[string]Addrs {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return maps.Clone(w.addrs)
+}
+
+// Resolve looks up the addresses of all gateways, and reports whether any
+// changed.
+func (w *GatewayWatcher) Resolve() bool {
+	addrs := make(map[string]Addrs, len(w.gateways))
+	for name, gw := range w.gateways {
+		a, err := resolveGateway(gw)
+		if err != nil {
+			w.s.Warnf("Failed to resolve gateway %s: %v", name, err)
+		}
+		addrs[name] = a
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changed := false
+	for name, a := range addrs {
+		if old, ok := w.addrs[name]; ok && old == a {
+			continue
+		}
+		w.s.Infof("Gateway %s resolved to %v", name, a)
+		changed = true
+	}
+	w.addrs = addrs
+	return changed
+}
+
+func (w *GatewayWatcher) notify() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
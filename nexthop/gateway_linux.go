@@ -0,0 +1,223 @@
+package nexthop
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// gatewaySettleDelay is how long to wait for further netlink updates
+	// before resolving the gateways, as changes such as an interface going
+	// down come in bursts.
+	gatewaySettleDelay = 200 * time.Millisecond
+	// gatewayResyncInterval is the interval the gateways are resolved at even
+	// without netlink updates, in case any was missed.
+	gatewayResyncInterval = time.Minute
+)
+
+// Run resolves the gateways and resolves them again on every change of the
+// routes, links and addresses of the kernel until ctx is done.
+func (w *GatewayWatcher) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	onError := func(err error) {
+		w.s.Warnf("Netlink subscription error: %v", err)
+	}
+	routeCh := make(chan netlink.RouteUpdate, 64)
+	if err := netlink.RouteSubscribeWithOptions(routeCh, done, netlink.RouteSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return fmt.Errorf("failed to subscribe to route updates: %w", err)
+	}
+	linkCh := make(chan netlink.LinkUpdate, 64)
+	if err := netlink.LinkSubscribeWithOptions(linkCh, done, netlink.LinkSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %w", err)
+	}
+	addrCh := make(chan netlink.AddrUpdate, 64)
+	if err := netlink.AddrSubscribeWithOptions(addrCh, done, netlink.AddrSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return fmt.Errorf("failed to subscribe to address updates: %w", err)
+	}
+
+	// wait returns once an update arrived or timeout fired. ok is false if
+	// the caller should return.
+	wait := func(timeout <-chan time.Time) (updated, ok bool, err error) {
+		var open bool
+		select {
+		case <-ctx.Done():
+			return false, false, nil
+		case _, open = <-routeCh:
+		case _, open = <-linkCh:
+		case _, open = <-addrCh:
+		case <-timeout:
+			return false, true, nil
+		}
+		if !open {
+			return false, false, errors.New("netlink subscription closed")
+		}
+		return true, true, nil
+	}
+
+	if w.Resolve() {
+		w.notify()
+	}
+
+	ticker := time.NewTicker(gatewayResyncInterval)
+	defer ticker.Stop()
+	for {
+		updated, ok, err := wait(ticker.C)
+		if !ok {
+			return err
+		}
+		if updated {
+			settle := time.NewTimer(gatewaySettleDelay)
+			for updated {
+				if updated, ok, err = wait(settle.C); !ok {
+					settle.Stop()
+					return err
+				}
+			}
+		}
+
+		if w.Resolve() {
+			w.notify()
+		}
+	}
+}
+
+func resolveGateway(gw *Gateway) (Addrs, error) {
+	filter := &netlink.Route{Table: gw.Table}
+	if filter.Table == 0 {
+		filter.Table = unix.RT_TABLE_MAIN
+	}
+	mask := netlink.RT_FILTER_TABLE
+	if gw.Interface != "" {
+		link, err := netlink.LinkByName(gw.Interface)
+		if err != nil {
+			// PPP interfaces only exist while connected.
+			if errors.As(err, &netlink.LinkNotFoundError{}) {
+				return Addrs{}, nil
+			}
+			return Addrs{}, err
+		}
+		filter.LinkIndex = link.Attrs().Index
+		mask |= netlink.RT_FILTER_OIF
+	}
+
+	var addrs Addrs
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, filter, mask)
+		if err != nil {
+			return Addrs{}, fmt.Errorf("failed to list routes: %w", err)
+		}
+		a := defaultGateway(routes, linkUp, peerAddr, linkName)
+		if family == netlink.FAMILY_V4 {
+			addrs.IP4 = a
+		} else {
+			addrs.IP6 = a
+		}
+	}
+	return addrs, nil
+}
+
+// defaultGateway returns the gateway of the most preferred default route of
+// routes whose link is up, as reported by up. The gateway of a route via a
+// point-to-point link without gateway is the peer address returned by peer.
+// Link-local gateways are only returned if there is no other, with the
+// name of their link returned by name as zone.
+func defaultGateway(routes []netlink.Route, up func(linkIndex int) bool, peer func(linkIndex, family int) netip.Addr, name func(linkIndex int) string) netip.Addr {
+	routes = slices.Clone(routes)
+	slices.SortStableFunc(routes, func(a, b netlink.Route) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+
+	var linkLocal netip.Addr
+	for _, r := range routes {
+		if r.Dst != nil && isNonZeroMask(r.Dst.Mask) || r.Type != unix.RTN_UNICAST {
+			continue
+		}
+
+		hops := []*netlink.NexthopInfo{{LinkIndex: r.LinkIndex, Gw: r.Gw, Flags: r.Flags}}
+		if len(r.MultiPath) > 0 {
+			hops = r.MultiPath
+		}
+		for _, hop := range hops {
+			if hop.Flags&unix.RTNH_F_LINKDOWN != 0 || !up(hop.LinkIndex) {
+				continue
+			}
+
+			var gw netip.Addr
+			if hop.Gw != nil {
+				gw, _ = netip.AddrFromSlice(hop.Gw)
+				gw = gw.Unmap()
+			} else {
+				gw = peer(hop.LinkIndex, r.Family)
+			}
+			switch {
+			case !gw.IsValid():
+			case !gw.IsLinkLocalUnicast():
+				return gw
+			case !linkLocal.IsValid():
+				linkLocal = gw.WithZone(name(hop.LinkIndex))
+			}
+		}
+	}
+	return linkLocal
+}
+
+func isNonZeroMask(m net.IPMask) bool {
+	ones, _ := m.Size()
+	return ones != 0
+}
+
+// linkUp reports whether the link is administratively and operationally up.
+func linkUp(linkIndex int) bool {
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return false
+	}
+	attrs := link.Attrs()
+	switch attrs.OperState {
+	case netlink.OperDown, netlink.OperLowerLayerDown, netlink.OperNotPresent:
+		return false
+	}
+	return attrs.Flags&net.FlagUp != 0
+}
+
+// linkName returns the name of the link, or its index if it is unknown.
+func linkName(linkIndex int) string {
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return strconv.Itoa(linkIndex)
+	}
+	return link.Attrs().Name
+}
+
+// peerAddr returns the peer address of a point-to-point link.
+func peerAddr(linkIndex, family int) netip.Addr {
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return netip.Addr{}
+	}
+	for _, a := range addrs {
+		if a.Peer == nil {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(a.Peer.IP); ok {
+			return addr.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
@@ -0,0 +1,114 @@
+package nexthop
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestDefaultGateway(t *testing.T) {
+	const (
+		eth0 = iota + 1
+		eth1
+		ppp0
+	)
+	up := func(linkIndex int) bool {
+		return linkIndex != eth1
+	}
+	peer := func(linkIndex, family int) netip.Addr {
+		if linkIndex == ppp0 && family == netlink.FAMILY_V4 {
+			return netip.MustParseAddr("100.64.0.1")
+		}
+		return netip.Addr{}
+	}
+	name := func(linkIndex int) string {
+		return map[int]string{eth0: "eth0", eth1: "eth1", ppp0: "ppp0"}[linkIndex]
+	}
+	route := func(dst string, linkIndex int, gw string, prio int) netlink.Route {
+		r := netlink.Route{LinkIndex: linkIndex, Priority: prio, Type: unix.RTN_UNICAST, Family: netlink.FAMILY_V4}
+		if dst != "" {
+			_, r.Dst, _ = net.ParseCIDR(dst)
+		}
+		if gw != "" {
+			r.Gw = net.ParseIP(gw)
+			if r.Gw.To4() == nil {
+				r.Family = netlink.FAMILY_V6
+			}
+		}
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		routes []netlink.Route
+		want   string
+	}{
+		{
+			name:   "default route",
+			routes: []netlink.Route{route("192.168.1.0/24", eth0, "", 0), route("", eth0, "192.168.1.1", 100)},
+			want:   "192.168.1.1",
+		},
+		{
+			name:   "explicit default prefix",
+			routes: []netlink.Route{route("0.0.0.0/0", eth0, "192.168.1.1", 0)},
+			want:   "192.168.1.1",
+		},
+		{
+			name:   "lowest metric",
+			routes: []netlink.Route{route("", eth0, "192.168.1.1", 200), route("", ppp0, "192.168.3.1", 100)},
+			want:   "192.168.3.1",
+		},
+		{
+			name:   "link down",
+			routes: []netlink.Route{route("", eth1, "192.168.2.1", 100), route("", eth0, "192.168.1.1", 200)},
+			want:   "192.168.1.1",
+		},
+		{
+			name:   "point-to-point",
+			routes: []netlink.Route{route("", ppp0, "", 0)},
+			want:   "100.64.0.1",
+		},
+		{
+			name:   "link-local IPv6",
+			routes: []netlink.Route{route("", eth0, "fe80::1", 100), route("", eth0, "2001:db8::1", 200)},
+			want:   "2001:db8::1",
+		},
+		{
+			name:   "only link-local IPv6",
+			routes: []netlink.Route{route("", eth1, "fe80::2", 100), route("", eth0, "fe80::1", 200)},
+			want:   "fe80::1%eth0",
+		},
+		{
+			name: "multipath",
+			routes: []netlink.Route{{Type: unix.RTN_UNICAST, Family: netlink.FAMILY_V4, MultiPath: []*netlink.NexthopInfo{
+				{LinkIndex: eth1, Gw: net.ParseIP("192.168.2.1")},
+				{LinkIndex: eth0, Gw: net.ParseIP("192.168.1.1")},
+			}}},
+			want: "192.168.1.1",
+		},
+		{
+			name:   "no default route",
+			routes: []netlink.Route{route("192.168.1.0/24", eth0, "", 0)},
+		},
+		{
+			name:   "unreachable default route",
+			routes: []netlink.Route{{Type: unix.RTN_UNREACHABLE, Family: netlink.FAMILY_V4}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := defaultGateway(tt.routes, up, peer, name)
+			want := netip.Addr{}
+			if tt.want != "" {
+				want = netip.MustParseAddr(tt.want)
+			}
+			if got != want {
+				t.Errorf("Expected gateway %v, got %v", want, got)
+			}
+		})
+	}
+}
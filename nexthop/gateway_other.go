@@ -0,0 +1,19 @@
+//go:build !linux
+
+package nexthop
+
+import (
+	"context"
+	"errors"
+)
+
+var errGatewayUnsupported = errors.New("gateway nexthops are only supported on Linux")
+
+// Run fails, as gateways are resolved through netlink, which is Linux only.
+func (w *GatewayWatcher) Run(ctx context.Context) error {
+	return errGatewayUnsupported
+}
+
+func resolveGateway(gw *Gateway) (Addrs, error) {
+	return Addrs{}, errGatewayUnsupported
+}
@@ -0,0 +1,115 @@
+package nexthop
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// icmpID is the identifier of the next ICMP prober. The identifiers
+// distinguish the replies to concurrent probers sharing the raw socket space.
+var icmpID atomic.Uint32
+
+func init() {
+	icmpID.Store(uint32(os.Getpid()))
+}
+
+// icmpProber succeeds if an ICMP echo reply is received from the target.
+// It uses raw sockets and thus requires CAP_NET_RAW.
+type icmpProber struct {
+	cfg    *CheckConfig
+	target netip.Addr
+	id     int
+	seq    atomic.Uint32
+}
+
+func newICMPProber(cfg *CheckConfig) (*icmpProber, error) {
+	target, err := netip.ParseAddr(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ICMP target %q: %w", cfg.Target, err)
+	}
+	return &icmpProber{
+		cfg:    cfg,
+		target: target,
+		id:     int(icmpID.Add(1) & 0xffff),
+	}, nil
+}
+
+func (p *icmpProber) Probe(ctx context.Context) error {
+	network, proto := "ip4:icmp", protocolICMP
+	var reqType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if p.target.Is6() {
+		network, proto = "ip6:ipv6-icmp", protocolIPv6ICMP
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	laddr := ""
+	if p.cfg.Source.IsValid() {
+		laddr = p.cfg.Source.String()
+	}
+	lc := net.ListenConfig{Control: bindToDeviceControl(p.cfg.Interface)}
+	conn, err := lc.ListenPacket(ctx, network, laddr)
+	if err != nil {
+		return fmt.Errorf("failed to open ICMP socket: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	seq := int(p.seq.Add(1) & 0xffff)
+	msg := icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: p.id, Seq: seq, Data: []byte("policybgp")},
+	}
+	// The checksum of ICMPv6 is filled in by the kernel.
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(b, &net.IPAddr{IP: p.target.AsSlice(), Zone: p.target.Zone()}); err != nil {
+		return fmt.Errorf("failed to send ICMP echo: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("no ICMP echo reply within %v", p.cfg.Timeout)
+			}
+			return fmt.Errorf("failed to receive ICMP echo reply: %w", err)
+		}
+
+		ipaddr, ok := peer.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ipaddr.IP); !ok || addr.Unmap() != p.target.WithZone("") {
+			continue
+		}
+
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == p.id && echo.Seq == seq {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package nexthop
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// latencySmoothing is the weight of a new measurement in the smoothed
+	// RTT and loss of a nexthop.
+	latencySmoothing = 0.25
+	// latencyWarmup is the number of measurements of every nexthop of a
+	// policy needed before its nexthop is selected by latency.
+	latencyWarmup = 3
+	// latencyDefaultTargets is the number of targets picked from the prefixes
+	// of a policy without explicit targets.
+	latencyDefaultTargets = 3
+)
+
+// LatencyConfig describes how the nexthop of a policy is selected by the
+// latency measured through each of its nexthops.
+type LatencyConfig struct {
+	// Targets are the addresses probed with ICMP echo through each nexthop.
+	// If a family has none, the first address after the network address of
+	// the largest prefixes of the policy is probed.
+	Targets  []netip.Addr
+	Interval time.Duration
+	Timeout  time.Duration
+	// Margin is how much lower the latency through another nexthop must be
+	// to switch to it.
+	Margin time.Duration
+	// HoldTime is the minimum time between two switches of a policy.
+	HoldTime time.Duration
+}
+
+// DefaultLatencyConfig returns a LatencyConfig with the default timers and
+// thresholds.
+func DefaultLatencyConfig() *LatencyConfig {
+	return &LatencyConfig{
+		Interval: 10 * time.Second,
+		Timeout:  2 * time.Second,
+		Margin:   10 * time.Millisecond,
+		HoldTime: 5 * time.Minute,
+	}
+}
+
+// ParseLatency parses a latency selection in the format
+// <policy>[,<key>=<value>...]. The keys are targets, whose addresses are
+// separated by "|", interval, timeout, margin and hold.
+func ParseLatency(s string) (policy string, cfg *LatencyConfig, err error) {
+	parts := strings.Split(s, ",")
+	if parts[0] == "" {
+		return "", nil, fmt.Errorf("invalid latency selection format %q. Expected <policy>[,<key>=<value>...]", s)
+	}
+
+	cfg = DefaultLatencyConfig()
+	for _, kv := range parts[1:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid option %q in latency selection %q. Expected <key>=<value>", kv, s)
+		}
+
+		switch k {
+		case "targets":
+			for _, ts := range strings.Split(v, "|") {
+				var target netip.Addr
+				if target, err = netip.ParseAddr(ts); err != nil {
+					break
+				}
+				cfg.Targets = append(cfg.Targets, target)
+			}
+		case "interval":
+			cfg.Interval, err = time.ParseDuration(v)
+		case "timeout":
+			cfg.Timeout, err = time.ParseDuration(v)
+		case "margin":
+			cfg.Margin, err = time.ParseDuration(v)
+		case "hold":
+			cfg.HoldTime, err = time.ParseDuration(v)
+		default:
+			return "", nil, fmt.Errorf("unknown option %q in latency selection %q", k, s)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s %q in latency selection %q: %w", k, v, s, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return "", nil, fmt.Errorf("invalid latency selection %q: %w", s, err)
+	}
+	return parts[0], cfg, nil
+}
+
+// Validate checks that cfg is usable.
+func (cfg *LatencyConfig) Validate() error {
+	if cfg.Interval <= 0 || cfg.Timeout <= 0 {
+		return fmt.Errorf("interval and timeout must be positive")
+	}
+	if cfg.Timeout > cfg.Interval {
+		return fmt.Errorf("timeout must not exceed the interval")
+	}
+	if cfg.Margin < 0 || cfg.HoldTime < 0 {
+		return fmt.Errorf("margin and hold must not be negative")
+	}
+	return nil
+}
+
+// LatencyStats are the smoothed measurements of the path through a nexthop.
+type LatencyStats struct {
+	// RTT is the smoothed round-trip time of the successful probes.
+	RTT time.Duration
+	// Loss is the smoothed share of lost probes, between 0 and 1.
+	Loss float64
+	// Samples is the number of measurements.
+	Samples int
+}
+
+// record adds a measurement of the probes sent in one interval: the mean RTT
+// of the successful ones, and the share of lost ones.
+func (st *LatencyStats) record(rtt time.Duration, loss float64) {
+	if st.Samples == 0 {
+		st.Loss = loss
+		if loss < 1 {
+			st.RTT = rtt
+		}
+	} else {
+		st.Loss += latencySmoothing * (loss - st.Loss)
+		if loss < 1 {
+			st.RTT += time.Duration(latencySmoothing * float64(rtt-st.RTT))
+		}
+	}
+	st.Samples++
+}
+
+// score returns the expected latency through the nexthop, counting lost
+// probes as timeout.
+func (st LatencyStats) score(timeout time.Duration) time.Duration {
+	return time.Duration((1-st.Loss)*float64(st.RTT) + st.Loss*float64(timeout))
+}
+
+func (st LatencyStats) String() string {
+	return fmt.Sprintf("%v RTT, %.0f%% loss", st.RTT.Round(100*time.Microsecond), st.Loss*100)
+}
+
+// LatencyCheck is the latency-driven selection of the nexthop of a policy.
+type LatencyCheck struct {
+	Policy string
+	// NextHops are the candidates in order of preference. The nexthop of
+	// each address family with at least two candidates is selected.
+	NextHops []netip.Addr
+	Config   *LatencyConfig
+}
+
+// latencyPath is a candidate nexthop and the path its probes are sent through.
+type latencyPath struct {
+	nh     netip.Addr
+	source netip.Addr
+	iface  string
+	stats  LatencyStats
+}
+
+// latencySelection selects the nexthop of one address family of a policy.
+type latencySelection struct {
+	policy string
+	family string
+	cfg    *LatencyConfig
+	paths  []*latencyPath
+
+	selected netip.Addr
+	switched time.Time
+}
+
+// decide selects the nexthop with the lowest score, unless the currently
+// selected one is within the margin or switched less than the hold time
+// before now. It reports whether the selection changed.
+func (sel *latencySelection) decide(now time.Time, s *zap.SugaredLogger) bool {
+	var cur, best *latencyPath
+	for _, p := range sel.paths {
+		if p.stats.Samples < latencyWarmup {
+			return false
+		}
+		if p.nh == sel.selected {
+			cur = p
+		}
+		if best == nil || p.stats.score(sel.cfg.Timeout) < best.stats.score(sel.cfg.Timeout) {
+			best = p
+		}
+	}
+	if best == cur {
+		return false
+	}
+	if cur.stats.score(sel.cfg.Timeout)-best.stats.score(sel.cfg.Timeout) < sel.cfg.Margin {
+		return false
+	}
+	if !sel.switched.IsZero() && now.Sub(sel.switched) < sel.cfg.HoldTime {
+		return false
+	}
+
+	s.Infof("Policy %s switches its %s nexthop from %s (%v) to %s (%v)",
+		sel.policy, sel.family, cur.nh, cur.stats, best.nh, best.stats)
+	sel.selected = best.nh
+	sel.switched = now
+	return true
+}
+
+// LatencyMonitor measures the latency through the nexthops of policies and
+// selects the nexthop of each with the lowest latency. The probes through a
+// nexthop are sent from the source address and interface of its health
+// check, which must route them through the nexthop.
+type LatencyMonitor struct {
+	s          *zap.SugaredLogger
+	selections []*latencySelection
+	changed    chan struct{}
+
+	// mu guards prefixes and the stats and selected nexthops of selections.
+	mu       sync.Mutex
+	prefixes map[string][]netip.Prefix
+}
+
+// NewLatencyMonitor returns a LatencyMonitor running checks, sending the
+// probes along the paths of the health checks of health.
+func NewLatencyMonitor(checks []*LatencyCheck, health *Monitor, l *zap.Logger) (*LatencyMonitor, error) {
+	m := &LatencyMonitor{
+		s:        l.Named("latency").Sugar(),
+		changed:  make(chan struct{}, 1),
+		prefixes: make(map[string][]netip.Prefix),
+	}
+
+	for _, chk := range checks {
+		var added bool
+		for _, is4 := range []bool{true, false} {
+			var nhs []netip.Addr
+			for _, nh := range chk.NextHops {
+				if nh.Is4() == is4 {
+					nhs = append(nhs, nh)
+				}
+			}
+			if len(nhs) < 2 {
+				continue
+			}
+
+			sel := &latencySelection{
+				policy:   chk.Policy,
+				family:   familyName(is4),
+				cfg:      chk.Config,
+				selected: nhs[0],
+			}
+			for _, nh := range nhs {
+				c, ok := health.checkers[nh]
+				if !ok || !c.cfg.Source.IsValid() && c.cfg.Interface == "" {
+					return nil, fmt.Errorf("nexthop %s of policy %s needs a health check with a source or interface to send latency probes through", nh, chk.Policy)
+				}
+				p := &latencyPath{nh: nh, iface: c.cfg.Interface}
+				if c.cfg.Source.Is4() == is4 {
+					p.source = c.cfg.Source
+				}
+				sel.paths = append(sel.paths, p)
+			}
+			m.selections = append(m.selections, sel)
+			added = true
+		}
+		if !added {
+			return nil, fmt.Errorf("policy %s needs at least two nexthops of an address family to select one by latency", chk.Policy)
+		}
+	}
+	return m, nil
+}
+
+func familyName(is4 bool) string {
+	if is4 {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// Changed returns a channel receiving a value after the nexthop selected for
+// any policy changed. Consecutive changes may be coalesced.
+func (m *LatencyMonitor) Changed() <-chan struct{} {
+	return m.changed
+}
+
+// SetPrefixes sets the prefixes of policy the default targets are picked from.
+func (m *LatencyMonitor) SetPrefixes(policy string, prefixes []netip.Prefix) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prefixes[policy] = prefixes
+}
+
+// Selected returns the nexthop selected for the address family of policy
+// selected by is4. ok is false if the nexthop of the family is not selected
+// by latency.
+func (m *LatencyMonitor) Selected(policy string, is4 bool) (nh netip.Addr, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sel := range m.selections {
+		if sel.policy == policy && sel.family == familyName(is4) {
+			return sel.selected, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// targets returns the addresses probed for sel.
+func (m *LatencyMonitor) targets(sel *latencySelection) []netip.Addr {
+	var targets []netip.Addr
+	for _, t := range sel.cfg.Targets {
+		if familyName(t.Is4()) == sel.family {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) > 0 {
+		return targets
+	}
+
+	m.mu.Lock()
+	var prefixes []netip.Prefix
+	for _, pre := range m.prefixes[sel.policy] {
+		if familyName(pre.Addr().Is4()) == sel.family {
+			prefixes = append(prefixes, pre)
+		}
+	}
+	m.mu.Unlock()
+	return defaultTargets(prefixes)
+}
+
+// defaultTargets returns the first address after the network address of the
+// largest of prefixes, up to latencyDefaultTargets.
+func defaultTargets(prefixes []netip.Prefix) []netip.Addr {
+	prefixes = slices.Clone(prefixes)
+	slices.SortStableFunc(prefixes, func(a, b netip.Prefix) int {
+		return cmp.Compare(a.Bits(), b.Bits())
+	})
+
+	var targets []netip.Addr
+	for _, pre := range prefixes {
+		if len(targets) == latencyDefaultTargets {
+			break
+		}
+		if t := pre.Masked().Addr().Next(); pre.Contains(t) {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// Run measures the latency through the nexthops until ctx is done.
+func (m *LatencyMonitor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, sel := range m.selections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runSelection(ctx, sel)
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *LatencyMonitor) runSelection(ctx context.Context, sel *latencySelection) {
+	m.s.Infof("Selecting the %s nexthop of policy %s by latency every %v (margin %v, hold %v)",
+		sel.family, sel.policy, sel.cfg.Interval, sel.cfg.Margin, sel.cfg.HoldTime)
+
+	ticker := time.NewTicker(sel.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		targets := m.targets(sel)
+		if len(targets) == 0 {
+			m.s.Debugf("No %s targets to probe for policy %s", sel.family, sel.policy)
+		} else {
+			var wg sync.WaitGroup
+			for _, p := range sel.paths {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					m.measure(ctx, sel, p, targets)
+				}()
+			}
+			wg.Wait()
+			if ctx.Err() != nil {
+				return
+			}
+
+			m.mu.Lock()
+			changed := sel.decide(time.Now(), m.s)
+			m.mu.Unlock()
+			if changed {
+				select {
+				case m.changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// measure probes targets through p once each and records the result.
+func (m *LatencyMonitor) measure(ctx context.Context, sel *latencySelection, p *latencyPath, targets []netip.Addr) {
+	var total time.Duration
+	var ok int
+	var lastErr error
+	for _, target := range targets {
+		prober, err := newICMPProber(&CheckConfig{
+			Method:    MethodICMP,
+			Target:    target.String(),
+			Source:    p.source,
+			Interface: p.iface,
+			Timeout:   sel.cfg.Timeout,
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, sel.cfg.Timeout)
+		start := time.Now()
+		err = prober.Probe(pctx)
+		rtt := time.Since(start)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		total += rtt
+		ok++
+	}
+
+	var rtt time.Duration
+	if ok > 0 {
+		rtt = total / time.Duration(ok)
+	}
+	loss := 1 - float64(ok)/float64(len(targets))
+	if lastErr != nil {
+		m.s.Debugf("Latency probe of policy %s via %s failed: %v", sel.policy, p.nh, lastErr)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p.stats.record(rtt, loss)
+}
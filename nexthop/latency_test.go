@@ -0,0 +1,171 @@
+package nexthop
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseLatency(t *testing.T) {
+	policy, cfg, err := ParseLatency("as2906,targets=198.51.100.1|2001:db8::1,interval=5s,timeout=1s,margin=20ms,hold=1m")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if policy != "as2906" {
+		t.Errorf("Expected policy as2906, got %q", policy)
+	}
+	want := LatencyConfig{
+		Targets:  []netip.Addr{netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("2001:db8::1")},
+		Interval: 5 * time.Second,
+		Timeout:  time.Second,
+		Margin:   20 * time.Millisecond,
+		HoldTime: time.Minute,
+	}
+	if !slices.Equal(cfg.Targets, want.Targets) || cfg.Interval != want.Interval || cfg.Timeout != want.Timeout ||
+		cfg.Margin != want.Margin || cfg.HoldTime != want.HoldTime {
+		t.Errorf("Expected %+v, got %+v", want, *cfg)
+	}
+
+	if _, cfg, err = ParseLatency("as2906"); err != nil || cfg.Targets != nil || cfg.Interval != DefaultLatencyConfig().Interval {
+		t.Errorf("Expected the defaults, got %+v, %v", cfg, err)
+	}
+
+	for _, s := range []string{
+		"",
+		"as2906,targets=example.com",
+		"as2906,interval",
+		"as2906,interval=0s",
+		"as2906,interval=1s,timeout=2s",
+		"as2906,margin=-1ms",
+		"as2906,bogus=1",
+	} {
+		if _, _, err := ParseLatency(s); err == nil {
+			t.Errorf("Expected error for %q, got nil", s)
+		}
+	}
+}
+
+func TestLatencyStatsRecord(t *testing.T) {
+	var st LatencyStats
+	st.record(20*time.Millisecond, 0)
+	if st.RTT != 20*time.Millisecond || st.Loss != 0 || st.Samples != 1 {
+		t.Errorf("Expected the first measurement to be taken as is, got %+v", st)
+	}
+	st.record(40*time.Millisecond, 0.5)
+	if st.RTT != 25*time.Millisecond || st.Loss != 0.125 {
+		t.Errorf("Expected 25ms RTT and 12.5%% loss, got %+v", st)
+	}
+	// Losing all probes leaves the RTT alone.
+	st.record(0, 1)
+	if st.RTT != 25*time.Millisecond || st.Loss != 0.34375 {
+		t.Errorf("Expected 25ms RTT and 34.375%% loss, got %+v", st)
+	}
+	if got := st.score(time.Second); got < 360*time.Millisecond || got > 361*time.Millisecond {
+		t.Errorf("Expected a score of about 360ms, got %v", got)
+	}
+}
+
+func TestLatencySelectionDecide(t *testing.T) {
+	a := netip.MustParseAddr("192.168.1.1")
+	b := netip.MustParseAddr("192.168.2.1")
+	cfg := &LatencyConfig{Timeout: time.Second, Margin: 10 * time.Millisecond, HoldTime: time.Minute}
+	pa, pb := &latencyPath{nh: a}, &latencyPath{nh: b}
+	sel := &latencySelection{policy: "as2906", family: "IPv4", cfg: cfg, paths: []*latencyPath{pa, pb}, selected: a}
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := zap.NewNop().Sugar()
+
+	steps := []struct {
+		at       time.Duration
+		rttA     time.Duration
+		rttB     time.Duration
+		selected netip.Addr
+	}{
+		// Still warming up.
+		{at: 0, rttA: 50 * time.Millisecond, rttB: 20 * time.Millisecond, selected: a},
+		{at: 10 * time.Second, rttA: 50 * time.Millisecond, rttB: 20 * time.Millisecond, selected: a},
+		{at: 20 * time.Second, rttA: 50 * time.Millisecond, rttB: 20 * time.Millisecond, selected: b},
+		// A is better again, but held down.
+		{at: 30 * time.Second, rttA: 10 * time.Millisecond, rttB: 100 * time.Millisecond, selected: b},
+		{at: 90 * time.Second, rttA: 10 * time.Millisecond, rttB: 100 * time.Millisecond, selected: a},
+	}
+	for i, step := range steps {
+		pa.stats.record(step.rttA, 0)
+		pb.stats.record(step.rttB, 0)
+		sel.decide(t0.Add(step.at), s)
+		if sel.selected != step.selected {
+			t.Errorf("Step %d: expected %s selected, got %s", i, step.selected, sel.selected)
+		}
+	}
+
+	// Differences within the margin keep the selection.
+	pa.stats = LatencyStats{RTT: 25 * time.Millisecond, Samples: latencyWarmup}
+	pb.stats = LatencyStats{RTT: 20 * time.Millisecond, Samples: latencyWarmup}
+	if sel.decide(t0.Add(time.Hour), s) || sel.selected != a {
+		t.Errorf("Expected %s to stay selected within the margin, got %s", a, sel.selected)
+	}
+	// Loss counts as timeout.
+	pa.stats.Loss = 0.1
+	if !sel.decide(t0.Add(time.Hour), s) || sel.selected != b {
+		t.Errorf("Expected %s to be selected over a lossy nexthop, got %s", b, sel.selected)
+	}
+}
+
+func TestDefaultTargets(t *testing.T) {
+	got := defaultTargets([]netip.Prefix{
+		netip.MustParsePrefix("8.8.8.0/24"),
+		netip.MustParsePrefix("8.34.208.0/20"),
+		netip.MustParsePrefix("8.8.4.4/32"),
+		netip.MustParsePrefix("35.192.0.0/12"),
+		netip.MustParsePrefix("34.0.0.0/15"),
+	})
+	want := []netip.Addr{
+		netip.MustParseAddr("35.192.0.1"),
+		netip.MustParseAddr("34.0.0.1"),
+		netip.MustParseAddr("8.34.208.1"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected targets %v, got %v", want, got)
+	}
+}
+
+func TestNewLatencyMonitor(t *testing.T) {
+	a := netip.MustParseAddr("192.168.1.1")
+	b := netip.MustParseAddr("192.168.2.1")
+	a6 := netip.MustParseAddr("2001:db8:1::1")
+	checkVia := func(nh netip.Addr, iface string) *Check {
+		cfg := DefaultCheckConfig()
+		cfg.Target = nh.String()
+		cfg.Interface = iface
+		return &Check{NextHops: []netip.Addr{nh}, Config: cfg}
+	}
+
+	health, err := NewMonitor([]*Check{checkVia(a, "eth1"), checkVia(b, "eth2"), checkVia(a6, "")}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create health monitor: %v", err)
+	}
+	m, err := NewLatencyMonitor([]*LatencyCheck{
+		{Policy: "as2906", NextHops: []netip.Addr{a, b, a6}, Config: DefaultLatencyConfig()},
+	}, health, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create latency monitor: %v", err)
+	}
+	if nh, ok := m.Selected("as2906", true); !ok || nh != a {
+		t.Errorf("Expected %s selected initially, got %s, %v", a, nh, ok)
+	}
+	// A single IPv6 nexthop is not selected by latency.
+	if _, ok := m.Selected("as2906", false); ok {
+		t.Errorf("Expected no IPv6 selection")
+	}
+
+	for name, checks := range map[string][]*LatencyCheck{
+		"single nexthop": {{Policy: "as2906", NextHops: []netip.Addr{a, a6}, Config: DefaultLatencyConfig()}},
+		"no path":        {{Policy: "as2906", NextHops: []netip.Addr{a, b, a6, netip.MustParseAddr("2001:db8:2::1")}, Config: DefaultLatencyConfig()}},
+	} {
+		if _, err := NewLatencyMonitor(checks, health, zap.NewNop()); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package nexthop
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DirectionTx = "tx"
+	DirectionRx = "rx"
+
+	// loadEventHistory is the number of shifts and restores kept by a
+	// LoadMonitor.
+	loadEventHistory = 100
+)
+
+// LoadConfig describes when a policy is shifted off a link by the
+// utilisation of its interface.
+type LoadConfig struct {
+	// Interface is the network interface whose counters are read.
+	Interface string
+	// Direction is DirectionTx or DirectionRx.
+	Direction string
+	// Capacity is the bandwidth of the link in bits per second. 0 takes the
+	// speed the interface reports, which virtual interfaces such as PPPoE
+	// lack.
+	Capacity uint64
+	// Threshold is the utilisation, between 0 and 1, above which the policy
+	// is shifted.
+	Threshold float64
+	// Clear is the utilisation below which the policy is shifted back.
+	Clear float64
+	// For is how long the utilisation must stay above Threshold, or below
+	// Clear, before the policy is shifted.
+	For time.Duration
+	// Cooldown is the minimum time between two shifts of the policy.
+	Cooldown time.Duration
+	// Interval is the interval between reads of the counters.
+	Interval time.Duration
+}
+
+// DefaultLoadConfig returns a LoadConfig with the default timers and
+// thresholds.
+func DefaultLoadConfig() *LoadConfig {
+	return &LoadConfig{
+		Direction: DirectionTx,
+		Threshold: 0.8,
+		Clear:     0.6,
+		For:       5 * time.Minute,
+		Cooldown:  15 * time.Minute,
+		Interval:  10 * time.Second,
+	}
+}
+
+// ParseLoadRule parses a load rule in the format
+// <policy>,interface=<interface>,to=<nexthop>[,<key>=<value>...]. The other
+// keys are direction, capacity, threshold, clear, for, cooldown and interval.
+// Capacities are in bits per second with an optional k, M or G suffix, and
+// utilisations are percentages with an optional "%" suffix. The nexthop is
+// returned unparsed, as it may refer to a named nexthop.
+func ParseLoadRule(s string) (policy, to string, cfg *LoadConfig, err error) {
+	parts := strings.Split(s, ",")
+	if parts[0] == "" {
+		return "", "", nil, fmt.Errorf("invalid load rule format %q. Expected <policy>,interface=<interface>,to=<nexthop>[,<key>=<value>...]", s)
+	}
+
+	cfg = DefaultLoadConfig()
+	for _, kv := range parts[1:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return "", "", nil, fmt.Errorf("invalid option %q in load rule %q. Expected <key>=<value>", kv, s)
+		}
+
+		switch k {
+		case "interface":
+			cfg.Interface = v
+		case "to":
+			to = v
+		case "direction":
+			cfg.Direction = v
+		case "capacity":
+			cfg.Capacity, err = parseRate(v)
+		case "threshold":
+			cfg.Threshold, err = parsePercent(v)
+		case "clear":
+			cfg.Clear, err = parsePercent(v)
+		case "for":
+			cfg.For, err = time.ParseDuration(v)
+		case "cooldown":
+			cfg.Cooldown, err = time.ParseDuration(v)
+		case "interval":
+			cfg.Interval, err = time.ParseDuration(v)
+		default:
+			return "", "", nil, fmt.Errorf("unknown option %q in load rule %q", k, s)
+		}
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid %s %q in load rule %q: %w", k, v, s, err)
+		}
+	}
+
+	if to == "" {
+		return "", "", nil, fmt.Errorf("load rule %q requires the nexthop to shift to", s)
+	}
+	if err := cfg.Validate(); err != nil {
+		return "", "", nil, fmt.Errorf("invalid load rule %q: %w", s, err)
+	}
+	return parts[0], to, cfg, nil
+}
+
+// parseRate parses a rate in bits per second with an optional k, M or G
+// suffix.
+func parseRate(s string) (uint64, error) {
+	mult := uint64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   uint64
+	}{{"k", 1e3}, {"M", 1e6}, {"G", 1e9}} {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, mult = n, u.mult
+			break
+		}
+	}
+	r, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if r > math.MaxUint64/mult {
+		return 0, fmt.Errorf("rate out of range")
+	}
+	return r * mult, nil
+}
+
+// parsePercent parses a percentage with an optional "%" suffix into a
+// fraction.
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	return p / 100, nil
+}
+
+// Validate checks that cfg is consistent.
+func (cfg *LoadConfig) Validate() error {
+	if cfg.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	if cfg.Direction != DirectionTx && cfg.Direction != DirectionRx {
+		return fmt.Errorf("direction must be %s or %s, got %q", DirectionTx, DirectionRx, cfg.Direction)
+	}
+	if cfg.Threshold <= 0 || cfg.Threshold > 1 {
+		return fmt.Errorf("threshold must be above 0%% and at most 100%%, got %g%%", cfg.Threshold*100)
+	}
+	if cfg.Clear < 0 || cfg.Clear > cfg.Threshold {
+		return fmt.Errorf("clear must be between 0%% and the threshold, got %g%%", cfg.Clear*100)
+	}
+	if cfg.For < 0 {
+		return fmt.Errorf("for must not be negative")
+	}
+	if cfg.Cooldown < 0 {
+		return fmt.Errorf("cooldown must not be negative")
+	}
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	return nil
+}
+
+// LoadRule shifts a policy to other nexthops while the utilisation of a link
+// is high.
+type LoadRule struct {
+	Policy string
+	// To are the nexthops preferred while the policy is shifted, of either
+	// address family.
+	To     []netip.Addr
+	Config *LoadConfig
+}
+
+// LoadEvent records a shift of a policy.
+type LoadEvent struct {
+	Time      time.Time
+	Policy    string
+	Interface string
+	Direction string
+	// Utilization is the utilisation of the link which triggered the event.
+	Utilization float64
+	// Shifted is set if the policy was shifted to the nexthops of the rule,
+	// and unset if it was shifted back.
+	Shifted bool
+}
+
+// LoadStatus is the state of a LoadRule.
+type LoadStatus struct {
+	Policy    string
+	Interface string
+	Direction string
+	// Utilization is the latest utilisation of the link, or -1 if it was not
+	// measured yet.
+	Utilization float64
+	Shifted     bool
+	// Since is the time of the last shift, or zero if the policy was never
+	// shifted.
+	Since time.Time
+}
+
+// Counters holds the byte counters of a network interface.
+type Counters struct {
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// loadState is the hysteresis of a LoadRule.
+type loadState struct {
+	shifted bool
+	// above and below are the times the utilisation rose above the threshold
+	// or fell below the clear level, or zero if it is not.
+	above time.Time
+	below time.Time
+	// changed is the time of the last shift.
+	changed time.Time
+}
+
+// record updates st with a utilisation measured at now, and reports whether
+// the policy is shifted or shifted back.
+func (st *loadState) record(cfg *LoadConfig, util float64, now time.Time) bool {
+	switch {
+	case util > cfg.Threshold:
+		if st.above.IsZero() {
+			st.above = now
+		}
+		st.below = time.Time{}
+	case util < cfg.Clear:
+		if st.below.IsZero() {
+			st.below = now
+		}
+		st.above = time.Time{}
+	default:
+		st.above, st.below = time.Time{}, time.Time{}
+	}
+
+	if !st.changed.IsZero() && now.Sub(st.changed) < cfg.Cooldown {
+		return false
+	}
+	since := st.above
+	if st.shifted {
+		since = st.below
+	}
+	if since.IsZero() || now.Sub(since) < cfg.For {
+		return false
+	}
+	st.shifted = !st.shifted
+	st.changed = now
+	return true
+}
+
+type loadRule struct {
+	*LoadRule
+
+	st   loadState
+	util float64
+	// last holds the counters read at lastAt, if lastAt is set.
+	last   Counters
+	lastAt time.Time
+}
+
+// LoadMonitor reads the counters of the interfaces of LoadRules, and shifts
+// their policies to other nexthops while the utilisation of the links is
+// high.
+type LoadMonitor struct {
+	s       *zap.SugaredLogger
+	rules   []*loadRule
+	changed chan struct{}
+	// counters and speed read the counters and the speed in bits per second
+	// of an interface, and are replaced by tests.
+	counters func(iface string) (Counters, error)
+	speed    func(iface string) (uint64, error)
+
+	mu     sync.Mutex
+	events []LoadEvent
+}
+
+// NewLoadMonitor returns a LoadMonitor running rules. Each policy may only
+// have one rule.
+func NewLoadMonitor(rules []*LoadRule, l *zap.Logger) (*LoadMonitor, error) {
+	m := &LoadMonitor{
+		s:        l.Named("load").Sugar(),
+		changed:  make(chan struct{}, 1),
+		counters: readCounters,
+		speed:    readSpeed,
+	}
+	for _, r := range rules {
+		if slices.ContainsFunc(m.rules, func(o *loadRule) bool { return o.Policy == r.Policy }) {
+			return nil, fmt.Errorf("policy %q has more than one load rule", r.Policy)
+		}
+		if len(r.To) == 0 {
+			return nil, fmt.Errorf("load rule of policy %q has no nexthop to shift to", r.Policy)
+		}
+		m.rules = append(m.rules, &loadRule{LoadRule: r, util: -1})
+	}
+	return m, nil
+}
+
+// Changed returns a channel receiving a value after any policy was shifted.
+// Consecutive changes may be coalesced.
+func (m *LoadMonitor) Changed() <-chan struct{} {
+	return m.changed
+}
+
+// Shifted returns the nexthops the policy is shifted to. ok is false if the
+// policy is not shifted.
+func (m *LoadMonitor) Shifted(policy string) (nhs []netip.Addr, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.rules {
+		if r.Policy == policy && r.st.shifted {
+			return r.To, true
+		}
+	}
+	return nil, false
+}
+
+// Status returns the state of the rules.
+func (m *LoadMonitor) Status() []LoadStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sts := make([]LoadStatus, 0, len(m.rules))
+	for _, r := range m.rules {
+		sts = append(sts, LoadStatus{
+			Policy:      r.Policy,
+			Interface:   r.Config.Interface,
+			Direction:   r.Config.Direction,
+			Utilization: r.util,
+			Shifted:     r.st.shifted,
+			Since:       r.st.changed,
+		})
+	}
+	return sts
+}
+
+// Events returns the latest shifts, oldest first.
+func (m *LoadMonitor) Events() []LoadEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.events)
+}
+
+// Run reads the counters of the interfaces until ctx is done.
+func (m *LoadMonitor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range m.rules {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runRule(ctx, r)
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *LoadMonitor) runRule(ctx context.Context, r *loadRule) {
+	m.s.Infof("Shifting policy %s to %v while %s %s is above %g%% for %v (clear %g%%, cooldown %v)",
+		r.Policy, r.To, r.Config.Interface, r.Config.Direction, r.Config.Threshold*100, r.Config.For,
+		r.Config.Clear*100, r.Config.Cooldown)
+
+	ticker := time.NewTicker(r.Config.Interval)
+	defer ticker.Stop()
+
+	warned := false
+	for {
+		if err := m.sample(r, time.Now()); err != nil {
+			if !warned {
+				m.s.Warnf("Failed to measure the utilisation of %s for policy %s: %v", r.Config.Interface, r.Policy, err)
+			}
+			warned = true
+		} else {
+			warned = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample reads the counters of the interface of r at now, and shifts its
+// policy if needed.
+func (m *LoadMonitor) sample(r *loadRule, now time.Time) error {
+	c, err := m.counters(r.Config.Interface)
+	if err != nil {
+		return err
+	}
+	capacity := r.Config.Capacity
+	if capacity == 0 {
+		if capacity, err = m.speed(r.Config.Interface); err != nil {
+			return err
+		}
+		if capacity == 0 {
+			return fmt.Errorf("speed of %s is unknown, set the capacity of the link", r.Config.Interface)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	last, lastAt := r.last, r.lastAt
+	r.last, r.lastAt = c, now
+	cur, prev := c.TxBytes, last.TxBytes
+	if r.Config.Direction == DirectionRx {
+		cur, prev = c.RxBytes, last.RxBytes
+	}
+	elapsed := now.Sub(lastAt).Seconds()
+	// The first read and counters reset by the interface going away are
+	// only a baseline.
+	if lastAt.IsZero() || cur < prev || elapsed <= 0 {
+		return nil
+	}
+
+	r.util = float64(cur-prev) * 8 / elapsed / float64(capacity)
+	m.s.Debugf("Utilisation of %s %s is %.1f%%", r.Config.Interface, r.Config.Direction, r.util*100)
+	if !r.st.record(r.Config, r.util, now) {
+		return nil
+	}
+
+	if r.st.shifted {
+		m.s.Warnf("Shifting policy %s to %v: %s %s at %.1f%% has been above %g%% for %v",
+			r.Policy, r.To, r.Config.Interface, r.Config.Direction, r.util*100, r.Config.Threshold*100, r.Config.For)
+	} else {
+		m.s.Infof("Shifting policy %s back: %s %s at %.1f%% has been below %g%% for %v",
+			r.Policy, r.Config.Interface, r.Config.Direction, r.util*100, r.Config.Clear*100, r.Config.For)
+	}
+	m.events = append(m.events, LoadEvent{
+		Time:        now,
+		Policy:      r.Policy,
+		Interface:   r.Config.Interface,
+		Direction:   r.Config.Direction,
+		Utilization: r.util,
+		Shifted:     r.st.shifted,
+	})
+	if len(m.events) > loadEventHistory {
+		m.events = slices.Delete(m.events, 0, len(m.events)-loadEventHistory)
+	}
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package nexthop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysClassNet is the directory of the network interfaces in sysfs.
+var sysClassNet = "/sys/class/net"
+
+func readSysfsUint(iface, name string) (uint64, error) {
+	bs, err := os.ReadFile(filepath.Join(sysClassNet, iface, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(bs)), 10, 64)
+}
+
+func readCounters(iface string) (Counters, error) {
+	rx, err := readSysfsUint(iface, "statistics/rx_bytes")
+	if err != nil {
+		return Counters{}, fmt.Errorf("failed to read counters of %s: %w", iface, err)
+	}
+	tx, err := readSysfsUint(iface, "statistics/tx_bytes")
+	if err != nil {
+		return Counters{}, fmt.Errorf("failed to read counters of %s: %w", iface, err)
+	}
+	return Counters{RxBytes: rx, TxBytes: tx}, nil
+}
+
+// readSpeed returns the speed of iface in bits per second, or 0 if the
+// interface does not report its speed.
+func readSpeed(iface string) (uint64, error) {
+	bs, err := os.ReadFile(filepath.Join(sysClassNet, iface, "speed"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("failed to read speed of %s: %w", iface, err)
+		}
+		// Virtual interfaces fail with EINVAL.
+		return 0, nil
+	}
+	// The speed is in Mbit/s, and -1 if unknown.
+	mbps, err := strconv.ParseInt(strings.TrimSpace(string(bs)), 10, 64)
+	if err != nil || mbps <= 0 {
+		return 0, nil
+	}
+	return uint64(mbps) * 1e6, nil
+}
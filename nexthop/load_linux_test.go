@@ -0,0 +1,15 @@
+package nexthop
+
+import "testing"
+
+func TestReadCounters(t *testing.T) {
+	if _, err := readCounters("lo"); err != nil {
+		t.Errorf("Failed to read counters of lo: %v", err)
+	}
+	if _, err := readCounters("nonexistent0"); err == nil {
+		t.Errorf("Expected error for a nonexistent interface, got nil")
+	}
+	if speed, err := readSpeed("lo"); err != nil || speed != 0 {
+		t.Errorf("Expected unknown speed of lo, got %d, %v", speed, err)
+	}
+}
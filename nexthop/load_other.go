@@ -0,0 +1,15 @@
+//go:build !linux
+
+package nexthop
+
+import "errors"
+
+var errLoadUnsupported = errors.New("interface counters are only supported on Linux")
+
+func readCounters(iface string) (Counters, error) {
+	return Counters{}, errLoadUnsupported
+}
+
+func readSpeed(iface string) (uint64, error) {
+	return 0, errLoadUnsupported
+}
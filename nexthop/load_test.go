@@ -0,0 +1,158 @@
+package nexthop
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseLoadRule(t *testing.T) {
+	policy, to, cfg, err := ParseLoadRule("as2906,interface=ppp0,to=isp-b,direction=rx,capacity=100M,threshold=90%,clear=50,for=1m,cooldown=2m,interval=5s")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if policy != "as2906" || to != "isp-b" {
+		t.Errorf("Expected policy as2906 shifted to isp-b, got %q and %q", policy, to)
+	}
+	want := LoadConfig{
+		Interface: "ppp0",
+		Direction: DirectionRx,
+		Capacity:  100e6,
+		Threshold: 0.9,
+		Clear:     0.5,
+		For:       time.Minute,
+		Cooldown:  2 * time.Minute,
+		Interval:  5 * time.Second,
+	}
+	if *cfg != want {
+		t.Errorf("Expected %+v, got %+v", want, *cfg)
+	}
+
+	if _, _, cfg, err = ParseLoadRule("as2906,interface=eth0,to=192.0.2.1"); err != nil || *cfg != *withInterface(DefaultLoadConfig(), "eth0") {
+		t.Errorf("Expected the defaults, got %+v, %v", cfg, err)
+	}
+
+	for _, s := range []string{
+		"",
+		"as2906,to=192.0.2.1",
+		"as2906,interface=eth0",
+		"as2906,interface=eth0,to=192.0.2.1,direction=both",
+		"as2906,interface=eth0,to=192.0.2.1,capacity=1T",
+		"as2906,interface=eth0,to=192.0.2.1,capacity=99999999999G",
+		"as2906,interface=eth0,to=192.0.2.1,threshold=0",
+		"as2906,interface=eth0,to=192.0.2.1,threshold=120%",
+		"as2906,interface=eth0,to=192.0.2.1,threshold=50%,clear=60%",
+		"as2906,interface=eth0,to=192.0.2.1,interval=0s",
+		"as2906,interface=eth0,to=192.0.2.1,cooldown=-1s",
+		"as2906,interface=eth0,to=192.0.2.1,bogus=1",
+	} {
+		if _, _, _, err := ParseLoadRule(s); err == nil {
+			t.Errorf("Expected error for %q, got nil", s)
+		}
+	}
+}
+
+func withInterface(cfg *LoadConfig, iface string) *LoadConfig {
+	cfg.Interface = iface
+	return cfg
+}
+
+func TestLoadStateRecord(t *testing.T) {
+	cfg := &LoadConfig{Threshold: 0.8, Clear: 0.5, For: time.Minute, Cooldown: 10 * time.Minute}
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	var st loadState
+	for _, step := range []struct {
+		at      time.Duration
+		util    float64
+		changed bool
+	}{
+		{0, 0.9, false},
+		// Dipping below the threshold restarts the timer.
+		{30 * time.Second, 0.7, false},
+		{40 * time.Second, 0.9, false},
+		{90 * time.Second, 0.9, false},
+		{100 * time.Second, 0.95, true},
+		// The cooldown delays shifting back.
+		{2 * time.Minute, 0.1, false},
+		{5 * time.Minute, 0.1, false},
+		{11 * time.Minute, 0.1, false},
+		{11*time.Minute + 40*time.Second, 0.1, true},
+		{12 * time.Minute, 0.9, false},
+	} {
+		if changed := st.record(cfg, step.util, at(step.at)); changed != step.changed {
+			t.Errorf("Expected changed %v at %v with %g, got %v", step.changed, step.at, step.util, changed)
+		}
+	}
+	if st.shifted || st.changed != at(11*time.Minute+40*time.Second) {
+		t.Errorf("Expected the policy to be shifted back at 11m40s, got %+v", st)
+	}
+}
+
+func TestLoadMonitorSample(t *testing.T) {
+	to := netip.MustParseAddr("192.0.2.2")
+	m, err := NewLoadMonitor([]*LoadRule{{
+		Policy: "as2906",
+		To:     []netip.Addr{to},
+		Config: &LoadConfig{Interface: "ppp0", Direction: DirectionTx, Threshold: 0.8, Clear: 0.5, Interval: time.Second},
+	}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %v", err)
+	}
+	var c Counters
+	m.counters = func(string) (Counters, error) { return c, nil }
+	m.speed = func(string) (uint64, error) { return 8000, nil }
+
+	start := time.Now()
+	r := m.rules[0]
+	if err := m.sample(r, start); err != nil {
+		t.Fatalf("Failed to sample: %v", err)
+	}
+	if st := m.Status()[0]; st.Utilization != -1 {
+		t.Errorf("Expected no utilisation after the first sample, got %+v", st)
+	}
+
+	// 900 bytes per second on a link of 8000 bits per second.
+	c = Counters{TxBytes: 900, RxBytes: 100}
+	if err := m.sample(r, start.Add(time.Second)); err != nil {
+		t.Fatalf("Failed to sample: %v", err)
+	}
+	if st := m.Status()[0]; st.Utilization != 0.9 || !st.Shifted {
+		t.Errorf("Expected the policy shifted at 90%%, got %+v", st)
+	}
+	if nhs, ok := m.Shifted("as2906"); !ok || len(nhs) != 1 || nhs[0] != to {
+		t.Errorf("Expected the policy shifted to %v, got %v, %v", to, nhs, ok)
+	}
+	select {
+	case <-m.Changed():
+	default:
+		t.Errorf("Expected a change notification")
+	}
+	if evs := m.Events(); len(evs) != 1 || !evs[0].Shifted || evs[0].Utilization != 0.9 {
+		t.Errorf("Expected a single shift event, got %+v", evs)
+	}
+
+	// A counter reset is only a new baseline.
+	c = Counters{}
+	if err := m.sample(r, start.Add(2*time.Second)); err != nil {
+		t.Fatalf("Failed to sample: %v", err)
+	}
+	if _, ok := m.Shifted("as2906"); !ok {
+		t.Errorf("Expected the policy to stay shifted after a counter reset")
+	}
+
+	m.speed = func(string) (uint64, error) { return 0, nil }
+	if err := m.sample(r, start.Add(3*time.Second)); err == nil {
+		t.Errorf("Expected error for a link of unknown speed, got nil")
+	}
+
+	if _, err := NewLoadMonitor([]*LoadRule{
+		{Policy: "as2906", To: []netip.Addr{to}, Config: DefaultLoadConfig()},
+		{Policy: "as2906", To: []netip.Addr{to}, Config: DefaultLoadConfig()},
+	}, zap.NewNop()); err == nil {
+		t.Errorf("Expected error for two rules of a policy, got nil")
+	}
+}
@@ -0,0 +1,241 @@
+package nexthop
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Status is the health of a checked nexthop.
+type Status struct {
+	Up bool
+	// Since is the time the nexthop entered its current state.
+	Since time.Time
+	// LastError is the error of the last failed probe, if the last probe failed.
+	LastError error
+}
+
+// state is the rise / fall state machine of a checked nexthop.
+type state struct {
+	up        bool
+	successes int
+	failures  int
+	since     time.Time
+}
+
+// record updates st with the result of a probe finished at now, and reports
+// whether the nexthop changed state.
+func (st *state) record(cfg *CheckConfig, ok bool, now time.Time) bool {
+	if ok {
+		st.successes++
+		st.failures = 0
+	} else {
+		st.failures++
+		st.successes = 0
+	}
+
+	switch {
+	case st.up && st.failures >= cfg.Fall:
+		st.up = false
+	case !st.up && st.successes >= cfg.Rise && now.Sub(st.since) >= cfg.HoldDown:
+		st.up = true
+	default:
+		return false
+	}
+	st.since = now
+	return true
+}
+
+// Check is a health check of one or more nexthops.
+type Check struct {
+	// Name identifies the check in logs. It defaults to the first nexthop.
+	Name string
+	// NextHops are the addresses sharing the result of the check, such as the
+	// IPv4 and IPv6 addresses of the same gateway.
+	NextHops []netip.Addr
+	Config   *CheckConfig
+}
+
+type checker struct {
+	name   string
+	cfg    *CheckConfig
+	prober Prober
+
+	mu      sync.Mutex
+	st      state
+	lastErr error
+}
+
+func (c *checker) status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Status{Up: c.st.up, Since: c.st.since, LastError: c.lastErr}
+}
+
+// Monitor runs the health checks of the nexthops and tracks their state.
+// Nexthops start up and are declared down once their health check fails
+// cfg.Fall times in a row. Nexthops without a health check are always up.
+type Monitor struct {
+	s        *zap.SugaredLogger
+	checkers map[netip.Addr]*checker
+	all      []*checker
+	changed  chan struct{}
+}
+
+// NewMonitor returns a Monitor running checks. Each nexthop may only be
+// checked by one of them.
+func NewMonitor(checks []*Check, l *zap.Logger) (*Monitor, error) {
+	m := &Monitor{
+		s:        l.Named("nexthop").Sugar(),
+		checkers: make(map[netip.Addr]*checker),
+		all:      make([]*checker, 0, len(checks)),
+		changed:  make(chan struct{}, 1),
+	}
+
+	now := time.Now()
+	for _, chk := range checks {
+		if len(chk.NextHops) == 0 {
+			return nil, fmt.Errorf("health check %q has no nexthop", chk.Name)
+		}
+		name := chk.Name
+		if name == "" {
+			name = chk.NextHops[0].String()
+		}
+
+		prober, err := NewProber(chk.Config)
+		if err != nil {
+			return nil, fmt.Errorf("health check for nexthop %s: %w", name, err)
+		}
+		c := &checker{
+			name:   name,
+			cfg:    chk.Config,
+			prober: prober,
+			st:     state{up: true, since: now},
+		}
+		for _, nh := range chk.NextHops {
+			if _, ok := m.checkers[nh]; ok {
+				return nil, fmt.Errorf("nexthop %s has more than one health check", nh)
+			}
+			m.checkers[nh] = c
+		}
+		m.all = append(m.all, c)
+	}
+	return m, nil
+}
+
+// Changed returns a channel receiving a value after any nexthop changed
+// state. Consecutive changes may be coalesced.
+func (m *Monitor) Changed() <-chan struct{} {
+	return m.changed
+}
+
+// Status returns the health of nh. ok is false if nh is not health checked.
+func (m *Monitor) Status(nh netip.Addr) (st Status, ok bool) {
+	c, ok := m.checkers[nh]
+	if !ok {
+		return Status{}, false
+	}
+	return c.status(), true
+}
+
+// Statuses returns the health of the health checked nexthops.
+func (m *Monitor) Statuses() map[netip.Addr]Status {
+	sts := make(map[netip.Addr]Status, len(m.checkers))
+	for nh, c := range m.checkers {
+		sts[nh] = c.status()
+	}
+	return sts
+}
+
+// Up reports whether nh is up. Nexthops without a health check are always up.
+func (m *Monitor) Up(nh netip.Addr) bool {
+	st, ok := m.Status(nh)
+	return !ok || st.Up
+}
+
+// Resolve returns the nexthop the routes towards nh should currently use: nh
+// itself if it is up, or its fallback if nh is down and the fallback is up.
+// ok is false if the routes should be withdrawn.
+func (m *Monitor) Resolve(nh netip.Addr) (netip.Addr, bool) {
+	if m.Up(nh) {
+		return nh, true
+	}
+
+	fallback := m.checkers[nh].cfg.Fallback
+	if !fallback.IsValid() || !m.Up(fallback) {
+		return netip.Addr{}, false
+	}
+	return fallback, true
+}
+
+// Select returns the nexthop to use for the first usable of nhs, which are in
+// order of preference, as resolved by Resolve. ok is false if none is usable.
+func (m *Monitor) Select(nhs []netip.Addr) (netip.Addr, bool) {
+	for _, nh := range nhs {
+		if r, ok := m.Resolve(nh); ok {
+			return r, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// Run runs the health checks until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range m.all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runChecker(ctx, c)
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *Monitor) runChecker(ctx context.Context, c *checker) {
+	m.s.Infof("Health checking nexthop %s: %s %s every %v (rise %d, fall %d, holddown %v)",
+		c.name, c.cfg.Method, c.cfg.Target, c.cfg.Interval, c.cfg.Rise, c.cfg.Fall, c.cfg.HoldDown)
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		pctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+		err := c.prober.Probe(pctx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			m.s.Debugf("Health check of nexthop %s failed: %v", c.name, err)
+		}
+
+		c.mu.Lock()
+		c.lastErr = err
+		changed := c.st.record(c.cfg, err == nil, time.Now())
+		up := c.st.up
+		c.mu.Unlock()
+
+		if changed {
+			if up {
+				m.s.Infof("Nexthop %s is up", c.name)
+			} else {
+				m.s.Warnf("Nexthop %s is down after %d failed health checks: %v", c.name, c.cfg.Fall, err)
+			}
+			select {
+			case m.changed <- struct{}{}:
+			default:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package nexthop
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestStateRecord(t *testing.T) {
+	cfg := &CheckConfig{Rise: 2, Fall: 3, HoldDown: 10 * time.Second}
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		ok      bool
+		at      time.Duration
+		up      bool
+		changed bool
+	}{
+		{ok: false, at: 1 * time.Second, up: true},
+		{ok: false, at: 2 * time.Second, up: true},
+		{ok: true, at: 3 * time.Second, up: true},
+		{ok: false, at: 4 * time.Second, up: true},
+		{ok: false, at: 5 * time.Second, up: true},
+		{ok: false, at: 6 * time.Second, up: false, changed: true},
+		{ok: true, at: 7 * time.Second, up: false},
+		// held down until 16s despite reaching rise
+		{ok: true, at: 8 * time.Second, up: false},
+		{ok: true, at: 15 * time.Second, up: false},
+		{ok: false, at: 16 * time.Second, up: false},
+		{ok: true, at: 17 * time.Second, up: false},
+		{ok: true, at: 18 * time.Second, up: true, changed: true},
+		{ok: false, at: 19 * time.Second, up: true},
+	}
+
+	st := state{up: true, since: t0}
+	for i, step := range steps {
+		changed := st.record(cfg, step.ok, t0.Add(step.at))
+		if changed != step.changed {
+			t.Errorf("Step %d: expected changed %v, got %v", i, step.changed, changed)
+		}
+		if st.up != step.up {
+			t.Errorf("Step %d: expected up %v, got %v", i, step.up, st.up)
+		}
+		if changed && !st.since.Equal(t0.Add(step.at)) {
+			t.Errorf("Step %d: expected since %v, got %v", i, t0.Add(step.at), st.since)
+		}
+	}
+}
+
+func TestMonitorResolve(t *testing.T) {
+	primary := netip.MustParseAddr("192.168.1.1")
+	backup := netip.MustParseAddr("192.168.2.1")
+	single := netip.MustParseAddr("192.168.3.1")
+	unchecked := netip.MustParseAddr("192.168.4.1")
+
+	icmpCheck := func(nh netip.Addr) *CheckConfig {
+		cfg := DefaultCheckConfig()
+		cfg.Target = nh.String()
+		return cfg
+	}
+	primaryCfg, backupCfg, singleCfg := icmpCheck(primary), icmpCheck(backup), icmpCheck(single)
+	primaryCfg.Fallback = backup
+	m, err := NewMonitor([]*Check{
+		{NextHops: []netip.Addr{primary}, Config: primaryCfg},
+		{NextHops: []netip.Addr{backup}, Config: backupCfg},
+		{NextHops: []netip.Addr{single}, Config: singleCfg},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %v", err)
+	}
+
+	setUp := func(nh netip.Addr, up bool) {
+		m.checkers[nh].st.up = up
+	}
+
+	tests := []struct {
+		name      string
+		down      []netip.Addr
+		nh        netip.Addr
+		want      netip.Addr
+		withdrawn bool
+	}{
+		{name: "up", nh: primary, want: primary},
+		{name: "unchecked", nh: unchecked, want: unchecked},
+		{name: "invalid", nh: netip.Addr{}, want: netip.Addr{}},
+		{name: "down with fallback", down: []netip.Addr{primary}, nh: primary, want: backup},
+		{name: "down with fallback down", down: []netip.Addr{primary, backup}, nh: primary, withdrawn: true},
+		{name: "down without fallback", down: []netip.Addr{single}, nh: single, withdrawn: true},
+		{name: "fallback down only", down: []netip.Addr{backup}, nh: primary, want: primary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for nh := range m.checkers {
+				setUp(nh, true)
+			}
+			for _, nh := range tt.down {
+				setUp(nh, false)
+			}
+
+			got, ok := m.Resolve(tt.nh)
+			if ok == tt.withdrawn {
+				t.Fatalf("Expected withdrawn %v, got %v", tt.withdrawn, !ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("Expected nexthop %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMonitorSelect(t *testing.T) {
+	ispA := netip.MustParseAddr("192.168.1.1")
+	ispB := netip.MustParseAddr("192.168.2.1")
+	unchecked := netip.MustParseAddr("192.168.3.1")
+
+	var checks []*Check
+	for _, nh := range []netip.Addr{ispA, ispB} {
+		cfg := DefaultCheckConfig()
+		cfg.Target = nh.String()
+		checks = append(checks, &Check{NextHops: []netip.Addr{nh}, Config: cfg})
+	}
+	m, err := NewMonitor(checks, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		down      []netip.Addr
+		nhs       []netip.Addr
+		want      netip.Addr
+		withdrawn bool
+	}{
+		{name: "first up", nhs: []netip.Addr{ispB, ispA}, want: ispB},
+		{name: "first down", down: []netip.Addr{ispB}, nhs: []netip.Addr{ispB, ispA}, want: ispA},
+		{name: "all down", down: []netip.Addr{ispA, ispB}, nhs: []netip.Addr{ispB, ispA}, withdrawn: true},
+		{name: "unchecked last resort", down: []netip.Addr{ispA, ispB}, nhs: []netip.Addr{ispB, ispA, unchecked}, want: unchecked},
+		{name: "empty", nhs: nil, withdrawn: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for nh, c := range m.checkers {
+				c.st.up = !slices.Contains(tt.down, nh)
+			}
+
+			got, ok := m.Select(tt.nhs)
+			if ok == tt.withdrawn {
+				t.Fatalf("Expected withdrawn %v, got %v", tt.withdrawn, !ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("Expected nexthop %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMonitorSharedCheck(t *testing.T) {
+	ip4 := netip.MustParseAddr("192.168.1.1")
+	ip6 := netip.MustParseAddr("2001:db8::1")
+
+	cfg := DefaultCheckConfig()
+	cfg.Target = ip4.String()
+	m, err := NewMonitor([]*Check{{Name: "isp-a", NextHops: []netip.Addr{ip4, ip6}, Config: cfg}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %v", err)
+	}
+	if len(m.all) != 1 {
+		t.Fatalf("Expected 1 checker, got %d", len(m.all))
+	}
+
+	m.checkers[ip4].st.up = false
+	for _, nh := range []netip.Addr{ip4, ip6} {
+		if m.Up(nh) {
+			t.Errorf("Expected nexthop %s to be down", nh)
+		}
+	}
+
+	if _, err := NewMonitor([]*Check{
+		{NextHops: []netip.Addr{ip4}, Config: cfg},
+		{NextHops: []netip.Addr{ip4, ip6}, Config: cfg},
+	}, zap.NewNop()); err == nil {
+		t.Errorf("Expected error for a nexthop checked twice")
+	}
+}
@@ -0,0 +1,94 @@
+package nexthop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Prober sends a single health check probe.
+type Prober interface {
+	// Probe returns nil if the probe succeeded before ctx is done.
+	Probe(ctx context.Context) error
+}
+
+// NewProber returns the Prober implementing cfg.Method.
+func NewProber(cfg *CheckConfig) (Prober, error) {
+	switch cfg.Method {
+	case MethodICMP:
+		return newICMPProber(cfg)
+	case MethodTCP:
+		return &tcpProber{cfg: cfg, dialer: newDialer(cfg)}, nil
+	case MethodHTTP:
+		return newHTTPProber(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown method %q", cfg.Method)
+	}
+}
+
+// newDialer returns a dialer sourcing connections from cfg.Source and cfg.Interface.
+func newDialer(cfg *CheckConfig) *net.Dialer {
+	d := &net.Dialer{Control: bindToDeviceControl(cfg.Interface)}
+	if cfg.Source.IsValid() {
+		d.LocalAddr = &net.TCPAddr{IP: cfg.Source.AsSlice()}
+	}
+	return d
+}
+
+// tcpProber succeeds if a TCP connection to the target can be established.
+type tcpProber struct {
+	cfg    *CheckConfig
+	dialer *net.Dialer
+}
+
+func (p *tcpProber) Probe(ctx context.Context) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", p.cfg.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// httpProber succeeds if a GET request to the target returns a non-error status.
+// Redirects are not followed.
+type httpProber struct {
+	cfg    *CheckConfig
+	client *http.Client
+}
+
+func newHTTPProber(cfg *CheckConfig) *httpProber {
+	return &httpProber{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       newDialer(cfg).DialContext,
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (p *httpProber) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.Target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "policybgp-healthcheck")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
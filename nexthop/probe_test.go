@@ -0,0 +1,61 @@
+package nexthop
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTCPAndHTTPProbers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	// A port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		wantErr bool
+	}{
+		{name: "TCP open", method: MethodTCP, target: ts.Listener.Addr().String()},
+		{name: "TCP closed", method: MethodTCP, target: closedAddr, wantErr: true},
+		{name: "HTTP ok", method: MethodHTTP, target: ts.URL + "/"},
+		{name: "HTTP error status", method: MethodHTTP, target: ts.URL + "/fail", wantErr: true},
+		{name: "HTTP closed", method: MethodHTTP, target: "http://" + closedAddr + "/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultCheckConfig()
+			cfg.Method = tt.method
+			cfg.Target = tt.target
+			prober, err := NewProber(cfg)
+			if err != nil {
+				t.Fatalf("Failed to create prober: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = prober.Probe(ctx)
+			if tt.wantErr && err == nil {
+				t.Errorf("Expected probe of %s to fail", tt.target)
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("Unexpected error probing %s: %v", tt.target, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package nexthop
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDeviceControl returns a net.Dialer / net.ListenConfig Control
+// function binding the socket to iface with SO_BINDTODEVICE. It returns nil
+// if iface is empty.
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("failed to bind to interface %q: %w", iface, serr)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package nexthop
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDeviceControl returns nil if iface is empty, and a Control function
+// failing every connection otherwise, as binding to an interface is only
+// supported on Linux.
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(string, string, syscall.RawConn) error {
+		return fmt.Errorf("binding to interface %q is not supported on this platform", iface)
+	}
+}
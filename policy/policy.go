@@ -0,0 +1,286 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+)
+
+// Policy steers traffic towards the prefixes owned by an AS to the given nexthops.
+type Policy struct {
+	// Name identifies the policy. It defaults to "as<ASN>".
+	Name string
+
+	ASN uint32
+	// IP4NextHops and IP6NextHops are the nexthops of each address family in
+	// order of preference.
+	IP4NextHops []netip.Addr
+	IP6NextHops []netip.Addr
+	// Multipath shares the traffic between all usable nexthops instead of
+	// sending it to the most preferred one.
+	Multipath bool
+	// Weights holds the share of the traffic of each nexthop in multipath
+	// mode. It is nil if the traffic is shared equally.
+	Weights map[netip.Addr]uint32
+
+	ASInfo *asinfo.ASInfo
+}
+
+// Route is a single prefix of a policy together with the nexthop it should be routed to.
+type Route struct {
+	Prefix  netip.Prefix
+	NextHop netip.Addr
+}
+
+// NamedNextHop holds the addresses of a nexthop object referred to by name.
+// Either address may be invalid. IP4 may be an IPv6 address, which IPv4 is
+// routed via (RFC 8950).
+type NamedNextHop struct {
+	IP4 netip.Addr
+	IP6 netip.Addr
+}
+
+// NextHopNames maps the names of nexthop objects to their addresses.
+type NextHopNames map[string]NamedNextHop
+
+// Parse parses a policy in the format <asn>[,<ip4_nexthops>[,<ip6_nexthops>]].
+// The nexthops of each family are either separated by "|" in order of
+// preference, or by "+" to share the traffic between them, optionally
+// weighted by appending "@<weight>" to each nexthop. Nexthops which are
+// omitted or empty are left unset.
+//
+// Link-local IPv6 nexthops are given with the interface they are reached
+// through as their zone, such as "fe80::1%eth0".
+//
+// A nexthop may also be given by a name in names, which stands for its
+// address of the family of the list and is skipped if it has none. If the
+// IPv6 nexthops are omitted, they are taken from the IPv6 addresses of the
+// names among the IPv4 nexthops, so that "15169,isp-a|isp-b" routes both
+// families via isp-a, or isp-b while isp-a is down.
+func Parse(s string, names NextHopNames) (*Policy, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid policy format %q. Expected <asn>[,<ip4_nexthops>[,<ip6_nexthops>]]", s)
+	}
+
+	asn, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASN in policy %q: %w", s, err)
+	}
+	if asn == 0 {
+		return nil, fmt.Errorf("ASN %d in policy %q is out of valid range", asn, s)
+	}
+
+	pol := &Policy{
+		Name: DefaultName(uint32(asn)),
+		ASN:  uint32(asn),
+	}
+
+	var ip4, ip6 *NextHops
+	if len(parts) >= 2 {
+		if ip4, err = ParseNextHops(parts[1], true, names); err != nil {
+			return nil, fmt.Errorf("invalid IPv4 nexthop in policy %q: %w", s, err)
+		}
+	}
+	switch {
+	case len(parts) == 3:
+		if ip6, err = ParseNextHops(parts[2], false, names); err != nil {
+			return nil, fmt.Errorf("invalid IPv6 nexthop in policy %q: %w", s, err)
+		}
+	case len(parts) == 2 && names != nil:
+		if ip6, err = parseNextHops(parts[1], false, names, true); err != nil {
+			return nil, fmt.Errorf("invalid IPv6 nexthop in policy %q: %w", s, err)
+		}
+	}
+
+	for _, nhs := range []*NextHops{ip4, ip6} {
+		if nhs == nil {
+			continue
+		}
+		if nhs.Multipath {
+			pol.Multipath = true
+		}
+		for nh, w := range nhs.Weights {
+			if pol.Weights == nil {
+				pol.Weights = make(map[netip.Addr]uint32)
+			}
+			pol.Weights[nh] = w
+		}
+	}
+	if ip4 != nil {
+		pol.IP4NextHops = ip4.Addrs
+	}
+	if ip6 != nil {
+		pol.IP6NextHops = ip6.Addrs
+	}
+	if pol.Multipath && (len(pol.IP4NextHops) > 1 && !ip4.Multipath || len(pol.IP6NextHops) > 1 && !ip6.Multipath) {
+		return nil, fmt.Errorf("invalid policy %q: nexthops must either be all separated by \"|\" or all by \"+\"", s)
+	}
+
+	return pol, nil
+}
+
+// NextHops is a list of nexthops of one address family as parsed by ParseNextHops.
+type NextHops struct {
+	Addrs []netip.Addr
+	// Multipath is set if the nexthops were separated by "+".
+	Multipath bool
+	// Weights is nil unless the nexthops were weighted.
+	Weights map[netip.Addr]uint32
+}
+
+// ParseNextHops parses a list of nexthops of the address family selected by
+// is4, separated by either "|" or "+" and referring to names as described in
+// Parse. It returns an empty list for an empty string.
+func ParseNextHops(s string, is4 bool, names NextHopNames) (*NextHops, error) {
+	return parseNextHops(s, is4, names, false)
+}
+
+// parseNextHops implements ParseNextHops. If namesOnly is set, addresses are
+// skipped rather than checked against the family.
+func parseNextHops(s string, is4 bool, names NextHopNames, namesOnly bool) (*NextHops, error) {
+	nhs := &NextHops{}
+	if s == "" {
+		return nhs, nil
+	}
+
+	family := "IPv6"
+	if is4 {
+		family = "IPv4"
+	}
+
+	sep := "|"
+	if strings.Contains(s, "+") {
+		if strings.Contains(s, "|") {
+			return nil, fmt.Errorf("%q mixes \"|\" and \"+\"", s)
+		}
+		sep = "+"
+		nhs.Multipath = true
+	}
+
+	for _, ns := range strings.Split(s, sep) {
+		as, ws, weighted := strings.Cut(ns, "@")
+		nh, err := netip.ParseAddr(as)
+		if err == nil {
+			if namesOnly {
+				continue
+			}
+			if nh.Is4() != is4 {
+				return nil, fmt.Errorf("%q is not an %s address", as, family)
+			}
+		} else {
+			named, ok := names[as]
+			if !ok {
+				if names == nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("%q is neither an IP address nor a known nexthop", as)
+			}
+			nh = named.IP6
+			if is4 {
+				nh = named.IP4
+			}
+			if !nh.IsValid() {
+				continue
+			}
+		}
+		if slices.Contains(nhs.Addrs, nh) {
+			return nil, fmt.Errorf("duplicate nexthop %s", nh)
+		}
+
+		if weighted {
+			if !nhs.Multipath {
+				return nil, fmt.Errorf("weight of nexthop %s is only allowed for nexthops separated by \"+\"", nh)
+			}
+			w, err := strconv.ParseUint(ws, 10, 32)
+			if err != nil || w == 0 {
+				return nil, fmt.Errorf("invalid weight %q of nexthop %s", ws, nh)
+			}
+			if nhs.Weights == nil {
+				nhs.Weights = make(map[netip.Addr]uint32)
+			}
+			nhs.Weights[nh] = uint32(w)
+		}
+		nhs.Addrs = append(nhs.Addrs, nh)
+	}
+
+	if nhs.Weights != nil && len(nhs.Weights) != len(nhs.Addrs) {
+		return nil, fmt.Errorf("%q weights only some of the nexthops", s)
+	}
+	return nhs, nil
+}
+
+// DefaultName returns the name of a policy for asn which was not explicitly named.
+func DefaultName(asn uint32) string {
+	return fmt.Sprintf("as%d", asn)
+}
+
+// ParseName returns the ASN of the policy named name, the inverse of
+// DefaultName.
+func ParseName(name string) (uint32, error) {
+	s, ok := strings.CutPrefix(name, "as")
+	asn, err := strconv.ParseUint(s, 10, 32)
+	if !ok || err != nil || asn == 0 {
+		return 0, fmt.Errorf("invalid policy name %q. Expected as<ASN>", name)
+	}
+	return uint32(asn), nil
+}
+
+// ParseAll parses each of ss with Parse.
+func ParseAll(ss []string, names NextHopNames) ([]*Policy, error) {
+	pols := make([]*Policy, 0, len(ss))
+	for _, s := range ss {
+		pol, err := Parse(s, names)
+		if err != nil {
+			return nil, err
+		}
+		pols = append(pols, pol)
+	}
+	return pols, nil
+}
+
+// Resolve looks up the ASN of the policy in db and fills in ASInfo.
+func (p *Policy) Resolve(db asinfo.ASInfoMap) error {
+	info := db[int(p.ASN)]
+	if info == nil {
+		return fmt.Errorf("ASN %d not found in database", p.ASN)
+	}
+
+	p.ASInfo = info
+	return nil
+}
+
+// NextHopsFor returns the nexthops for the address family of pre in order of preference.
+func (p *Policy) NextHopsFor(pre netip.Prefix) []netip.Addr {
+	if pre.Addr().Is4() {
+		return p.IP4NextHops
+	}
+	return p.IP6NextHops
+}
+
+// NextHopFor returns the most preferred nexthop for the address family of pre.
+// The returned address is invalid if no nexthop is configured for the family.
+func (p *Policy) NextHopFor(pre netip.Prefix) netip.Addr {
+	if nhs := p.NextHopsFor(pre); len(nhs) > 0 {
+		return nhs[0]
+	}
+	return netip.Addr{}
+}
+
+// Routes returns the routes of the policy. Prefixes whose address family has
+// no nexthop configured are omitted. The policy must be resolved beforehand.
+func (p *Policy) Routes() []Route {
+	routes := make([]Route, 0, len(p.ASInfo.Prefixes))
+	for _, pre := range p.ASInfo.Prefixes {
+		nh := p.NextHopFor(pre)
+		if !nh.IsValid() {
+			continue
+		}
+		routes = append(routes, Route{Prefix: pre, NextHop: nh})
+	}
+	return routes
+}
@@ -0,0 +1,323 @@
+package policy
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		asn       uint32
+		ip4       string
+		ip6       string
+		multipath bool
+		weights   map[string]uint32
+		wantErr   bool
+	}{
+		{
+			name:  "IPv4 nexthop only",
+			input: "15169,192.168.1.1",
+			asn:   15169,
+			ip4:   "192.168.1.1",
+		},
+		{
+			name:  "IPv4 and IPv6 nexthops",
+			input: "32934,10.0.0.1,2001:db8::1",
+			asn:   32934,
+			ip4:   "10.0.0.1",
+			ip6:   "2001:db8::1",
+		},
+		{
+			name:  "empty IPv6 nexthop",
+			input: "32934,10.0.0.1,",
+			asn:   32934,
+			ip4:   "10.0.0.1",
+		},
+		{
+			name:  "32bit ASN",
+			input: "4200000000,10.0.0.1",
+			asn:   4200000000,
+			ip4:   "10.0.0.1",
+		},
+		{
+			name:  "no nexthops",
+			input: "15169",
+			asn:   15169,
+		},
+		{
+			name:  "IPv6 nexthop only",
+			input: "15169,,2001:db8::1",
+			asn:   15169,
+			ip6:   "2001:db8::1",
+		},
+		{
+			name:  "link-local IPv6 nexthop",
+			input: "15169,,fe80::1%eth0",
+			asn:   15169,
+			ip6:   "fe80::1%eth0",
+		},
+		{
+			name:  "ordered nexthop lists",
+			input: "15169,192.168.2.1|192.168.1.1,2001:db8::2|2001:db8::1|2001:db8::3",
+			asn:   15169,
+			ip4:   "192.168.2.1|192.168.1.1",
+			ip6:   "2001:db8::2|2001:db8::1|2001:db8::3",
+		},
+		{
+			name:    "duplicate nexthop in list",
+			input:   "15169,192.168.2.1|192.168.2.1",
+			wantErr: true,
+		},
+		{
+			name:    "empty entry in list",
+			input:   "15169,192.168.2.1|",
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 address in IPv4 list",
+			input:   "15169,192.168.2.1|2001:db8::1",
+			wantErr: true,
+		},
+		{
+			name:      "multipath",
+			input:     "15169,192.168.1.1+192.168.2.1,2001:db8::1",
+			asn:       15169,
+			ip4:       "192.168.1.1|192.168.2.1",
+			ip6:       "2001:db8::1",
+			multipath: true,
+		},
+		{
+			name:      "weighted multipath",
+			input:     "15169,192.168.1.1@3+192.168.2.1@1,2001:db8::1@2+2001:db8::2@2",
+			asn:       15169,
+			ip4:       "192.168.1.1|192.168.2.1",
+			ip6:       "2001:db8::1|2001:db8::2",
+			multipath: true,
+			weights: map[string]uint32{
+				"192.168.1.1": 3,
+				"192.168.2.1": 1,
+				"2001:db8::1": 2,
+				"2001:db8::2": 2,
+			},
+		},
+		{
+			name:    "mixed separators",
+			input:   "15169,192.168.1.1+192.168.2.1|192.168.3.1",
+			wantErr: true,
+		},
+		{
+			name:    "multipath and failover across families",
+			input:   "15169,192.168.1.1+192.168.2.1,2001:db8::1|2001:db8::2",
+			wantErr: true,
+		},
+		{
+			name:    "weight in failover list",
+			input:   "15169,192.168.1.1@3|192.168.2.1",
+			wantErr: true,
+		},
+		{
+			name:    "partially weighted",
+			input:   "15169,192.168.1.1@3+192.168.2.1",
+			wantErr: true,
+		},
+		{
+			name:    "zero weight",
+			input:   "15169,192.168.1.1@0+192.168.2.1@1",
+			wantErr: true,
+		},
+		{
+			name:    "too many fields",
+			input:   "15169,192.168.1.1,2001:db8::1,2001:db8::2",
+			wantErr: true,
+		},
+		{
+			name:    "ASN zero",
+			input:   "0,192.168.1.1",
+			wantErr: true,
+		},
+		{
+			name:    "ASN out of range",
+			input:   "4294967296,192.168.1.1",
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 address as IPv4 nexthop",
+			input:   "15169,2001:db8::1",
+			wantErr: true,
+		},
+		{
+			name:    "IPv4 address as IPv6 nexthop",
+			input:   "15169,192.168.1.1,192.168.1.2",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol, err := Parse(tt.input, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if pol.ASN != tt.asn {
+				t.Errorf("Expected ASN %d, got %d", tt.asn, pol.ASN)
+			}
+			if got := addrsString(pol.IP4NextHops); got != tt.ip4 {
+				t.Errorf("Expected IPv4 nexthops %q, got %q", tt.ip4, got)
+			}
+			if got := addrsString(pol.IP6NextHops); got != tt.ip6 {
+				t.Errorf("Expected IPv6 nexthops %q, got %q", tt.ip6, got)
+			}
+			if pol.Multipath != tt.multipath {
+				t.Errorf("Expected multipath %v, got %v", tt.multipath, pol.Multipath)
+			}
+			if len(pol.Weights) != len(tt.weights) {
+				t.Errorf("Expected weights %v, got %v", tt.weights, pol.Weights)
+			}
+			for nh, w := range tt.weights {
+				if got := pol.Weights[netip.MustParseAddr(nh)]; got != w {
+					t.Errorf("Expected weight %d for %s, got %d", w, nh, got)
+				}
+			}
+		})
+	}
+}
+
+func addrsString(as []netip.Addr) string {
+	ss := make([]string, 0, len(as))
+	for _, a := range as {
+		ss = append(ss, a.String())
+	}
+	return strings.Join(ss, "|")
+}
+
+func TestParseNames(t *testing.T) {
+	names := NextHopNames{
+		"isp-fiber": {IP4: netip.MustParseAddr("192.168.1.1"), IP6: netip.MustParseAddr("2001:db8::1")},
+		"isp-lte":   {IP4: netip.MustParseAddr("192.168.2.1"), IP6: netip.MustParseAddr("2001:db8::2")},
+		"v4-only":   {IP4: netip.MustParseAddr("192.168.3.1")},
+		"v6-only":   {IP4: netip.MustParseAddr("2001:db8::4"), IP6: netip.MustParseAddr("2001:db8::4")},
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		ip4     string
+		ip6     string
+		weights map[string]uint32
+		wantErr bool
+	}{
+		{
+			name:  "IPv6 taken from names",
+			input: "15169,isp-fiber|isp-lte",
+			ip4:   "192.168.1.1|192.168.2.1",
+			ip6:   "2001:db8::1|2001:db8::2",
+		},
+		{
+			name:  "names and addresses",
+			input: "15169,isp-fiber|192.168.4.1|v4-only",
+			ip4:   "192.168.1.1|192.168.4.1|192.168.3.1",
+			ip6:   "2001:db8::1",
+		},
+		{
+			name:  "IPv4 via IPv6",
+			input: "15169,isp-fiber|v6-only",
+			ip4:   "192.168.1.1|2001:db8::4",
+			ip6:   "2001:db8::1|2001:db8::4",
+		},
+		{
+			name:  "explicit IPv6",
+			input: "15169,isp-fiber,isp-lte|2001:db8::3",
+			ip4:   "192.168.1.1",
+			ip6:   "2001:db8::2|2001:db8::3",
+		},
+		{
+			name:  "explicitly no IPv6",
+			input: "15169,isp-fiber,",
+			ip4:   "192.168.1.1",
+		},
+		{
+			name:    "weighted names",
+			input:   "15169,isp-fiber@3+isp-lte@1",
+			ip4:     "192.168.1.1|192.168.2.1",
+			ip6:     "2001:db8::1|2001:db8::2",
+			weights: map[string]uint32{"192.168.1.1": 3, "192.168.2.1": 1, "2001:db8::1": 3, "2001:db8::2": 1},
+		},
+		{
+			name:    "unknown name",
+			input:   "15169,isp-cable",
+			wantErr: true,
+		},
+		{
+			name:    "name and its address",
+			input:   "15169,isp-fiber|192.168.1.1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol, err := Parse(tt.input, names)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if got := addrsString(pol.IP4NextHops); got != tt.ip4 {
+				t.Errorf("Expected IPv4 nexthops %q, got %q", tt.ip4, got)
+			}
+			if got := addrsString(pol.IP6NextHops); got != tt.ip6 {
+				t.Errorf("Expected IPv6 nexthops %q, got %q", tt.ip6, got)
+			}
+			if len(pol.Weights) != len(tt.weights) {
+				t.Errorf("Expected weights %v, got %v", tt.weights, pol.Weights)
+			}
+			for nh, w := range tt.weights {
+				if got := pol.Weights[netip.MustParseAddr(nh)]; got != w {
+					t.Errorf("Expected weight %d for %s, got %d", w, nh, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseName(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		want    uint32
+		wantErr bool
+	}{
+		{name: "as15169", want: 15169},
+		{name: DefaultName(4200000000), want: 4200000000},
+		{name: "as0", wantErr: true},
+		{name: "AS15169", wantErr: true},
+		{name: "15169", wantErr: true},
+		{name: "as15169x", wantErr: true},
+		{name: "as4294967296", wantErr: true},
+	} {
+		got, err := ParseName(tc.name)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Expected error for %q, got %d", tc.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("Expected %d for %q, got %d, %v", tc.want, tc.name, got, err)
+		}
+	}
+}
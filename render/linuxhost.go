@@ -0,0 +1,109 @@
+package render
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// ipsetDefaultMaxElem is the default maxelem of an ipset hash set.
+const ipsetDefaultMaxElem = 65536
+
+// RenderNftables writes an nft script that (re)creates one named interval set
+// per policy and address family. The script is idempotent and can be applied
+// repeatedly with "nft -f".
+func RenderNftables(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "add table %s %s\n", opts.NftFamily, opts.NftTable)
+	for _, pol := range pols {
+		fmt.Fprintf(bw, "\n# AS%d (%s)\n", pol.ASN, pol.ASInfo.Organization)
+		for _, fam := range familySets(pol, opts) {
+			name := fam.name
+			typ := "ipv6_addr"
+			if fam.is4 {
+				typ = "ipv4_addr"
+			}
+			fmt.Fprintf(bw, "add set %s %s %s { type %s; flags interval; auto-merge; }\n",
+				opts.NftFamily, opts.NftTable, name, typ)
+			fmt.Fprintf(bw, "flush set %s %s %s\n", opts.NftFamily, opts.NftTable, name)
+			if len(fam.prefixes) == 0 {
+				continue
+			}
+			fmt.Fprintf(bw, "add element %s %s %s {\n", opts.NftFamily, opts.NftTable, name)
+			for i, pre := range fam.prefixes {
+				sep := ","
+				if i == len(fam.prefixes)-1 {
+					sep = ""
+				}
+				fmt.Fprintf(bw, "\t%s%s\n", pre, sep)
+			}
+			fmt.Fprintf(bw, "}\n")
+		}
+	}
+
+	return bw.Flush()
+}
+
+// RenderIpset writes an "ipset restore" file that creates one hash:net set per
+// policy and address family, and replaces its contents.
+func RenderIpset(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	for _, pol := range pols {
+		for _, fam := range familySets(pol, opts) {
+			name := fam.name
+			family := "inet6"
+			if fam.is4 {
+				family = "inet"
+			}
+			maxElem := max(ipsetDefaultMaxElem, len(fam.prefixes))
+			fmt.Fprintf(bw, "create %s hash:net family %s maxelem %d -exist\n", name, family, maxElem)
+			fmt.Fprintf(bw, "flush %s\n", name)
+			for _, pre := range fam.prefixes {
+				fmt.Fprintf(bw, "add %s %s\n", name, pre)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// RenderIPRoute writes an "ip -batch" file that installs the routes of the
+// policies into opts.Table. "route replace" is used so the file can be
+// applied on top of an already populated table.
+func RenderIPRoute(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	suffix := fmt.Sprintf(" table %d", opts.Table)
+	if opts.Protocol != 0 {
+		suffix += fmt.Sprintf(" proto %d", opts.Protocol)
+	}
+
+	for _, pol := range pols {
+		fmt.Fprintf(bw, "# AS%d (%s)\n", pol.ASN, pol.ASInfo.Organization)
+		for _, r := range routesOf(pol, opts) {
+			fmt.Fprintf(bw, "route replace %s %s%s\n", r.Prefix, ipRouteVia(r), suffix)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ipRouteVia returns the "via" argument of "ip route" for the nexthop of r,
+// naming the family of IPv6 nexthops of IPv4 routes and the interface of
+// link-local nexthops.
+func ipRouteVia(r policy.Route) string {
+	nh := r.NextHop
+	via := "via "
+	if nh.Is6() && r.Prefix.Addr().Is4() {
+		via += "inet6 "
+	}
+	via += nh.WithZone("").String()
+	if zone := nh.Zone(); zone != "" {
+		via += " dev " + zone
+	}
+	return via
+}
@@ -0,0 +1,219 @@
+package render
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+const (
+	// PACModeTable emits the prefixes as sorted address ranges which are
+	// looked up by binary search. It works for IPv4 and IPv6 in every browser.
+	PACModeTable = "table"
+	// PACModeIsInNet emits the prefixes as isInNet() / isInNetEx() checks.
+	// IPv6 is only matched by browsers implementing isInNetEx().
+	PACModeIsInNet = "isinnet"
+)
+
+// pacLookupTable matches addresses against the ranges emitted in PACModeTable.
+// IPv4 addresses are compared as numbers and IPv6 addresses as 32 digit
+// hexadecimal strings, which sort the same way as the addresses.
+const pacLookupTable = `function ip4Key(ip) {
+	var p = ip.split(".");
+	return ((+p[0] * 256 + +p[1]) * 256 + +p[2]) * 256 + +p[3];
+}
+
+function ip6Key(ip) {
+	var zone = ip.indexOf("%");
+	if (zone >= 0) ip = ip.substring(0, zone);
+	var halves = ip.split("::");
+	var head = halves[0] ? halves[0].split(":") : [];
+	var tail = halves.length > 1 && halves[1] ? halves[1].split(":") : [];
+	var groups = tail.length ? tail : head;
+	var last = groups[groups.length - 1];
+	if (last && last.indexOf(".") >= 0) {
+		var n = ip4Key(last);
+		groups.splice(groups.length - 1, 1, Math.floor(n / 65536).toString(16), (n % 65536).toString(16));
+	}
+	var all = head;
+	for (var i = head.length + tail.length; i < 8; i++) all.push("0");
+	all = all.concat(tail);
+	var key = "";
+	for (var j = 0; j < all.length; j++) key += ("0000" + all[j]).slice(-4);
+	return key.toLowerCase();
+}
+
+function inRanges(ranges, key) {
+	var lo = 0, hi = ranges.length / 2 - 1;
+	while (lo <= hi) {
+		var mid = (lo + hi) >> 1;
+		if (key < ranges[2 * mid]) hi = mid - 1;
+		else if (key > ranges[2 * mid + 1]) lo = mid + 1;
+		else return true;
+	}
+	return false;
+}
+
+function matches(pol, addr) {
+	if (addr.indexOf(":") >= 0) return inRanges(pol.v6, ip6Key(addr));
+	return inRanges(pol.v4, ip4Key(addr));
+}
+`
+
+// pacLookupIsInNet matches addresses against the prefixes emitted in PACModeIsInNet.
+const pacLookupIsInNet = `function matches(pol, addr) {
+	var i;
+	if (addr.indexOf(":") >= 0) {
+		if (typeof isInNetEx !== "function") return false;
+		for (i = 0; i < pol.v6.length; i++) {
+			if (isInNetEx(addr, pol.v6[i])) return true;
+		}
+		return false;
+	}
+	for (i = 0; i < pol.v4.length; i += 2) {
+		if (isInNet(addr, pol.v4[i], pol.v4[i + 1])) return true;
+	}
+	return false;
+}
+`
+
+// pacFindProxy resolves the host and returns the proxy of the first policy
+// matching any of its addresses.
+const pacFindProxy = `function resolveHost(host) {
+	if (host.charAt(0) === "[") host = host.substring(1, host.length - 1);
+	if (/^[0-9.]+$/.test(host) || host.indexOf(":") >= 0) return [host];
+	var addrs;
+	if (typeof dnsResolveEx === "function") {
+		addrs = dnsResolveEx(host);
+		return addrs ? addrs.split(";") : [];
+	}
+	addrs = dnsResolve(host);
+	return addrs ? [addrs] : [];
+}
+
+function FindProxyForURL(url, host) {
+	var addrs = resolveHost(host);
+	for (var i = 0; i < POLICIES.length; i++) {
+		for (var j = 0; j < addrs.length; j++) {
+			if (matches(POLICIES[i], addrs[j])) return POLICIES[i].proxy;
+		}
+	}
+	return DEFAULT_PROXY;
+}
+`
+
+// pacRangeKey formats a as the key the table lookup compares addresses with.
+func pacRangeKey(a netip.Addr) string {
+	if a.Is4() {
+		b := a.As4()
+		return strconv.FormatUint(uint64(b[0])<<24|uint64(b[1])<<16|uint64(b[2])<<8|uint64(b[3]), 10)
+	}
+	b := a.As16()
+	return strconv.Quote(hex.EncodeToString(b[:]))
+}
+
+// writePACTable writes the prefixes of pol as sorted, flattened [start, end] pairs.
+func writePACTable(w io.Writer, pol *policy.Policy) {
+	var v4, v6 []string
+	for _, r := range asinfo.MergedRanges(pol.ASInfo.Prefixes) {
+		if r.Start.Is4() {
+			v4 = append(v4, pacRangeKey(r.Start), pacRangeKey(r.End))
+		} else {
+			v6 = append(v6, pacRangeKey(r.Start), pacRangeKey(r.End))
+		}
+	}
+	fmt.Fprintf(w, "\t\tv4: [%s],\n", strings.Join(v4, ", "))
+	fmt.Fprintf(w, "\t\tv6: [%s]\n", strings.Join(v6, ", "))
+}
+
+// writePACIsInNet writes the aggregated prefixes of pol as isInNet() address
+// and mask pairs for IPv4, and isInNetEx() prefixes for IPv6.
+func writePACIsInNet(w io.Writer, pol *policy.Policy) {
+	var v4, v6 []string
+	for _, pre := range asinfo.AggregatePrefixes(pol.ASInfo.Prefixes) {
+		if pre.Addr().Is4() {
+			mask := net.IP(net.CIDRMask(pre.Bits(), 32))
+			v4 = append(v4, strconv.Quote(pre.Addr().String()), strconv.Quote(mask.String()))
+		} else {
+			v6 = append(v6, strconv.Quote(pre.String()))
+		}
+	}
+	fmt.Fprintf(w, "\t\tv4: [%s],\n", strings.Join(v4, ", "))
+	fmt.Fprintf(w, "\t\tv6: [%s]\n", strings.Join(v6, ", "))
+}
+
+// RenderPAC writes a proxy auto-config file returning the proxy directive
+// configured in opts.PACProxies for the first policy containing an address
+// of the requested host, and opts.PACDefault otherwise. Policies without a
+// proxy directive are left out.
+func RenderPAC(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	var writeData func(io.Writer, *policy.Policy)
+	var lookup string
+	switch opts.PACMode {
+	case PACModeTable:
+		writeData, lookup = writePACTable, pacLookupTable
+	case PACModeIsInNet:
+		writeData, lookup = writePACIsInNet, pacLookupIsInNet
+	default:
+		return fmt.Errorf("unknown PAC mode %q", opts.PACMode)
+	}
+
+	pols = slices.DeleteFunc(slices.Clone(pols), func(pol *policy.Policy) bool {
+		return opts.PACProxies[pol.Name] == ""
+	})
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "// Generated by policybgp. Do not edit.\n\n")
+	fmt.Fprintf(bw, "var DEFAULT_PROXY = %s;\n\n", strconv.Quote(opts.PACDefault))
+	fmt.Fprintf(bw, "var POLICIES = [\n")
+	for i, pol := range pols {
+		fmt.Fprintf(bw, "\t// AS%d (%s)\n", pol.ASN, pol.ASInfo.Organization)
+		fmt.Fprintf(bw, "\t{\n")
+		fmt.Fprintf(bw, "\t\tproxy: %s,\n", strconv.Quote(opts.PACProxies[pol.Name]))
+		writeData(bw, pol)
+		if i == len(pols)-1 {
+			fmt.Fprintf(bw, "\t}\n")
+		} else {
+			fmt.Fprintf(bw, "\t},\n")
+		}
+	}
+	fmt.Fprintf(bw, "];\n\n")
+	fmt.Fprintf(bw, "%s\n%s", lookup, pacFindProxy)
+
+	return bw.Flush()
+}
+
+// CheckPACProxies returns an error if proxies holds a directive for a policy
+// which is not in pols.
+func CheckPACProxies(proxies map[string]string, pols []*policy.Policy) error {
+	for name := range proxies {
+		if !slices.ContainsFunc(pols, func(pol *policy.Policy) bool { return pol.Name == name }) {
+			return fmt.Errorf("PAC proxy for unknown policy %q", name)
+		}
+	}
+	return nil
+}
+
+// ParsePACProxies parses proxy directives in the format <policy>=<directive>
+// (e.g. "as15169=PROXY proxy.example.com:8080") into Options.PACProxies.
+func ParsePACProxies(ss []string) (map[string]string, error) {
+	proxies := make(map[string]string, len(ss))
+	for _, s := range ss {
+		name, directive, ok := strings.Cut(s, "=")
+		if !ok || name == "" || directive == "" {
+			return nil, fmt.Errorf("invalid PAC proxy %q. Expected <policy>=<directive>", s)
+		}
+		proxies[name] = directive
+	}
+	return proxies, nil
+}
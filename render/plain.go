@@ -0,0 +1,60 @@
+package render
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// RenderText writes the prefixes of the policies, one per line.
+func RenderText(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	for _, pol := range pols {
+		for _, pre := range prefixesOf(pol, opts) {
+			fmt.Fprintf(bw, "%s\n", pre)
+		}
+	}
+
+	return bw.Flush()
+}
+
+type jsonPolicy struct {
+	Name         string         `json:"name"`
+	ASN          uint32         `json:"asn"`
+	Organization string         `json:"organization"`
+	IP4NextHops  []netip.Addr   `json:"ip4NextHops,omitempty"`
+	IP6NextHops  []netip.Addr   `json:"ip6NextHops,omitempty"`
+	Prefixes     []netip.Prefix `json:"prefixes"`
+}
+
+type jsonDocument struct {
+	Policies []jsonPolicy `json:"policies"`
+}
+
+// RenderJSON writes the policies and their prefixes as a JSON document.
+func RenderJSON(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	doc := jsonDocument{Policies: make([]jsonPolicy, 0, len(pols))}
+	for _, pol := range pols {
+		prefixes := prefixesOf(pol, opts)
+		if prefixes == nil {
+			prefixes = []netip.Prefix{}
+		}
+		doc.Policies = append(doc.Policies, jsonPolicy{
+			Name:         pol.Name,
+			ASN:          pol.ASN,
+			Organization: pol.ASInfo.Organization,
+			IP4NextHops:  pol.IP4NextHops,
+			IP6NextHops:  pol.IP6NextHops,
+			Prefixes:     prefixes,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,173 @@
+package render
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"sort"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// Options holds the knobs shared by the renderers. Renderers ignore the fields
+// that do not apply to their format.
+type Options struct {
+	// Table is the kernel routing table ID routes are installed to (iproute).
+	Table uint32
+	// Protocol is the routing protocol ID routes are tagged with (iproute).
+	// Zero omits the "proto" argument.
+	Protocol uint32
+
+	// NftFamily and NftTable name the nftables table the sets are created in (nftables).
+	NftFamily string
+	NftTable  string
+
+	// Aggregate merges the prefixes of each policy into the smallest covering list.
+	// The tunnel formats (wireguard, openvpn) always aggregate.
+	Aggregate bool
+	// Invert renders every address except the prefixes of the policies and the
+	// special-purpose ranges (wireguard, openvpn).
+	Invert bool
+	// InvertExclude are further prefixes left out with Invert, such as the
+	// tunnel endpoint.
+	InvertExclude []netip.Prefix
+
+	// IOSPrevious holds the prefix-list entries written by the previous run,
+	// keyed by the list name and the sequence number, as read by ParseIOS (ios).
+	IOSPrevious map[string]map[uint32]netip.Prefix
+
+	// PACProxies maps the policy names to the proxy directive returned for
+	// their prefixes, e.g. "PROXY proxy.example.com:8080" (pac).
+	PACProxies map[string]string
+	// PACDefault is the proxy directive returned for other addresses (pac).
+	PACDefault string
+	// PACMode selects how the prefixes are matched, PACModeTable or PACModeIsInNet (pac).
+	PACMode string
+}
+
+// DefaultOptions returns Options with the default values used by the export command.
+func DefaultOptions() *Options {
+	return &Options{
+		Table:     100,
+		Protocol:  0,
+		NftFamily: "inet",
+		NftTable:  "policybgp",
+		Aggregate: true,
+
+		PACDefault: "DIRECT",
+		PACMode:    PACModeTable,
+	}
+}
+
+// Renderer writes the given resolved policies to w in a specific format.
+type Renderer func(w io.Writer, pols []*policy.Policy, opts *Options) error
+
+// Formats maps the format names accepted by the export command to their renderer.
+var Formats = map[string]Renderer{
+	"text": RenderText,
+	"json": RenderJSON,
+
+	"nftables": RenderNftables,
+	"ipset":    RenderIpset,
+	"iproute":  RenderIPRoute,
+
+	"wireguard":    RenderWireGuard,
+	"openvpn":      RenderOpenVPN,
+	"openvpn-push": RenderOpenVPNPush,
+
+	"junos":          RenderJunos,
+	"ios":            RenderIOS,
+	"routeros":       RenderRouterOS,
+	"routeros-route": RenderRouterOSRoute,
+
+	"pac": RenderPAC,
+}
+
+// FormatNames returns the sorted list of keys of Formats.
+func FormatNames() []string {
+	names := make([]string, 0, len(Formats))
+	for name := range Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render writes pols to w using the renderer registered for format.
+func Render(w io.Writer, format string, pols []*policy.Policy, opts *Options) error {
+	r, ok := Formats[format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return r(w, pols, opts)
+}
+
+// SetName returns the name of the nftables/ipset set holding the prefixes
+// of pol in the address family of the IPv4 (is4=true) or IPv6 prefixes.
+func SetName(pol *policy.Policy, is4 bool) string {
+	if is4 {
+		return pol.Name + "_v4"
+	}
+	return pol.Name + "_v6"
+}
+
+// prefixesOf returns the sorted prefixes of pol, aggregated if opts.Aggregate is set.
+// The order is stable regardless of the order in the database, so that the
+// rendered output can be diffed meaningfully.
+func prefixesOf(pol *policy.Policy, opts *Options) []netip.Prefix {
+	if opts.Aggregate {
+		return asinfo.AggregatePrefixes(pol.ASInfo.Prefixes)
+	}
+
+	prefixes := slices.Clone(pol.ASInfo.Prefixes)
+	slices.SortFunc(prefixes, comparePrefixes)
+	return slices.CompactFunc(prefixes, func(a, b netip.Prefix) bool {
+		return a == b
+	})
+}
+
+// comparePrefixes orders prefixes by address, then by prefix length.
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Bits(), b.Bits())
+}
+
+// routesOf returns the routes of pol, aggregated if opts.Aggregate is set.
+func routesOf(pol *policy.Policy, opts *Options) []policy.Route {
+	prefixes := prefixesOf(pol, opts)
+	routes := make([]policy.Route, 0, len(prefixes))
+	for _, pre := range prefixes {
+		nh := pol.NextHopFor(pre)
+		if !nh.IsValid() {
+			continue
+		}
+		routes = append(routes, policy.Route{Prefix: pre, NextHop: nh})
+	}
+	return routes
+}
+
+// familySet is the set of prefixes of a policy in a single address family.
+type familySet struct {
+	is4      bool
+	name     string
+	prefixes []netip.Prefix
+}
+
+// familySets splits the prefixes of pol into an IPv4 and an IPv6 familySet, in that order.
+func familySets(pol *policy.Policy, opts *Options) []familySet {
+	v4 := familySet{is4: true, name: SetName(pol, true)}
+	v6 := familySet{is4: false, name: SetName(pol, false)}
+	for _, pre := range prefixesOf(pol, opts) {
+		if pre.Addr().Is4() {
+			v4.prefixes = append(v4.prefixes, pre)
+		} else {
+			v6.prefixes = append(v6.prefixes, pre)
+		}
+	}
+	return []familySet{v4, v6}
+}
@@ -0,0 +1,232 @@
+package render
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+func testPolicies(t *testing.T) []*policy.Policy {
+	t.Helper()
+
+	db := asinfo.ASInfoMap{
+		15169: {
+			Organization: "Google LLC",
+			// deliberately unsorted to test that the output order is stable
+			Prefixes: []netip.Prefix{
+				netip.MustParsePrefix("2001:4860::/32"),
+				netip.MustParsePrefix("8.8.8.128/25"),
+				netip.MustParsePrefix("8.8.4.0/24"),
+				netip.MustParsePrefix("8.8.8.0/25"),
+			},
+		},
+		32934: {
+			Organization: "Facebook, Inc.",
+			Prefixes: []netip.Prefix{
+				netip.MustParsePrefix("31.13.24.0/21"),
+			},
+		},
+	}
+
+	pols, err := policy.ParseAll([]string{
+		"15169,192.168.1.1,2001:db8::1",
+		"32934,192.168.2.1|192.168.1.1",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+	for _, pol := range pols {
+		if err := pol.Resolve(db); err != nil {
+			t.Fatalf("Failed to resolve policy: %v", err)
+		}
+	}
+	return pols
+}
+
+// TestRender compares the output of each format against testdata/<format>.golden.
+// Run with UPDATE_GOLDEN=1 to regenerate the golden files.
+func TestRender(t *testing.T) {
+	pols := testPolicies(t)
+
+	opts := DefaultOptions()
+	opts.Protocol = 250
+	opts.PACProxies = map[string]string{
+		"as15169": "PROXY proxy-a.example.com:8080",
+		"as32934": "SOCKS5 proxy-b.example.com:1080; DIRECT",
+	}
+
+	type testCase struct {
+		name   string
+		format string
+		opts   *Options
+	}
+	var tests []testCase
+	for _, format := range FormatNames() {
+		tests = append(tests, testCase{format, format, opts})
+	}
+
+	inverted := *opts
+	inverted.Invert = true
+	tests = append(tests,
+		testCase{"wireguard-invert", "wireguard", &inverted},
+		testCase{"openvpn-invert", "openvpn", &inverted})
+
+	isInNet := *opts
+	isInNet.PACMode = PACModeIsInNet
+	tests = append(tests, testCase{"pac-isinnet", "pac", &isInNet})
+
+	raw := *opts
+	raw.Aggregate = false
+	tests = append(tests, testCase{"iproute-raw", "iproute", &raw})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Render(&buf, tt.format, pols, tt.opts); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if os.Getenv("UPDATE_GOLDEN") != "" {
+				if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatalf("Failed to update golden file: %v", err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read golden file: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), expected) {
+				t.Errorf("Output mismatch for %s.\nExpected:\n%s\nGot:\n%s", tt.name, expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestRenderIPRouteIPv6NextHops(t *testing.T) {
+	pol := &policy.Policy{
+		ASN:         15169,
+		IP4NextHops: []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+		IP6NextHops: []netip.Addr{netip.MustParseAddr("fe80::1%eth0")},
+		ASInfo: &asinfo.ASInfo{
+			Organization: "Google LLC",
+			Prefixes:     []netip.Prefix{netip.MustParsePrefix("8.8.8.0/24"), netip.MustParsePrefix("2001:4860::/32")},
+		},
+	}
+	var buf bytes.Buffer
+	if err := Render(&buf, "iproute", []*policy.Policy{pol}, DefaultOptions()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"route replace 8.8.8.0/24 via inet6 2001:db8::1 table ",
+		"route replace 2001:4860::/32 via fe80::1 dev eth0 table ",
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(want)) {
+			t.Errorf("Expected %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRenderPACMissingProxy(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PACProxies = map[string]string{"as15169": "PROXY proxy-a.example.com:8080"}
+
+	var buf bytes.Buffer
+	if err := Render(&buf, "pac", testPolicies(t), opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("// AS15169 ")) || bytes.Contains(buf.Bytes(), []byte("// AS32934 ")) {
+		t.Errorf("Expected only the policy with a proxy directive in:\n%s", buf.String())
+	}
+}
+
+func TestCheckPACProxies(t *testing.T) {
+	pols := testPolicies(t)
+	if err := CheckPACProxies(map[string]string{"as15169": "DIRECT"}, pols); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := CheckPACProxies(map[string]string{"as1519": "DIRECT"}, pols); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
+
+func TestTunnelPrefixesInvert(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Invert = true
+	endpoint := netip.MustParsePrefix("1.1.1.1/32")
+	opts.InvertExclude = []netip.Prefix{endpoint}
+
+	pres := tunnelPrefixes(testPolicies(t), opts)
+	excluded := append([]netip.Prefix{endpoint}, specialPrefixes...)
+	for _, pre := range pres {
+		for _, ex := range excluded {
+			if pre.Overlaps(ex) {
+				t.Errorf("Expected %s left out, got %s", ex, pre)
+			}
+		}
+	}
+	for _, addr := range []string{"1.1.1.2", "8.8.8.9", "2001:4860::1"} {
+		var covered bool
+		for _, pre := range pres {
+			covered = covered || pre.Contains(netip.MustParseAddr(addr))
+		}
+		if want := addr == "1.1.1.2"; covered != want {
+			t.Errorf("Expected %s covered %v, got %v", addr, want, covered)
+		}
+	}
+}
+
+func TestRenderIOSPrevious(t *testing.T) {
+	pols := testPolicies(t)
+
+	var prev bytes.Buffer
+	if err := Render(&prev, "ios", pols, DefaultOptions()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// 8.8.4.0/24 is no longer announced, and 8.8.0.0/24 and 8.9.0.0/24 are
+	// added without renumbering 8.8.8.0/24.
+	pols[0].ASInfo.Prefixes = []netip.Prefix{
+		netip.MustParsePrefix("2001:4860::/32"),
+		netip.MustParsePrefix("8.8.0.0/24"),
+		netip.MustParsePrefix("8.8.8.0/24"),
+		netip.MustParsePrefix("8.9.0.0/24"),
+	}
+	pols = pols[:1]
+
+	opts := DefaultOptions()
+	var err error
+	opts.IOSPrevious, err = ParseIOS(&prev)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := Render(&buf, "ios", pols, opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := `! AS15169 (Google LLC)
+no ip prefix-list as15169_v4 seq 5
+ip prefix-list as15169_v4 seq 5 permit 8.8.0.0/24
+ip prefix-list as15169_v4 seq 10 permit 8.8.8.0/24
+ip prefix-list as15169_v4 seq 15 permit 8.9.0.0/24
+ipv6 prefix-list as15169_v6 seq 5 permit 2001:4860::/32
+no ip prefix-list as32934_v4
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Render(&buf, "nonexistent", nil, DefaultOptions()); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
@@ -0,0 +1,124 @@
+package render
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/IPA-CyberLab/policybgp/asinfo"
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// specialPrefixes are the special-purpose ranges not reachable through a
+// tunnel (RFC 6890 and its updates): local, private, link-local, documentation
+// and multicast addresses. They are left out of the inverted lists, so that
+// they stay on the local network.
+var specialPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// tunnelPrefixes returns the aggregated union of the prefixes of pols, or its
+// complement in both address families if opts.Invert is set. The complement
+// leaves out specialPrefixes and opts.InvertExclude.
+func tunnelPrefixes(pols []*policy.Policy, opts *Options) []netip.Prefix {
+	var union []netip.Prefix
+	for _, pol := range pols {
+		union = append(union, pol.ASInfo.Prefixes...)
+	}
+	if !opts.Invert {
+		return asinfo.AggregatePrefixes(union)
+	}
+
+	union = append(union, specialPrefixes...)
+	union = append(union, opts.InvertExclude...)
+	return append(
+		asinfo.ComplementPrefixes(union, true),
+		asinfo.ComplementPrefixes(union, false)...)
+}
+
+// writeTunnelHeader writes a comment line describing which policies the list was generated from.
+func writeTunnelHeader(w io.Writer, pols []*policy.Policy, opts *Options) {
+	descs := make([]string, 0, len(pols))
+	for _, pol := range pols {
+		descs = append(descs, fmt.Sprintf("AS%d (%s)", pol.ASN, pol.ASInfo.Organization))
+	}
+	if opts.Invert {
+		fmt.Fprintf(w, "# policybgp: everything except %s\n", strings.Join(descs, ", "))
+	} else {
+		fmt.Fprintf(w, "# policybgp: %s\n", strings.Join(descs, ", "))
+	}
+}
+
+// RenderWireGuard writes the prefixes of the policies as a WireGuard AllowedIPs line.
+func RenderWireGuard(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	prefixes := tunnelPrefixes(pols, opts)
+	strs := make([]string, 0, len(prefixes))
+	for _, pre := range prefixes {
+		strs = append(strs, pre.String())
+	}
+
+	writeTunnelHeader(bw, pols, opts)
+	fmt.Fprintf(bw, "AllowedIPs = %s\n", strings.Join(strs, ", "))
+
+	return bw.Flush()
+}
+
+// openVPNRoute formats pre as the arguments of an OpenVPN route or route-ipv6 directive.
+func openVPNRoute(pre netip.Prefix) string {
+	if pre.Addr().Is4() {
+		mask := net.IP(net.CIDRMask(pre.Bits(), 32))
+		return fmt.Sprintf("route %s %s", pre.Addr(), mask)
+	}
+	return fmt.Sprintf("route-ipv6 %s", pre)
+}
+
+// RenderOpenVPN writes the prefixes of the policies as OpenVPN client route directives.
+func RenderOpenVPN(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	writeTunnelHeader(bw, pols, opts)
+	for _, pre := range tunnelPrefixes(pols, opts) {
+		fmt.Fprintf(bw, "%s\n", openVPNRoute(pre))
+	}
+
+	return bw.Flush()
+}
+
+// RenderOpenVPNPush writes the prefixes of the policies as OpenVPN server
+// directives pushing the routes to the clients.
+func RenderOpenVPNPush(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	writeTunnelHeader(bw, pols, opts)
+	for _, pre := range tunnelPrefixes(pols, opts) {
+		fmt.Fprintf(bw, "push \"%s\"\n", openVPNRoute(pre))
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,227 @@
+package render
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/IPA-CyberLab/policybgp/policy"
+)
+
+// RenderJunos writes Junos "set" commands replacing one prefix-list per
+// policy and address family, each policy preceded by a "#" comment line,
+// which "load set terminal" skips.
+func RenderJunos(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	for _, pol := range pols {
+		fmt.Fprintf(bw, "# AS%d (%s)\n", pol.ASN, pol.ASInfo.Organization)
+		for _, fam := range familySets(pol, opts) {
+			fmt.Fprintf(bw, "delete policy-options prefix-list %s\n", fam.name)
+			for _, pre := range fam.prefixes {
+				fmt.Fprintf(bw, "set policy-options prefix-list %s %s\n", fam.name, pre)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// iosSeqStep is the difference between the sequence numbers of consecutive
+// prefix-list entries.
+const iosSeqStep = 5
+
+// iosCommand returns the command configuring a prefix-list of the address family.
+func iosCommand(is4 bool) string {
+	if is4 {
+		return "ip prefix-list"
+	}
+	return "ipv6 prefix-list"
+}
+
+// iosSeqs numbers the entries of a prefix-list. The prefixes of prev keep their
+// sequence number, and the others take the lowest free multiples of iosSeqStep.
+func iosSeqs(prefixes []netip.Prefix, prev map[uint32]netip.Prefix) map[uint32]netip.Prefix {
+	prevSeqs := make(map[netip.Prefix]uint32, len(prev))
+	for _, seq := range slices.Sorted(maps.Keys(prev)) {
+		if _, ok := prevSeqs[prev[seq]]; !ok {
+			prevSeqs[prev[seq]] = seq
+		}
+	}
+
+	entries := make(map[uint32]netip.Prefix, len(prefixes))
+	var added []netip.Prefix
+	for _, pre := range prefixes {
+		if seq, ok := prevSeqs[pre]; ok {
+			entries[seq] = pre
+		} else {
+			added = append(added, pre)
+		}
+	}
+	seq := uint32(iosSeqStep)
+	for _, pre := range added {
+		for {
+			if _, ok := entries[seq]; !ok {
+				break
+			}
+			seq += iosSeqStep
+		}
+		entries[seq] = pre
+	}
+	return entries
+}
+
+// RenderIOS writes Cisco IOS / IOS-XE configuration of one "ip prefix-list"
+// or "ipv6 prefix-list" per policy and address family, numbered by iosSeqs.
+// The list is updated in place rather than removed, so that it does not deny
+// everything while being replaced: the entries of opts.IOSPrevious no longer
+// listed, or listed under another number, are removed.
+func RenderIOS(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	rendered := make(map[string]bool)
+	for _, pol := range pols {
+		fmt.Fprintf(bw, "! AS%d (%s)\n", pol.ASN, pol.ASInfo.Organization)
+		for _, fam := range familySets(pol, opts) {
+			rendered[fam.name] = true
+			cmd := iosCommand(fam.is4)
+			prev := opts.IOSPrevious[fam.name]
+			entries := iosSeqs(fam.prefixes, prev)
+			seqs := slices.Collect(maps.Keys(entries))
+			for seq := range prev {
+				if _, ok := entries[seq]; !ok {
+					seqs = append(seqs, seq)
+				}
+			}
+			slices.Sort(seqs)
+			for _, seq := range seqs {
+				pre, ok := entries[seq]
+				if old, had := prev[seq]; had && (!ok || old != pre) {
+					fmt.Fprintf(bw, "no %s %s seq %d\n", cmd, fam.name, seq)
+				}
+				if ok {
+					fmt.Fprintf(bw, "%s %s seq %d permit %s\n", cmd, fam.name, seq, pre)
+				}
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(opts.IOSPrevious)) {
+		if rendered[name] {
+			continue
+		}
+		for _, pre := range opts.IOSPrevious[name] {
+			// The entries of a list share its address family.
+			fmt.Fprintf(bw, "no %s %s\n", iosCommand(pre.Addr().Is4()), name)
+			break
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ParseIOS reads the prefix-list entries written by RenderIOS, keyed by the
+// list name and the sequence number.
+func ParseIOS(r io.Reader) (map[string]map[uint32]netip.Prefix, error) {
+	lists := make(map[string]map[uint32]netip.Prefix)
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fs := strings.Fields(sc.Text())
+		if len(fs) != 7 || (fs[0] != "ip" && fs[0] != "ipv6") || fs[1] != "prefix-list" || fs[3] != "seq" || fs[5] != "permit" {
+			continue
+		}
+		seq, err := strconv.ParseUint(fs[4], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sequence number %q: %w", fs[4], err)
+		}
+		pre, err := netip.ParsePrefix(fs[6])
+		if err != nil {
+			return nil, err
+		}
+		if lists[fs[2]] == nil {
+			lists[fs[2]] = make(map[uint32]netip.Prefix)
+		}
+		lists[fs[2]][uint32(seq)] = pre
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// routerOSQuote quotes s as a RouterOS script string.
+func routerOSQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "?", `\?`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// routerOSComment returns the comment attached to the entries of pol, so they
+// can be found and replaced by the next run of the script. It does not include
+// the organization name, as it may change between database versions.
+func routerOSComment(pol *policy.Policy) string {
+	return "policybgp:" + pol.Name
+}
+
+// RenderRouterOS writes a RouterOS script replacing one firewall address-list
+// per policy and address family.
+func RenderRouterOS(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	for _, pol := range pols {
+		comment := routerOSQuote(routerOSComment(pol))
+		for _, fam := range familySets(pol, opts) {
+			menu := "/ipv6 firewall address-list"
+			if fam.is4 {
+				menu = "/ip firewall address-list"
+			}
+			fmt.Fprintf(bw, "%s\n", menu)
+			fmt.Fprintf(bw, "remove [find list=%s]\n", fam.name)
+			for _, pre := range fam.prefixes {
+				fmt.Fprintf(bw, "add list=%s address=%s comment=%s\n", fam.name, pre, comment)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// RenderRouterOSRoute writes a RouterOS script replacing the static routes of
+// each policy. The routes are identified by their comment.
+func RenderRouterOSRoute(w io.Writer, pols []*policy.Policy, opts *Options) error {
+	bw := bufio.NewWriter(w)
+
+	for _, pol := range pols {
+		comment := routerOSQuote(routerOSComment(pol))
+
+		var v4, v6 []policy.Route
+		for _, r := range routesOf(pol, opts) {
+			if r.Prefix.Addr().Is4() {
+				v4 = append(v4, r)
+			} else {
+				v6 = append(v6, r)
+			}
+		}
+
+		for _, fam := range []struct {
+			menu   string
+			routes []policy.Route
+		}{
+			{"/ip route", v4},
+			{"/ipv6 route", v6},
+		} {
+			fmt.Fprintf(bw, "%s\n", fam.menu)
+			fmt.Fprintf(bw, "remove [find comment=%s]\n", comment)
+			for _, r := range fam.routes {
+				fmt.Fprintf(bw, "add dst-address=%s gateway=%s comment=%s\n", r.Prefix, r.NextHop, comment)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,273 @@
+// Package zebra installs routes into the RIB of the zebra daemon of FRR over
+// the zebra API (ZAPI), the way other routing daemons of FRR do.
+package zebra
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	gobgplog "github.com/osrg/gobgp/v4/pkg/log"
+	zapi "github.com/osrg/gobgp/v4/pkg/zebra"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/kernel"
+)
+
+// DefaultURL is the address of the zserv socket of a default FRR install.
+const DefaultURL = "unix:/var/run/frr/zserv.api"
+
+// reconnectInterval is the interval of the attempts to connect to zebra.
+const reconnectInterval = 5 * time.Second
+
+// Config configures a Table.
+type Config struct {
+	// URL is the address of the zserv socket in the format
+	// <network>:<address>, where <network> is unix or tcp.
+	URL string
+	// Version is the ZAPI version spoken, between 2 and 6. FRR 7.2 and later
+	// speak version 6.
+	Version uint8
+	// Software is the name and version of the zebra daemon, such as frr7.5 or
+	// frr8.2, which selects the message format within a ZAPI version. Empty
+	// selects the latest software of Version.
+	Software string
+	// RouteType is the type of the routes in the RIB, such as static or bgp.
+	RouteType string
+	// Distance is the administrative distance of the routes. 0 selects the
+	// default distance of RouteType.
+	Distance uint8
+}
+
+// Table keeps the routes of the route type of a Config in the RIB of zebra
+// in sync with the desired routes. zebra removes the routes of a client when
+// it disconnects, so Table connects to zebra in Run and installs the desired
+// routes again every time the connection is established.
+type Table struct {
+	s        *zap.SugaredLogger
+	logger   gobgplog.Logger
+	network  string
+	address  string
+	version  uint8
+	software zapi.Software
+	typ      zapi.RouteType
+	distance uint8
+	// retry is the interval of the attempts to connect.
+	retry time.Duration
+
+	mu     sync.Mutex
+	client *zapi.Client
+	// want holds the routes to be installed while connected.
+	want map[netip.Prefix]kernel.Route
+	// installed holds the routes sent to zebra over the current connection.
+	installed map[netip.Prefix]kernel.Route
+}
+
+// NewTable returns a Table for cfg. It does not connect to zebra until Run is
+// called. The ZAPI client logs to logger.
+func NewTable(cfg *Config, l *zap.Logger, logger gobgplog.Logger) (*Table, error) {
+	network, address, ok := strings.Cut(cfg.URL, ":")
+	if !ok || address == "" {
+		return nil, fmt.Errorf("invalid zebra URL %q. Expected <network>:<address>", cfg.URL)
+	}
+	if network != "unix" && network != "tcp" {
+		return nil, fmt.Errorf("invalid zebra URL %q. The network must be unix or tcp", cfg.URL)
+	}
+	if cfg.Version < zapi.MinZapiVer || cfg.Version > zapi.MaxZapiVer {
+		return nil, fmt.Errorf("invalid ZAPI version %d. It must be between %d and %d", cfg.Version, zapi.MinZapiVer, zapi.MaxZapiVer)
+	}
+	software := zapi.NewSoftware(cfg.Version, cfg.Software)
+	typ, err := zapi.RouteTypeFromString(cfg.RouteType, cfg.Version, software)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zebra route type %q: %w", cfg.RouteType, err)
+	}
+
+	return &Table{
+		s:         l.Named("zebra").Sugar(),
+		logger:    logger,
+		network:   network,
+		address:   address,
+		version:   cfg.Version,
+		software:  software,
+		typ:       typ,
+		distance:  cfg.Distance,
+		retry:     reconnectInterval,
+		want:      make(map[netip.Prefix]kernel.Route),
+		installed: make(map[netip.Prefix]kernel.Route),
+	}, nil
+}
+
+func (t *Table) String() string {
+	return "zebra RIB"
+}
+
+// Len returns the number of routes installed in zebra.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.installed)
+}
+
+// Run connects to zebra, and connects again whenever the connection is lost,
+// until ctx is done.
+func (t *Table) Run(ctx context.Context) {
+	for {
+		c, err := zapi.NewClient(t.logger, t.network, t.address, t.typ, t.version, t.software, 0)
+		if err != nil {
+			t.s.Warnf("Failed to connect to zebra at %s:%s: %v", t.network, t.address, err)
+		} else {
+			installed, err := t.connected(c)
+			t.s.Infof("Connected to zebra at %s:%s, %d routes installed", t.network, t.address, installed)
+			if err != nil {
+				t.s.Errorf("Failed to install routes: %v", err)
+			}
+
+			for open := true; open; {
+				select {
+				case <-ctx.Done():
+					return
+				case _, open = <-c.Receive():
+				}
+			}
+			t.disconnected()
+			t.s.Warnf("Lost connection to zebra at %s:%s", t.network, t.address)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(t.retry):
+		}
+	}
+}
+
+func (t *Table) connected(c *zapi.Client) (installed int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.client = c
+	t.installed = make(map[netip.Prefix]kernel.Route)
+	installed, _, err = t.sync()
+	return installed, err
+}
+
+func (t *Table) disconnected() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.client = nil
+	t.installed = make(map[netip.Prefix]kernel.Route)
+}
+
+// Sync installs, replaces and removes routes so that the routes installed in
+// zebra are want. Routes without nexthop are removed. While disconnected,
+// want is installed once connected. Failing routes are skipped, and the
+// first error is returned after all routes were processed.
+func (t *Table) Sync(want map[netip.Prefix]kernel.Route) (installed, removed int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.want = make(map[netip.Prefix]kernel.Route, len(want))
+	for pre, r := range want {
+		if len(r.NextHops) > 0 {
+			t.want[pre] = r
+		}
+	}
+	return t.sync()
+}
+
+// Flush removes all routes installed in zebra.
+func (t *Table) Flush() (removed int, err error) {
+	_, removed, err = t.Sync(nil)
+	return removed, err
+}
+
+func (t *Table) sync() (installed, removed int, err error) {
+	if t.client == nil {
+		return 0, 0, nil
+	}
+
+	var failed int
+	fail := func(e error) {
+		if failed == 0 {
+			err = e
+		}
+		failed++
+	}
+
+	for pre, r := range t.want {
+		if cur, ok := t.installed[pre]; ok && cur.Equal(r) {
+			continue
+		}
+		body, e := t.routeBody(pre, r)
+		if e == nil {
+			e = t.client.SendIPRoute(zapi.DefaultVrf, body, false)
+		}
+		if e != nil {
+			fail(fmt.Errorf("failed to install route %v: %w", pre, e))
+			continue
+		}
+		t.installed[pre] = r
+		installed++
+	}
+
+	for pre, r := range t.installed {
+		if _, ok := t.want[pre]; ok {
+			continue
+		}
+		// A nexthop whose interface is gone needs no removal; zebra already
+		// dropped the routes through it.
+		body, e := t.routeBody(pre, r)
+		if e == nil {
+			e = t.client.SendIPRoute(zapi.DefaultVrf, body, true)
+		}
+		if e != nil && body != nil {
+			fail(fmt.Errorf("failed to remove route %v: %w", pre, e))
+			continue
+		}
+		delete(t.installed, pre)
+		removed++
+	}
+
+	if failed > 1 {
+		err = fmt.Errorf("%d routes failed, first: %w", failed, err)
+	}
+	return installed, removed, err
+}
+
+// routeBody returns the ZAPI message installing r for pre. The nexthops may
+// be reached through other routes, as for routes learned over multihop BGP.
+// Those with a zone are reached through the interface of that name of this
+// host, which zebra is expected to run on.
+func (t *Table) routeBody(pre netip.Prefix, r kernel.Route) (*zapi.IPRouteBody, error) {
+	body := &zapi.IPRouteBody{
+		Type:    t.typ,
+		Flags:   zapi.FlagAllowRecursion,
+		Safi:    zapi.SafiUnicast,
+		Message: zapi.MessageNexthop,
+		Prefix: zapi.Prefix{
+			Prefix:    pre.Addr().AsSlice(),
+			PrefixLen: uint8(pre.Bits()),
+		},
+	}
+	if t.distance > 0 {
+		body.Message |= zapi.MessageDistance.ToEach(t.version, t.software)
+		body.Distance = t.distance
+	}
+	for _, nh := range r.NextHops {
+		link, err := nh.LinkIndex()
+		if err != nil {
+			return nil, err
+		}
+		znh := zapi.Nexthop{Gate: nh.Addr.AsSlice(), Ifindex: uint32(link)}
+		if len(r.NextHops) > 1 {
+			// zebra scales the weights of multipath routes itself.
+			znh.Weight = max(nh.Weight, 1)
+		}
+		body.Nexthops = append(body.Nexthops, znh)
+	}
+	return body, nil
+}
@@ -0,0 +1,268 @@
+package zebra
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	gobgplog "github.com/osrg/gobgp/v4/pkg/log"
+	zapi "github.com/osrg/gobgp/v4/pkg/zebra"
+	"go.uber.org/zap"
+
+	"github.com/IPA-CyberLab/policybgp/kernel"
+)
+
+// fakeZebra accepts ZAPI connections on a unix socket and records the routes
+// added and deleted by its clients.
+type fakeZebra struct {
+	t        *testing.T
+	ln       net.Listener
+	version  uint8
+	software zapi.Software
+	conns    chan net.Conn
+	msgs     chan *zapi.Message
+}
+
+func newFakeZebra(t *testing.T, version uint8) *fakeZebra {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "zserv.api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	z := &fakeZebra{
+		t:        t,
+		ln:       ln,
+		version:  version,
+		software: zapi.NewSoftware(version, ""),
+		conns:    make(chan net.Conn, 1),
+		msgs:     make(chan *zapi.Message, 64),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			z.conns <- conn
+			go z.serve(conn)
+		}
+	}()
+	return z
+}
+
+func (z *fakeZebra) serve(conn net.Conn) {
+	logger := quietLogger()
+	greeted := false
+	for {
+		m, err := zapi.ReceiveSingleMsg(logger, conn, z.version, z.software, "test")
+		if err != nil {
+			return
+		}
+		if !greeted {
+			// The client waits for a first message after its hello, which
+			// may be one it ignores.
+			greeted = true
+			hdr := zapi.Message{Header: zapi.Header{
+				Len:     zapi.HeaderSize(z.version),
+				Marker:  zapi.HeaderMarker(z.version),
+				Version: z.version,
+				Command: zapi.RouteAdd.ToEach(z.version, z.software) + 1000,
+			}}
+			bs, err := hdr.Serialize(z.software)
+			if err != nil {
+				z.t.Error(err)
+				return
+			}
+			if _, err := conn.Write(bs); err != nil {
+				return
+			}
+		}
+		if m != nil {
+			z.msgs <- m
+		}
+	}
+}
+
+func (z *fakeZebra) url() string {
+	return "unix:" + z.ln.Addr().String()
+}
+
+func quietLogger() gobgplog.Logger {
+	logger := gobgplog.NewDefaultLogger()
+	logger.SetLevel(gobgplog.PanicLevel)
+	return logger
+}
+
+type routeMsg struct {
+	withdraw bool
+	body     *zapi.IPRouteBody
+}
+
+// next returns the next route message received.
+func (z *fakeZebra) next() routeMsg {
+	z.t.Helper()
+	for {
+		select {
+		case m := <-z.msgs:
+			body, ok := m.Body.(*zapi.IPRouteBody)
+			if !ok {
+				continue
+			}
+			add := zapi.RouteAdd.ToEach(z.version, z.software)
+			return routeMsg{withdraw: m.Header.Command != add, body: body}
+		case <-time.After(5 * time.Second):
+			z.t.Fatal("Timed out waiting for a route message")
+			return routeMsg{}
+		}
+	}
+}
+
+func TestTableSync(t *testing.T) {
+	z := newFakeZebra(t, 6)
+	table, err := NewTable(&Config{URL: z.url(), Version: 6, RouteType: "static", Distance: 5}, zap.NewNop(), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.retry = 10 * time.Millisecond
+
+	pre := netip.MustParsePrefix("8.8.8.0/24")
+	route := kernel.Route{NextHops: []kernel.NextHop{
+		{Addr: netip.MustParseAddr("192.0.2.1"), Weight: 2},
+		{Addr: netip.MustParseAddr("192.0.2.2"), Weight: 1},
+	}}
+	if installed, _, err := table.Sync(map[netip.Prefix]kernel.Route{pre: route}); err != nil || installed != 0 {
+		t.Fatalf("Expected nothing installed before connecting, got %d, %v", installed, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go table.Run(ctx)
+
+	m := z.next()
+	if m.withdraw {
+		t.Fatal("Expected a route to be added, got a withdrawal")
+	}
+	if m.body.Prefix.Prefix.String() != "8.8.8.0" || m.body.Prefix.PrefixLen != 24 {
+		t.Errorf("Expected prefix 8.8.8.0/24, got %v/%d", m.body.Prefix.Prefix, m.body.Prefix.PrefixLen)
+	}
+	if static, _ := zapi.RouteTypeFromString("static", 6, z.software); m.body.Type != static {
+		t.Errorf("Expected route type static, got %v", m.body.Type)
+	}
+	if m.body.Distance != 5 {
+		t.Errorf("Expected distance 5, got %d", m.body.Distance)
+	}
+	var gates []string
+	var weights []uint32
+	for _, nh := range m.body.Nexthops {
+		gates = append(gates, nh.Gate.String())
+		weights = append(weights, nh.Weight)
+	}
+	if !slices.Equal(gates, []string{"192.0.2.1", "192.0.2.2"}) || !slices.Equal(weights, []uint32{2, 1}) {
+		t.Errorf("Expected nexthops 192.0.2.1 and 192.0.2.2 weighted 2 and 1, got %v weighted %v", gates, weights)
+	}
+
+	waitLen := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); table.Len() != n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d routes installed, got %d", n, table.Len())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitLen(1)
+
+	// Unchanged routes are not sent again.
+	pre6 := netip.MustParsePrefix("2001:4860::/32")
+	route6 := kernel.Route{NextHops: []kernel.NextHop{{Addr: netip.MustParseAddr("2001:db8::1")}}}
+	installed, removed, err := table.Sync(map[netip.Prefix]kernel.Route{pre: route, pre6: route6})
+	if err != nil || installed != 1 || removed != 0 {
+		t.Fatalf("Expected 1 route installed, got %d installed, %d removed, %v", installed, removed, err)
+	}
+	m = z.next()
+	if m.withdraw || m.body.Prefix.Prefix.String() != "2001:4860::" {
+		t.Errorf("Expected 2001:4860::/32 to be added, got %v (withdraw %v)", m.body.Prefix.Prefix, m.withdraw)
+	}
+
+	// zebra drops the routes of a client disconnecting, so they are installed
+	// again on the new connection.
+	(<-z.conns).Close()
+	got := map[string]bool{}
+	for range 2 {
+		m = z.next()
+		if m.withdraw {
+			t.Fatal("Expected routes to be added after reconnecting, got a withdrawal")
+		}
+		got[m.body.Prefix.Prefix.String()] = true
+	}
+	if !got["8.8.8.0"] || !got["2001:4860::"] {
+		t.Errorf("Expected both routes to be installed again, got %v", got)
+	}
+	waitLen(2)
+
+	removed, err = table.Flush()
+	if err != nil || removed != 2 {
+		t.Fatalf("Expected 2 routes removed, got %d, %v", removed, err)
+	}
+	for range 2 {
+		if m = z.next(); !m.withdraw {
+			t.Errorf("Expected routes to be withdrawn, got %v added", m.body.Prefix.Prefix)
+		}
+	}
+}
+
+func TestRouteBodyIPv6NextHops(t *testing.T) {
+	table, err := NewTable(&Config{URL: DefaultURL, Version: 6, RouteType: "static"}, zap.NewNop(), quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IPv4 via a link-local IPv6 nexthop, whose zone may be the index of
+	// the interface.
+	body, err := table.routeBody(netip.MustParsePrefix("8.8.8.0/24"), kernel.Route{NextHops: []kernel.NextHop{
+		{Addr: netip.MustParseAddr("2001:db8::1")},
+		{Addr: netip.MustParseAddr("fe80::1%1")},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var gates []string
+	var ifindexes []uint32
+	for _, nh := range body.Nexthops {
+		gates = append(gates, nh.Gate.String())
+		ifindexes = append(ifindexes, nh.Ifindex)
+	}
+	if !slices.Equal(gates, []string{"2001:db8::1", "fe80::1"}) || !slices.Equal(ifindexes, []uint32{0, 1}) {
+		t.Errorf("Expected nexthops 2001:db8::1 and fe80::1 via interface 1, got %v via %v", gates, ifindexes)
+	}
+
+	if _, err := table.routeBody(netip.MustParsePrefix("2001:4860::/32"), kernel.Route{NextHops: []kernel.NextHop{
+		{Addr: netip.MustParseAddr("fe80::1")},
+	}}); err == nil {
+		t.Error("Expected error for a link-local nexthop without zone")
+	}
+}
+
+func TestNewTableInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"no network", Config{URL: "/var/run/frr/zserv.api", Version: 6, RouteType: "static"}},
+		{"unknown network", Config{URL: "udp:127.0.0.1:2600", Version: 6, RouteType: "static"}},
+		{"version too old", Config{URL: DefaultURL, Version: 1, RouteType: "static"}},
+		{"version too new", Config{URL: DefaultURL, Version: 7, RouteType: "static"}},
+		{"unknown route type", Config{URL: DefaultURL, Version: 6, RouteType: "bogus"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewTable(&tc.cfg, zap.NewNop(), quietLogger()); err == nil {
+				t.Errorf("Expected an error, got nil")
+			}
+		})
+	}
+}